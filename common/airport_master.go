@@ -0,0 +1,151 @@
+package common
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cast"
+)
+
+// 随脚本附带的机场主数据，列为 iata,name,latitude,longitude,city_market_id,state,state_name,country，按列名读取，其他列忽略，name 只用于查看。
+// 城市市场、州、国家与 DB1B、on-time 数据中机场的对应字段相同，没有这些列时只有坐标。
+// 只收录了主要机场，可以替换为有这些列的完整机场表
+var AirportMasterFile = "airports.csv"
+
+// GeoPoint ES 的 geo_point
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// 机场坐标，key:IATA 机场代码
+var airportMaster = map[string]*GeoPoint{}
+
+// AirportInfo 机场主数据中机场所属的城市市场、州、国家
+type AirportInfo struct {
+	CityMarketID string
+	State        string
+	StateName    string
+	Country      string
+}
+
+// 机场主数据中有城市市场的机场，key:IATA 机场代码
+var airportInfos = map[string]*AirportInfo{}
+
+// 读取机场主数据，文件不存在时文档中不写坐标
+func ReadAirportMaster() {
+	f, err := os.Open(AirportMasterFile)
+	if err != nil {
+		fmt.Println("读取机场主数据失败，不生成坐标:", err)
+		return
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	header, err := reader.Read()
+	if err != nil {
+		panic(err)
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[strings.TrimPrefix(name, "\ufeff")] = i
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		v := func(name string) string {
+			return CsvValue(col, record, name)
+		}
+		airportMaster[v("iata")] = &GeoPoint{Lat: cast.ToFloat64(v("latitude")), Lon: cast.ToFloat64(v("longitude"))}
+		if id := v("city_market_id"); id != "" {
+			airportInfos[v("iata")] = &AirportInfo{CityMarketID: id, State: v("state"), StateName: v("state_name"), Country: v("country")}
+		}
+	}
+	fmt.Println("读取机场主数据完成:", len(airportMaster))
+}
+
+// AirportInfos 机场主数据中有城市市场的机场，key:IATA 机场代码，只读
+func AirportInfos() map[string]*AirportInfo {
+	return airportInfos
+}
+
+// 机场主数据中没有的机场及查询的次数，运行结束时输出
+var missingLocations = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: map[string]int{}}
+
+// 机场坐标，机场主数据中没有该机场时为 nil
+func AirportLocation(code string) *GeoPoint {
+	p, ok := airportMaster[code]
+	if !ok && len(airportMaster) > 0 {
+		missingLocations.Lock()
+		missingLocations.counts[code]++
+		missingLocations.Unlock()
+	}
+	return p
+}
+
+// 机场主数据中没有的机场及查询的次数
+func MissingLocations() map[string]int {
+	missingLocations.Lock()
+	defer missingLocations.Unlock()
+	res := make(map[string]int, len(missingLocations.counts))
+	for code, n := range missingLocations.counts {
+		res[code] = n
+	}
+	return res
+}
+
+// 输出机场主数据中没有的机场数，以及出现次数最多的几个
+func ReportMissingLocations() {
+	missingLocations.Lock()
+	defer missingLocations.Unlock()
+	if len(missingLocations.counts) == 0 {
+		return
+	}
+	codes := make([]string, 0, len(missingLocations.counts))
+	for code := range missingLocations.counts {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		a, b := missingLocations.counts[codes[i]], missingLocations.counts[codes[j]]
+		if a != b {
+			return a > b
+		}
+		return codes[i] < codes[j]
+	})
+	examples := make([]string, 0, 10)
+	for _, code := range codes[:min(len(codes), 10)] {
+		examples = append(examples, fmt.Sprintf("%s(%d)", code, missingLocations.counts[code]))
+	}
+	fmt.Println("机场主数据中没有的机场:", len(codes), "个，不写坐标和大圆距离，如", strings.Join(examples, " "))
+}
+
+// 地球平均半径（英里）
+const earthRadiusMiles = 3958.8
+
+// 两点间的大圆距离（英里），保留 1 位小数，任一点为 nil 时为 nil
+func GreatCircleMiles(a, b *GeoPoint) *float64 {
+	if a == nil || b == nil {
+		return nil
+	}
+	rad := func(deg float64) float64 {
+		return deg * math.Pi / 180
+	}
+	dLat := rad(b.Lat - a.Lat)
+	dLon := rad(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	miles := math.Round(2*earthRadiusMiles*math.Asin(math.Min(1, math.Sqrt(h)))*10) / 10
+	return &miles
+}
@@ -0,0 +1,458 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// BulkConfig ES 批量写入配置，config.json 中 bulk 配置，不配置时使用默认值
+type BulkConfig struct {
+	Actions        int `json:"actions"`         // 每批最多的文档数，默认 1000
+	Bytes          int `json:"bytes"`           // 每批最多的字节数，默认 5MB
+	FlushSeconds   int `json:"flush_seconds"`   // 未满的批最多等待的秒数，默认 1
+	MaxRetries     int `json:"max_retries"`     // 被拒绝的文档最多重试的次数，默认 8
+	InitialBackoff int `json:"initial_backoff"` // 第一次重试前等待的毫秒数，之后每次加倍，默认 100
+	MaxBackoff     int `json:"max_backoff"`     // 重试前最多等待的毫秒数，默认 10000
+}
+
+// 每批写入的文档数的默认值，也是各输出端、环比同比每次读写的文档数
+const bulkActions = 1000
+
+// 批量写入配置，各脚本启动时设置为 config.json 中的 bulk 配置
+var Bulk BulkConfig
+
+// 写入ES的并发请求数，各脚本启动时设置为 config.json 中的 concurrency.es_write 配置，不大于 0 时为CPU核心数
+var EsWriteWorkers int
+
+// 写入ES的并发请求数
+func EsWorkers() int {
+	if EsWriteWorkers > 0 {
+		return EsWriteWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+func (c BulkConfig) withDefaults() BulkConfig {
+	if c.Actions <= 0 {
+		c.Actions = bulkActions
+	}
+	if c.Bytes <= 0 {
+		c.Bytes = 5 << 20
+	}
+	if c.FlushSeconds <= 0 {
+		c.FlushSeconds = 1
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = 8
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = 100
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 10000
+	}
+	return c
+}
+
+// 第 n 次重试前等待的时间
+func (c BulkConfig) backoff(n int) time.Duration {
+	d := time.Duration(c.InitialBackoff) * time.Millisecond
+	for i := 1; i < n && d < time.Duration(c.MaxBackoff)*time.Millisecond; i++ {
+		d *= 2
+	}
+	return min(d, time.Duration(c.MaxBackoff)*time.Millisecond)
+}
+
+// BulkWriter 批量写入ES：按文档数和字节数分批，ES 拒绝（429、503）的文档按指数退避重试，
+// 被拒绝时把并发减半，之后连续成功再逐步恢复；待提交的批满时 Add 阻塞，不会无限占用内存。
+// 连接失败、超时等整个请求失败时 ES 可能已经写入了其中一部分，只重试有文档ID的文档（按ID覆盖，重复提交不会多出文档），
+// 没有文档ID的文档重复提交会写入重复的文档，记为失败
+type BulkWriter struct {
+	client *elastic.Client
+	cfg    BulkConfig
+
+	mu       sync.Mutex
+	batch    []*bulkItem
+	size     int
+	pending  int        // 已交给 workers 还没完成的批数
+	idle     *sync.Cond // pending 为 0 时通知 Flush
+	reported int64      // 已由 Flush 返回的失败文档数
+	failedBy map[string]int64
+
+	batches chan []*bulkItem
+	limit   *adaptiveLimit
+	stop    chan struct{}
+	workers sync.WaitGroup
+	closed  bool
+
+	start                              time.Time
+	docs, bytes, retries, failed, reqs atomic.Int64
+	throttled                          atomic.Int64
+}
+
+type bulkItem struct {
+	req    elastic.BulkableRequest
+	action string // 请求的第一行，失败时输出，不输出整个文档
+	id     string // 文档ID，由ES生成ID时为空
+	size   int
+	tries  int
+}
+
+// 从请求的第一行取文档ID，如 {"index":{"_index":"airlines","_id":"2020_1_..."}}
+func actionId(action string) string {
+	var meta map[string]struct {
+		Id string `json:"_id"`
+	}
+	if json.Unmarshal([]byte(action), &meta) != nil {
+		return ""
+	}
+	for _, m := range meta {
+		return m.Id
+	}
+	return ""
+}
+
+// 文档ID的 年_期 前缀，各报表的文档ID都以年、月（季度）开头，按此统计各期写入和失败的文档数
+func periodKey(id string) string {
+	parts := strings.SplitN(id, "_", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[0] + "_" + parts[1]
+}
+
+// 批量写入的统计
+type BulkStats struct {
+	Docs      int64         // 成功写入的文档数
+	Bytes     int64         // 成功写入的字节数
+	Requests  int64         // bulk 请求数，包括重试
+	Retries   int64         // 重试的文档次数
+	Failed    int64         // 重试后仍失败或不能重试的文档数
+	Throttled int64         // 因 ES 拒绝降低并发的次数
+	Elapsed   time.Duration // 从创建到统计时的耗时
+}
+
+func (s BulkStats) String() string {
+	seconds := max(s.Elapsed.Seconds(), 0.001)
+	return fmt.Sprintf("写入 %d 条，失败 %d 条，重试 %d 次，降低并发 %d 次，请求 %d 次，%.0f 条/秒，%.2f MB/秒",
+		s.Docs, s.Failed, s.Retries, s.Throttled, s.Requests, float64(s.Docs)/seconds, float64(s.Bytes)/seconds/(1<<20))
+}
+
+// workers 为最大并发请求数
+func NewBulkWriter(client *elastic.Client, workers int) *BulkWriter {
+	w := &BulkWriter{
+		client:   client,
+		cfg:      Bulk.withDefaults(),
+		batches:  make(chan []*bulkItem, workers),
+		limit:    newAdaptiveLimit(workers),
+		stop:     make(chan struct{}),
+		start:    time.Now(),
+		failedBy: map[string]int64{},
+	}
+	w.idle = sync.NewCond(&w.mu)
+	for i := 0; i < workers; i++ {
+		w.workers.Add(1)
+		go w.work()
+	}
+	go w.tick()
+	return w
+}
+
+// Add 加入一个请求，当前批满时交给 workers，待提交的批过多时阻塞
+func (w *BulkWriter) Add(req elastic.BulkableRequest) {
+	lines, err := req.Source()
+	if err != nil {
+		w.failed.Add(1)
+		log.Printf("DebugFailedEs: 序列化失败: %v\n", err)
+		return
+	}
+	size := 0
+	for _, line := range lines {
+		size += len(line) + 1
+	}
+	w.mu.Lock()
+	var full []*bulkItem
+	if len(w.batch) > 0 && w.size+size > w.cfg.Bytes {
+		full = w.take()
+	}
+	w.batch = append(w.batch, &bulkItem{req: req, action: lines[0], id: actionId(lines[0]), size: size})
+	w.size += size
+	w.mu.Unlock()
+	w.dispatch(full)
+
+	w.mu.Lock()
+	full = nil
+	if len(w.batch) >= w.cfg.Actions || w.size >= w.cfg.Bytes {
+		full = w.take()
+	}
+	w.mu.Unlock()
+	w.dispatch(full)
+}
+
+// 取出当前批，调用时持有 mu
+func (w *BulkWriter) take() []*bulkItem {
+	b := w.batch
+	w.batch, w.size = nil, 0
+	if len(b) > 0 {
+		w.pending++
+	}
+	return b
+}
+
+func (w *BulkWriter) dispatch(b []*bulkItem) {
+	if len(b) > 0 {
+		w.batches <- b
+	}
+}
+
+// 定时提交未满的批
+func (w *BulkWriter) tick() {
+	t := time.NewTicker(time.Duration(w.cfg.FlushSeconds) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.mu.Lock()
+			b := w.take()
+			w.mu.Unlock()
+			w.dispatch(b)
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *BulkWriter) work() {
+	defer w.workers.Done()
+	for b := range w.batches {
+		w.commit(b)
+		w.mu.Lock()
+		w.pending--
+		if w.pending == 0 {
+			w.idle.Broadcast()
+		}
+		w.mu.Unlock()
+	}
+}
+
+// 提交一批，被拒绝的文档退避后在当前协程中重试，直到成功或超过重试次数
+func (w *BulkWriter) commit(items []*bulkItem) {
+	for len(items) > 0 {
+		w.limit.acquire()
+		retry, throttled := w.send(items)
+		w.limit.release(throttled)
+		if throttled {
+			w.throttled.Add(1)
+		}
+		items = items[:0:0]
+		wait := time.Duration(0)
+		for _, item := range retry {
+			item.tries++
+			if item.tries > w.cfg.MaxRetries {
+				w.fail(item)
+				log.Printf("DebugFailedEs: 重试 %d 次后仍被拒绝，放弃: %s\n", w.cfg.MaxRetries, item.action)
+				continue
+			}
+			w.retries.Add(1)
+			wait = max(wait, w.cfg.backoff(item.tries))
+			items = append(items, item)
+		}
+		if len(items) > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// 发送一次 bulk 请求，返回需要重试的文档，以及 ES 是否因压力拒绝了请求
+func (w *BulkWriter) send(items []*bulkItem) ([]*bulkItem, bool) {
+	reqs := make([]elastic.BulkableRequest, len(items))
+	for i, item := range items {
+		reqs[i] = item.req
+	}
+	w.reqs.Add(1)
+	res, err := w.client.Bulk().Add(reqs...).Do(context.Background())
+	if err != nil {
+		if !retryableBulkError(err) {
+			for _, item := range items {
+				w.fail(item)
+			}
+			log.Printf("DebugFailedEs: bulk 请求失败，%d 条: %v\n", len(items), err)
+			return nil, false
+		}
+		// 不知道ES写入了哪些，只重试可以按ID覆盖的文档
+		var retry []*bulkItem
+		lost := 0
+		for _, item := range items {
+			if item.id != "" {
+				retry = append(retry, item)
+				continue
+			}
+			w.fail(item)
+			lost++
+		}
+		if lost > 0 {
+			log.Printf("DebugFailedEs: bulk 请求失败，%d 条没有文档ID不能重试: %v\n", lost, err)
+		}
+		return retry, elastic.IsStatusCode(err, 429)
+	}
+	var retry []*bulkItem
+	throttled := false
+	for i, m := range res.Items {
+		if i >= len(items) {
+			break
+		}
+		for _, r := range m {
+			switch {
+			case r.Status >= 200 && r.Status <= 299:
+				w.docs.Add(1)
+				w.bytes.Add(int64(items[i].size))
+			case retryableStatus(r.Status):
+				retry = append(retry, items[i])
+				throttled = throttled || r.Status == 429
+			default:
+				w.fail(items[i])
+				log.Printf("DebugFailedEs: index:%s type:%s id:%s version:%d  status:%d result:%s ForceRefresh:%v errorDetail:%v getResult:%v\n", r.Index, r.Type, r.Id, r.Version, r.Status, r.Result, r.ForcedRefresh, r.Error, r.GetResult)
+			}
+		}
+	}
+	return retry, throttled
+}
+
+// 可以重试的文档状态：429 拒绝执行，503 分片暂不可用，都是没有写入的文档
+func retryableStatus(status int) bool {
+	return status == 429 || status == 503
+}
+
+// 可以重试的整个请求的错误：ES 拒绝、超时或节点暂不可用，ES 可能已经写入了一部分
+func retryableBulkError(err error) bool {
+	for _, status := range []int{408, 429, 502, 503, 504} {
+		if elastic.IsStatusCode(err, status) {
+			return true
+		}
+	}
+	return elastic.IsConnErr(err) || elastic.IsTimeout(err)
+}
+
+// 记录重试后仍失败或不能重试的文档
+func (w *BulkWriter) fail(item *bulkItem) {
+	w.failed.Add(1)
+	w.mu.Lock()
+	w.failedBy[periodKey(item.id)]++
+	w.mu.Unlock()
+}
+
+// 文档ID以 key（年_期）开头的失败文档数
+func (w *BulkWriter) Failures(key string) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.failedBy[key]
+}
+
+// 提交当前批并等待所有批完成，包括其他协程加入的批
+func (w *BulkWriter) wait() {
+	w.mu.Lock()
+	b := w.take()
+	w.mu.Unlock()
+	w.dispatch(b)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.pending > 0 {
+		w.idle.Wait()
+	}
+}
+
+// Flush 提交当前批并等待所有批完成。上次 Flush 之后整个 BulkWriter 有文档最终写入失败时返回错误，
+// 只适合一个 BulkWriter 只写一期的情况（如 import_ontime 每月一个）；多期共用时各期的失败数见 Failures
+func (w *BulkWriter) Flush() error {
+	w.wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if failed := w.failed.Load(); failed > w.reported {
+		n := failed - w.reported
+		w.reported = failed
+		return fmt.Errorf("写入ES失败 %d 条", n)
+	}
+	return nil
+}
+
+// Close 提交剩余的文档并停止 workers
+func (w *BulkWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.Flush()
+	close(w.stop)
+	close(w.batches)
+	w.workers.Wait()
+	return err
+}
+
+func (w *BulkWriter) Stats() BulkStats {
+	return BulkStats{
+		Docs:      w.docs.Load(),
+		Bytes:     w.bytes.Load(),
+		Requests:  w.reqs.Load(),
+		Retries:   w.retries.Load(),
+		Failed:    w.failed.Load(),
+		Throttled: w.throttled.Load(),
+		Elapsed:   time.Since(w.start),
+	}
+}
+
+// adaptiveLimit 并发上限：被拒绝时减半，之后每连续成功 limit 次加 1，直到 max
+type adaptiveLimit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	max     int
+	limit   int
+	active  int
+	success int
+}
+
+func newAdaptiveLimit(n int) *adaptiveLimit {
+	l := &adaptiveLimit{max: n, limit: n}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *adaptiveLimit) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+func (l *adaptiveLimit) release(throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if throttled {
+		l.limit = max(1, l.limit/2)
+		l.success = 0
+	} else if l.limit < l.max {
+		l.success++
+		if l.success >= l.limit {
+			l.limit++
+			l.success = 0
+		}
+	}
+	l.cond.Broadcast()
+}
+
+func (l *adaptiveLimit) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
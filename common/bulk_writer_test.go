@@ -0,0 +1,125 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common/fakees"
+)
+
+func bulkDoc(i int) *elastic.BulkIndexRequest {
+	return elastic.NewBulkIndexRequest().Index("bulk_test").Id(cast.ToString(i)).Doc(map[string]interface{}{"n": i})
+}
+
+func TestBulkWriter(t *testing.T) {
+	old := Bulk
+	t.Cleanup(func() { Bulk = old })
+	Bulk = BulkConfig{Actions: 4, MaxRetries: 3, InitialBackoff: 1, MaxBackoff: 5}
+
+	// 被拒绝的文档重试后全部写入
+	es := fakees.New(t)
+	es.Rejects = 6
+	w := NewBulkWriter(es.Client(), 2)
+	for i := 0; i < 10; i++ {
+		w.Add(bulkDoc(i))
+	}
+	w.Close()
+	if st := w.Stats(); st.Docs != 10 || st.Retries != 6 || st.Failed != 0 || st.Throttled == 0 {
+		t.Errorf("重试 stats = %+v", st)
+	}
+	if docs := es.Docs("bulk_test"); len(docs) != 10 {
+		t.Errorf("文档数 = %d", len(docs))
+	}
+
+	// 400 不重试，超过重试次数的放弃，都记为失败
+	es = fakees.New(t)
+	es.BadIds = map[string]bool{"3": true}
+	w = NewBulkWriter(es.Client(), 1)
+	for i := 0; i < 5; i++ {
+		w.Add(bulkDoc(i))
+	}
+	if err := w.Flush(); err == nil {
+		t.Error("有文档失败时 Flush 应返回错误")
+	}
+	if err := w.Flush(); err != nil {
+		t.Error("失败已返回过，再次 Flush 不应返回错误:", err)
+	}
+	es.Mu.Lock()
+	es.Rejects = 100
+	es.Mu.Unlock()
+	w.Add(bulkDoc(5))
+	if err := w.Close(); err == nil {
+		t.Error("有文档失败时 Close 应返回错误")
+	}
+	if st := w.Stats(); st.Docs != 4 || st.Retries != 3 || st.Failed != 2 {
+		t.Errorf("失败 stats = %+v", st)
+	}
+	if _, ok := es.Docs("bulk_test")["3"]; ok || len(es.Docs("bulk_test")) != 4 {
+		t.Errorf("文档 = %v", es.Docs("bulk_test"))
+	}
+
+	// 整个请求超时时ES可能已写入，有文档ID的按ID覆盖重试，没有文档ID的不重试，记为失败
+	Bulk = BulkConfig{Actions: 4, MaxRetries: 3, InitialBackoff: 1, MaxBackoff: 5}
+	es = fakees.New(t)
+	es.Timeouts = 1
+	w = NewBulkWriter(es.Client(), 1)
+	for i := 0; i < 4; i++ {
+		w.Add(bulkDoc(i))
+	}
+	if err := w.Flush(); err != nil {
+		t.Error("有文档ID时超时后重试成功:", err)
+	}
+	es.Mu.Lock()
+	es.Timeouts = 1
+	es.Mu.Unlock()
+	for i := 0; i < 4; i++ {
+		w.Add(elastic.NewBulkIndexRequest().Index("bulk_test").Doc(map[string]interface{}{"n": i}))
+	}
+	if err := w.Close(); err == nil {
+		t.Error("没有文档ID的请求超时后应返回错误")
+	}
+	if st := w.Stats(); st.Docs != 4 || st.Retries != 4 || st.Failed != 4 {
+		t.Errorf("超时 stats = %+v", st)
+	}
+	// 超时的请求已写入，没有重复提交
+	if n := len(es.Docs("bulk_test")); n != 8 {
+		t.Errorf("超时后文档数 = %d", n)
+	}
+	if w.Failures("") != 4 {
+		t.Errorf("没有文档ID的失败数 = %d", w.Failures(""))
+	}
+
+	// 按字节数分批
+	lines, _ := bulkDoc(0).Source()
+	size := 0
+	for _, line := range lines {
+		size += len(line) + 1
+	}
+	Bulk = BulkConfig{Actions: 1000, Bytes: size*2 + 1}
+	es = fakees.New(t)
+	w = NewBulkWriter(es.Client(), 1)
+	for i := 0; i < 6; i++ {
+		w.Add(bulkDoc(i))
+	}
+	w.Close()
+	if !reflect.DeepEqual(es.Bulks, []int{2, 2, 2}) {
+		t.Errorf("每批文档数 = %v", es.Bulks)
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	l := newAdaptiveLimit(4)
+	var got []int
+	for _, throttled := range []bool{true, true, true, false, false, false, false, false} {
+		l.acquire()
+		l.release(throttled)
+		got = append(got, l.current())
+	}
+	// 被拒绝时减半，之后每连续成功 limit 次加 1
+	if want := []int{2, 1, 1, 2, 2, 3, 3, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("并发上限 = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,283 @@
+package common
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BTS 的城市市场表 L_CITY_MARKET_ID，列为 Code,Description，随脚本附带
+var CityMarketFile = "L_CITY_MARKET_ID.csv"
+
+// City 城市维度：由 L_CITY_MARKET_ID 和 on-time 数据的 *_city_name 解析得到
+type City struct {
+	CityMarketID string `json:"city_market_id"`
+	Name         string `json:"name"`       // BTS 的原始名称，如 New York City, NY (Metropolitan Area)
+	City         string `json:"city"`       // 城市，如 New York City
+	State        string `json:"state"`      // 州代码，美国以外为空
+	StateName    string `json:"state_name"` // 州名称
+	Country      string `json:"country"`    // 国家，美国（包括属地）为 United States
+	Domestic     bool   `json:"domestic"`   // 美国本土 50 州和 DC 为 true，属地和其他国家为 false
+	Source       string `json:"source"`     // 来源：L_CITY_MARKET_ID 或 on_time_data 等
+}
+
+// 名称解析的异常类型
+const (
+	CityEmpty           = "empty"            // 名称为空
+	CityNoSeparator     = "no_separator"     // 没有逗号，无法区分城市和州/国家，整个名称作为城市
+	CityUnknownState    = "unknown_state"    // 两位大写代码但不是美国的州或属地，当作州代码
+	CityWhitespace      = "whitespace"       // 多余或缺少空格，已规范化
+	CityCountryMismatch = "country_mismatch" // 同一城市市场在不同来源中的国家不同，以 L_CITY_MARKET_ID 为准
+	AirportNoSeparator  = "no_city"          // L_AIRPORT 的描述中没有冒号，整个描述作为机场名称
+)
+
+const (
+	metropolitanSuffix  = " (Metropolitan Area)"
+	unitedStatesCountry = "United States"
+)
+
+// 美国的州代码 → 州名称，包括 DC 和 BTS 数据中出现的属地
+var usStates = map[string]string{
+	"AL": "Alabama", "AK": "Alaska", "AZ": "Arizona", "AR": "Arkansas", "CA": "California",
+	"CO": "Colorado", "CT": "Connecticut", "DE": "Delaware", "FL": "Florida", "GA": "Georgia",
+	"HI": "Hawaii", "ID": "Idaho", "IL": "Illinois", "IN": "Indiana", "IA": "Iowa",
+	"KS": "Kansas", "KY": "Kentucky", "LA": "Louisiana", "ME": "Maine", "MD": "Maryland",
+	"MA": "Massachusetts", "MI": "Michigan", "MN": "Minnesota", "MS": "Mississippi", "MO": "Missouri",
+	"MT": "Montana", "NE": "Nebraska", "NV": "Nevada", "NH": "New Hampshire", "NJ": "New Jersey",
+	"NM": "New Mexico", "NY": "New York", "NC": "North Carolina", "ND": "North Dakota", "OH": "Ohio",
+	"OK": "Oklahoma", "OR": "Oregon", "PA": "Pennsylvania", "RI": "Rhode Island", "SC": "South Carolina",
+	"SD": "South Dakota", "TN": "Tennessee", "TX": "Texas", "UT": "Utah", "VT": "Vermont",
+	"VA": "Virginia", "WA": "Washington", "WV": "West Virginia", "WI": "Wisconsin", "WY": "Wyoming",
+	"DC": "District of Columbia",
+	"PR": "Puerto Rico", "VI": "U.S. Virgin Islands", "GU": "Guam", "AS": "American Samoa",
+	"MP": "Northern Mariana Islands", "TT": "U.S. Pacific Trust Territories and Possessions",
+}
+
+// 属地不算本土
+var usTerritories = map[string]bool{"PR": true, "VI": true, "GU": true, "AS": true, "MP": true, "TT": true}
+
+// 解析 BTS 的城市名称：美国为 "城市, 州代码"，都市区带 " (Metropolitan Area)" 后缀，其他国家为 "城市, 国家"，
+// 国家名称中可能有逗号（如 Bonaire, Sint Eustatius, and Saba）。不能正常解析时仍返回尽量完整的结果和异常类型
+func ParseCityName(name string) (City, string) {
+	c := City{Name: name}
+	s := strings.Join(strings.Fields(name), " ")
+	if s == "" {
+		return c, CityEmpty
+	}
+	metro := strings.HasSuffix(s, metropolitanSuffix)
+	s = strings.TrimSuffix(s, metropolitanSuffix)
+	canonical := func(tail string) string {
+		n := c.City + ", " + tail
+		if metro {
+			n += metropolitanSuffix
+		}
+		return n
+	}
+	anomaly := ""
+	if i := strings.LastIndex(s, ","); i >= 0 {
+		c.City, c.State = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+		if stateName, ok := usStates[c.State]; ok {
+			c.StateName, c.Country = stateName, unitedStatesCountry
+			c.Domestic = !usTerritories[c.State]
+			if canonical(c.State) != name {
+				anomaly = CityWhitespace
+			}
+			return c, anomaly
+		}
+		if len(c.State) == 2 && strings.ToUpper(c.State) == c.State {
+			return c, CityUnknownState
+		}
+	}
+	i := strings.Index(s, ",")
+	if i < 0 {
+		c.City, c.State = s, ""
+		return c, CityNoSeparator
+	}
+	c.City, c.State, c.Country = strings.TrimSpace(s[:i]), "", strings.TrimSpace(s[i+1:])
+	if canonical(c.Country) != name {
+		anomaly = CityWhitespace
+	}
+	return c, anomaly
+}
+
+// 解析 L_AIRPORT 的描述 "城市, 州: 机场名称"，冒号后的空格可有可无
+func ParseAirportDescription(desc string) (cityName, airportName, anomaly string) {
+	i := strings.Index(desc, ":")
+	if i < 0 {
+		return "", strings.TrimSpace(desc), AirportNoSeparator
+	}
+	return strings.TrimSpace(desc[:i]), strings.TrimSpace(desc[i+1:]), ""
+}
+
+// 解析异常的质量报告，同一来源、同一取值只记录一项并累计次数，处理完成后统一输出
+type ParseQuality struct {
+	mu     sync.Mutex
+	issues map[parseIssue]int
+}
+
+type parseIssue struct {
+	kind, source, value string
+}
+
+func NewParseQuality() *ParseQuality {
+	return &ParseQuality{issues: map[parseIssue]int{}}
+}
+
+func (q *ParseQuality) Add(kind, source, value string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.issues[parseIssue{kind, source, value}]++
+}
+
+// 某种异常在某个来源中某个取值的次数
+func (q *ParseQuality) Count(kind, source, value string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.issues[parseIssue{kind, source, value}]
+}
+
+// 不同异常的项数，同一来源、同一取值算一项
+func (q *ParseQuality) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.issues)
+}
+
+// 每种异常最多输出的示例数
+const qualityExamples = 5
+
+// 按异常类型输出数量和示例，没有异常时只输出一行
+func (q *ParseQuality) Report(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.issues) == 0 {
+		fmt.Println(name, "解析质量报告: 没有异常")
+		return
+	}
+	byKind := map[string][]parseIssue{}
+	for issue := range q.issues {
+		byKind[issue.kind] = append(byKind[issue.kind], issue)
+	}
+	kinds := make([]string, 0, len(byKind))
+	for kind := range byKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Println(name, "解析质量报告:", len(q.issues), "项异常")
+	for _, kind := range kinds {
+		issues := byKind[kind]
+		sort.Slice(issues, func(i, j int) bool {
+			if issues[i].source != issues[j].source {
+				return issues[i].source < issues[j].source
+			}
+			return issues[i].value < issues[j].value
+		})
+		examples := make([]string, 0, qualityExamples)
+		for _, issue := range issues[:min(len(issues), qualityExamples)] {
+			examples = append(examples, fmt.Sprintf("%s:%q(%d)", issue.source, issue.value, q.issues[issue]))
+		}
+		fmt.Println("  ", kind, len(issues), "项，如", strings.Join(examples, " "))
+	}
+}
+
+// CityDimension 城市维度，key:城市市场ID。L_CITY_MARKET_ID 优先，on-time 数据中有而表中没有的城市市场由 *_city_name 补充
+type CityDimension struct {
+	mu      sync.RWMutex
+	cities  map[string]*City
+	Quality *ParseQuality // 解析质量报告
+}
+
+func NewCityDimension() *CityDimension {
+	return &CityDimension{cities: map[string]*City{}, Quality: NewParseQuality()}
+}
+
+// 读取 L_CITY_MARKET_ID
+func (d *CityDimension) ReadCityMarkets(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	n := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 2 || record[0] == "Code" {
+			continue
+		}
+		c, anomaly := ParseCityName(record[1])
+		if anomaly != "" {
+			d.Quality.Add(anomaly, "L_CITY_MARKET_ID", record[1])
+		}
+		c.CityMarketID, c.Source = record[0], "L_CITY_MARKET_ID"
+		d.mu.Lock()
+		d.cities[c.CityMarketID] = &c
+		d.mu.Unlock()
+		n++
+	}
+	fmt.Println("读取城市完成:", n)
+	return nil
+}
+
+// 加入 on-time 等数据中的城市名称。一个城市市场可以包含不同州的机场（如纽约包含 NJ 的 EWR），
+// 表中已有的城市市场只检查国家是否一致；表中没有的取名称最小的一个，结果与读取顺序无关
+func (d *CityDimension) AddName(id, name, source string) {
+	if id == "" {
+		return
+	}
+	c, anomaly := ParseCityName(name)
+	if anomaly != "" {
+		d.Quality.Add(anomaly, source, name)
+	}
+	c.CityMarketID, c.Source = id, source
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old, ok := d.cities[id]
+	switch {
+	case !ok:
+		d.cities[id] = &c
+	case old.Source == "L_CITY_MARKET_ID":
+		if old.Country != c.Country {
+			d.Quality.Add(CityCountryMismatch, source, id+" "+name+" <> "+old.Name)
+		}
+	case c.Name < old.Name:
+		d.cities[id] = &c
+	}
+}
+
+// 取城市，没有时返回 nil
+func (d *CityDimension) Get(id string) *City {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.cities[id]
+}
+
+// 按城市市场ID排序的所有城市
+func (d *CityDimension) All() []*City {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	res := make([]*City, 0, len(d.cities))
+	for _, c := range d.cities {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CityMarketID < res[j].CityMarketID })
+	return res
+}
+
+// 城市的原始名称，没有时为空
+func (d *CityDimension) Name(id string) string {
+	if c := d.Get(id); c != nil {
+		return c.Name
+	}
+	return ""
+}
@@ -0,0 +1,38 @@
+package common
+
+import "testing"
+
+func TestParseCityName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    City
+		anomaly string
+	}{
+		{"New York, NY", City{City: "New York", State: "NY", StateName: "New York", Country: "United States", Domestic: true}, ""},
+		{"New York City, NY (Metropolitan Area)", City{City: "New York City", State: "NY", StateName: "New York", Country: "United States", Domestic: true}, ""},
+		{"Kekaha, Kauai, HI", City{City: "Kekaha, Kauai", State: "HI", StateName: "Hawaii", Country: "United States", Domestic: true}, ""},
+		{"San Juan, PR", City{City: "San Juan", State: "PR", StateName: "Puerto Rico", Country: "United States"}, ""},
+		{"Toronto, Canada", City{City: "Toronto", Country: "Canada"}, ""},
+		{"Saba, Bonaire, Sint Eustatius, and Saba", City{City: "Saba", Country: "Bonaire, Sint Eustatius, and Saba"}, ""},
+		{"Unknown Point in Alaska", City{City: "Unknown Point in Alaska"}, CityNoSeparator},
+		{"Springfield,  IL ", City{City: "Springfield", State: "IL", StateName: "Illinois", Country: "United States", Domestic: true}, CityWhitespace},
+		{"Springfield,IL", City{City: "Springfield", State: "IL", StateName: "Illinois", Country: "United States", Domestic: true}, CityWhitespace},
+		{"Somewhere, ZZ", City{City: "Somewhere", State: "ZZ"}, CityUnknownState},
+		{"", City{}, CityEmpty},
+	}
+	for _, tt := range tests {
+		got, anomaly := ParseCityName(tt.name)
+		tt.want.Name = tt.name
+		if got != tt.want || anomaly != tt.anomaly {
+			t.Errorf("ParseCityName(%q) = %+v %q, want %+v %q", tt.name, got, anomaly, tt.want, tt.anomaly)
+		}
+	}
+
+	city, airport, anomaly := ParseAirportDescription("New York, NY:John F. Kennedy International")
+	if city != "New York, NY" || airport != "John F. Kennedy International" || anomaly != "" {
+		t.Errorf("ParseAirportDescription = %q %q %q", city, airport, anomaly)
+	}
+	if _, airport, anomaly = ParseAirportDescription("Unknown Point in Alaska"); airport != "Unknown Point in Alaska" || anomaly != AirportNoSeparator {
+		t.Errorf("没有冒号的描述 = %q %q", airport, anomaly)
+	}
+}
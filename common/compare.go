@@ -0,0 +1,262 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+)
+
+// CompareConfig 环比、同比配置：生成一期报表后，读取 ES 中该期的文档，与上一期、去年同期 key 相同的文档比较，结果写入文档的 changes 字段
+type CompareConfig struct {
+	Index  string   `json:"index"`  // 报表索引
+	Period string   `json:"period"` // 期的字段：month 或 quarter
+	Keys   []string `json:"keys"`   // 除年、期外确定同一对象的字段
+	Fields []string `json:"fields"` // 比较的数值字段
+
+	// 由上一期的文档生成本期 discontinued 文档的ID，与报表生成文档ID的方法一致；为 nil 时为 年_期_keys。
+	// 只在各脚本默认的配置中设置
+	DocId func(year, period int, doc map[string]interface{}) string `json:"-"`
+}
+
+// PeriodChanges 文档的 changes 字段
+type PeriodChanges struct {
+	PrevYear     int                    `json:"prev_year"`    // 上一期的年
+	PrevPeriod   int                    `json:"prev_period"`  // 上一期的月或季度
+	IsNew        bool                   `json:"is_new"`       // 上一期没有该对象
+	IsNewYoy     bool                   `json:"is_new_yoy"`   // 去年同期没有该对象
+	Discontinued bool                   `json:"discontinued"` // 上一期有、本期没有，文档只有 key 和比较的字段，比较的字段为 0
+	Fields       map[string]FieldChange `json:"fields"`       // 各比较字段的变化
+}
+
+// FieldChange 一个字段的变化，没有对应文档或上一期为 0 时相应的值为 null
+type FieldChange struct {
+	Prev     *float64 `json:"prev"`      // 上一期的值
+	Delta    *float64 `json:"delta"`     // 与上一期的差
+	Pct      *float64 `json:"pct"`       // 与上一期相比的变化率，0.1 为增长 10%
+	YoyPrev  *float64 `json:"yoy_prev"`  // 去年同期的值
+	YoyDelta *float64 `json:"yoy_delta"` // 与去年同期的差
+	YoyPct   *float64 `json:"yoy_pct"`   // 与去年同期相比的变化率
+}
+
+// 按索引补全 keys、period、fields，未配置 fields 时使用默认的比较字段
+func ResolveCompareConfigs(cfgs, defaults []CompareConfig) ([]CompareConfig, error) {
+	var res []CompareConfig
+	for _, c := range cfgs {
+		for _, d := range defaults {
+			if d.Index != c.Index {
+				continue
+			}
+			if c.Period == "" {
+				c.Period = d.Period
+			}
+			if len(c.Keys) == 0 {
+				c.Keys = d.Keys
+			}
+			if len(c.Fields) == 0 {
+				c.Fields = d.Fields
+			}
+			c.DocId = d.DocId
+		}
+		if c.Period != "month" && c.Period != "quarter" {
+			return nil, fmt.Errorf("compare %s 的 period 只能是 month 或 quarter", c.Index)
+		}
+		if len(c.Keys) == 0 {
+			return nil, fmt.Errorf("compare %s 没有配置 keys", c.Index)
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// 上一期，1 月（1 季度）的上一期为去年 12 月（4 季度）
+func (c CompareConfig) prevPeriod(year, period int) (int, int) {
+	if period > 1 {
+		return year, period - 1
+	}
+	if c.Period == "quarter" {
+		return year - 1, 4
+	}
+	return year - 1, 12
+}
+
+// 本期 discontinued 文档的ID，key 为上一期文档 keys 字段的值
+func (c CompareConfig) id(year, period int, key string, prev map[string]interface{}) string {
+	if c.DocId != nil {
+		return c.DocId(year, period, prev)
+	}
+	return strings.Join([]string{cast.ToString(year), cast.ToString(period), key}, "_")
+}
+
+// 环比、同比读取并更新 ES 中的文档，只支持 ES 输出；本地计算模式需要同时配置 es 输出
+func CheckCompareSinks(cfgs []CompareConfig, sinks []SinkConfig) error {
+	if len(cfgs) > 0 && !HasEsSink(sinks) {
+		return fmt.Errorf("compare 只支持 ES 输出，sinks 中需要配置 es")
+	}
+	return nil
+}
+
+// 依次计算各索引本期的环比、同比，先等待 out 中本期的文档写入完成。
+// 本期的文档有写入失败或计算出错时返回错误，由调用方记为该期失败，不影响其他期
+func ComparePeriod(client *elastic.Client, out *CountingSink, cfgs []CompareConfig, year, period int) error {
+	if len(cfgs) == 0 {
+		return nil
+	}
+	if client == nil {
+		return fmt.Errorf("环比、同比只支持 ES 输出，需要连接ES")
+	}
+	out.FlushPeriod(year, period)
+	if err := out.Failed(year, period); err != nil {
+		return fmt.Errorf("本期的文档没有全部写入，不计算环比、同比: %v", err)
+	}
+	for _, c := range cfgs {
+		if err := enrichPeriodChanges(client, c, year, period); err != nil {
+			return fmt.Errorf("%s 环比、同比: %v", c.Index, err)
+		}
+	}
+	return nil
+}
+
+type periodDoc struct {
+	id     string
+	source map[string]interface{}
+}
+
+func enrichPeriodChanges(client *elastic.Client, c CompareConfig, year, period int) error {
+	ctx := context.Background()
+	exists, err := client.IndexExists(c.Index).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		fmt.Println(c.Index, "索引不存在，跳过环比、同比")
+		return nil
+	}
+	if _, err = client.Refresh(c.Index).Do(ctx); err != nil {
+		return err
+	}
+	prevYear, prevPeriod := c.prevPeriod(year, period)
+	current, err := loadPeriodDocs(client, c, year, period)
+	if err != nil {
+		return err
+	}
+	prev, err := loadPeriodDocs(client, c, prevYear, prevPeriod)
+	if err != nil {
+		return err
+	}
+	yoy, err := loadPeriodDocs(client, c, year-1, period)
+	if err != nil {
+		return err
+	}
+
+	var requests []elastic.BulkableRequest
+	for key, doc := range current {
+		p, hasPrev := prev[key]
+		y, hasYoy := yoy[key]
+		changes := PeriodChanges{PrevYear: prevYear, PrevPeriod: prevPeriod, IsNew: !hasPrev, IsNewYoy: !hasYoy, Fields: map[string]FieldChange{}}
+		for _, f := range c.Fields {
+			changes.Fields[f] = fieldChange(doc.source[f], p.source, y.source, f)
+		}
+		requests = append(requests, elastic.NewBulkUpdateRequest().Index(c.Index).Id(doc.id).Doc(map[string]interface{}{"changes": changes}))
+	}
+	// 上一期有、本期没有的对象，写入一个本期的文档标记为 discontinued
+	var discontinued []string
+	for key := range prev {
+		if _, ok := current[key]; !ok {
+			discontinued = append(discontinued, key)
+		}
+	}
+	sort.Strings(discontinued)
+	for _, key := range discontinued {
+		p := prev[key]
+		y, hasYoy := yoy[key]
+		doc := map[string]interface{}{"year": year, c.Period: period}
+		for _, k := range c.Keys {
+			doc[k] = p.source[k]
+		}
+		changes := PeriodChanges{PrevYear: prevYear, PrevPeriod: prevPeriod, IsNewYoy: !hasYoy, Discontinued: true, Fields: map[string]FieldChange{}}
+		for _, f := range c.Fields {
+			doc[f] = 0
+			changes.Fields[f] = fieldChange(0, p.source, y.source, f)
+		}
+		doc["changes"] = changes
+		requests = append(requests, elastic.NewBulkIndexRequest().Index(c.Index).Id(c.id(year, period, key, p.source)).Doc(doc))
+	}
+
+	for len(requests) > 0 {
+		n := min(len(requests), bulkActions)
+		res, err := client.Bulk().Add(requests[:n]...).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if failed := res.Failed(); len(failed) > 0 {
+			return fmt.Errorf("%s 写入 changes 失败: %s %v", c.Index, failed[0].Id, failed[0].Error)
+		}
+		requests = requests[n:]
+	}
+	fmt.Println(c.Index, year, period, "环比、同比:", len(current), "discontinued:", len(discontinued))
+	return nil
+}
+
+// 读取一期的文档，key 为 keys 字段的值，之前标记为 discontinued 的文档不算该期的对象
+func loadPeriodDocs(client *elastic.Client, c CompareConfig, year, period int) (map[string]periodDoc, error) {
+	ctx := context.Background()
+	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("year", year), elastic.NewTermQuery(c.Period, period))
+	docs := map[string]periodDoc{}
+	scroll := client.Scroll(c.Index).Query(query).Size(bulkActions)
+	defer scroll.Clear(ctx)
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range res.Hits.Hits {
+			var source map[string]interface{}
+			if err = json.Unmarshal(hit.Source, &source); err != nil {
+				return nil, err
+			}
+			if changes, ok := source["changes"].(map[string]interface{}); ok && changes["discontinued"] == true {
+				continue
+			}
+			values := make([]string, len(c.Keys))
+			for i, k := range c.Keys {
+				values[i] = cast.ToString(source[k])
+			}
+			docs[strings.Join(values, "_")] = periodDoc{id: hit.Id, source: source}
+		}
+	}
+}
+
+func fieldChange(current interface{}, prev, yoy map[string]interface{}, field string) FieldChange {
+	var res FieldChange
+	v := cast.ToFloat64(current)
+	if prev != nil {
+		res.Prev, res.Delta, res.Pct = delta(v, cast.ToFloat64(prev[field]))
+	}
+	if yoy != nil {
+		res.YoyPrev, res.YoyDelta, res.YoyPct = delta(v, cast.ToFloat64(yoy[field]))
+	}
+	return res
+}
+
+// 差和变化率保留 4 位小数，比较的值为 0 时不计算变化率
+func delta(current, prev float64) (*float64, *float64, *float64) {
+	round := func(v float64) *float64 {
+		v = math.Round(v*10000) / 10000
+		return &v
+	}
+	var pct *float64
+	if prev != 0 {
+		pct = round((current - prev) / prev)
+	}
+	return &prev, round(current - prev), pct
+}
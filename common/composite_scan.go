@@ -0,0 +1,177 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// ParallelConfig 并行翻页配置，config.json 中 parallel 配置，不配置或 workers 不大于 1 时顺序翻页
+type ParallelConfig struct {
+	Workers    int `json:"workers"`    // 同时翻页的协程数
+	Partitions int `json:"partitions"` // 分区数，默认为 workers 的 4 倍，分区越多各协程越均衡，但每个分区至少多一次请求
+}
+
+// CompositeScan 翻页读取一个复合聚合的所有分组
+type CompositeScan struct {
+	Client *elastic.Client
+	Index  string
+	Query  elastic.Query
+	Name   string                               // 聚合名称
+	NewAgg func() *elastic.CompositeAggregation // 每个分区新建一个聚合，翻页时会修改 after
+	// 分区字段，必须是复合聚合中第一个取值不固定的分组（年、月等查询中固定的分组除外），为空时不分区
+	Field string
+}
+
+type compositePage struct {
+	buckets []*elastic.AggregationBucketCompositeItem
+	err     error
+}
+
+// 按 after_key 的顺序把所有分组交给 handle，handle 只在当前协程中调用。
+// 并行时先按 Field 的取值把键空间分成连续的分区，各分区的记录数尽量相同，workers 个协程各自翻页，
+// 分组仍按分区顺序交给 handle，因此输出与协程数、分区数无关，与顺序翻页相同。
+// 不用 hash 或 terms 的 include.partition 分区，是因为那样分组的顺序会随分区数变化
+func (s CompositeScan) Run(p ParallelConfig, handle func(bucket *elastic.AggregationBucketCompositeItem)) error {
+	if p.Workers <= 1 || s.Field == "" {
+		return s.scan(s.Query, func(page compositePage) bool {
+			for _, bucket := range page.buckets {
+				handle(bucket)
+			}
+			return true
+		})
+	}
+	n := p.Partitions
+	if n <= 0 {
+		n = p.Workers * 4
+	}
+	parts, err := s.partitions(n)
+	if err != nil {
+		return err
+	}
+	fmt.Println(s.Index, s.Name, "并行翻页，协程数:", p.Workers, "分区数:", len(parts))
+
+	// 每个分区一个 channel，缓存一页，写入顺序靠当前协程依次读取各分区的 channel 保证
+	pages := make([]chan compositePage, len(parts))
+	for i := range pages {
+		pages[i] = make(chan compositePage, 1)
+	}
+	jobs := make(chan int, len(parts))
+	for i := range parts {
+		jobs <- i
+	}
+	close(jobs)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	for w := 0; w < min(p.Workers, len(parts)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				select {
+				case <-stop:
+					close(pages[i])
+					continue
+				default:
+				}
+				query := elastic.NewBoolQuery().Filter(s.Query, elastic.NewTermsQuery(s.Field, parts[i]...))
+				_ = s.scan(query, func(page compositePage) bool {
+					select {
+					case pages[i] <- page:
+						return page.err == nil
+					case <-stop:
+						return false
+					}
+				})
+				close(pages[i])
+			}
+		}()
+	}
+	for _, ch := range pages {
+		for page := range ch {
+			if page.err != nil {
+				return page.err
+			}
+			for _, bucket := range page.buckets {
+				handle(bucket)
+			}
+		}
+	}
+	return nil
+}
+
+// 用 query 翻页，每一页交给 emit，emit 返回 false 时停止；查询出错时把错误交给 emit
+func (s CompositeScan) scan(query elastic.Query, emit func(page compositePage) bool) error {
+	ctx := context.Background()
+	agg := s.NewAgg()
+	var afterKey map[string]interface{}
+	for {
+		if afterKey != nil {
+			agg = agg.AggregateAfter(afterKey)
+		}
+		searchResult, err := s.Client.Search().
+			Index(s.Index).
+			Query(query).
+			Size(0).
+			Aggregation(s.Name, agg).
+			Do(ctx)
+		if err != nil {
+			emit(compositePage{err: err})
+			return err
+		}
+		res, _ := searchResult.Aggregations.Composite(s.Name)
+		if res == nil {
+			return nil
+		}
+		if !emit(compositePage{buckets: res.Buckets}) {
+			return nil
+		}
+		afterKey = res.AfterKey
+		if res.AfterKey == nil || len(res.Buckets) == 0 {
+			return nil
+		}
+	}
+}
+
+// 按 Field 的取值顺序把键空间分成最多 n 个连续的分区，每个分区为该字段的一组取值，各分区的记录数尽量相同
+func (s CompositeScan) partitions(n int) ([][]interface{}, error) {
+	type value struct {
+		key   interface{}
+		count int64
+	}
+	var values []value
+	var total int64
+	keys := CompositeScan{Client: s.Client, Index: s.Index, Query: s.Query, Name: "partition_keys",
+		NewAgg: func() *elastic.CompositeAggregation {
+			return elastic.NewCompositeAggregation().Size(10000).Sources(elastic.NewCompositeAggregationTermsValuesSource("key").Field(s.Field))
+		}}
+	err := keys.Run(ParallelConfig{}, func(bucket *elastic.AggregationBucketCompositeItem) {
+		values = append(values, value{bucket.Key["key"], bucket.DocCount})
+		total += bucket.DocCount
+	})
+	if err != nil {
+		return nil, err
+	}
+	var parts [][]interface{}
+	var part []interface{}
+	var sum int64
+	for _, v := range values {
+		part = append(part, v.key)
+		sum += v.count
+		// 累计记录数达到下一个分区的边界时切分
+		if sum*int64(n) >= total*int64(len(parts)+1) {
+			parts = append(parts, part)
+			part = nil
+		}
+	}
+	if len(part) > 0 {
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
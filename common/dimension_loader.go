@@ -0,0 +1,193 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// PIT 在两次翻页之间保持的时间
+const pitKeepAlive = "1m"
+
+// DimensionConfig 维度索引的读取配置，如 config.json 中的 city_info
+type DimensionConfig struct {
+	PageSize  int    `json:"page_size"`  // 每页读取的文档数，默认 1000
+	CacheFile string `json:"cache_file"` // 本地缓存文件，为空时不缓存
+	CacheTTL  int    `json:"cache_ttl"`  // 缓存有效的分钟数，默认 1440
+}
+
+func (c DimensionConfig) withDefaults() DimensionConfig {
+	if c.PageSize <= 0 {
+		c.PageSize = 1000
+	}
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = 1440
+	}
+	return c
+}
+
+// LoadDimensionIndex 用 PIT 翻页读取整个维度索引，返回所有文档。配置了 CacheFile 时，来源（source，如 ES 地址）
+// 和索引的指纹（UUID、各主分片的 max_seq_no）都没有变化且缓存未过期，直接使用缓存，cached 为 true
+func LoadDimensionIndex[T any](client *elastic.Client, source, index string, cfg DimensionConfig) (docs []T, cached bool, err error) {
+	cfg = cfg.withDefaults()
+	// 指纹在读取之前取得，读取期间的写入会使下次运行时指纹不同而重新读取
+	var fingerprint string
+	if cfg.CacheFile != "" {
+		f, err := indexFingerprint(client, index)
+		if err != nil {
+			fmt.Println("读取", index, "统计信息失败，不使用缓存:", err)
+			cfg.CacheFile = ""
+		}
+		fingerprint = source + "/" + f
+	}
+	if cfg.CacheFile != "" && readDimensionCache(cfg.CacheFile, fingerprint, time.Duration(cfg.CacheTTL)*time.Minute, &docs) {
+		return docs, true, nil
+	}
+	_, err = pitScan(client, index, elastic.NewMatchAllQuery(), cfg.PageSize, func(hit *elastic.SearchHit) error {
+		var doc T
+		if err := json.Unmarshal(hit.Source, &doc); err != nil {
+			return fmt.Errorf("解析 %s 文档 %s 失败: %v", index, hit.Id, err)
+		}
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if cfg.CacheFile != "" {
+		if err = writeDimensionCache(cfg.CacheFile, fingerprint, docs); err != nil {
+			fmt.Println("写入", index, "缓存失败:", err)
+		}
+	}
+	return docs, false, nil
+}
+
+// pitScan 用 point in time 和 search_after 按 _shard_doc 翻页读取索引的所有文档，
+// 不受 max_result_window（默认 10000）的限制，翻页期间索引的写入也不影响结果。返回读取的文档数
+func pitScan(client *elastic.Client, index string, query elastic.Query, pageSize int, handle func(hit *elastic.SearchHit) error) (int, error) {
+	ctx := context.Background()
+	pit, err := client.OpenPointInTime(index).KeepAlive(pitKeepAlive).Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// 每次查询都可能返回新的 PIT ID，关闭最后一个
+	id := pit.Id
+	defer func() {
+		_, _ = client.ClosePointInTime(id).Do(ctx)
+	}()
+	n := 0
+	var after []interface{}
+	for {
+		search := client.Search().
+			PointInTime(elastic.NewPointInTimeWithKeepAlive(id, pitKeepAlive)).
+			Size(pageSize).
+			SortBy(elastic.NewFieldSort("_shard_doc"))
+		if query != nil {
+			search = search.Query(query)
+		}
+		if after != nil {
+			search = search.SearchAfter(after...)
+		}
+		res, err := search.Do(ctx)
+		if err != nil {
+			return n, err
+		}
+		if res.PitId != "" {
+			id = res.PitId
+		}
+		if res.Hits == nil || len(res.Hits.Hits) == 0 {
+			return n, nil
+		}
+		for _, hit := range res.Hits.Hits {
+			if err = handle(hit); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if len(res.Hits.Hits) < pageSize {
+			return n, nil
+		}
+		after = res.Hits.Hits[len(res.Hits.Hits)-1].Sort
+	}
+}
+
+// 索引的指纹：索引的 UUID 和各主分片的 max_seq_no。每次写入、删除文档都会增加所在分片的 max_seq_no，
+// 文档数不变的修改也会改变指纹；删除后重建的索引 UUID 不同。index 为别名时包括别名下的所有索引
+func indexFingerprint(client *elastic.Client, index string) (string, error) {
+	res, err := client.IndexStats(index).Level("shards").Do(context.Background())
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(res.Indices))
+	for name := range res.Indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		stats := res.Indices[name]
+		var shards []string
+		for shard, copies := range stats.Shards {
+			for _, c := range copies {
+				if c.Routing != nil && c.Routing.Primary && c.SeqNo != nil {
+					shards = append(shards, fmt.Sprintf("%s:%d", shard, c.SeqNo.MaxSeqNo))
+				}
+			}
+		}
+		if len(shards) == 0 {
+			return "", fmt.Errorf("索引 %s 的统计信息中没有主分片的 max_seq_no", name)
+		}
+		sort.Strings(shards)
+		parts = append(parts, fmt.Sprintf("%s uuid=%s max_seq_no=%s", name, stats.UUID, strings.Join(shards, ",")))
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("没有索引 %s 的统计信息", index)
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// 维度的本地缓存文件：来源的指纹相同且没有过期时直接使用，不再读取整个索引
+type dimensionCache struct {
+	Fingerprint string          `json:"fingerprint"` // 来源的指纹，如 ES 地址和索引的 UUID、max_seq_no
+	Created     time.Time       `json:"created"`
+	Docs        json.RawMessage `json:"docs"`
+}
+
+// 读取缓存到 v，文件不存在、过期或指纹不同时返回 false
+func readDimensionCache(path, fingerprint string, ttl time.Duration, v interface{}) bool {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var c dimensionCache
+	if err = json.Unmarshal(b, &c); err != nil {
+		return false
+	}
+	if c.Fingerprint != fingerprint || time.Since(c.Created) > ttl {
+		return false
+	}
+	return json.Unmarshal(c.Docs, v) == nil
+}
+
+// 写入缓存，先写临时文件再改名，同时运行的脚本不会读到写了一半的文件
+func writeDimensionCache(path, fingerprint string, v interface{}) error {
+	docs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(dimensionCache{Fingerprint: fingerprint, Created: time.Now(), Docs: docs})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
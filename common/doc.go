@@ -0,0 +1,4 @@
+// Package common 各脚本共用的代码：输出端、ES 批量写入、多期并发处理、环比同比、
+// 本地 BTS 文件的读取和解析、机场主数据、城市维度和复合聚合翻页。
+// 各脚本的 go.mod 通过 replace common => ../common 引用
+package common
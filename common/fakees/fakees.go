@@ -0,0 +1,1086 @@
+// Package fakees 各脚本端到端测试共用的进程内 ES 模拟，基于 httptest，不需要真实的 Elasticsearch
+package fakees
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// ES 进程内的 ES 模拟，只实现各脚本用到的接口：
+// 索引是否存在/创建、bulk、delete_by_query、count、refresh、stats（UUID 和 max_seq_no）、scroll、point in time（search_after 翻页），
+// 以及 search 中的 bool/term/terms/range 查询和 composite（含 Scripts 中注册的脚本）/filter/range/terms/avg/weighted_avg/sum/percentiles/top_hits 聚合。
+// 所有写操作都会记录在 Writes 中。
+// Rejects、BadIds 模拟 bulk 中被拒绝（429）和不能重试（400）的文档，Timeouts 模拟已写入但响应超时（504）的 bulk 请求，
+// Bulks 记录每次 bulk 请求的文档数。测试中修改这些字段时需要持有 Mu
+type ES struct {
+	t        *testing.T
+	server   *httptest.Server
+	Mu       sync.Mutex
+	indices  map[string]*fakeIndex
+	Writes   []Write
+	scrolls  map[string][]map[string]interface{}
+	Pits     map[string][]map[string]interface{} // 打开 PIT 时的文档快照
+	nextId   int
+	Rejects  int             // 接下来 bulk 中被拒绝的文档数，每拒绝一条减 1
+	BadIds   map[string]bool // bulk 中总是返回 400 的文档ID
+	Timeouts int             // 接下来写入后返回 504 的 bulk 请求数
+	Bulks    []int
+}
+
+type fakeIndex struct {
+	mapping string
+	uuid    string
+	seqNo   int64 // 只有一个分片，每次写入、删除文档加 1，与 ES 的 max_seq_no 一样从 -1 开始
+	ids     []string
+	docs    map[string]map[string]interface{}
+}
+
+// 一次写操作，Op 为 create_index、index、update、delete、delete_by_query
+type Write struct {
+	Op    string
+	Index string
+	Id    string
+	Doc   map[string]interface{}
+}
+
+// 启动模拟的 ES，测试结束时关闭
+func New(t *testing.T) *ES {
+	f := &ES{t: t, indices: map[string]*fakeIndex{}, scrolls: map[string][]map[string]interface{}{}, Pits: map[string][]map[string]interface{}{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// 连接模拟 ES 的客户端，不嗅探节点、不做健康检查
+func (f *ES) Client() *elastic.Client {
+	c, err := elastic.NewClient(elastic.SetURL(f.server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return c
+}
+
+// 直接写入文档，不记录为写操作，用于准备源数据
+func (f *ES) Seed(index, id string, doc interface{}) {
+	m := DocMap(f.t, doc)
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	f.put(index, id, m)
+}
+
+// 索引中的全部文档，key 为文档ID
+func (f *ES) Docs(index string) map[string]map[string]interface{} {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	res := map[string]map[string]interface{}{}
+	if idx, ok := f.indices[index]; ok {
+		for id, doc := range idx.docs {
+			res[id] = doc
+		}
+	}
+	return res
+}
+
+// 断言索引中的文档与 want 完全一致，want 的值按 json 序列化后比较
+func (f *ES) AssertDocs(index string, want map[string]interface{}) {
+	f.t.Helper()
+	got := f.Docs(index)
+	for id, doc := range want {
+		g, ok := got[id]
+		if !ok {
+			f.t.Errorf("%s 缺少文档 %s", index, id)
+			continue
+		}
+		if w := DocMap(f.t, doc); !reflect.DeepEqual(g, w) {
+			gb, _ := json.Marshal(g)
+			wb, _ := json.Marshal(w)
+			f.t.Errorf("%s 文档 %s 不一致\n got: %s\nwant: %s", index, id, gb, wb)
+		}
+	}
+	for id, doc := range got {
+		if _, ok := want[id]; !ok {
+			b, _ := json.Marshal(doc)
+			f.t.Errorf("%s 多出文档 %s: %s", index, id, b)
+		}
+	}
+}
+
+// 文档按 json 序列化再解析为 map，与写入 ES 后读到的文档一致
+func DocMap(t *testing.T, doc interface{}) map[string]interface{} {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func (f *ES) index(name string) *fakeIndex {
+	idx, ok := f.indices[name]
+	if !ok {
+		f.nextId++
+		idx = &fakeIndex{uuid: "uuid_" + strconv.Itoa(f.nextId), seqNo: -1, docs: map[string]map[string]interface{}{}}
+		f.indices[name] = idx
+	}
+	return idx
+}
+
+func (f *ES) put(index, id string, doc map[string]interface{}) (created bool) {
+	idx := f.index(index)
+	if id == "" {
+		f.nextId++
+		id = "auto_" + strconv.Itoa(f.nextId)
+	}
+	if _, ok := idx.docs[id]; !ok {
+		idx.ids = append(idx.ids, id)
+		created = true
+	}
+	idx.docs[id] = doc
+	idx.seqNo++
+	return created
+}
+
+func (f *ES) remove(index, id string) bool {
+	idx, ok := f.indices[index]
+	if !ok {
+		return false
+	}
+	if _, ok = idx.docs[id]; !ok {
+		return false
+	}
+	delete(idx.docs, id)
+	idx.seqNo++
+	for i, v := range idx.ids {
+		if v == id {
+			idx.ids = append(idx.ids[:i], idx.ids[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// 按写入顺序返回文档，附带 _id
+func (f *ES) hits(index string, query map[string]interface{}) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, name := range strings.Split(index, ",") {
+		idx, ok := f.indices[name]
+		if !ok {
+			continue
+		}
+		for _, id := range idx.ids {
+			doc := idx.docs[id]
+			if matchQuery(query, doc) {
+				res = append(res, map[string]interface{}{"_index": name, "_id": id, "_source": doc})
+			}
+		}
+	}
+	return res
+}
+
+func (f *ES) handle(w http.ResponseWriter, r *http.Request) {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var res interface{}
+	status := http.StatusOK
+	switch {
+	case r.URL.Path == "/":
+		res = map[string]interface{}{"version": map[string]interface{}{"number": "8.15.0"}}
+	case parts[0] == "_bulk":
+		res = f.bulk(body)
+		if f.Timeouts > 0 {
+			f.Timeouts--
+			status = http.StatusGatewayTimeout
+			res = map[string]interface{}{"error": map[string]interface{}{"type": "timeout"}, "status": status}
+		}
+	case parts[0] == "_pit":
+		id, _ := decodeBody(body)["id"].(string)
+		if _, ok := f.Pits[id]; !ok {
+			status = http.StatusNotFound
+			break
+		}
+		delete(f.Pits, id)
+		res = map[string]interface{}{"succeeded": true, "num_freed": 1}
+	case parts[0] == "_search" && len(parts) == 1:
+		res = f.pitSearch(decodeBody(body))
+	case parts[0] == "_search" && len(parts) > 1 && parts[1] == "scroll":
+		if r.Method == http.MethodDelete {
+			res = map[string]interface{}{"succeeded": true}
+			break
+		}
+		var req map[string]interface{}
+		_ = json.Unmarshal(body, &req)
+		id, _ := req["scroll_id"].(string)
+		res = f.scrollPage(id, 0)
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodHead:
+			if _, ok := f.indices[parts[0]]; !ok {
+				status = http.StatusNotFound
+			}
+		case http.MethodPut:
+			if _, ok := f.indices[parts[0]]; ok {
+				status = http.StatusBadRequest
+				res = map[string]interface{}{"error": map[string]interface{}{"type": "resource_already_exists_exception"}, "status": status}
+				break
+			}
+			f.index(parts[0]).mapping = string(body)
+			f.Writes = append(f.Writes, Write{Op: "create_index", Index: parts[0]})
+			res = map[string]interface{}{"acknowledged": true, "shards_acknowledged": true, "index": parts[0]}
+		default:
+			status = http.StatusMethodNotAllowed
+		}
+	case parts[1] == "_pit":
+		f.nextId++
+		id := "pit_" + strconv.Itoa(f.nextId)
+		f.Pits[id] = f.hits(parts[0], nil)
+		res = map[string]interface{}{"id": id}
+	case parts[1] == "_stats":
+		idx, ok := f.indices[parts[0]]
+		if !ok {
+			status = http.StatusNotFound
+			break
+		}
+		shard := map[string]interface{}{
+			"routing": map[string]interface{}{"state": "STARTED", "primary": true, "node": "fake"},
+			"docs":    map[string]interface{}{"count": len(idx.docs)},
+			"seq_no":  map[string]interface{}{"max_seq_no": idx.seqNo, "local_checkpoint": idx.seqNo, "global_checkpoint": idx.seqNo},
+		}
+		res = map[string]interface{}{"indices": map[string]interface{}{parts[0]: map[string]interface{}{
+			"uuid": idx.uuid, "shards": map[string]interface{}{"0": []interface{}{shard}}}}}
+	case parts[1] == "_refresh":
+		res = map[string]interface{}{"_shards": map[string]interface{}{"total": 1, "successful": 1}}
+	case parts[1] == "_count":
+		req := decodeBody(body)
+		res = map[string]interface{}{"count": len(f.hits(parts[0], asMap(req["query"])))}
+	case parts[1] == "_delete_by_query":
+		req := decodeBody(body)
+		hits := f.hits(parts[0], asMap(req["query"]))
+		for _, h := range hits {
+			f.remove(h["_index"].(string), h["_id"].(string))
+		}
+		f.Writes = append(f.Writes, Write{Op: "delete_by_query", Index: parts[0], Doc: asMap(req["query"])})
+		res = map[string]interface{}{"total": len(hits), "deleted": len(hits), "failures": []interface{}{}}
+	case parts[1] == "_search":
+		res = f.search(parts[0], decodeBody(body), r.URL.Query().Get("scroll") != "")
+	default:
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if res != nil && r.Method != http.MethodHead {
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func decodeBody(body []byte) map[string]interface{} {
+	req := map[string]interface{}{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		_ = json.Unmarshal(body, &req)
+	}
+	return req
+}
+
+func asMap(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+// bulk 请求为 ndjson，支持 index、create、update、delete
+func (f *ES) bulk(body []byte) map[string]interface{} {
+	var items []interface{}
+	failed := false
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var action map[string]map[string]interface{}
+		if err := json.Unmarshal(line, &action); err != nil {
+			f.t.Errorf("bulk action 解析失败: %s", line)
+			continue
+		}
+		for op, meta := range action {
+			index, _ := meta["_index"].(string)
+			id, _ := meta["_id"].(string)
+			item := map[string]interface{}{"_index": index, "_id": id, "status": http.StatusOK}
+			if reject := f.Rejects > 0; reject || f.BadIds[id] {
+				if op != "delete" {
+					scanner.Scan()
+				}
+				if reject {
+					f.Rejects--
+					item["status"] = http.StatusTooManyRequests
+					item["error"] = map[string]interface{}{"type": "es_rejected_execution_exception"}
+				} else {
+					item["status"] = http.StatusBadRequest
+					item["error"] = map[string]interface{}{"type": "mapper_parsing_exception"}
+				}
+				failed = true
+				items = append(items, map[string]interface{}{op: item})
+				continue
+			}
+			switch op {
+			case "index", "create", "update":
+				scanner.Scan()
+				var doc map[string]interface{}
+				_ = json.Unmarshal(scanner.Bytes(), &doc)
+				if op == "update" {
+					old, ok := f.index(index).docs[id]
+					if !ok && doc["doc_as_upsert"] != true {
+						item["status"] = http.StatusNotFound
+						item["error"] = map[string]interface{}{"type": "document_missing_exception"}
+						break
+					}
+					merged := map[string]interface{}{}
+					for k, v := range old {
+						merged[k] = v
+					}
+					for k, v := range asMap(doc["doc"]) {
+						merged[k] = v
+					}
+					doc = merged
+				}
+				if f.put(index, id, doc) {
+					item["status"] = http.StatusCreated
+					item["result"] = "created"
+				} else {
+					item["result"] = "updated"
+				}
+				if id == "" {
+					idx := f.indices[index]
+					item["_id"] = idx.ids[len(idx.ids)-1]
+				}
+				f.Writes = append(f.Writes, Write{Op: op, Index: index, Id: item["_id"].(string), Doc: doc})
+			case "delete":
+				if !f.remove(index, id) {
+					item["status"] = http.StatusNotFound
+				}
+				f.Writes = append(f.Writes, Write{Op: op, Index: index, Id: id})
+			}
+			items = append(items, map[string]interface{}{op: item})
+		}
+	}
+	f.Bulks = append(f.Bulks, len(items))
+	return map[string]interface{}{"took": 1, "errors": failed, "items": items}
+}
+
+func (f *ES) search(index string, req map[string]interface{}, scroll bool) map[string]interface{} {
+	hits := f.hits(index, asMap(req["query"]))
+	size := 10
+	if v, ok := req["size"]; ok {
+		size = int(toFloat(v))
+	}
+	res := map[string]interface{}{"took": 1, "timed_out": false}
+	if scroll {
+		f.nextId++
+		id := "scroll_" + strconv.Itoa(f.nextId)
+		f.scrolls[id] = hits
+		page := f.scrollPage(id, size)
+		page["hits"].(map[string]interface{})["total"] = map[string]interface{}{"value": len(hits), "relation": "eq"}
+		return page
+	}
+	from := 0
+	if v, ok := req["from"]; ok {
+		from = int(toFloat(v))
+	}
+	page := hits[min(from, len(hits)):min(from+size, len(hits))]
+	res["hits"] = map[string]interface{}{"total": map[string]interface{}{"value": len(hits), "relation": "eq"}, "hits": sourceHits(page, req["_source"])}
+	aggs := asMap(req["aggregations"])
+	if aggs == nil {
+		aggs = asMap(req["aggs"])
+	}
+	if aggs != nil {
+		docs := make([]map[string]interface{}, 0, len(hits))
+		for _, h := range hits {
+			docs = append(docs, h["_source"].(map[string]interface{}))
+		}
+		res["aggregations"] = runAggs(aggs, docs)
+	}
+	return res
+}
+
+// 在 PIT 的快照上查询，按 sort 排序后返回 search_after 之后的一页，每个文档带有 sort 的值。
+// _shard_doc 为文档在快照中的位置
+func (f *ES) pitSearch(req map[string]interface{}) map[string]interface{} {
+	pit := asMap(req["pit"])
+	id, _ := pit["id"].(string)
+	snapshot, ok := f.Pits[id]
+	if !ok {
+		panic("ES 不存在的 PIT: " + id)
+	}
+	var fields []string
+	for _, s := range clauses(req["sort"]) {
+		for field := range s {
+			fields = append(fields, field)
+		}
+	}
+	type sortedHit struct {
+		hit    map[string]interface{}
+		values []interface{}
+	}
+	var hits []sortedHit
+	for i, h := range snapshot {
+		if !matchQuery(asMap(req["query"]), h["_source"].(map[string]interface{})) {
+			continue
+		}
+		values := make([]interface{}, len(fields))
+		for j, field := range fields {
+			if field == "_shard_doc" {
+				values[j] = float64(i)
+			} else {
+				values[j] = h["_source"].(map[string]interface{})[field]
+			}
+		}
+		hits = append(hits, sortedHit{h, values})
+	}
+	less := func(a, b []interface{}) int {
+		for i := range a {
+			if c := CompareValues(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return less(hits[i].values, hits[j].values) < 0 })
+	if after, ok := req["search_after"].([]interface{}); ok {
+		start := sort.Search(len(hits), func(i int) bool { return less(hits[i].values, after) > 0 })
+		hits = hits[start:]
+	}
+	size := 10
+	if v, ok := req["size"]; ok {
+		size = int(toFloat(v))
+	}
+	hits = hits[:min(size, len(hits))]
+	page := make([]interface{}, len(hits))
+	for i, h := range hits {
+		page[i] = map[string]interface{}{"_index": h.hit["_index"], "_id": h.hit["_id"], "_source": h.hit["_source"], "sort": h.values}
+	}
+	return map[string]interface{}{"took": 1, "timed_out": false, "pit_id": id,
+		"hits": map[string]interface{}{"total": map[string]interface{}{"value": len(snapshot), "relation": "eq"}, "hits": page}}
+}
+
+// scroll 每次返回一页，size 为 0 时沿用第一次的大小
+func (f *ES) scrollPage(id string, size int) map[string]interface{} {
+	hits := f.scrolls[id]
+	if size == 0 {
+		size = len(hits)
+	}
+	n := min(size, len(hits))
+	f.scrolls[id] = hits[n:]
+	return map[string]interface{}{
+		"_scroll_id": id,
+		"hits":       map[string]interface{}{"total": map[string]interface{}{"value": len(hits), "relation": "eq"}, "hits": hits[:n]},
+	}
+}
+
+func sourceHits(hits []map[string]interface{}, sourceSpec interface{}) []interface{} {
+	res := []interface{}{}
+	includes := sourceIncludes(sourceSpec)
+	for _, h := range hits {
+		src := h["_source"].(map[string]interface{})
+		if includes != nil {
+			filtered := map[string]interface{}{}
+			for _, field := range includes {
+				if v, ok := src[field]; ok {
+					filtered[field] = v
+				}
+			}
+			src = filtered
+		}
+		res = append(res, map[string]interface{}{"_index": h["_index"], "_id": h["_id"], "_score": 1.0, "_source": src})
+	}
+	return res
+}
+
+func sourceIncludes(spec interface{}) []string {
+	var raw []interface{}
+	switch s := spec.(type) {
+	case []interface{}:
+		raw = s
+	case map[string]interface{}:
+		raw, _ = s["includes"].([]interface{})
+	}
+	if raw == nil {
+		return nil
+	}
+	var res []string
+	for _, v := range raw {
+		res = append(res, fmt.Sprint(v))
+	}
+	return res
+}
+
+func matchQuery(q map[string]interface{}, doc map[string]interface{}) bool {
+	if len(q) == 0 {
+		return true
+	}
+	for typ, body := range q {
+		switch typ {
+		case "match_all":
+			return true
+		case "bool":
+			b := asMap(body)
+			for _, clause := range clauses(b["must"]) {
+				if !matchQuery(clause, doc) {
+					return false
+				}
+			}
+			for _, clause := range clauses(b["filter"]) {
+				if !matchQuery(clause, doc) {
+					return false
+				}
+			}
+			for _, clause := range clauses(b["must_not"]) {
+				if matchQuery(clause, doc) {
+					return false
+				}
+			}
+			should := clauses(b["should"])
+			if len(should) == 0 {
+				return true
+			}
+			for _, clause := range should {
+				if matchQuery(clause, doc) {
+					return true
+				}
+			}
+			return false
+		case "term":
+			for field, v := range asMap(body) {
+				if m, ok := v.(map[string]interface{}); ok {
+					v = m["value"]
+				}
+				if !fieldMatches(doc, field, func(x interface{}) bool { return sameValue(x, v) }) {
+					return false
+				}
+			}
+			return true
+		case "terms":
+			for field, v := range asMap(body) {
+				values, _ := v.([]interface{})
+				if !fieldMatches(doc, field, func(x interface{}) bool {
+					for _, want := range values {
+						if sameValue(x, want) {
+							return true
+						}
+					}
+					return false
+				}) {
+					return false
+				}
+			}
+			return true
+		case "range":
+			for field, v := range asMap(body) {
+				if !fieldMatches(doc, field, func(x interface{}) bool { return inRange(x, asMap(v)) }) {
+					return false
+				}
+			}
+			return true
+		case "exists":
+			field := fmt.Sprint(asMap(body)["field"])
+			return fieldMatches(doc, field, func(x interface{}) bool { return true })
+		default:
+			panic("ES 不支持的查询: " + typ)
+		}
+	}
+	return true
+}
+
+func clauses(v interface{}) []map[string]interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{c}
+	case []interface{}:
+		var res []map[string]interface{}
+		for _, x := range c {
+			res = append(res, asMap(x))
+		}
+		return res
+	}
+	return nil
+}
+
+// 字段值（数组时任一元素）满足条件，字段缺失或为 null 时不匹配
+func fieldMatches(doc map[string]interface{}, field string, fn func(interface{}) bool) bool {
+	v, ok := doc[field]
+	if !ok || v == nil {
+		return false
+	}
+	if arr, ok := v.([]interface{}); ok {
+		for _, x := range arr {
+			if fn(x) {
+				return true
+			}
+		}
+		return false
+	}
+	return fn(v)
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case float64, int, int64, json.Number:
+		return true
+	}
+	return false
+}
+
+func toFloat(v interface{}) float64 {
+	switch x := v.(type) {
+	case float64:
+		return x
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case json.Number:
+		f, _ := x.Float64()
+		return f
+	case string:
+		f, _ := strconv.ParseFloat(x, 64)
+		return f
+	case bool:
+		if x {
+			return 1
+		}
+	}
+	return 0
+}
+
+// keyword 字段与数字比较时按字符串比较，与 ES 一致
+func sameValue(a, b interface{}) bool {
+	if isNumber(a) && isNumber(b) {
+		return toFloat(a) == toFloat(b)
+	}
+	return valueString(a) == valueString(b)
+}
+
+func valueString(v interface{}) string {
+	if isNumber(v) {
+		return strconv.FormatFloat(toFloat(v), 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func inRange(x interface{}, r map[string]interface{}) bool {
+	cmp := func(bound interface{}) int { return CompareValues(x, bound) }
+	if v, ok := r["gt"]; ok && cmp(v) <= 0 {
+		return false
+	}
+	if v, ok := r["gte"]; ok && cmp(v) < 0 {
+		return false
+	}
+	if v, ok := r["lt"]; ok && cmp(v) >= 0 {
+		return false
+	}
+	if v, ok := r["lte"]; ok && cmp(v) > 0 {
+		return false
+	}
+	if v, ok := r["from"]; ok && v != nil {
+		if c := cmp(v); c < 0 || (c == 0 && r["include_lower"] == false) {
+			return false
+		}
+	}
+	if v, ok := r["to"]; ok && v != nil {
+		if c := cmp(v); c > 0 || (c == 0 && r["include_upper"] == false) {
+			return false
+		}
+	}
+	return true
+}
+
+// 按 ES 的排序规则比较两个值：都是数字时比较数值，否则比较字符串，测试中注册的脚本也用它比较
+func CompareValues(a, b interface{}) int {
+	if isNumber(a) && isNumber(b) {
+		fa, fb := toFloat(a), toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(valueString(a), valueString(b))
+}
+
+// 执行一组聚合，返回 ES 格式的聚合结果
+func runAggs(aggs map[string]interface{}, docs []map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	for name, spec := range aggs {
+		res[name] = runAgg(asMap(spec), docs)
+	}
+	return res
+}
+
+func runAgg(spec map[string]interface{}, docs []map[string]interface{}) map[string]interface{} {
+	subs := asMap(spec["aggregations"])
+	if subs == nil {
+		subs = asMap(spec["aggs"])
+	}
+	for typ, body := range spec {
+		b := asMap(body)
+		switch typ {
+		case "aggregations", "aggs", "meta":
+			continue
+		case "composite":
+			return compositeAgg(b, subs, docs)
+		case "filter":
+			var matched []map[string]interface{}
+			for _, d := range docs {
+				if matchQuery(b, d) {
+					matched = append(matched, d)
+				}
+			}
+			res := runAggs(subs, matched)
+			res["doc_count"] = len(matched)
+			return res
+		case "avg", "sum", "min", "max", "value_count":
+			values := fieldValues(b, docs)
+			return map[string]interface{}{"value": metric(typ, values)}
+		case "weighted_avg":
+			return weightedAvgAgg(b, docs)
+		case "percentiles":
+			return percentilesAgg(b, fieldValues(b, docs))
+		case "range":
+			return rangeAgg(b, subs, docs)
+		case "terms":
+			return termsAgg(b, subs, docs)
+		case "top_hits":
+			size := 3
+			if v, ok := b["size"]; ok {
+				size = int(toFloat(v))
+			}
+			var hits []map[string]interface{}
+			for i, d := range docs {
+				if i >= size {
+					break
+				}
+				hits = append(hits, map[string]interface{}{"_index": "", "_id": "", "_source": d})
+			}
+			return map[string]interface{}{"hits": map[string]interface{}{
+				"total":     map[string]interface{}{"value": len(docs), "relation": "eq"},
+				"max_score": 1.0,
+				"hits":      sourceHits(hits, b["_source"]),
+			}}
+		default:
+			panic("ES 不支持的聚合: " + typ)
+		}
+	}
+	return nil
+}
+
+// 取字段值，missing 为缺失时使用的默认值
+func fieldValues(b map[string]interface{}, docs []map[string]interface{}) []float64 {
+	field := fmt.Sprint(b["field"])
+	missing, hasMissing := b["missing"]
+	var values []float64
+	for _, d := range docs {
+		v, ok := d[field]
+		if !ok || v == nil {
+			if hasMissing {
+				values = append(values, toFloat(missing))
+			}
+			continue
+		}
+		if arr, ok := v.([]interface{}); ok {
+			for _, x := range arr {
+				values = append(values, toFloat(x))
+			}
+			continue
+		}
+		values = append(values, toFloat(v))
+	}
+	return values
+}
+
+func metric(typ string, values []float64) interface{} {
+	switch typ {
+	case "value_count":
+		return len(values)
+	case "sum":
+		s := 0.0
+		for _, v := range values {
+			s += v
+		}
+		return s
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	switch typ {
+	case "avg":
+		s := 0.0
+		for _, v := range values {
+			s += v
+		}
+		return s / float64(len(values))
+	case "min":
+		m := math.Inf(1)
+		for _, v := range values {
+			m = math.Min(m, v)
+		}
+		return m
+	default:
+		m := math.Inf(-1)
+		for _, v := range values {
+			m = math.Max(m, v)
+		}
+		return m
+	}
+}
+
+// weighted_avg 聚合，sum(value*weight)/sum(weight)，缺少 value 或 weight 的文档不参与计算
+func weightedAvgAgg(b map[string]interface{}, docs []map[string]interface{}) map[string]interface{} {
+	value, weight := asMap(b["value"]), asMap(b["weight"])
+	sum, weights := 0.0, 0.0
+	for _, d := range docs {
+		vs := fieldValues(value, []map[string]interface{}{d})
+		ws := fieldValues(weight, []map[string]interface{}{d})
+		if len(vs) == 0 || len(ws) == 0 {
+			continue
+		}
+		sum += vs[0] * ws[0]
+		weights += ws[0]
+	}
+	if weights == 0 {
+		return map[string]interface{}{"value": nil}
+	}
+	return map[string]interface{}{"value": sum / weights}
+}
+
+// percentiles 聚合，用精确的线性插值代替 ES 的 TDigest 近似
+func percentilesAgg(b map[string]interface{}, values []float64) map[string]interface{} {
+	percents := []float64{1, 5, 25, 50, 75, 95, 99}
+	if v, ok := b["percents"].([]interface{}); ok {
+		percents = percents[:0]
+		for _, p := range v {
+			percents = append(percents, toFloat(p))
+		}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	res := map[string]interface{}{}
+	for _, p := range percents {
+		key := strconv.FormatFloat(p, 'f', 1, 64)
+		if len(sorted) == 0 {
+			res[key] = nil
+			continue
+		}
+		rank := p / 100 * float64(len(sorted)-1)
+		i := int(rank)
+		if i+1 >= len(sorted) {
+			res[key] = sorted[len(sorted)-1]
+		} else {
+			res[key] = sorted[i] + (sorted[i+1]-sorted[i])*(rank-float64(i))
+		}
+	}
+	return map[string]interface{}{"values": res}
+}
+
+// range 聚合，包含 from 不包含 to
+// terms 聚合，按文档数降序、key 升序排列，取前 size 个分组，不支持 order
+func termsAgg(b, subs map[string]interface{}, docs []map[string]interface{}) map[string]interface{} {
+	field := fmt.Sprint(b["field"])
+	size := 10
+	if v, ok := b["size"]; ok {
+		size = int(toFloat(v))
+	}
+	type bucket struct {
+		key  interface{}
+		docs []map[string]interface{}
+	}
+	groups := map[string]*bucket{}
+	var keys []string
+	for _, d := range docs {
+		v := d[field]
+		if v == nil {
+			continue
+		}
+		k := valueString(v)
+		if groups[k] == nil {
+			groups[k] = &bucket{key: v}
+			keys = append(keys, k)
+		}
+		groups[k].docs = append(groups[k].docs, d)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := groups[keys[i]], groups[keys[j]]
+		if len(a.docs) != len(b.docs) {
+			return len(a.docs) > len(b.docs)
+		}
+		return CompareValues(a.key, b.key) < 0
+	})
+	buckets := []interface{}{}
+	other := 0
+	for i, k := range keys {
+		g := groups[k]
+		if i >= size {
+			other += len(g.docs)
+			continue
+		}
+		res := runAggs(subs, g.docs)
+		res["key"] = g.key
+		res["doc_count"] = len(g.docs)
+		buckets = append(buckets, res)
+	}
+	return map[string]interface{}{"doc_count_error_upper_bound": 0, "sum_other_doc_count": other, "buckets": buckets}
+}
+
+func rangeAgg(b, subs map[string]interface{}, docs []map[string]interface{}) map[string]interface{} {
+	var buckets []interface{}
+	for _, r := range b["ranges"].([]interface{}) {
+		rm := asMap(r)
+		var matched []map[string]interface{}
+		for _, d := range docs {
+			for _, v := range fieldValues(b, []map[string]interface{}{d}) {
+				if from, ok := rm["from"]; ok && from != nil && v < toFloat(from) {
+					continue
+				}
+				if to, ok := rm["to"]; ok && to != nil && v >= toFloat(to) {
+					continue
+				}
+				matched = append(matched, d)
+				break
+			}
+		}
+		bucket := runAggs(subs, matched)
+		key, ok := rm["key"]
+		if !ok {
+			key = fmt.Sprintf("%v-%v", rm["from"], rm["to"])
+		}
+		bucket["key"] = key
+		bucket["doc_count"] = len(matched)
+		if from, ok := rm["from"]; ok && from != nil {
+			bucket["from"] = toFloat(from)
+		}
+		if to, ok := rm["to"]; ok && to != nil {
+			bucket["to"] = toFloat(to)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return map[string]interface{}{"buckets": buckets}
+}
+
+// composite terms source 中脚本的模拟实现，key 为脚本内容，由各脚本的测试注册，返回 nil 表示文档不参与分组
+var Scripts = map[string]func(params, doc map[string]interface{}) interface{}{}
+
+type compositeBucket struct {
+	key    []interface{}
+	docs   []map[string]interface{}
+	keyMap map[string]interface{}
+}
+
+// composite 聚合，按 sources 的顺序排序分页，缺少任一 key 的文档不参与分组
+func compositeAgg(b, subs map[string]interface{}, docs []map[string]interface{}) map[string]interface{} {
+	var names []string
+	var values []func(map[string]interface{}) interface{}
+	for _, s := range b["sources"].([]interface{}) {
+		for name, src := range asMap(s) {
+			names = append(names, name)
+			terms := asMap(asMap(src)["terms"])
+			if script := asMap(terms["script"]); script != nil {
+				fn, ok := Scripts[fmt.Sprint(script["source"])]
+				if !ok {
+					panic("ES 不支持的脚本: " + fmt.Sprint(script["source"]))
+				}
+				params := asMap(script["params"])
+				values = append(values, func(d map[string]interface{}) interface{} { return fn(params, d) })
+				continue
+			}
+			field := fmt.Sprint(terms["field"])
+			values = append(values, func(d map[string]interface{}) interface{} { return d[field] })
+		}
+	}
+	groups := map[string]*compositeBucket{}
+	for _, d := range docs {
+		key := make([]interface{}, len(values))
+		ok := true
+		for i, value := range values {
+			v := value(d)
+			if v == nil {
+				ok = false
+				break
+			}
+			key[i] = v
+		}
+		if !ok {
+			continue
+		}
+		k, _ := json.Marshal(key)
+		g, exists := groups[string(k)]
+		if !exists {
+			g = &compositeBucket{key: key, keyMap: map[string]interface{}{}}
+			for i, name := range names {
+				g.keyMap[name] = key[i]
+			}
+			groups[string(k)] = g
+		}
+		g.docs = append(g.docs, d)
+	}
+	buckets := make([]*compositeBucket, 0, len(groups))
+	for _, g := range groups {
+		buckets = append(buckets, g)
+	}
+	less := func(a, b []interface{}) int {
+		for i := range a {
+			if c := CompareValues(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+	sort.Slice(buckets, func(i, j int) bool { return less(buckets[i].key, buckets[j].key) < 0 })
+	if after := asMap(b["after"]); after != nil {
+		afterKey := make([]interface{}, len(names))
+		for i, name := range names {
+			afterKey[i] = after[name]
+		}
+		start := sort.Search(len(buckets), func(i int) bool { return less(buckets[i].key, afterKey) > 0 })
+		buckets = buckets[start:]
+	}
+	size := 10
+	if v, ok := b["size"]; ok {
+		size = int(toFloat(v))
+	}
+	if len(buckets) > size {
+		buckets = buckets[:size]
+	}
+	res := map[string]interface{}{}
+	var out []interface{}
+	for _, g := range buckets {
+		bucket := runAggs(subs, g.docs)
+		bucket["key"] = g.keyMap
+		bucket["doc_count"] = len(g.docs)
+		out = append(out, bucket)
+	}
+	res["buckets"] = out
+	if len(buckets) > 0 {
+		res["after_key"] = buckets[len(buckets)-1].keyMap
+	} else {
+		res["buckets"] = []interface{}{}
+	}
+	return res
+}
@@ -0,0 +1,116 @@
+package common
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// 与 import_ontime 下载、解压后的文件名一致
+	OnTimeZipNamePrefix = "On_Time_Reporting_Carrier_On_Time_Performance_1987_present_"
+	OnTimeCsvNamePrefix = "On_Time_Reporting_Carrier_On_Time_Performance_(1987_present)_"
+	// BTS DB1B Market 下载文件名
+	MarketNamePrefix = "Origin_and_Destination_Survey_DB1BMarket_"
+)
+
+// LocalConfig 本地计算模式配置，配置后不再从ES聚合，直接读取本地文件计算
+type LocalConfig struct {
+	DataDir      string `json:"data_dir"`       // csv 或 zip 文件所在目录
+	CityInfoFile string `json:"city_info_file"` // city_info 索引导出的 json 文件，gen_airlines 使用
+}
+
+// 本地 on-time 数据文件，优先读取解压后的 csv
+func OnTimeFileNames(year, month int) []string {
+	return []string{
+		fmt.Sprintf("%s%d_%d.csv", OnTimeCsvNamePrefix, year, month),
+		fmt.Sprintf("%s%d_%d.zip", OnTimeZipNamePrefix, year, month),
+	}
+}
+
+// 本地 DB1B Market 数据文件
+func MarketFileNames(year, quarter int) []string {
+	return []string{
+		fmt.Sprintf("%s%d_%d.csv", MarketNamePrefix, year, quarter),
+		fmt.Sprintf("%s%d_%d.zip", MarketNamePrefix, year, quarter),
+	}
+}
+
+// 逐行读取本地 csv（或 zip 中的 csv），header 为列名到下标的映射
+func ReadLocalCsv(dir string, names []string, fn func(header map[string]int, record []string) error) error {
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if strings.HasSuffix(name, ".zip") {
+			return readZipCsv(path, fn)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return readCsvRecords(f, fn)
+	}
+	return fmt.Errorf("%s 下未找到数据文件: %s", dir, strings.Join(names, ", "))
+}
+
+func readZipCsv(path string, fn func(header map[string]int, record []string) error) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	for _, f := range archive.File {
+		if !strings.HasSuffix(f.Name, ".csv") {
+			continue
+		}
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		return readCsvRecords(src, fn)
+	}
+	return fmt.Errorf("%s 中没有 csv 文件", path)
+}
+
+func readCsvRecords(r io.Reader, fn func(header map[string]int, record []string) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	first, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	header := map[string]int{}
+	for i, name := range first {
+		header[strings.TrimPrefix(name, "\ufeff")] = i
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(header, record); err != nil {
+			return err
+		}
+	}
+}
+
+// 按列名取值，列不存在时返回空
+func CsvValue(header map[string]int, record []string, name string) string {
+	i, ok := header[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return record[i]
+}
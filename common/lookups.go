@@ -0,0 +1,158 @@
+package common
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// BTS 的机场表 L_AIRPORT，列为 Code,Description，随脚本附带
+var AirportFile = "L_AIRPORT.csv"
+
+// CityInfo city_info 索引的文档
+type CityInfo struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Code     string `json:"code"`
+	Domestic bool   `json:"domestic"`
+	Country  string `json:"country,omitempty"` // 旧的 city_info 文档没有国家
+}
+
+// Lookups 各脚本共用的维度查找表，启动时读取一次，之后只读：
+// 城市维度（L_CITY_MARKET_ID 和 on-time 数据中的城市名称）、机场名称（L_AIRPORT）和 city_info
+type Lookups struct {
+	Cities   *CityDimension
+	airports map[string]string    // key:机场代码 value:机场名称
+	cityInfo map[string]*CityInfo // key:城市市场ID
+}
+
+func NewLookups() *Lookups {
+	return &Lookups{Cities: NewCityDimension(), airports: map[string]string{}, cityInfo: map[string]*CityInfo{}}
+}
+
+// ReadAirports 读取 L_AIRPORT，描述为 "城市, 州: 机场名称"，城市部分的解析异常记入城市维度的质量报告
+func (l *Lookups) ReadAirports(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	n := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 2 || record[0] == "Code" {
+			continue
+		}
+		cityName, name, anomaly := ParseAirportDescription(record[1])
+		if anomaly != "" {
+			l.Cities.Quality.Add(anomaly, "L_AIRPORT", record[1])
+		} else if _, anomaly = ParseCityName(cityName); anomaly != "" {
+			l.Cities.Quality.Add(anomaly, "L_AIRPORT", record[1])
+		}
+		l.airports[record[0]] = name
+		n++
+	}
+	fmt.Println("读取机场完成:", n)
+	return nil
+}
+
+// AirportName 机场名称，L_AIRPORT 中没有时为空
+func (l *Lookups) AirportName(code string) string {
+	return l.airports[code]
+}
+
+// SetCityInfo 由 city_info 文档生成 city_info 维度，城市市场ID重复时取第一个，返回重复的文档数
+func (l *Lookups) SetCityInfo(infos []CityInfo) int {
+	l.cityInfo = make(map[string]*CityInfo, len(infos))
+	dup := 0
+	for i := range infos {
+		if _, ok := l.cityInfo[infos[i].Code]; ok {
+			dup++
+			continue
+		}
+		l.cityInfo[infos[i].Code] = &infos[i]
+	}
+	return dup
+}
+
+// LoadCityInfo 用 PIT 翻页读取整个 city_info 索引，cfg 配置了缓存时按 LoadDimensionIndex 使用缓存。返回文档数和重复的文档数
+func (l *Lookups) LoadCityInfo(client *elastic.Client, source, index string, cfg DimensionConfig) (n, dup int, cached bool, err error) {
+	infos, cached, err := LoadDimensionIndex[CityInfo](client, source, index, cfg)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return len(infos), l.SetCityInfo(infos), cached, nil
+}
+
+// ReadCityInfoFile 从本地文件读取 city_info，支持 json 数组或每行一个文档
+func (l *Lookups) ReadCityInfoFile(path string) (dup int, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var infos []CityInfo
+	if err = json.Unmarshal(b, &infos); err != nil {
+		infos = nil
+		scanner := bufio.NewScanner(strings.NewReader(string(b)))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var info CityInfo
+			if err = json.Unmarshal([]byte(line), &info); err != nil {
+				return 0, err
+			}
+			infos = append(infos, info)
+		}
+	}
+	return l.SetCityInfo(infos), nil
+}
+
+// CityInfoLen city_info 维度中的城市市场数
+func (l *Lookups) CityInfoLen() int {
+	return len(l.cityInfo)
+}
+
+// Domestic 城市市场是否为国内，city_info 中没有时为 false
+func (l *Lookups) Domestic(id string) bool {
+	if info, ok := l.cityInfo[id]; ok {
+		return info.Domestic
+	}
+	return false
+}
+
+// State 城市市场的州代码，city_info 中没有时取城市维度
+func (l *Lookups) State(id string) string {
+	if info, ok := l.cityInfo[id]; ok && info.State != "" {
+		return info.State
+	}
+	if c := l.Cities.Get(id); c != nil {
+		return c.State
+	}
+	return ""
+}
+
+// Country 城市市场的国家，city_info 中没有时取城市维度
+func (l *Lookups) Country(id string) string {
+	if info, ok := l.cityInfo[id]; ok && info.Country != "" {
+		return info.Country
+	}
+	if c := l.Cities.Get(id); c != nil {
+		return c.Country
+	}
+	return ""
+}
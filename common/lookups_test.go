@@ -0,0 +1,134 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"common/fakees"
+)
+
+// city_info 按页读取全部文档；缓存在指纹（索引 UUID、max_seq_no）不变且未过期时使用，索引有写入或过期后重新读取
+func TestLoadCityInfo(t *testing.T) {
+	es := fakees.New(t)
+	for i := 0; i < 2500; i++ {
+		code := strconv.Itoa(40000 + i)
+		es.Seed("city_info", code, CityInfo{Name: "City " + code, State: "TX", Code: code, Domestic: i%2 == 0})
+	}
+	es.Seed("city_info", "34819", CityInfo{Name: "San Juan", State: "PR", Code: "34819", Domestic: false})
+	cache := filepath.Join(t.TempDir(), "city_info.cache.json")
+	cfg := DimensionConfig{PageSize: 1000, CacheFile: cache}
+	l := NewLookups()
+	load := func() bool {
+		t.Helper()
+		_, _, cached, err := l.LoadCityInfo(es.Client(), "http://es", "city_info", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cached
+	}
+
+	if load() {
+		t.Error("第一次读取不应使用缓存")
+	}
+	if n := l.CityInfoLen(); n != 2501 {
+		t.Fatalf("城市数 = %d, want 2501", n)
+	}
+	if !l.Domestic("42498") || l.Domestic("42499") || l.Domestic("99999") {
+		t.Error("Domestic 与 city_info 不一致")
+	}
+	if got := l.State("34819"); got != "PR" {
+		t.Errorf("State(34819) = %q", got)
+	}
+	// city_info 没有国家时取城市维度
+	path := filepath.Join(t.TempDir(), "L_CITY_MARKET_ID.csv")
+	if err := os.WriteFile(path, []byte("Code,Description\n\"34819\",\"San Juan, PR\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Cities.ReadCityMarkets(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Country("34819"); got != "United States" {
+		t.Errorf("Country(34819) = %q", got)
+	}
+	if len(es.Pits) != 0 {
+		t.Errorf("PIT 没有关闭: %v", es.Pits)
+	}
+
+	// 没有写入时使用缓存
+	if !load() {
+		t.Error("没有写入时应使用缓存")
+	}
+	if b, _ := os.ReadFile(cache); !strings.Contains(string(b), "max_seq_no=0:2500") {
+		t.Errorf("缓存的指纹中没有 max_seq_no: %.200s", b)
+	}
+	// ES 地址不同时不使用缓存
+	if _, _, cached, _ := l.LoadCityInfo(es.Client(), "http://other", "city_info", cfg); cached {
+		t.Error("ES 地址不同时不应使用缓存")
+	}
+	// 文档数不变的修改也会重新读取
+	es.Seed("city_info", "40000", CityInfo{Name: "City 40000", State: "TX", Code: "40000", Domestic: false})
+	load()
+	if l.Domestic("40000") {
+		t.Error("文档数不变的修改后应重新读取")
+	}
+	// 文档数变化后重新读取
+	es.Seed("city_info", "49999", CityInfo{Name: "City 49999", State: "TX", Code: "49999", Domestic: true})
+	load()
+	if l.CityInfoLen() != 2502 {
+		t.Error("文档数变化后应重新读取")
+	}
+	// 把缓存中的 40000 改为国内城市：索引没有写入时读到缓存中的值，缓存过期后读到索引中的值
+	var c dimensionCache
+	b, _ := os.ReadFile(cache)
+	_ = json.Unmarshal(b, &c)
+	var cached []CityInfo
+	_ = json.Unmarshal(c.Docs, &cached)
+	for i := range cached {
+		if cached[i].Code == "40000" {
+			cached[i].Domestic = true
+		}
+	}
+	c.Docs, _ = json.Marshal(cached)
+	writeCache := func() {
+		b, _ = json.Marshal(c)
+		_ = os.WriteFile(cache, b, 0644)
+	}
+	writeCache()
+	load()
+	if !l.Domestic("40000") {
+		t.Error("索引没有写入且未过期时应使用缓存")
+	}
+	c.Created = c.Created.Add(-25 * time.Hour)
+	writeCache()
+	load()
+	if l.Domestic("40000") {
+		t.Error("缓存过期后应重新读取")
+	}
+}
+
+// L_AIRPORT 的机场名称，描述不能正常解析的记入城市维度的质量报告
+func TestReadAirports(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "L_AIRPORT.csv")
+	table := "Code,Description\n\"JFK\",\"New York, NY: John F. Kennedy International\"\n\"AAA\",\"Unknown Point in Alaska\"\n"
+	if err := os.WriteFile(path, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := NewLookups()
+	if err := l.ReadAirports(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.AirportName("JFK"); got != "John F. Kennedy International" {
+		t.Errorf("JFK = %q", got)
+	}
+	if got := l.AirportName("LAX"); got != "" {
+		t.Errorf("表中没有的机场 = %q", got)
+	}
+	if n := l.Cities.Quality.Count(AirportNoSeparator, "L_AIRPORT", "Unknown Point in Alaska"); n != 1 {
+		t.Errorf("质量报告中 Unknown Point in Alaska = %d", n)
+	}
+}
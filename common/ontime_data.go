@@ -0,0 +1,129 @@
+package common
+
+import "github.com/spf13/cast"
+
+// 按 BTS on-time 报表的列顺序解析一行 csv
+func ParseOnTimeRecord(record []string) *OnTimeData {
+	return &OnTimeData{
+		Year:                         cast.ToInt(record[0]),
+		Quarter:                      cast.ToInt(record[1]),
+		Month:                        cast.ToInt(record[2]),
+		DayofMonth:                   cast.ToInt(record[3]),
+		DayofWeek:                    cast.ToInt(record[4]),
+		FlightDate:                   record[5],
+		ReportingAirline:             record[6],
+		DotIDReportingAirline:        record[7],
+		IATACodeReportingAirline:     record[8],
+		TailNumber:                   record[9],
+		FlightNumberReportingAirline: record[10],
+		OriginAirportID:              record[11],
+		OriginAirportSeqID:           record[12],
+		OriginCityMarketID:           record[13],
+		Origin:                       record[14],
+		OriginCityName:               record[15],
+		OriginState:                  record[16],
+		OriginStateFips:              cast.ToInt(record[17]),
+		OriginStateName:              record[18],
+		OriginWac:                    record[19],
+		DestAirportID:                record[20],
+		DestAirportSeqID:             cast.ToInt(record[21]),
+		DestCityMarketID:             record[22],
+		Dest:                         record[23],
+		DestCityName:                 record[24],
+		DestState:                    record[25],
+		DestStateFips:                cast.ToInt(record[26]),
+		DestStateName:                record[27],
+		DestWac:                      cast.ToInt(record[28]),
+		CrsDepTime:                   ParseHHMM(record[29]),
+		DepTime:                      ParseHHMM(record[30]),
+		DepDelay:                     cast.ToInt(record[31]),
+		DepDelayMinutes:              cast.ToInt(record[32]),
+		DepDel15:                     cast.ToInt(record[33]),
+		DepartureDelayGroups:         cast.ToInt(record[34]),
+		DepTimeBlk:                   record[35],
+		TaxiOut:                      cast.ToInt(record[36]),
+		WheelsOff:                    ParseHHMM(record[37]),
+		WheelsOn:                     ParseHHMM(record[38]),
+		TaxiIn:                       cast.ToInt(record[39]),
+		CrsArrTime:                   ParseHHMM(record[40]),
+		ArrTime:                      ParseHHMM(record[41]),
+		ArrDelay:                     cast.ToInt(record[42]),
+		ArrDelayMinutes:              cast.ToInt(record[43]),
+		ArrDel15:                     cast.ToInt(record[44]),
+		ArrivalDelayGroups:           cast.ToInt(record[45]),
+		ArrTimeBlk:                   record[46],
+		Cancelled:                    cast.ToInt(record[47]),
+		CancellationCode:             record[48],
+		Diverted:                     cast.ToInt(record[49]),
+		CrsElapsedTime:               cast.ToInt(record[50]),
+		ActualElapsedTime:            cast.ToInt(record[51]),
+		AirTime:                      cast.ToInt(record[52]),
+		Flights:                      cast.ToInt(record[53]),
+		Distance:                     cast.ToFloat64(record[54]),
+		DistanceGroup:                cast.ToInt(record[55]),
+	}
+}
+
+type OnTimeData struct {
+	Year                         int     `json:"year"`
+	Quarter                      int     `json:"quarter"`
+	Month                        int     `json:"month"`
+	DayofMonth                   int     `json:"dayof_month"`
+	DayofWeek                    int     `json:"dayof_week"`
+	FlightDate                   string  `json:"flight_date"`
+	ReportingAirline             string  `json:"reporting_airline"`
+	DotIDReportingAirline        string  `json:"dot_id_reporting_airline"`
+	IATACodeReportingAirline     string  `json:"iata_code_reporting_airline"`
+	TailNumber                   string  `json:"tail_number"`
+	FlightNumberReportingAirline string  `json:"flight_number_reporting_airline"`
+	OriginAirportID              string  `json:"origin_airport_id"`
+	OriginAirportSeqID           string  `json:"origin_airport_seq_id"`
+	OriginCityMarketID           string  `json:"origin_city_market_id"`
+	Origin                       string  `json:"origin"`
+	OriginCityName               string  `json:"origin_city_name"`
+	OriginState                  string  `json:"origin_state"`
+	OriginStateFips              int     `json:"origin_state_fips"`
+	OriginStateName              string  `json:"origin_state_name"`
+	OriginWac                    string  `json:"origin_wac"`
+	DestAirportID                string  `json:"dest_airport_id"`
+	DestAirportSeqID             int     `json:"dest_airport_seq_id"`
+	DestCityMarketID             string  `json:"dest_city_market_id"`
+	Dest                         string  `json:"dest"`
+	DestCityName                 string  `json:"dest_city_name"`
+	DestState                    string  `json:"dest_state"`
+	DestStateFips                int     `json:"dest_state_fips"`
+	DestStateName                string  `json:"dest_state_name"`
+	DestWac                      int     `json:"dest_wac"`
+	CrsDepTime                   int     `json:"crs_dep_time"`
+	DepTime                      int     `json:"dep_time"`
+	DepDelay                     int     `json:"dep_delay"`
+	DepDelayMinutes              int     `json:"dep_delay_minutes"`
+	DepDel15                     int     `json:"dep_del15"`
+	DepartureDelayGroups         int     `json:"departure_delay_groups"`
+	DepTimeBlk                   string  `json:"dep_time_blk"`
+	TaxiOut                      int     `json:"taxi_out"`
+	WheelsOff                    int     `json:"wheels_off"`
+	WheelsOn                     int     `json:"wheels_on"`
+	TaxiIn                       int     `json:"taxi_in"`
+	CrsArrTime                   int     `json:"crs_arr_time"`
+	ArrTime                      int     `json:"arr_time"`
+	ArrDelay                     int     `json:"arr_delay"`
+	ArrDelayMinutes              int     `json:"arr_delay_minutes"`
+	ArrDel15                     int     `json:"arr_del15"`
+	ArrivalDelayGroups           int     `json:"arrival_delay_groups"`
+	ArrTimeBlk                   string  `json:"arr_time_blk"`
+	Cancelled                    int     `json:"cancelled"`
+	CancellationCode             string  `json:"cancellation_code"`
+	Diverted                     int     `json:"diverted"`
+	CrsElapsedTime               int     `json:"crs_elapsed_time"`
+	ActualElapsedTime            int     `json:"actual_elapsed_time"`
+	AirTime                      int     `json:"air_time"`
+	Flights                      int     `json:"flights"`
+	Distance                     float64 `json:"distance"`
+	DistanceGroup                int     `json:"distance_group"`
+}
+
+// 解析 hhmm 格式的时刻，如 0900。cast.ToInt 会把以 0 开头的数字当作八进制，0900 解析为 0、0700 解析为 448
+func ParseHHMM(s string) int {
+	return int(cast.ToFloat64(s))
+}
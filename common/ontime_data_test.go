@@ -0,0 +1,16 @@
+package common
+
+import "testing"
+
+// 按列顺序解析：dep_time_blk 取下标 35 的 DepTimeBlk 列，不是下标 25 的 DestState；hhmm 字段按十进制解析
+func TestParseOnTimeRecord(t *testing.T) {
+	record := make([]string, 110)
+	record[25], record[29], record[35], record[40], record[46] = "CA", "0900", "0900-0959", "0705", "0700-0759"
+	r := ParseOnTimeRecord(record)
+	if r.DestState != "CA" || r.DepTimeBlk != "0900-0959" || r.ArrTimeBlk != "0700-0759" {
+		t.Errorf("州、时段: %q %q %q", r.DestState, r.DepTimeBlk, r.ArrTimeBlk)
+	}
+	if r.CrsDepTime != 900 || r.CrsArrTime != 705 {
+		t.Errorf("计划时刻: %d %d", r.CrsDepTime, r.CrsArrTime)
+	}
+}
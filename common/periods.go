@@ -0,0 +1,100 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ConcurrencyConfig 并发配置，config.json 中 concurrency 配置，不配置时逐期处理
+type ConcurrencyConfig struct {
+	Periods int `json:"periods"`  // 同时处理的期数（月或季度）
+	Network int `json:"network"`  // 同时从ES聚合（import_ontime 为同时下载）的期数，不配置时不限制
+	Cpu     int `json:"cpu"`      // 同时在本地计算（import_ontime 为同时解压、解析导入）的期数，不配置时不限制
+	EsWrite int `json:"es_write"` // 写入ES的并发请求数，默认为CPU核心数
+}
+
+// PeriodResult 一期的处理结果
+type PeriodResult struct {
+	Period  string        // 期，如 2020-1
+	Docs    int64         // 写入的文档数（import_ontime 为导入的记录数）
+	Elapsed time.Duration // 耗时
+	Note    string        // 附加信息
+	Err     error         // 失败原因，为 nil 时成功
+}
+
+// 按资源限制并发，容量不大于 0 时不限制
+type Limiter chan struct{}
+
+func NewLimiter(n int) Limiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(Limiter, n)
+}
+
+func (l Limiter) Do(fn func()) {
+	if l != nil {
+		l <- struct{}{}
+		defer func() { <-l }()
+	}
+	fn()
+}
+
+// 用 workers 个协程处理各期，workers 不大于 1 时逐期处理。
+// fn 中的 panic 记为该期失败，不影响其他期；结果按 periods 的顺序返回
+func RunPeriods(periods []string, workers int, fn func(i int) (docs int64, note string, err error)) []PeriodResult {
+	results := make([]PeriodResult, len(periods))
+	jobs := make(chan int, len(periods))
+	for i := range periods {
+		jobs <- i
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, min(workers, len(periods))); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = runPeriod(periods[i], func() (int64, string, error) { return fn(i) })
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func runPeriod(period string, fn func() (int64, string, error)) (res PeriodResult) {
+	res.Period = period
+	start := time.Now()
+	defer func() {
+		res.Elapsed = time.Since(start)
+		if r := recover(); r != nil {
+			fmt.Println(period, "处理失败:", r)
+			fmt.Println(string(debug.Stack()))
+			res.Err = fmt.Errorf("%v", r)
+		}
+	}()
+	res.Docs, res.Note, res.Err = fn()
+	return res
+}
+
+// 输出各期的汇总表
+func PrintPeriodSummary(results []PeriodResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "期\t状态\t文档数\t耗时\t说明")
+	failed := 0
+	for _, r := range results {
+		status, note := "成功", r.Note
+		if r.Err != nil {
+			status, note = "失败", r.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", r.Period, status, r.Docs, r.Elapsed.Round(time.Millisecond), note)
+	}
+	w.Flush()
+	fmt.Println("共", len(results), "期，失败", failed, "期")
+}
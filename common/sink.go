@@ -0,0 +1,779 @@
+package common
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "github.com/lib/pq"
+	"github.com/olivere/elastic/v7"
+	"github.com/parquet-go/parquet-go"
+	_ "modernc.org/sqlite"
+)
+
+// Sink 聚合结果输出目标，id 与写入 ES 时的文档 ID 一致，作为各输出端的 upsert 主键
+type Sink interface {
+	Write(index, id string, doc interface{}) error
+	// Flush 等待已写入的数据全部落盘/提交
+	Flush() error
+	Close() error
+}
+
+// SinkConfig 输出端配置
+type SinkConfig struct {
+	Type string `json:"type"` // es、csv、jsonl、parquet、sqlite、postgres
+	Path string `json:"path"` // csv/jsonl/parquet 为输出目录，sqlite 为数据库文件
+	Dsn  string `json:"dsn"`  // postgres 连接串
+}
+
+// 未配置 sinks 时默认只写 ES
+func sinkConfigsOrDefault(cfgs []SinkConfig) []SinkConfig {
+	if len(cfgs) == 0 {
+		return []SinkConfig{{Type: "es"}}
+	}
+	return cfgs
+}
+
+// 是否配置了 ES 输出，决定是否需要初始化 ES 索引
+func HasEsSink(cfgs []SinkConfig) bool {
+	for _, c := range sinkConfigsOrDefault(cfgs) {
+		if c.Type == "es" {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据配置创建输出端，多个输出端时同时写入
+func NewSinks(cfgs []SinkConfig, client *elastic.Client) (Sink, error) {
+	var sinks multiSink
+	for _, c := range sinkConfigsOrDefault(cfgs) {
+		var s Sink
+		var err error
+		switch c.Type {
+		case "es":
+			s, err = newEsSink(client)
+		case "csv":
+			s, err = newFileSink(c.Path, ".csv", newCsvTable)
+		case "jsonl":
+			s, err = newFileSink(c.Path, ".jsonl", newJsonlTable)
+		case "parquet":
+			s, err = newFileSink(c.Path, ".parquet", newParquetTable)
+		case "sqlite":
+			s, err = newSqlSink("sqlite", c.Path, sqliteDialect)
+		case "postgres":
+			s, err = newSqlSink("postgres", c.Dsn, postgresDialect)
+		default:
+			err = fmt.Errorf("未知的输出类型: %s", c.Type)
+		}
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+type multiSink []Sink
+
+func (m multiSink) Write(index, id string, doc interface{}) error {
+	for _, s := range m {
+		if err := s.Write(index, id, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiSink) Flush() error {
+	for _, s := range m {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 各输出端中文档ID以 key（年_期）开头的写入失败的文档数，只有 ES 输出是异步写入的，其他输出端写入失败时 Write 直接返回错误
+func (m multiSink) failures(key string) int64 {
+	var n int64
+	for _, s := range m {
+		if es, ok := s.(*esSink); ok {
+			n += es.w.Failures(key)
+		}
+	}
+	return n
+}
+
+func (m multiSink) Close() error {
+	var first error
+	for _, s := range m {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// 按文档ID的 年_期 前缀统计各期写入的文档数和失败，各报表的文档ID都以年、月（季度）开头
+type CountingSink struct {
+	Sink
+	mu     sync.Mutex
+	counts map[string]int64
+	errs   map[string]error // 各期 FlushPeriod 的错误
+}
+
+func NewCountingSink(s Sink) *CountingSink {
+	return &CountingSink{Sink: s, counts: map[string]int64{}, errs: map[string]error{}}
+}
+
+func (s *CountingSink) Write(index, id string, doc interface{}) error {
+	if err := s.Sink.Write(index, id, doc); err != nil {
+		return err
+	}
+	if key := periodKey(id); key != "" {
+		s.mu.Lock()
+		s.counts[key]++
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// 一期写入的文档数
+func (s *CountingSink) Count(year, period int) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[fmt.Sprintf("%d_%d", year, period)]
+}
+
+// FlushPeriod 一期生成完成后等待已写入的数据全部提交。出错时记为该期失败，由 Failed 返回，不影响其他期
+func (s *CountingSink) FlushPeriod(year, period int) {
+	if err := s.Sink.Flush(); err != nil {
+		fmt.Println(year, period, "提交输出失败:", err)
+		s.mu.Lock()
+		s.errs[fmt.Sprintf("%d_%d", year, period)] = err
+		s.mu.Unlock()
+	}
+}
+
+// 一期 FlushPeriod 出错或文档写入ES时最终失败的，返回错误，各期的汇总中记为失败
+func (s *CountingSink) Failed(year, period int) error {
+	key := fmt.Sprintf("%d_%d", year, period)
+	s.mu.Lock()
+	err := s.errs[key]
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	m, ok := s.Sink.(multiSink)
+	if !ok {
+		return nil
+	}
+	if n := m.failures(key); n > 0 {
+		return fmt.Errorf("写入ES失败 %d 条", n)
+	}
+	return nil
+}
+
+// ES 输出，用 BulkWriter 批量写入，关闭时输出写入统计
+type esSink struct {
+	w *BulkWriter
+}
+
+func newEsSink(client *elastic.Client) (*esSink, error) {
+	if client == nil {
+		return nil, fmt.Errorf("es 输出需要先连接ES")
+	}
+	return &esSink{w: NewBulkWriter(client, EsWorkers())}, nil
+}
+
+func (s *esSink) Write(index, id string, doc interface{}) error {
+	s.w.Add(elastic.NewBulkIndexRequest().Index(index).Id(id).Doc(doc))
+	return nil
+}
+
+// 各期共用一个 BulkWriter，写入失败的文档按期记录，由 CountingSink.Failed 返回，不作为 Flush 的错误，
+// 否则一期的失败会让其他期的 Flush 出错；关闭时返回所有未返回过的失败
+func (s *esSink) Flush() error {
+	s.w.wait()
+	return nil
+}
+
+func (s *esSink) Close() error {
+	err := s.w.Close()
+	fmt.Println("ES写入统计:", s.w.Stats())
+	return err
+}
+
+// 文档的一列，按结构体字段顺序展开
+type docColumn struct {
+	Name  string
+	Kind  columnKind
+	Value interface{} // nil、int64、float64、bool、string
+}
+
+type columnKind int
+
+const (
+	kindString columnKind = iota
+	kindInt
+	kindFloat
+	kindBool
+	kindJson // 嵌套对象或数组，以 JSON 文本保存
+)
+
+// 将文档展开为列，结构体按字段顺序，map 按 key 排序。
+// 结构体的列名和类型只由结构体类型决定（见 structColumns），与第一条文档中字段是否为 nil 无关
+func docColumns(doc interface{}) ([]docColumn, error) {
+	v := reflect.ValueOf(doc)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, fmt.Errorf("文档为空")
+		}
+		v = v.Elem()
+	}
+	var cols []docColumn
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, sc := range structColumns(v.Type()) {
+			col, err := columnOf(sc.Name, v.Field(sc.field))
+			if err != nil {
+				return nil, err
+			}
+			cols = append(cols, col)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			col, err := columnOf(k.String(), v.MapIndex(k))
+			if err != nil {
+				return nil, err
+			}
+			cols = append(cols, col)
+		}
+	default:
+		return nil, fmt.Errorf("不支持的文档类型: %s", v.Type())
+	}
+	return cols, nil
+}
+
+// 结构体的一列，field 为字段的序号
+type structColumn struct {
+	Name  string
+	Kind  columnKind
+	field int
+}
+
+var structColumnsCache sync.Map // reflect.Type → []structColumn
+
+// 结构体类型的列：json 标签的名称和由字段类型决定的列类型，跳过未导出和 json:"-" 的字段
+func structColumns(t reflect.Type) []structColumn {
+	if cols, ok := structColumnsCache.Load(t); ok {
+		return cols.([]structColumn)
+	}
+	var cols []structColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		cols = append(cols, structColumn{Name: name, Kind: typeKind(f.Type), field: i})
+	}
+	structColumnsCache.Store(t, cols)
+	return cols
+}
+
+// 类型对应的列类型，指针取指向的类型，interface 不能确定类型时为字符串
+func typeKind(t reflect.Type) columnKind {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return kindInt
+	case reflect.Float32, reflect.Float64:
+		return kindFloat
+	case reflect.Bool:
+		return kindBool
+	case reflect.String, reflect.Interface:
+		return kindString
+	default:
+		return kindJson
+	}
+}
+
+// 列的值，nil 指针、nil 切片和 map 的值为 nil，列类型不变
+func columnOf(name string, v reflect.Value) (docColumn, error) {
+	col := docColumn{Name: name, Kind: typeKind(v.Type())}
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return col, nil
+		}
+		v = v.Elem()
+	}
+	col.Kind = typeKind(v.Type())
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		col.Value = v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		col.Value = int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		col.Value = v.Float()
+	case reflect.Bool:
+		col.Value = v.Bool()
+	case reflect.String:
+		col.Value = v.String()
+	default:
+		if (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil() {
+			return col, nil
+		}
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			return docColumn{}, err
+		}
+		col.Value = string(b)
+	}
+	return col, nil
+}
+
+func columnText(value interface{}) string {
+	switch x := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// 文件类输出，每个索引每期一个文件 <索引名>_<年>_<期><ext>，重新运行某一期时只覆盖该期的文件，不影响其他期；
+// 文档ID不以 年_期 开头的索引（如 city）一个文件 <索引名><ext>
+type fileSink struct {
+	dir      string
+	ext      string
+	newTable func(path string, cols []docColumn) (fileTable, error)
+	mu       sync.Mutex
+	tables   map[string]fileTable // key:文件路径
+}
+
+type fileTable interface {
+	write(id string, doc interface{}, cols []docColumn) error
+	flush() error
+	close() error
+}
+
+func newFileSink(dir, ext string, newTable func(path string, cols []docColumn) (fileTable, error)) (*fileSink, error) {
+	if dir == "" {
+		dir = "output"
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &fileSink{dir: dir, ext: ext, newTable: newTable, tables: map[string]fileTable{}}, nil
+}
+
+func (s *fileSink) Write(index, id string, doc interface{}) error {
+	cols, err := docColumns(doc)
+	if err != nil {
+		return err
+	}
+	name := index
+	if key := periodKey(id); key != "" {
+		name += "_" + key
+	}
+	path := filepath.Join(s.dir, name+s.ext)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tables[path]
+	if !ok {
+		t, err = s.newTable(path, cols)
+		if err != nil {
+			return err
+		}
+		s.tables[path] = t
+	}
+	return t.write(id, doc, cols)
+}
+
+func (s *fileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tables {
+		if err := t.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var first error
+	for _, t := range s.tables {
+		if err := t.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.tables = map[string]fileTable{}
+	return first
+}
+
+type csvTable struct {
+	f *os.File
+	w *csv.Writer
+}
+
+func newCsvTable(path string, cols []docColumn) (fileTable, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := csv.NewWriter(f)
+	header := []string{"_id"}
+	for _, c := range cols {
+		header = append(header, c.Name)
+	}
+	if err := w.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &csvTable{f: f, w: w}, nil
+}
+
+func (t *csvTable) write(id string, doc interface{}, cols []docColumn) error {
+	record := []string{id}
+	for _, c := range cols {
+		record = append(record, columnText(c.Value))
+	}
+	return t.w.Write(record)
+}
+
+func (t *csvTable) flush() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+func (t *csvTable) close() error {
+	if err := t.flush(); err != nil {
+		t.f.Close()
+		return err
+	}
+	return t.f.Close()
+}
+
+type jsonlTable struct {
+	f *os.File
+}
+
+func newJsonlTable(path string, cols []docColumn) (fileTable, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlTable{f: f}, nil
+}
+
+// 每行一个文档，第一个字段为 _id
+func (t *jsonlTable) write(id string, doc interface{}, cols []docColumn) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	idJson, _ := json.Marshal(id)
+	line := `{"_id":` + string(idJson)
+	if len(b) > 2 {
+		line += "," + string(b[1:])
+	} else {
+		line += "}"
+	}
+	_, err = t.f.WriteString(line + "\n")
+	return err
+}
+
+func (t *jsonlTable) flush() error {
+	return t.f.Sync()
+}
+
+func (t *jsonlTable) close() error {
+	return t.f.Close()
+}
+
+type parquetTable struct {
+	f *os.File
+	w *parquet.GenericWriter[map[string]any]
+}
+
+// parquet 的 schema 取文档的列，结构体的列类型由字段类型决定，所有列均为 optional
+func newParquetTable(path string, cols []docColumn) (fileTable, error) {
+	group := parquet.Group{"_id": parquet.String()}
+	for _, c := range cols {
+		var node parquet.Node
+		switch c.Kind {
+		case kindInt:
+			node = parquet.Int(64)
+		case kindFloat:
+			node = parquet.Leaf(parquet.DoubleType)
+		case kindBool:
+			node = parquet.Leaf(parquet.BooleanType)
+		case kindJson:
+			node = parquet.JSON()
+		default:
+			node = parquet.String()
+		}
+		group[c.Name] = parquet.Optional(node)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	w := parquet.NewGenericWriter[map[string]any](f, parquet.NewSchema(name, group))
+	return &parquetTable{f: f, w: w}, nil
+}
+
+func (t *parquetTable) write(id string, doc interface{}, cols []docColumn) error {
+	row := map[string]any{"_id": id}
+	for _, c := range cols {
+		row[c.Name] = c.Value
+	}
+	_, err := t.w.Write([]map[string]any{row})
+	return err
+}
+
+func (t *parquetTable) flush() error {
+	return t.w.Flush()
+}
+
+func (t *parquetTable) close() error {
+	if err := t.w.Close(); err != nil {
+		t.f.Close()
+		return err
+	}
+	return t.f.Close()
+}
+
+// 数据库方言
+type sqlDialect struct {
+	placeholder func(n int) string
+	columnType  func(k columnKind) string
+	// 查询已有表的列名，表不存在时返回空
+	existingColumns string
+}
+
+var sqliteDialect = sqlDialect{
+	placeholder: func(n int) string { return "?" },
+	columnType: func(k columnKind) string {
+		switch k {
+		case kindInt, kindBool:
+			return "INTEGER"
+		case kindFloat:
+			return "REAL"
+		default:
+			return "TEXT"
+		}
+	},
+	existingColumns: `SELECT name FROM pragma_table_info(?)`,
+}
+
+var postgresDialect = sqlDialect{
+	placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	columnType: func(k columnKind) string {
+		switch k {
+		case kindInt:
+			return "BIGINT"
+		case kindFloat:
+			return "DOUBLE PRECISION"
+		case kindBool:
+			return "BOOLEAN"
+		case kindJson:
+			return "JSONB"
+		default:
+			return "TEXT"
+		}
+	},
+	existingColumns: `SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1`,
+}
+
+// 数据库输出，每个索引一张表，_id 为主键，重复写入时更新
+type sqlSink struct {
+	db      *sql.DB
+	dialect sqlDialect
+	mu      sync.Mutex
+	tables  map[string]*sqlTable
+}
+
+type sqlTable struct {
+	columns []string
+	known   map[string]bool
+	rows    [][]interface{}
+}
+
+func newSqlSink(driver, dsn string, dialect sqlDialect) (*sqlSink, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("%s 输出缺少连接配置", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlSink{db: db, dialect: dialect, tables: map[string]*sqlTable{}}, nil
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (s *sqlSink) Write(index, id string, doc interface{}) error {
+	cols, err := docColumns(doc)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tables[index]
+	if !ok {
+		if t, err = s.initTable(index, cols); err != nil {
+			return err
+		}
+		s.tables[index] = t
+	}
+	row := make([]interface{}, len(t.columns))
+	row[0] = id
+	pos := map[string]int{}
+	for i, name := range t.columns {
+		pos[name] = i
+	}
+	for _, c := range cols {
+		i, ok := pos[c.Name]
+		if !ok {
+			return fmt.Errorf("%s 表中没有列 %s", index, c.Name)
+		}
+		row[i] = c.Value
+	}
+	t.rows = append(t.rows, row)
+	if len(t.rows) >= bulkActions {
+		return s.flushTable(index, t)
+	}
+	return nil
+}
+
+// 建表，表已存在时补齐缺少的列
+func (s *sqlSink) initTable(index string, cols []docColumn) (*sqlTable, error) {
+	t := &sqlTable{columns: []string{"_id"}, known: map[string]bool{}}
+	rows, err := s.db.Query(s.dialect.existingColumns, index)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.known[name] = true
+	}
+	rows.Close()
+	if len(t.known) == 0 {
+		defs := []string{quoteIdent("_id") + " TEXT PRIMARY KEY"}
+		for _, c := range cols {
+			defs = append(defs, quoteIdent(c.Name)+" "+s.dialect.columnType(c.Kind))
+			t.known[c.Name] = true
+		}
+		stmt := "CREATE TABLE IF NOT EXISTS " + quoteIdent(index) + " (" + strings.Join(defs, ", ") + ")"
+		if _, err = s.db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range cols {
+		if !t.known[c.Name] {
+			stmt := "ALTER TABLE " + quoteIdent(index) + " ADD COLUMN " + quoteIdent(c.Name) + " " + s.dialect.columnType(c.Kind)
+			if _, err = s.db.Exec(stmt); err != nil {
+				return nil, err
+			}
+			t.known[c.Name] = true
+		}
+		t.columns = append(t.columns, c.Name)
+	}
+	return t, nil
+}
+
+func (s *sqlSink) flushTable(index string, t *sqlTable) error {
+	if len(t.rows) == 0 {
+		return nil
+	}
+	var names, holders, updates []string
+	for i, name := range t.columns {
+		names = append(names, quoteIdent(name))
+		holders = append(holders, s.dialect.placeholder(i+1))
+		if i > 0 {
+			updates = append(updates, quoteIdent(name)+" = excluded."+quoteIdent(name))
+		}
+	}
+	stmt := "INSERT INTO " + quoteIdent(index) + " (" + strings.Join(names, ", ") + ") VALUES (" + strings.Join(holders, ", ") +
+		") ON CONFLICT (" + quoteIdent("_id") + ") DO UPDATE SET " + strings.Join(updates, ", ")
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	ps, err := tx.Prepare(stmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, row := range t.rows {
+		if _, err = ps.Exec(row...); err != nil {
+			ps.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	ps.Close()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	t.rows = t.rows[:0]
+	return nil
+}
+
+func (s *sqlSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for index, t := range s.tables {
+		if err := s.flushTable(index, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlSink) Close() error {
+	err := s.Flush()
+	if e := s.db.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+// 本地计算航司延误报表，统计口径与 queryAirCarrierDelays 的 filter 子聚合一致
+func localAirCarrierDelays(d Date) {
+	reports := map[string]*AirCarrierFlightReport{}
+	err := common.ReadLocalCsv(config.Local.DataDir, common.OnTimeFileNames(d.Year, d.Month), func(header map[string]int, record []string) error {
+		o := common.ParseOnTimeRecord(record)
+		if o.Year != d.Year || o.Month != d.Month {
+			return nil
+		}
+		r, ok := reports[o.ReportingAirline]
+		if !ok {
+			r = &AirCarrierFlightReport{AirCarrier: o.ReportingAirline, Year: int16(o.Year), Month: int16(o.Month)}
+			reports[o.ReportingAirline] = r
+		}
+		r.FlightCount++
+		if o.Cancelled == 1 {
+			r.CancelledCount++
+		}
+		if o.Cancelled != 0 {
+			return nil
+		}
+		if o.DepDelay < 0 {
+			r.EarlyDepartureCount++
+		}
+		if o.DepDelay > 0 {
+			r.DelayedDepartureCount++
+		}
+		if o.DepDel15 == 1 {
+			r.Delayed15DepartureCount++
+		}
+		if o.ArrDelay < 0 {
+			r.EarlyArrivalCount++
+		}
+		if o.ArrDelay > 0 {
+			r.DelayedArrivalCount++
+		}
+		if o.ArrDel15 == 1 {
+			r.Delayed15ArrivalCount++
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	carriers := make([]string, 0, len(reports))
+	for c := range reports {
+		carriers = append(carriers, c)
+	}
+	sort.Strings(carriers)
+	for _, c := range carriers {
+		r := reports[c]
+		id := strings.Join([]string{cast.ToString(r.Year), cast.ToString(r.Month), r.AirCarrier}, "_")
+		if err = out.Write(AirCarrierFlightReportIndexName, id, r); err != nil {
+			panic(err)
+		}
+	}
+	out.FlushPeriod(d.Year, d.Month)
+	fmt.Println("最后Count:", len(reports))
+}
@@ -6,41 +6,79 @@ import (
 	"fmt"
 	"github.com/olivere/elastic/v7"
 	"github.com/spf13/cast"
-	"log"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
+
+	"common"
 )
 
 const (
-	bulkActions = 1000
-
 	OnTimeDataIndexName             = "on_time_data"
 	AirCarrierFlightReportIndexName = "air_carrier_flight_report"
 )
 
 var (
-	config       = Config{}
-	actualNumCPU = runtime.GOMAXPROCS(0)
-	esClient     *elastic.Client
+	config   = Config{}
+	esClient *elastic.Client
+	out      *common.CountingSink
 )
 
 func main() {
 	config = getDateConfig()
-	if len(config.Dates) == 0 || config.EsUrl == "" {
+	if len(config.Dates) == 0 || (config.EsUrl == "" && (config.Local == nil || common.HasEsSink(config.Sinks))) {
 		fmt.Println("配置文件错误")
 		os.Exit(0)
 	}
 	fmt.Println("待处理数据时间为:", config.Dates)
-	connectES()
-	initAirCarrierIndex()
+	var err error
+	compareConfigs, err = common.ResolveCompareConfigs(config.Compare, compareDefaults)
+	if err == nil {
+		err = common.CheckCompareSinks(compareConfigs, config.Sinks)
+	}
+	if err != nil {
+		fmt.Println("配置文件错误:", err)
+		os.Exit(0)
+	}
+	if config.Local == nil || common.HasEsSink(config.Sinks) {
+		connectES()
+	}
+	if common.HasEsSink(config.Sinks) {
+		initAirCarrierIndex()
+	}
+	common.EsWriteWorkers = config.Concurrency.EsWrite
+	common.Bulk = config.Bulk
+	sinks, err := common.NewSinks(config.Sinks, esClient)
+	if err != nil {
+		fmt.Println("创建输出失败:", err)
+		os.Exit(0)
+	}
+	out = common.NewCountingSink(sinks)
+	defer out.Close()
 
 	start := time.Now().Unix()
-	for _, d := range config.Dates {
-		queryAirCarrierDelays(d)
+	periods := make([]string, len(config.Dates))
+	for i, d := range config.Dates {
+		periods[i] = fmt.Sprintf("%d-%d", d.Year, d.Month)
+	}
+	network, cpu := common.NewLimiter(config.Concurrency.Network), common.NewLimiter(config.Concurrency.Cpu)
+	results := common.RunPeriods(periods, config.Concurrency.Periods, func(i int) (int64, string, error) {
+		d := config.Dates[i]
+		if config.Local != nil {
+			cpu.Do(func() { localAirCarrierDelays(d) })
+		} else {
+			network.Do(func() { queryAirCarrierDelays(d) })
+		}
+		return out.Count(d.Year, d.Month), "", out.Failed(d.Year, d.Month)
+	})
+	// 环比、同比要读取上一期的文档，所有月份生成完成后再按配置的顺序计算
+	for i, d := range config.Dates {
+		if results[i].Err == nil {
+			results[i].Err = common.ComparePeriod(esClient, out, compareConfigs, d.Year, d.Month)
+		}
 	}
+	common.PrintPeriodSummary(results)
 
 	fmt.Println("总耗时", time.Now().Unix()-start, "s")
 }
@@ -208,19 +246,6 @@ func queryAirCarrierDelays(d Date) {
 		))
 
 	ctx := context.Background()
-	w, err := esClient.BulkProcessor().
-		BulkActions(bulkActions).
-		FlushInterval(time.Second).
-		Workers(actualNumCPU).
-		Stats(true).
-		After(GetFailed).
-		Do(ctx)
-	if err != nil {
-		// Handle error
-		panic(err)
-	}
-	w.Start(ctx)
-	defer w.Close()
 	var carrierDelayCount = 0
 	// 执行查询
 	var afterKey map[string]interface{}
@@ -264,9 +289,11 @@ func queryAirCarrierDelays(d Date) {
 			r.Delayed15ArrivalCount = cast.ToInt64(delayed15ArrivalCount.DocCount)
 			r.CancelledCount = cast.ToInt64(cancelledCount.DocCount)
 
-			req := elastic.NewBulkIndexRequest().Index(AirCarrierFlightReportIndexName).Id(strings.Join([]string{cast.ToString(r.Year), cast.ToString(r.Month), r.AirCarrier}, "_")).Doc(r)
+			id := strings.Join([]string{cast.ToString(r.Year), cast.ToString(r.Month), r.AirCarrier}, "_")
+			if err = out.Write(AirCarrierFlightReportIndexName, id, r); err != nil {
+				panic(err)
+			}
 			carrierDelayCount++
-			w.Add(req)
 		}
 
 		// 处理分页
@@ -275,43 +302,32 @@ func queryAirCarrierDelays(d Date) {
 			break
 		}
 	}
-	for {
-		st1 := w.Stats() //获取数据写入情况
-
-		var finish = true
-		for _, s := range st1.Workers {
-			if s.Queued > 0 {
-				finish = false
-				break
-			}
-		}
-		if finish {
-			break
-		}
-	}
+	out.FlushPeriod(d.Year, d.Month)
 
 	fmt.Println("最后Count:", carrierDelayCount)
 }
-func GetFailed(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
-	if response == nil { //可能存在为空的情况 😳
-		//log.Println("GetNil response return")
-		return
-	}
-	fi := response.Failed()
-	if len(fi) != 0 {
-		for _, f := range fi {
-			log.Printf("DebugFailedEs: index:%s type:%s id:%s version:%d  status:%d result:%s ForceRefresh:%v errorDetail:%v getResult:%v\n", f.Index, f.Type, f.Id, f.Version, f.Status, f.Result, f.ForcedRefresh, f.Error, f.GetResult)
-			//panic(f.Error)
-			return
-		}
-	}
 
+type Config struct {
+	Dates []Date              `json:"dates"`
+	EsUrl string              `json:"es_url"`
+	Sinks []common.SinkConfig `json:"sinks"`
+	Local *common.LocalConfig `json:"local"` // 本地计算模式，不配置时从ES聚合
+
+	Concurrency common.ConcurrencyConfig `json:"concurrency"` // 同时处理多个月，不配置时逐月处理
+	Bulk        common.BulkConfig        `json:"bulk"`        // ES 批量写入的批大小和重试，不配置时使用默认值
+
+	Compare []common.CompareConfig `json:"compare"` // 需要计算环比、同比的索引，默认不计算
 }
 
-type Config struct {
-	Dates []Date `json:"dates"`
-	EsUrl string `json:"es_url"`
+// 计算环比、同比的索引
+var compareConfigs []common.CompareConfig
+
+// 各索引默认的 key 和比较字段，config.json 的 compare 中只配置 index 时使用
+var compareDefaults = []common.CompareConfig{
+	{Index: AirCarrierFlightReportIndexName, Period: "month", Keys: []string{"air_carrier"},
+		Fields: []string{"flight_count", "delayed_15_departure_count", "delayed_15_arrival_count", "cancelled_count"}},
 }
+
 type Date struct {
 	Year  int
 	Month int
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"common"
+	"common/fakees"
+)
+
+// 用 testdata 下的 BTS 数据准备 on_time_data 索引
+func seedFakeES(t *testing.T) *fakees.ES {
+	es := fakees.New(t)
+	err := common.ReadLocalCsv("testdata", common.OnTimeFileNames(2020, 1), func(header map[string]int, record []string) error {
+		es.Seed(OnTimeDataIndexName, "", common.ParseOnTimeRecord(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+// 设置全局的 ES 客户端和输出，测试结束后还原
+func useFakeES(t *testing.T, es *fakees.ES, c Config) {
+	oldClient, oldOut, oldConfig := esClient, out, config
+	t.Cleanup(func() {
+		esClient, out, config = oldClient, oldOut, oldConfig
+	})
+	esClient = es.Client()
+	config = c
+	sinks, err := common.NewSinks(nil, esClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = common.NewCountingSink(sinks)
+}
+
+var wantAirCarrierReports = map[string]interface{}{
+	"2020_1_AA": AirCarrierFlightReport{AirCarrier: "AA", Year: 2020, Month: 1, FlightCount: 5,
+		EarlyDepartureCount: 1, DelayedDepartureCount: 2, Delayed15DepartureCount: 2,
+		EarlyArrivalCount: 1, DelayedArrivalCount: 3, Delayed15ArrivalCount: 2, CancelledCount: 1},
+	"2020_1_DL": AirCarrierFlightReport{AirCarrier: "DL", Year: 2020, Month: 1, FlightCount: 4,
+		EarlyDepartureCount: 1, DelayedDepartureCount: 2, Delayed15DepartureCount: 1,
+		EarlyArrivalCount: 1, DelayedArrivalCount: 1, CancelledCount: 1},
+	"2020_1_UA": AirCarrierFlightReport{AirCarrier: "UA", Year: 2020, Month: 1, FlightCount: 2,
+		EarlyArrivalCount: 1, CancelledCount: 1},
+}
+
+func TestQueryAirCarrierDelays(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}})
+
+	initAirCarrierIndex()
+	queryAirCarrierDelays(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es.AssertDocs(AirCarrierFlightReportIndexName, wantAirCarrierReports)
+}
+
+// 本地计算模式与ES聚合的结果一致
+func TestLocalAirCarrierDelays(t *testing.T) {
+	es := fakees.New(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}, Local: &common.LocalConfig{DataDir: "testdata"}})
+
+	localAirCarrierDelays(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es.AssertDocs(AirCarrierFlightReportIndexName, wantAirCarrierReports)
+}
+
+// 1 月的上一期为去年 12 月
+func TestComparePeriod(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}})
+	es.Seed(AirCarrierFlightReportIndexName, "2019_12_AA", map[string]interface{}{"year": 2019, "month": 12, "air_carrier": "AA", "delayed_15_arrival_count": 4})
+	es.Seed(AirCarrierFlightReportIndexName, "2019_1_AA", map[string]interface{}{"year": 2019, "month": 1, "air_carrier": "AA", "delayed_15_arrival_count": 1})
+	cfgs, err := common.ResolveCompareConfigs([]common.CompareConfig{{Index: AirCarrierFlightReportIndexName, Fields: []string{"delayed_15_arrival_count"}}}, compareDefaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryAirCarrierDelays(Date{2020, 1})
+	if err := common.ComparePeriod(esClient, out, cfgs, 2020, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	f := func(v float64) *float64 { return &v }
+	want := map[string]common.PeriodChanges{
+		"2020_1_AA": {PrevYear: 2019, PrevPeriod: 12, Fields: map[string]common.FieldChange{
+			"delayed_15_arrival_count": {Prev: f(4), Delta: f(-2), Pct: f(-0.5), YoyPrev: f(1), YoyDelta: f(1), YoyPct: f(1)}}},
+		"2020_1_UA": {PrevYear: 2019, PrevPeriod: 12, IsNew: true, IsNewYoy: true, Fields: map[string]common.FieldChange{"delayed_15_arrival_count": {}}},
+	}
+	docs := es.Docs(AirCarrierFlightReportIndexName)
+	for id, w := range want {
+		if got := docs[id]["changes"]; !reflect.DeepEqual(got, fakees.DocMap(t, w)) {
+			t.Errorf("%s changes = %v, want %v", id, got, fakees.DocMap(t, w))
+		}
+	}
+}
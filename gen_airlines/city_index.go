@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+const CityIndexName = "city"
+
+// 所有月份处理完成后写入城市维度，文档ID为城市市场ID
+func writeCities() {
+	all := lookups.Cities.All()
+	for _, c := range all {
+		if err := out.Write(CityIndexName, c.CityMarketID, c); err != nil {
+			panic(err)
+		}
+	}
+	// 城市维度不属于任何一期，写入ES失败的文档数在关闭输出时的写入统计中
+	if err := out.Flush(); err != nil {
+		fmt.Println("写入城市维度失败:", err)
+		return
+	}
+	fmt.Println("城市维度数量", len(all))
+}
+
+// 创建 city 索引
+func initCityIndex() {
+	ctx := context.Background()
+	exists, err := esClient.IndexExists(CityIndexName).Do(ctx)
+	if err != nil {
+		fmt.Println("判断index是否存在失败:", err)
+		os.Exit(0)
+	}
+	if exists {
+		fmt.Println(CityIndexName, "索引已存在")
+		return
+	}
+	mapping := `{
+  "mappings": {
+    "properties": {
+      "city_market_id": {
+        "type": "keyword"
+      },
+      "name": {
+        "type": "keyword"
+      },
+      "city": {
+        "type": "keyword"
+      },
+      "state": {
+        "type": "keyword"
+      },
+      "state_name": {
+        "type": "keyword"
+      },
+      "country": {
+        "type": "keyword"
+      },
+      "domestic": {
+        "type": "boolean"
+      },
+      "source": {
+        "type": "keyword"
+      }
+    }
+  }
+}`
+	index, err := esClient.CreateIndex(CityIndexName).BodyString(mapping).Do(ctx)
+	if err != nil {
+		fmt.Println("创建index失败:", err)
+		os.Exit(0)
+	}
+	if !index.Acknowledged {
+		fmt.Println("创建index.Acknowledged.no")
+		os.Exit(0)
+	}
+	fmt.Println("initCityIndex成功")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// 读取 city_info 后检查：有重复的城市市场ID时提示，没有文档时退出
+func checkCityInfos(dup int) {
+	if dup > 0 {
+		fmt.Println(CityInfoIndexName, "中城市市场ID重复的文档:", dup, "，取第一个")
+	}
+	if lookups.CityInfoLen() == 0 {
+		fmt.Println("cityInfoCount nil")
+		os.Exit(0)
+	}
+}
+
+// 用 PIT 翻页读取整个 city_info 索引。配置了 cache_file 时，ES 地址和索引的指纹（UUID、各主分片的 max_seq_no）都没有变化且缓存未过期，直接使用缓存
+func readCityInfoIndexData() {
+	_, dup, cached, err := lookups.LoadCityInfo(esClient, config.Es.Url, CityInfoIndexName, config.CityInfo)
+	if err != nil {
+		fmt.Println("读取", CityInfoIndexName, "失败:", err)
+		os.Exit(0)
+	}
+	checkCityInfos(dup)
+	if cached {
+		fmt.Println("使用", CityInfoIndexName, "缓存:", config.CityInfo.CacheFile, "城市数:", lookups.CityInfoLen())
+		return
+	}
+	fmt.Println("load cityInfo ok. 城市数:", lookups.CityInfoLen())
+}
+
+// 从本地文件读取 city_info，支持 json 数组或每行一个文档
+func readLocalCityInfo() {
+	dup, err := lookups.ReadCityInfoFile(config.Local.CityInfoFile)
+	if err != nil {
+		fmt.Println("读取", config.Local.CityInfoFile, "失败:", err)
+		os.Exit(0)
+	}
+	checkCityInfos(dup)
+	fmt.Println("load local cityInfo ok.")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+// AirportDim 机场维度：机场所属的城市市场和城市名称，同一机场在所有航班中都相同
+type AirportDim struct {
+	CityMarketID string
+	CityName     string // 如 New York, NY
+}
+
+// 机场维度表，key:机场代码。ES 模式启动时读取一次，各期共用，只读；本地计算时各期由读取的记录生成
+type airportDims map[string]*AirportDim
+
+// ES 模式下各期共用的机场维度
+var esAirportDims airportDims
+
+// 同一机场有多组属性时取最小的一组，ES和本地计算的结果与读取顺序无关
+func (dims airportDims) add(code string, d AirportDim) {
+	if old, ok := dims[code]; ok && !d.less(old) {
+		return
+	}
+	dims[code] = &d
+}
+
+func (d AirportDim) less(o *AirportDim) bool {
+	if d.CityMarketID != o.CityMarketID {
+		return d.CityMarketID < o.CityMarketID
+	}
+	return d.CityName < o.CityName
+}
+
+// 从 on_time_data 按机场聚合得到所有待处理月份的机场维度，启动时读取一次，代替在每个航班分组中用 top_hits 取城市信息
+func loadAirportDims(dates []Date) airportDims {
+	ctx := context.Background()
+	dims := airportDims{}
+	query := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+	for _, d := range dates {
+		query.Should(elastic.NewBoolQuery().Must(elastic.NewTermQuery("year", d.Year), elastic.NewTermQuery("month", d.Month)))
+	}
+	for _, side := range []string{"origin", "dest"} {
+		compositeAgg := elastic.NewCompositeAggregation().Size(10000).Sources(
+			elastic.NewCompositeAggregationTermsValuesSource("airport").Field(side),
+			elastic.NewCompositeAggregationTermsValuesSource("city_market_id").Field(side+"_city_market_id"),
+			elastic.NewCompositeAggregationTermsValuesSource("city_name").Field(side+"_city_name"))
+		var afterKey map[string]interface{}
+		for {
+			if afterKey != nil {
+				compositeAgg = compositeAgg.AggregateAfter(afterKey)
+			}
+			searchResult, err := esClient.Search().
+				Index(OnTimeDataIndexName).
+				Query(query).
+				Size(0).
+				Aggregation("airports", compositeAgg).
+				Do(ctx)
+			if err != nil {
+				panic(err)
+			}
+			agg, _ := searchResult.Aggregations.Composite("airports")
+			for _, bucket := range agg.Buckets {
+				dims.add(cast.ToString(bucket.Key["airport"]), AirportDim{
+					CityMarketID: cast.ToString(bucket.Key["city_market_id"]),
+					CityName:     cast.ToString(bucket.Key["city_name"]),
+				})
+			}
+			afterKey = agg.AfterKey
+			if agg.AfterKey == nil {
+				break
+			}
+		}
+	}
+	dims.addCities()
+	fmt.Println("读取机场维度完成:", len(dims))
+	return dims
+}
+
+// 机场维度中的城市名称加入城市维度，L_CITY_MARKET_ID 中没有的城市市场由此补充，解析异常记入质量报告
+func (dims airportDims) addCities() {
+	for _, d := range dims {
+		lookups.Cities.AddName(d.CityMarketID, d.CityName, OnTimeDataIndexName)
+	}
+}
+
+// 本地计算时由每条记录加入机场维度
+func (dims airportDims) addOnTime(r *common.OnTimeData) {
+	dims.add(r.Origin, AirportDim{CityMarketID: r.OriginCityMarketID, CityName: r.OriginCityName})
+	dims.add(r.Dest, AirportDim{CityMarketID: r.DestCityMarketID, CityName: r.DestCityName})
+}
+
+// 取机场维度，没有时记入 missing 并返回空的维度
+func (dims airportDims) get(code string, missing missingDims) *AirportDim {
+	if d, ok := dims[code]; ok {
+		return d
+	}
+	missing.add(code)
+	return &AirportDim{}
+}
+
+// 维度表中没有的机场及其出现的航班数，生成完成后统一输出，不中断生成
+type missingDims map[string]int
+
+func (m missingDims) add(key string) {
+	m[key]++
+}
+
+func (m missingDims) report(index string) {
+	if len(m) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = fmt.Sprintf("%s(%d)", k, m[k])
+	}
+	fmt.Println(index, "维度表中没有的机场，文档中缺少城市信息:", strings.Join(keys, " "))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"common"
+)
+
+// 本地计算航班信息，分组方式与 queryAirlines 的复合聚合一致
+func localAirlines(d Date) {
+	airlines := map[segmentKey]*scheduleCounts{}
+	onTime := map[segmentKey]*onTimeCounts{}
+	dims := airportDims{}
+	legs := throughBuilder{}
+	err := common.ReadLocalCsv(config.Local.DataDir, common.OnTimeFileNames(d.Year, d.Month), func(header map[string]int, record []string) error {
+		r := common.ParseOnTimeRecord(record)
+		if r.Year != d.Year || r.Month != d.Month {
+			return nil
+		}
+		k := segmentKey{r.Origin, r.Dest, r.IATACodeReportingAirline, r.FlightNumberReportingAirline}
+		if airlines[k] == nil {
+			airlines[k], onTime[k] = newScheduleCounts(), &onTimeCounts{}
+		}
+		airlines[k].add(r)
+		onTime[k].add(r)
+		dims.addOnTime(r)
+		legs.addOnTime(r)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	dims.addCities()
+	through := legs.build()
+	keys := make([]segmentKey, 0, len(airlines))
+	for k := range airlines {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.origin != b.origin {
+			return a.origin < b.origin
+		}
+		if a.dest != b.dest {
+			return a.dest < b.dest
+		}
+		if a.carrier != b.carrier {
+			return a.carrier < b.carrier
+		}
+		return a.flightNumber < b.flightNumber
+	})
+	missing := missingDims{}
+	for _, k := range keys {
+		al, id := newAirline(d.Year, d.Month, k.carrier, k.flightNumber, k.origin, k.dest, dims.get(k.origin, missing), dims.get(k.dest, missing))
+		airlines[k].apply(al)
+		through.apply(k, al)
+		if err = out.Write(AirlinesIndexName, id, al); err != nil {
+			panic(err)
+		}
+		if onTimeReport {
+			if err = out.Write(FlightOnTimeReportIndexName, id, onTime[k].report(al)); err != nil {
+				panic(err)
+			}
+		}
+	}
+	out.FlushPeriod(d.Year, d.Month)
+	missing.report(AirlinesIndexName)
+	fmt.Println(d.Year, d.Month, "最后数量", len(keys))
+}
@@ -6,32 +6,55 @@ import (
 	"fmt"
 	"github.com/olivere/elastic/v7"
 	"github.com/spf13/cast"
-	"log"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
+
+	"common"
 )
 
 const (
-	bulkActions         = 1000
 	CityInfoIndexName   = "city_info"
 	OnTimeDataIndexName = "on_time_data"
 	AirlinesIndexName   = "airlines"
 )
 
 var (
-	config       = Config{}
-	actualNumCPU = runtime.GOMAXPROCS(0)
-	esClient     *elastic.Client
-	cityInfoMap  = map[string]bool{} //key：city_market_id ,value:domestic
+	config   = Config{}
+	esClient *elastic.Client
+	out      *common.CountingSink
 )
 
+// 城市、city_info 维度及其解析质量报告
+var lookups = common.NewLookups()
+
 type Config struct {
 	Dates []Date `json:"dates"`
 	Es    `json:"elasticsearch"`
+	Sinks []common.SinkConfig `json:"sinks"`
+	Local *common.LocalConfig `json:"local"` // 本地计算模式，不配置时从ES聚合
+
+	Reports      []string           `json:"reports"`       // 附加报表，如 flight_ontime_report、route_changes、city，默认不生成
+	RouteChanges RouteChangesConfig `json:"route_changes"` // route_changes 的加班/减班阈值和回看年数
+
+	Parallel    common.ParallelConfig    `json:"parallel"`    // 按出发机场分区并行翻页，不配置时顺序翻页
+	Concurrency common.ConcurrencyConfig `json:"concurrency"` // 同时处理多个月，不配置时逐月处理
+	Bulk        common.BulkConfig        `json:"bulk"`        // ES 批量写入的批大小和重试，不配置时使用默认值
+	CityInfo    common.DimensionConfig   `json:"city_info"`   // city_info 翻页大小和本地缓存，不配置时不缓存
+
+	Compare []common.CompareConfig `json:"compare"` // 需要计算环比、同比的索引，默认不计算
+}
+
+// 计算环比、同比的索引
+var compareConfigs []common.CompareConfig
+
+// 各索引默认的 key 和比较字段，config.json 的 compare 中只配置 index 时使用
+var compareDefaults = []common.CompareConfig{
+	{Index: AirlinesIndexName, Period: "month", Keys: []string{"origin_airport", "dest_airport", "air_carrier", "flight_number"}, DocId: airlineDocId},
+	{Index: FlightOnTimeReportIndexName, Period: "month", Keys: []string{"origin_airport", "dest_airport", "air_carrier", "flight_number"}, Fields: []string{"operations", "on_time_pct", "avg_arr_delay", "late_30_pct"}, DocId: airlineDocId},
 }
+
 type Es struct {
 	Url      string
 	Username string
@@ -40,52 +63,101 @@ type Es struct {
 
 func main() {
 	config = getDateConfig()
-	if len(config.Dates) == 0 || config.Es.Url == "" {
+	if len(config.Dates) == 0 || (config.Es.Url == "" && (config.Local == nil || common.HasEsSink(config.Sinks))) {
 		fmt.Println("配置文件错误")
 		os.Exit(0)
 	}
 	fmt.Println("待处理数据时间为:", config.Dates)
-	connectES()
-
-	readCityInfoIndexData()
-
-	initAirlinesIndex()
-	fmt.Println(time.Now().String(), "=====start")
-	start := time.Now().Unix()
-	for _, d := range config.Dates {
-		queryAirlines(d)
+	var err error
+	if err = selectReports(config.Reports); err != nil {
+		fmt.Println("配置文件错误:", err)
+		os.Exit(0)
+	}
+	compareConfigs, err = common.ResolveCompareConfigs(config.Compare, compareDefaults)
+	if err == nil {
+		err = common.CheckCompareSinks(compareConfigs, config.Sinks)
 	}
-	fmt.Println(time.Now().String(), "=====end")
-	fmt.Println("航班信息添加总耗时", time.Now().Unix()-start, "s")
-}
-func readCityInfoIndexData() {
-	ctx := context.Background()
-	searchResult, err := esClient.Search().Index(CityInfoIndexName).Size(10000).Do(ctx)
 	if err != nil {
-		fmt.Println("读取", CityInfoIndexName, "失败:", err)
+		fmt.Println("配置文件错误:", err)
 		os.Exit(0)
 	}
+	if config.Local == nil || common.HasEsSink(config.Sinks) {
+		connectES()
+	}
 
-	var count = 0
-	for _, hit := range searchResult.Hits.Hits {
-		var info CityInfo
-		if e := json.Unmarshal(hit.Source, &info); e != nil {
-			fmt.Println("readCityInfoIndexData.Unmarshal.err", err)
-			panic(e)
-		}
-		cityInfoMap[info.Code] = info.Domestic
-		count++
+	if config.Local != nil {
+		readLocalCityInfo()
+	} else {
+		readCityInfoIndexData()
+	}
+	common.ReadAirportMaster()
+	if err = lookups.Cities.ReadCityMarkets(common.CityMarketFile); err != nil {
+		fmt.Println("读取城市表失败，城市维度只由 on_time_data 生成:", err)
+	}
+	if config.Local == nil {
+		esAirportDims = loadAirportDims(config.Dates)
 	}
 
-	if count != len(cityInfoMap) {
-		fmt.Println("cityInfoCount", count, "map len:", len(cityInfoMap))
-		os.Exit(0)
+	if common.HasEsSink(config.Sinks) {
+		initAirlinesIndex()
+		if onTimeReport {
+			initFlightOnTimeReportIndex()
+		}
+		if routeChangesReport {
+			initRouteChangesIndex()
+		}
+		if cityReport {
+			initCityIndex()
+		}
 	}
-	if count == 0 {
-		fmt.Println("cityInfoCount nil")
+	common.EsWriteWorkers = config.Concurrency.EsWrite
+	common.Bulk = config.Bulk
+	sinks, err := common.NewSinks(config.Sinks, esClient)
+	if err != nil {
+		fmt.Println("创建输出失败:", err)
 		os.Exit(0)
 	}
-	fmt.Println("load cityInfo ok.")
+	out = common.NewCountingSink(sinks)
+	defer out.Close()
+	fmt.Println(time.Now().String(), "=====start")
+	start := time.Now().Unix()
+	periods := make([]string, len(config.Dates))
+	for i, d := range config.Dates {
+		periods[i] = fmt.Sprintf("%d-%d", d.Year, d.Month)
+	}
+	if config.Local != nil && routeChangesReport {
+		routeMonths = newRouteMonthCache(config.Dates, config.RouteChanges.withDefaults().HistoryYears)
+	}
+	network, cpu := common.NewLimiter(config.Concurrency.Network), common.NewLimiter(config.Concurrency.Cpu)
+	results := common.RunPeriods(periods, config.Concurrency.Periods, func(i int) (int64, string, error) {
+		d := config.Dates[i]
+		if config.Local != nil {
+			cpu.Do(func() { localAirlines(d) })
+			if routeChangesReport {
+				cpu.Do(func() { localRouteChanges(d) })
+			}
+		} else {
+			network.Do(func() { queryAirlines(d) })
+			if routeChangesReport {
+				network.Do(func() { queryRouteChanges(d) })
+			}
+		}
+		return out.Count(d.Year, d.Month), "", out.Failed(d.Year, d.Month)
+	})
+	// 环比、同比要读取上一期的文档，所有月份生成完成后再按配置的顺序计算
+	for i, d := range config.Dates {
+		if results[i].Err == nil {
+			results[i].Err = common.ComparePeriod(esClient, out, compareConfigs, d.Year, d.Month)
+		}
+	}
+	common.PrintPeriodSummary(results)
+	common.ReportMissingLocations()
+	if cityReport {
+		writeCities()
+	}
+	lookups.Cities.Quality.Report("城市名称")
+	fmt.Println(time.Now().String(), "=====end")
+	fmt.Println("航班信息添加总耗时", time.Now().Unix()-start, "s")
 }
 
 // 获取下载数据配置
@@ -177,6 +249,53 @@ func initAirlinesIndex() {
       },
       "domestic": {
         "type": "boolean"
+      },
+      "origin_location": {
+        "type": "geo_point"
+      },
+      "dest_location": {
+        "type": "geo_point"
+      },
+      "great_circle_miles": {
+        "type": "float"
+      },
+      "operations": {
+        "type": "integer"
+      },
+      "days_of_week": {
+        "type": "short"
+      },
+      "first_date": {
+        "type": "date",
+        "format": "yyyy-MM-dd"
+      },
+      "last_date": {
+        "type": "date",
+        "format": "yyyy-MM-dd"
+      },
+      "crs_dep_time": {
+        "type": "short"
+      },
+      "crs_arr_time": {
+        "type": "short"
+      },
+      "crs_block_minutes": {
+        "type": "short"
+      },
+      "tail_numbers": {
+        "type": "keyword"
+      },
+      "through_routing": {
+        "type": "keyword"
+      },
+      "leg_sequence": {
+        "type": "short"
+      },
+      "leg_count": {
+        "type": "short"
+      },
+      "through_days": {
+        "type": "short"
       }
     }
   }
@@ -200,129 +319,91 @@ func queryAirlines(d Date) {
 			elastic.NewTermQuery("year", d.Year),
 			elastic.NewTermQuery("month", d.Month),
 		)
-	// 定义复合聚合查询
-	compositeAgg := elastic.NewCompositeAggregation().Size(2000).Sources(
-		elastic.NewCompositeAggregationTermsValuesSource("year").Field("year"),
-		elastic.NewCompositeAggregationTermsValuesSource("month").Field("month"),
-		elastic.NewCompositeAggregationTermsValuesSource("origin").Field("origin"),
-		elastic.NewCompositeAggregationTermsValuesSource("dest").Field("dest"),
-		elastic.NewCompositeAggregationTermsValuesSource("iata_code_reporting_airline").Field("iata_code_reporting_airline"),
-		elastic.NewCompositeAggregationTermsValuesSource("flight_number_reporting_airline").Field("flight_number_reporting_airline"),
-	)
-	// 定义子聚合（top_hits用于获取origin_country和origin_state）
-	topHitsAgg := elastic.NewTopHitsAggregation().
-		Size(1). // 只需要返回1条记录
-		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("origin_city_name", "dest_city_name", "origin_city_market_id", "dest_city_market_id"))
-
-	var afterKey map[string]interface{}
-
-	ctx := context.Background()
-	w, err := esClient.BulkProcessor().
-		BulkActions(bulkActions).
-		FlushInterval(time.Second).
-		Workers(actualNumCPU).
-		Stats(true).
-		After(GetFailed).
-		Do(ctx)
-	if err != nil {
-		// Handle error
-		panic(err)
+	// 每页的分组数。flight_ontime_report 的 arr_delays 每个分组最多再有一个月班次数的桶，减小每页的分组数，以免超过 ES 的 search.max_buckets
+	pageSize := 2000
+	if onTimeReport {
+		pageSize = 500
 	}
-	w.Start(ctx)
-	defer w.Close()
+	// 定义复合聚合查询，year、month 在查询中固定，按出发机场分区
+	scan := common.CompositeScan{Client: esClient, Index: OnTimeDataIndexName, Query: boolQuery, Name: "unique_routes", Field: "origin",
+		NewAgg: func() *elastic.CompositeAggregation {
+			agg := scheduleAggregations(elastic.NewCompositeAggregation().Size(pageSize).Sources(
+				elastic.NewCompositeAggregationTermsValuesSource("year").Field("year"),
+				elastic.NewCompositeAggregationTermsValuesSource("month").Field("month"),
+				elastic.NewCompositeAggregationTermsValuesSource("origin").Field("origin"),
+				elastic.NewCompositeAggregationTermsValuesSource("dest").Field("dest"),
+				elastic.NewCompositeAggregationTermsValuesSource("iata_code_reporting_airline").Field("iata_code_reporting_airline"),
+				elastic.NewCompositeAggregationTermsValuesSource("flight_number_reporting_airline").Field("flight_number_reporting_airline"),
+			))
+			if onTimeReport {
+				agg = onTimeAggregations(agg)
+			}
+			return agg
+		}}
+	// 城市信息从启动时读取的机场维度中取，不在每个分组中用 top_hits 取记录
+	dims := esAirportDims
+	through := loadThroughFlights(d)
+	missing := missingDims{}
+
 	var count = 0
-	for {
-		// 每次查询时将 afterKey 传递给聚合
-		if afterKey != nil {
-			compositeAgg = compositeAgg.AggregateAfter(afterKey)
-		}
-		// 组合查询
-		searchResult, err := esClient.Search().
-			Index(OnTimeDataIndexName). // 索引名称
-			Query(boolQuery).           // 添加查询条件
-			Size(0).                    // 我们不需要返回文档，设置为0
-			Aggregation("unique_routes", compositeAgg.SubAggregation("route_info", topHitsAgg)).
-			Do(ctx)
-		if err != nil {
+	err := scan.Run(config.Parallel, func(bucket *elastic.AggregationBucketCompositeItem) {
+		origin, dest := cast.ToString(bucket.Key["origin"]), cast.ToString(bucket.Key["dest"])
+		al, id := newAirline(cast.ToInt(bucket.Key["year"]), cast.ToInt(bucket.Key["month"]),
+			cast.ToString(bucket.Key["iata_code_reporting_airline"]), cast.ToString(bucket.Key["flight_number_reporting_airline"]),
+			origin, dest, dims.get(origin, missing), dims.get(dest, missing))
+		scheduleCountsOf(bucket).apply(al)
+		through.apply(segmentKey{origin, dest, al.AirCarrier, cast.ToString(bucket.Key["flight_number_reporting_airline"])}, al)
+		if err := out.Write(AirlinesIndexName, id, al); err != nil {
 			panic(err)
 		}
-
-		// 处理结果
-		agg, _ := searchResult.Aggregations.Composite("unique_routes")
-		for _, bucket := range agg.Buckets {
-			//count++
-			al := &Airline{}
-			al.Year = cast.ToInt(bucket.Key["year"])
-			al.Month = cast.ToInt(bucket.Key["month"])
-			al.AirCarrier = cast.ToString(bucket.Key["iata_code_reporting_airline"])
-			al.OriginAirport = cast.ToString(bucket.Key["origin"])
-			al.DestAirport = cast.ToString(bucket.Key["dest"])
-			al.FlightNumber = al.AirCarrier + cast.ToString(bucket.Key["flight_number_reporting_airline"])
-
-			topHits, _ := bucket.Aggregations.TopHits("route_info")
-			hit := topHits.Hits.Hits[0]
-
-			var source map[string]interface{}
-			_ = json.Unmarshal(hit.Source, &source)
-
-			origin_city_name := cast.ToString(source["origin_city_name"])
-			al.OriginCity = strings.Split(origin_city_name, ", ")[0]
-			al.OriginState = strings.Split(origin_city_name, ", ")[1]
-			dest_city_name := cast.ToString(source["dest_city_name"])
-			al.DestCity = strings.Split(dest_city_name, ", ")[0]
-			al.DestState = strings.Split(dest_city_name, ", ")[1]
-
-			origin_city_market_id := cast.ToString(source["origin_city_market_id"])
-			dest_city_market_id := cast.ToString(source["dest_city_market_id"])
-			originDomestic, _ := cityInfoMap[origin_city_market_id]
-			destDomestic, _ := cityInfoMap[dest_city_market_id]
-			if originDomestic && destDomestic {
-				al.Domestic = true
-			} else {
-				al.Domestic = false
+		if onTimeReport {
+			if err := out.Write(FlightOnTimeReportIndexName, id, onTimeCountsOf(bucket).report(al)); err != nil {
+				panic(err)
 			}
-
-			req := elastic.NewBulkIndexRequest().Index(AirlinesIndexName).Id(strings.Join([]string{cast.ToString(bucket.Key["year"]), cast.ToString(bucket.Key["month"]), al.OriginAirport, al.DestAirport, al.AirCarrier, cast.ToString(bucket.Key["flight_number_reporting_airline"])}, "_")).Doc(al)
-			count++
-			w.Add(req)
-		}
-		afterKey = agg.AfterKey
-		if agg.AfterKey == nil {
-			break
 		}
+		count++
+	})
+	if err != nil {
+		panic(err)
 	}
-	for {
-		st1 := w.Stats() //获取数据写入情况
+	out.FlushPeriod(d.Year, d.Month)
+	missing.report(AirlinesIndexName)
+	fmt.Println(d.Year, d.Month, "最后数量", count)
+}
 
-		var finish = true
-		for _, s := range st1.Workers {
-			if s.Queued > 0 {
-				finish = false
-				break
-			}
-		}
-		if finish {
-			break
-		}
+// 由聚合的 key 和出发、到达机场的维度生成航班文档及文档ID
+func newAirline(year, month int, carrier, flightNumber, origin, dest string, originDim, destDim *AirportDim) (*Airline, string) {
+	al := &Airline{}
+	al.Year = year
+	al.Month = month
+	al.AirCarrier = carrier
+	al.OriginAirport = origin
+	al.DestAirport = dest
+	al.FlightNumber = al.AirCarrier + flightNumber
 
-	}
-	fmt.Println(d.Year, d.Month, "最后数量", count)
+	originCity, _ := common.ParseCityName(originDim.CityName)
+	destCity, _ := common.ParseCityName(destDim.CityName)
+	al.OriginCity, al.OriginState = originCity.City, originCity.State
+	al.DestCity, al.DestState = destCity.City, destCity.State
+
+	al.Domestic = lookups.Domestic(originDim.CityMarketID) && lookups.Domestic(destDim.CityMarketID)
+	al.OriginLocation = common.AirportLocation(origin)
+	al.DestLocation = common.AirportLocation(dest)
+	al.GreatCircleMiles = common.GreatCircleMiles(al.OriginLocation, al.DestLocation)
+
+	return al, airlineId(year, month, origin, dest, carrier, flightNumber)
 }
 
-func GetFailed(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
-	if response == nil { //可能存在为空的情况 😳
-		//log.Println("GetNil response return")
-		return
-	}
-	fi := response.Failed()
-	if len(fi) != 0 {
-		for _, f := range fi {
-			log.Printf("DebugFailedEs: index:%s type:%s id:%s version:%d  status:%d result:%s ForceRefresh:%v errorDetail:%v getResult:%v\n", f.Index, f.Type, f.Id, f.Version, f.Status, f.Result, f.ForcedRefresh, f.Error, f.GetResult)
-			//panic(f.Error)
-			return
-		}
-	}
+// 航班文档ID：年_月_出发_到达_航司_航班号，航班号不带航司代码。flight_ontime_report 与 airlines 的文档ID相同
+func airlineId(year, month int, origin, dest, carrier, flightNumber string) string {
+	return strings.Join([]string{cast.ToString(year), cast.ToString(month), origin, dest, carrier, flightNumber}, "_")
+}
 
+// 由上一期的航班文档生成本期的文档ID，文档中的 flight_number 带航司代码
+func airlineDocId(year, month int, doc map[string]interface{}) string {
+	carrier := cast.ToString(doc["air_carrier"])
+	return airlineId(year, month, cast.ToString(doc["origin_airport"]), cast.ToString(doc["dest_airport"]), carrier,
+		strings.TrimPrefix(cast.ToString(doc["flight_number"]), carrier))
 }
 
 type Date struct {
@@ -341,10 +422,24 @@ type Airline struct {
 	DestCity      string `json:"dest_city"`
 	DestState     string `json:"dest_state"`
 	Domestic      bool   `json:"domestic"`
-}
-type CityInfo struct {
-	Name     string `json:"name"`
-	State    string `json:"state"`
-	Code     string `json:"code"`
-	Domestic bool   `json:"domestic"`
+
+	OriginLocation   *common.GeoPoint `json:"origin_location,omitempty"`    // 出发机场坐标，机场主数据中没有该机场时不写
+	DestLocation     *common.GeoPoint `json:"dest_location,omitempty"`      // 到达机场坐标
+	GreatCircleMiles *float64         `json:"great_circle_miles,omitempty"` // 出发、到达机场间的大圆距离（英里），任一机场没有坐标时不写
+
+	// 由该月的记录重建的时刻表
+	Operations      int      `json:"operations"`           // 运营（未取消）的班次数
+	DaysOfWeek      []int    `json:"days_of_week"`         // 运营的星期，1 为星期一，7 为星期日
+	FirstDate       string   `json:"first_date,omitempty"` // 第一个运营日，全部取消时不写
+	LastDate        string   `json:"last_date,omitempty"`  // 最后一个运营日
+	CrsDepTime      int      `json:"crs_dep_time"`         // 计划起飞时刻（hhmm）的众数，包括取消的班次
+	CrsArrTime      int      `json:"crs_arr_time"`         // 计划到达时刻（hhmm）的众数
+	CrsBlockMinutes int      `json:"crs_block_minutes"`    // 计划轮挡时间（分钟）的众数
+	TailNumbers     []string `json:"tail_numbers"`         // 运营的机尾号
+
+	// 经停航班：同一航班号、同一天、同一机尾号，前一航段的到达机场为后一航段的出发机场
+	ThroughRouting string `json:"through_routing,omitempty"` // 本航段所在的完整经停航线，如 ORD-DEN-SFO，有多条时取运营天数最多的，不是经停航班时不写
+	LegSequence    int    `json:"leg_sequence,omitempty"`    // 本航段在经停航线中的序号，从 1 开始
+	LegCount       int    `json:"leg_count,omitempty"`       // 经停航线的航段数
+	ThroughDays    int    `json:"through_days,omitempty"`    // 按该经停航线运营的天数
 }
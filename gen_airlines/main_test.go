@@ -0,0 +1,589 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"common"
+	"common/fakees"
+)
+
+// 用 testdata 下的 BTS 数据准备 on_time_data 和 city_info 索引
+func seedFakeES(t *testing.T) *fakees.ES {
+	es := fakees.New(t)
+	err := common.ReadLocalCsv("testdata", common.OnTimeFileNames(2020, 1), func(header map[string]int, record []string) error {
+		es.Seed(OnTimeDataIndexName, "", common.ParseOnTimeRecord(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.Seed(CityInfoIndexName, "31703", common.CityInfo{Name: "New York City", State: "NY", Code: "31703", Domestic: true})
+	es.Seed(CityInfoIndexName, "32575", common.CityInfo{Name: "Los Angeles", State: "CA", Code: "32575", Domestic: true})
+	es.Seed(CityInfoIndexName, "30977", common.CityInfo{Name: "Chicago", State: "IL", Code: "30977", Domestic: true})
+	es.Seed(CityInfoIndexName, "34819", common.CityInfo{Name: "San Juan", State: "PR", Code: "34819", Domestic: false})
+	return es
+}
+
+// 设置全局的 ES 客户端和输出，测试结束后还原
+func useFakeES(t *testing.T, es *fakees.ES, c Config) {
+	oldClient, oldOut, oldConfig, oldLookups, oldDims, oldRouteMonths := esClient, out, config, lookups, esAirportDims, routeMonths
+	t.Cleanup(func() {
+		esClient, out, config, lookups, esAirportDims, routeMonths = oldClient, oldOut, oldConfig, oldLookups, oldDims, oldRouteMonths
+	})
+	esClient = es.Client()
+	config = c
+	lookups = common.NewLookups()
+	common.ReadAirportMaster()
+	esAirportDims = loadAirportDims(c.Dates)
+	routeMonths = newRouteMonthCache(c.Dates, c.RouteChanges.withDefaults().HistoryYears)
+	sinks, err := common.NewSinks(nil, esClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = common.NewCountingSink(sinks)
+}
+
+func miles(v float64) *float64 {
+	return &v
+}
+
+// airports.csv 中的机场坐标
+var (
+	jfk = &common.GeoPoint{Lat: 40.6398, Lon: -73.7789}
+	lax = &common.GeoPoint{Lat: 33.9425, Lon: -118.4081}
+	ord = &common.GeoPoint{Lat: 41.9786, Lon: -87.9048}
+	ewr = &common.GeoPoint{Lat: 40.6925, Lon: -74.1687}
+	sju = &common.GeoPoint{Lat: 18.4394, Lon: -66.0018}
+)
+
+// 时刻表字段：UA500 1 月 2 日取消，不计入运营日；时刻 0900 等以 0 开头的按十进制解析
+var wantAirlines = map[string]interface{}{
+	"2020_1_JFK_LAX_AA_100": Airline{Year: 2020, Month: 1, AirCarrier: "AA", FlightNumber: "AA100",
+		OriginAirport: "JFK", OriginCity: "New York", OriginState: "NY",
+		DestAirport: "LAX", DestCity: "Los Angeles", DestState: "CA", Domestic: true,
+		OriginLocation: jfk, DestLocation: lax, GreatCircleMiles: miles(2469.5),
+		Operations: 2, DaysOfWeek: []int{3, 4}, FirstDate: "2020-01-01", LastDate: "2020-01-02",
+		CrsDepTime: 900, CrsArrTime: 1230, CrsBlockMinutes: 210, TailNumbers: []string{"N101AA", "N102AA"}},
+	"2020_1_LAX_ORD_AA_200": Airline{Year: 2020, Month: 1, AirCarrier: "AA", FlightNumber: "AA200",
+		OriginAirport: "LAX", OriginCity: "Los Angeles", OriginState: "CA",
+		DestAirport: "ORD", DestCity: "Chicago", DestState: "IL", Domestic: true,
+		OriginLocation: lax, DestLocation: ord, GreatCircleMiles: miles(1741.2),
+		Operations: 2, DaysOfWeek: []int{3, 4}, FirstDate: "2020-01-01", LastDate: "2020-01-02",
+		CrsDepTime: 1400, CrsArrTime: 2010, CrsBlockMinutes: 370, TailNumbers: []string{"N101AA", "N103AA"}},
+	"2020_1_ORD_JFK_DL_300": Airline{Year: 2020, Month: 1, AirCarrier: "DL", FlightNumber: "DL300",
+		OriginAirport: "ORD", OriginCity: "Chicago", OriginState: "IL",
+		DestAirport: "JFK", DestCity: "New York", DestState: "NY", Domestic: true,
+		OriginLocation: ord, DestLocation: jfk, GreatCircleMiles: miles(738.1),
+		Operations: 2, DaysOfWeek: []int{3, 5}, FirstDate: "2020-01-01", LastDate: "2020-01-03",
+		CrsDepTime: 700, CrsArrTime: 1030, CrsBlockMinutes: 210, TailNumbers: []string{"N201DL", "N202DL"}},
+	"2020_1_JFK_SJU_DL_400": Airline{Year: 2020, Month: 1, AirCarrier: "DL", FlightNumber: "DL400",
+		OriginAirport: "JFK", OriginCity: "New York", OriginState: "NY",
+		DestAirport: "SJU", DestCity: "San Juan", DestState: "PR", Domestic: false,
+		OriginLocation: jfk, DestLocation: sju, GreatCircleMiles: miles(1601.9),
+		Operations: 1, DaysOfWeek: []int{3}, FirstDate: "2020-01-01", LastDate: "2020-01-01",
+		CrsDepTime: 815, CrsArrTime: 1310, CrsBlockMinutes: 295, TailNumbers: []string{"N202DL"}},
+	"2020_1_EWR_ORD_UA_500": Airline{Year: 2020, Month: 1, AirCarrier: "UA", FlightNumber: "UA500",
+		OriginAirport: "EWR", OriginCity: "Newark", OriginState: "NJ",
+		DestAirport: "ORD", DestCity: "Chicago", DestState: "IL", Domestic: true,
+		OriginLocation: ewr, DestLocation: ord, GreatCircleMiles: miles(717.4),
+		Operations: 1, DaysOfWeek: []int{5}, FirstDate: "2020-01-03", LastDate: "2020-01-03",
+		CrsDepTime: 600, CrsArrTime: 745, CrsBlockMinutes: 105, TailNumbers: []string{"N301UA"}},
+}
+
+func TestQueryAirlines(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}})
+
+	readCityInfoIndexData()
+	initAirlinesIndex()
+	queryAirlines(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if es.Writes[0].Op != "create_index" || es.Writes[0].Index != AirlinesIndexName {
+		t.Errorf("第一个写操作应为创建 %s 索引: %+v", AirlinesIndexName, es.Writes[0])
+	}
+	es.AssertDocs(AirlinesIndexName, wantAirlines)
+}
+
+// 本地计算模式与ES聚合的结果一致
+func TestLocalAirlines(t *testing.T) {
+	es := fakees.New(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}, Local: &common.LocalConfig{DataDir: "testdata", CityInfoFile: "testdata/city_info.json"}})
+
+	readLocalCityInfo()
+	localAirlines(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es.AssertDocs(AirlinesIndexName, wantAirlines)
+}
+
+// 按出发机场分区并行翻页，文档及写入顺序与顺序翻页相同
+func TestParallelAirlines(t *testing.T) {
+	run := func(p common.ParallelConfig) *fakees.ES {
+		es := seedFakeES(t)
+		useFakeES(t, es, Config{Dates: []Date{{2020, 1}}, Parallel: p})
+		readCityInfoIndexData()
+		queryAirlines(Date{2020, 1})
+		if err := out.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return es
+	}
+	ids := func(es *fakees.ES) []string {
+		var res []string
+		for _, w := range es.Writes {
+			res = append(res, w.Id)
+		}
+		return res
+	}
+	want := run(common.ParallelConfig{})
+	for _, p := range []common.ParallelConfig{{Workers: 3}, {Workers: 2, Partitions: 2}} {
+		es := run(p)
+		es.AssertDocs(AirlinesIndexName, wantAirlines)
+		if !reflect.DeepEqual(ids(es), ids(want)) {
+			t.Errorf("%+v 并行翻页的写入顺序与顺序翻页不一致:\n%v\n%v", p, ids(es), ids(want))
+		}
+	}
+}
+
+// 维度表中没有的机场记入 missing，城市名称没有州时不 panic；机场主数据中没有的机场不写坐标和距离
+func TestMissingAirportDims(t *testing.T) {
+	dims := airportDims{"JFK": {CityMarketID: "31703", CityName: "New York, NY"}, "XYZ": {CityMarketID: "99999", CityName: "Nowhere"}}
+
+	missing := missingDims{}
+	al, _ := newAirline(2020, 1, "AA", "1", "JFK", "ABC", dims.get("JFK", missing), dims.get("ABC", missing))
+	if al.OriginCity != "New York" || al.OriginState != "NY" || al.DestCity != "" || al.DestState != "" {
+		t.Errorf("航班城市信息错误: %+v", al)
+	}
+	al, _ = newAirline(2020, 1, "AA", "2", "XYZ", "ABC", dims.get("XYZ", missing), dims.get("ABC", missing))
+	if al.OriginCity != "Nowhere" || al.OriginState != "" {
+		t.Errorf("航班城市信息错误: %+v", al)
+	}
+	if len(missing) != 1 || missing["ABC"] != 2 {
+		t.Errorf("缺少的维度: %v", missing)
+	}
+
+	// 机场主数据中没有的机场不写坐标和大圆距离，记入 missingLocations
+	common.ReadAirportMaster()
+	al, _ = newAirline(2020, 1, "AA", "3", "JFK", "ABC", dims.get("JFK", missing), dims.get("ABC", missing))
+	if al.OriginLocation == nil || al.DestLocation != nil || al.GreatCircleMiles != nil {
+		t.Errorf("没有坐标的机场: %+v", al)
+	}
+	b, _ := json.Marshal(al)
+	if strings.Contains(string(b), "great_circle_miles") || strings.Contains(string(b), "dest_location") {
+		t.Errorf("没有坐标时不写字段: %s", b)
+	}
+	if missing := common.MissingLocations(); missing["ABC"] == 0 || missing["JFK"] != 0 {
+		t.Errorf("机场主数据中没有的机场: %v", missing)
+	}
+	common.ReportMissingLocations()
+}
+
+// 同时处理多个月：结果按配置顺序返回，缺少数据文件的月份记为失败，不影响其他月份
+func TestRunPeriods(t *testing.T) {
+	es := fakees.New(t)
+	useFakeES(t, es, Config{Local: &common.LocalConfig{DataDir: "testdata", CityInfoFile: "testdata/city_info.json"}})
+	readLocalCityInfo()
+
+	dates := []Date{{2020, 2}, {2020, 1}, {2019, 12}}
+	results := common.RunPeriods([]string{"2020-2", "2020-1", "2019-12"}, 3, func(i int) (int64, string, error) {
+		localAirlines(dates[i])
+		return out.Count(dates[i].Year, dates[i].Month), "", nil
+	})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	common.PrintPeriodSummary(results)
+
+	for i, r := range results {
+		if i == 1 {
+			if r.Period != "2020-1" || r.Err != nil || r.Docs != int64(len(wantAirlines)) {
+				t.Errorf("2020-1 的结果错误: %+v", r)
+			}
+		} else if r.Err == nil || r.Docs != 0 {
+			t.Errorf("%s 没有数据文件，应为失败: %+v", r.Period, r)
+		}
+	}
+	es.AssertDocs(AirlinesIndexName, wantAirlines)
+}
+
+// ES 最终写入失败的文档记在所属的期，该期在汇总中为失败
+func TestPeriodWriteFailures(t *testing.T) {
+	es := fakees.New(t)
+	es.BadIds = map[string]bool{"2020_1_JFK_LAX_AA_100": true}
+	useFakeES(t, es, Config{Local: &common.LocalConfig{DataDir: "testdata", CityInfoFile: "testdata/city_info.json"}})
+	readLocalCityInfo()
+
+	results := common.RunPeriods([]string{"2020-1"}, 1, func(i int) (int64, string, error) {
+		localAirlines(Date{2020, 1})
+		return out.Count(2020, 1), "", out.Failed(2020, 1)
+	})
+	if results[0].Err == nil {
+		t.Errorf("有文档写入失败，应为失败: %+v", results[0])
+	}
+	if err := out.Failed(2020, 1); err == nil {
+		t.Error("2020-1 应有写入失败的文档")
+	}
+	if err := out.Failed(2019, 12); err != nil {
+		t.Error("2019-12 没有写入失败的文档:", err)
+	}
+	out.Close()
+}
+
+// 计划时刻和轮挡时间取班次最多的值，相同时取较小的值；全部取消时没有运营日
+func TestScheduleCounts(t *testing.T) {
+	s := newScheduleCounts()
+	for _, r := range []*common.OnTimeData{
+		{FlightDate: "2020-01-05", CrsDepTime: common.ParseHHMM("0905"), CrsArrTime: 1200, CrsElapsedTime: 175, Cancelled: 1},
+		{FlightDate: "2020-01-06", CrsDepTime: common.ParseHHMM("0900"), CrsArrTime: 1205, CrsElapsedTime: 185, Cancelled: 1},
+	} {
+		s.add(r)
+	}
+	al := &Airline{}
+	s.apply(al)
+	if al.CrsDepTime != 900 || al.CrsArrTime != 1200 || al.CrsBlockMinutes != 175 || al.Operations != 0 ||
+		al.FirstDate != "" || len(al.DaysOfWeek) != 0 || len(al.TailNumbers) != 0 {
+		t.Errorf("全部取消的时刻表: %+v", al)
+	}
+
+	s.add(&common.OnTimeData{FlightDate: "2020-01-05", TailNumber: "N1", CrsDepTime: 905, CrsElapsedTime: 185})
+	s.apply(al)
+	// 2020-01-05 为星期日
+	if al.CrsDepTime != 905 || al.CrsBlockMinutes != 185 || al.Operations != 1 ||
+		!reflect.DeepEqual(al.DaysOfWeek, []int{7}) || !reflect.DeepEqual(al.TailNumbers, []string{"N1"}) {
+		t.Errorf("时刻表: %+v", al)
+	}
+}
+
+// 取消、备降的班次算作不准点，延误只统计正常到达的班次
+func wantFlightOnTimeReports() map[string]interface{} {
+	report := func(carrier, number, origin, dest string, ops, onTime, late30, cancelled, diverted int, avg, p90 float64, chronic bool) FlightOnTimeReport {
+		return FlightOnTimeReport{Year: 2020, Month: 1, AirCarrier: carrier, FlightNumber: carrier + number, OriginAirport: origin, DestAirport: dest,
+			Operations: ops, Arrivals: ops - cancelled - diverted, OnTimeArrivals: onTime, OnTimePct: float64(onTime) / float64(ops) * 100,
+			AvgArrDelay: avg, P90ArrDelay: p90, Late30Count: late30, Late30Pct: float64(late30+cancelled+diverted) / float64(ops) * 100,
+			CancelledCount: cancelled, DivertedCount: diverted, ChronicallyDelayed: chronic}
+	}
+	return map[string]interface{}{
+		"2020_1_JFK_LAX_AA_100": report("AA", "100", "JFK", "LAX", 3, 1, 0, 1, 0, 7.5, 21.5, true),
+		"2020_1_LAX_ORD_AA_200": report("AA", "200", "LAX", "ORD", 2, 1, 1, 0, 0, 27.5, 45.5, true),
+		"2020_1_ORD_JFK_DL_300": report("DL", "300", "ORD", "JFK", 3, 2, 0, 1, 0, 6.5, 12.5, true),
+		"2020_1_JFK_SJU_DL_400": report("DL", "400", "JFK", "SJU", 1, 0, 0, 0, 1, 0, 0, false),
+		"2020_1_EWR_ORD_UA_500": report("UA", "500", "EWR", "ORD", 2, 1, 0, 1, 0, -5, -5, true),
+	}
+}
+
+// ES 聚合和本地计算的 flight_ontime_report 一致，不影响 airlines
+func TestFlightOnTimeReport(t *testing.T) {
+	oldReport, oldMin := onTimeReport, chronicMinOperations
+	t.Cleanup(func() { onTimeReport, chronicMinOperations = oldReport, oldMin })
+	if err := selectReports([]string{FlightOnTimeReportIndexName}); err != nil || !onTimeReport {
+		t.Fatal("selectReports:", err)
+	}
+	if err := selectReports([]string{"unknown"}); err == nil {
+		t.Error("不支持的报表应返回错误")
+	}
+	// 测试数据每个航班不到 10 班，降低门槛以覆盖长期延误：AA200 2 班中 1 班延误 50 分钟，
+	// AA100、DL300、UA500 各有 1 班取消，取消的班次算作延误，也超过 30%；DL400 只有 1 班，不判断
+	chronicMinOperations = 2
+
+	es := seedFakeES(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}})
+	readCityInfoIndexData()
+	initFlightOnTimeReportIndex()
+	queryAirlines(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(FlightOnTimeReportIndexName, wantFlightOnTimeReports())
+	es.AssertDocs(AirlinesIndexName, wantAirlines)
+
+	es = fakees.New(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}, Local: &common.LocalConfig{DataDir: "testdata", CityInfoFile: "testdata/city_info.json"}})
+	readLocalCityInfo()
+	localAirlines(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(FlightOnTimeReportIndexName, wantFlightOnTimeReports())
+}
+
+// UA700 ORD→DEN→SFO：6、7 日同一架飞机连飞两段为经停航班；8 日两段机尾号不同，9 日 ORD→DEN 取消，都不算
+func throughFlightRecords() [][]string {
+	row := func(day, date, tail, crsDep, origin, dest, cancelled string) []string {
+		r := make([]string, 110)
+		r[0], r[1], r[2], r[3], r[5] = "2020", "1", "1", day, date
+		r[8], r[9], r[10] = "UA", tail, "700"
+		r[14], r[23], r[29], r[47], r[49] = origin, dest, crsDep, cancelled, "0"
+		return r
+	}
+	return [][]string{
+		row("6", "2020-01-06", "N701UA", "0800", "ORD", "DEN", "0"),
+		row("6", "2020-01-06", "N701UA", "1100", "DEN", "SFO", "0"),
+		row("7", "2020-01-07", "N701UA", "1100", "DEN", "SFO", "0"),
+		row("7", "2020-01-07", "N701UA", "0800", "ORD", "DEN", "0"),
+		row("8", "2020-01-08", "N701UA", "0800", "ORD", "DEN", "0"),
+		row("8", "2020-01-08", "N702UA", "1100", "DEN", "SFO", "0"),
+		row("9", "2020-01-09", "N701UA", "0800", "ORD", "DEN", "1"),
+		row("9", "2020-01-09", "N701UA", "1100", "DEN", "SFO", "0"),
+	}
+}
+
+func assertThroughFlights(t *testing.T, es *fakees.ES) {
+	docs := es.Docs(AirlinesIndexName)
+	want := map[string][]interface{}{
+		"2020_1_ORD_DEN_UA_700": {"ORD-DEN-SFO", 1.0, 2.0, 2.0},
+		"2020_1_DEN_SFO_UA_700": {"ORD-DEN-SFO", 2.0, 2.0, 2.0},
+	}
+	for id, w := range want {
+		d := docs[id]
+		if got := []interface{}{d["through_routing"], d["leg_sequence"], d["leg_count"], d["through_days"]}; !reflect.DeepEqual(got, w) {
+			t.Errorf("%s 经停信息 = %v, want %v", id, got, w)
+		}
+	}
+	// AA100 JFK→LAX 和 AA200 LAX→ORD 是同一架飞机，但航班号不同
+	for id := range wantAirlines {
+		if _, ok := docs[id]["through_routing"]; ok {
+			t.Errorf("%s 不是经停航班: %v", id, docs[id])
+		}
+	}
+}
+
+func TestThroughFlights(t *testing.T) {
+	es := seedFakeES(t)
+	for _, r := range throughFlightRecords() {
+		es.Seed(OnTimeDataIndexName, "", common.ParseOnTimeRecord(r))
+	}
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}})
+	readCityInfoIndexData()
+	queryAirlines(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertThroughFlights(t, es)
+
+	// 本地计算：在测试数据后追加航段
+	dir := t.TempDir()
+	name := common.OnTimeCsvNamePrefix + "2020_1.csv"
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(b)
+	w := csv.NewWriter(f)
+	_ = w.WriteAll(throughFlightRecords())
+	_ = f.Close()
+
+	es = fakees.New(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}, Local: &common.LocalConfig{DataDir: dir, CityInfoFile: "testdata/city_info.json"}})
+	readLocalCityInfo()
+	localAirlines(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertThroughFlights(t, es)
+}
+
+// 航线变化的测试数据：2020 年 1 月为 testdata，往年 1、2 月和 2020 年 2 月补充记录
+func routeChangeRecords() [][]string {
+	row := func(year, month, day, carrier, origin, dest string) []string {
+		r := make([]string, 110)
+		r[0], r[2], r[3], r[5] = year, month, day, year+"-0"+month+"-0"+day
+		r[8], r[10], r[14], r[23], r[47], r[49] = carrier, "900", origin, dest, "0", "0"
+		return r
+	}
+	return [][]string{
+		// DL ORD→JFK 2019 年 1 月运营、2 月停航，2018 年两个月都运营
+		row("2018", "1", "1", "DL", "ORD", "JFK"),
+		row("2018", "2", "1", "DL", "ORD", "JFK"),
+		row("2019", "1", "1", "DL", "ORD", "JFK"),
+		// WN LAX→SJU 只在往年的 2 月运营
+		row("2018", "2", "1", "WN", "LAX", "SJU"),
+		row("2019", "2", "1", "WN", "LAX", "SJU"),
+		row("2020", "2", "1", "WN", "LAX", "SJU"),
+		// AA JFK→LAX、DL JFK→SJU 班次不变，AA LAX→ORD 由 2 班增加到 4 班，UA EWR→ORD 由 2 班减少到 1 班
+		row("2020", "2", "1", "AA", "JFK", "LAX"),
+		row("2020", "2", "2", "AA", "JFK", "LAX"),
+		row("2020", "2", "3", "AA", "JFK", "LAX"),
+		row("2020", "2", "1", "DL", "JFK", "SJU"),
+		row("2020", "2", "1", "AA", "LAX", "ORD"),
+		row("2020", "2", "2", "AA", "LAX", "ORD"),
+		row("2020", "2", "3", "AA", "LAX", "ORD"),
+		row("2020", "2", "4", "AA", "LAX", "ORD"),
+		row("2020", "2", "1", "UA", "EWR", "ORD"),
+		// B6 JFK→MCO 新开
+		row("2020", "2", "1", "B6", "JFK", "MCO"),
+		row("2020", "2", "2", "B6", "JFK", "MCO"),
+	}
+}
+
+var wantRouteChanges = map[string]interface{}{
+	"2020_2_LAX_ORD_AA": RouteChange{Year: 2020, Month: 2, AirCarrier: "AA", OriginAirport: "LAX", DestAirport: "ORD",
+		Change: RouteFrequencyIncrease, Flights: 4, PrevFlights: 2, FlightsChangePct: 100},
+	"2020_2_EWR_ORD_UA": RouteChange{Year: 2020, Month: 2, AirCarrier: "UA", OriginAirport: "EWR", DestAirport: "ORD",
+		Change: RouteFrequencyDecrease, Flights: 1, PrevFlights: 2, FlightsChangePct: -50},
+	"2020_2_ORD_JFK_DL": RouteChange{Year: 2020, Month: 2, AirCarrier: "DL", OriginAirport: "ORD", DestAirport: "JFK",
+		Change: RouteSuspension, Flights: 0, PrevFlights: 3, Seasonal: true, SeasonalYears: []int{2019}},
+	"2020_2_LAX_SJU_WN": RouteChange{Year: 2020, Month: 2, AirCarrier: "WN", OriginAirport: "LAX", DestAirport: "SJU",
+		Change: RouteResumption, Flights: 1, LastServed: "2019-02", Seasonal: true, SeasonalYears: []int{2019, 2018}},
+	"2020_2_JFK_MCO_B6": RouteChange{Year: 2020, Month: 2, AirCarrier: "B6", OriginAirport: "JFK", DestAirport: "MCO",
+		Change: RouteLaunch, Flights: 2},
+}
+
+func TestRouteChanges(t *testing.T) {
+	oldReport := routeChangesReport
+	t.Cleanup(func() { routeChangesReport = oldReport })
+	if err := selectReports([]string{RouteChangesIndexName}); err != nil || !routeChangesReport {
+		t.Fatal("selectReports:", err)
+	}
+
+	es := seedFakeES(t)
+	for _, r := range routeChangeRecords() {
+		es.Seed(OnTimeDataIndexName, "", common.ParseOnTimeRecord(r))
+	}
+	useFakeES(t, es, Config{Dates: []Date{{2020, 2}}, Parallel: common.ParallelConfig{Workers: 2}})
+	initRouteChangesIndex()
+	// 2019 年 12 月没有数据，1 月不生成
+	queryRouteChanges(Date{2020, 1})
+	queryRouteChanges(Date{2020, 2})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(RouteChangesIndexName, wantRouteChanges)
+
+	// 本地计算：每月一个文件，header 取自 testdata
+	dir := t.TempDir()
+	b, err := os.ReadFile(filepath.Join("testdata", common.OnTimeCsvNamePrefix+"2020_1.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, common.OnTimeCsvNamePrefix+"2020_1.csv"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	header, _, _ := strings.Cut(string(b), "\n")
+	files := map[string]*csv.Writer{}
+	for _, r := range routeChangeRecords() {
+		name := common.OnTimeCsvNamePrefix + r[0] + "_" + r[2] + ".csv"
+		if files[name] == nil {
+			f, err := os.Create(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			_, _ = f.WriteString(header + "\n")
+			files[name] = csv.NewWriter(f)
+		}
+		_ = files[name].Write(r)
+	}
+	for _, w := range files {
+		w.Flush()
+	}
+
+	// 两个月的回看期重叠，每个数据文件只读取一次，处理完成后全部释放
+	es = fakees.New(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}, {2020, 2}}, Local: &common.LocalConfig{DataDir: dir}})
+	localRouteChanges(Date{2020, 1})
+	localRouteChanges(Date{2020, 2})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(RouteChangesIndexName, wantRouteChanges)
+	entries, _ := os.ReadDir(dir)
+	if routeMonths.reads != len(entries) || len(routeMonths.months) != 0 {
+		t.Errorf("读取 %d 个月的数据文件，期望 %d；未释放的月份 %d", routeMonths.reads, len(entries), len(routeMonths.months))
+	}
+}
+
+// 城市维度以城市表为准，表中没有的城市市场由 on_time_data 的城市名称补充，国家不一致的记入质量报告；
+// 纽约 31703 包含 NJ 的 EWR，州不同不算异常
+func TestCityReport(t *testing.T) {
+	oldReport := cityReport
+	t.Cleanup(func() { cityReport = oldReport })
+	if err := selectReports([]string{CityIndexName}); err != nil || !cityReport {
+		t.Fatal("selectReports:", err)
+	}
+	es := fakees.New(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}, Local: &common.LocalConfig{DataDir: "testdata", CityInfoFile: "testdata/city_info.json"}})
+	path := filepath.Join(t.TempDir(), "L_CITY_MARKET_ID.csv")
+	table := "Code,Description\n\"31703\",\"New York City, NY (Metropolitan Area)\"\n\"32575\",\"Los Angeles, Mexico\"\n"
+	if err := os.WriteFile(path, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := lookups.Cities.ReadCityMarkets(path); err != nil {
+		t.Fatal(err)
+	}
+
+	readLocalCityInfo()
+	initCityIndex()
+	localAirlines(Date{2020, 1})
+	writeCities()
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(CityIndexName, map[string]interface{}{
+		"31703": common.City{CityMarketID: "31703", Name: "New York City, NY (Metropolitan Area)", City: "New York City", State: "NY",
+			StateName: "New York", Country: "United States", Domestic: true, Source: "L_CITY_MARKET_ID"},
+		"32575": common.City{CityMarketID: "32575", Name: "Los Angeles, Mexico", City: "Los Angeles", Country: "Mexico", Source: "L_CITY_MARKET_ID"},
+		"30977": common.City{CityMarketID: "30977", Name: "Chicago, IL", City: "Chicago", State: "IL",
+			StateName: "Illinois", Country: "United States", Domestic: true, Source: OnTimeDataIndexName},
+		"34819": common.City{CityMarketID: "34819", Name: "San Juan, PR", City: "San Juan", State: "PR",
+			StateName: "Puerto Rico", Country: "United States", Source: OnTimeDataIndexName},
+	})
+	if n := lookups.Cities.Quality.Count(common.CityCountryMismatch, OnTimeDataIndexName, "32575 Los Angeles, CA <> Los Angeles, Mexico"); n != 1 {
+		t.Errorf("质量报告中 32575 国家不一致的记录 = %d, want 1", n)
+	}
+	if n := lookups.Cities.Quality.Len(); n != 1 {
+		t.Errorf("质量报告中的异常 = %d, want 1", n)
+	}
+	// 航班文档中的城市、州取自 on_time_data 的城市名称
+	es.AssertDocs(AirlinesIndexName, wantAirlines)
+}
+
+// 上一期有、本期没有的航班，discontinued 文档的ID与本期生成该航班时的文档ID一致，重新计算不会多出文档
+func TestCompareDiscontinued(t *testing.T) {
+	es := fakees.New(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 2}}})
+	dim := &AirportDim{}
+	prev, prevId := newAirline(2020, 1, "AA", "100", "JFK", "LAX", dim, dim)
+	_, wantId := newAirline(2020, 2, "AA", "100", "JFK", "LAX", dim, dim)
+	es.Seed(AirlinesIndexName, prevId, prev)
+	cur, curId := newAirline(2020, 2, "DL", "300", "ORD", "JFK", dim, dim)
+	es.Seed(AirlinesIndexName, curId, cur)
+
+	if got := airlineDocId(2020, 2, fakees.DocMap(t, prev)); got != wantId {
+		t.Errorf("discontinued 文档ID = %s, want %s", got, wantId)
+	}
+	cfgs, err := common.ResolveCompareConfigs([]common.CompareConfig{{Index: AirlinesIndexName}}, compareDefaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := common.ComparePeriod(esClient, out, cfgs, 2020, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	docs := es.Docs(AirlinesIndexName)
+	if len(docs) != 3 {
+		t.Errorf("文档数 = %d, want 3: %v", len(docs), docs)
+	}
+	if changes, _ := docs[wantId]["changes"].(map[string]interface{}); changes["discontinued"] != true {
+		t.Errorf("%s 应为 discontinued: %v", wantId, docs[wantId])
+	}
+
+	if err = common.CheckCompareSinks(cfgs, []common.SinkConfig{{Type: "csv", Path: t.TempDir()}}); err == nil {
+		t.Error("没有 ES 输出时不能配置 compare")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+const FlightOnTimeReportIndexName = "flight_ontime_report"
+
+// 附加报表，config.json 中 reports 配置，默认不生成。
+// flight_ontime_report 与 airlines 在同一次复合聚合中生成，route_changes 在 airlines 之后单独聚合，
+// city 为所有月份处理完成后的城市维度
+var allReports = []string{FlightOnTimeReportIndexName, RouteChangesIndexName, CityIndexName}
+
+// 是否生成 flight_ontime_report、route_changes、city
+var onTimeReport, routeChangesReport, cityReport bool
+
+// 每月至少运营的班次数，达到后才判断是否长期延误，与 DOT 的定义一致
+var chronicMinOperations = 10
+
+// 检查配置的附加报表
+func selectReports(names []string) error {
+	for _, name := range names {
+		found := false
+		for _, r := range allReports {
+			found = found || r == name
+		}
+		if !found {
+			return fmt.Errorf("不支持的报表: %s", name)
+		}
+		switch name {
+		case FlightOnTimeReportIndexName:
+			onTimeReport = true
+		case RouteChangesIndexName:
+			routeChangesReport = true
+		case CityIndexName:
+			cityReport = true
+		}
+	}
+	return nil
+}
+
+// FlightOnTimeReport 航班号级别的准点统计，参照 DOT 航空消费者报告中的航班统计
+type FlightOnTimeReport struct {
+	Year          int    `json:"year"`
+	Month         int    `json:"month"`
+	AirCarrier    string `json:"air_carrier"`
+	FlightNumber  string `json:"flight_number"` // 航司代码 + 航班号，与 airlines 一致
+	OriginAirport string `json:"origin_airport"`
+	DestAirport   string `json:"dest_airport"`
+
+	Operations         int     `json:"operations"`          // 计划的班次数，包括取消、备降的班次
+	Arrivals           int     `json:"arrivals"`            // 正常到达（未取消、未备降）的班次数
+	OnTimeArrivals     int     `json:"on_time_arrivals"`    // 到达延误不超过 15 分钟的班次数
+	OnTimePct          float64 `json:"on_time_pct"`         // 准点率（%）= on_time_arrivals / operations，取消、备降的班次算作不准点
+	AvgArrDelay        float64 `json:"avg_arr_delay"`       // 正常到达班次的平均到达延误（分钟），提前到达为负数
+	P90ArrDelay        float64 `json:"p90_arr_delay"`       // 正常到达班次到达延误的 90 分位数（分钟），在相邻两个值之间线性插值
+	Late30Count        int     `json:"late_30_count"`       // 正常到达且到达延误超过 30 分钟的班次数
+	Late30Pct          float64 `json:"late_30_pct"`         // 延误超过 30 分钟或取消、备降的比例（%）=（late_30_count + cancelled_count + diverted_count）/ operations
+	CancelledCount     int     `json:"cancelled_count"`     // 取消的班次数
+	DivertedCount      int     `json:"diverted_count"`      // 备降的班次数
+	ChronicallyDelayed bool    `json:"chronically_delayed"` // 长期延误：运营不少于 10 班且 late_30_pct 超过 30%，与 DOT 一样取消、备降的班次算作延误
+}
+
+// 一个航班号一个月的准点统计，ES 聚合和本地计算的结果都先转换为这个结构
+type onTimeCounts struct {
+	operations, onTime, late30, cancelled, diverted int
+	delays                                          []float64 // 正常到达班次的到达延误
+}
+
+// 本地计算时加入一条记录
+func (c *onTimeCounts) add(r *common.OnTimeData) {
+	c.operations++
+	switch {
+	case r.Cancelled != 0:
+		c.cancelled++
+	case r.Diverted != 0:
+		c.diverted++
+	default:
+		c.delays = append(c.delays, float64(r.ArrDelay))
+		if r.ArrDel15 == 0 {
+			c.onTime++
+		}
+		if r.ArrDelay > 30 {
+			c.late30++
+		}
+	}
+}
+
+// arr_delay 的 terms 聚合最多返回的取值数。一个航班号一个月的班次不多，terms 只为出现过的取值建桶，实际远少于这个数
+const maxArrDelayTerms = 1000
+
+// 航班分组的子聚合，正常到达的班次单独统计延误。
+// 到达延误按取值统计班次数，由此还原每个班次的延误，平均值和 90 分位数与本地计算一样精确，不用 percentiles 的 TDigest 近似值
+func onTimeAggregations(agg *elastic.CompositeAggregation) *elastic.CompositeAggregation {
+	arrived := elastic.NewBoolQuery().Must(elastic.NewTermQuery("cancelled", 0), elastic.NewTermQuery("diverted", 0))
+	return agg.
+		SubAggregation("cancelled_count", elastic.NewFilterAggregation().Filter(elastic.NewTermQuery("cancelled", 1))).
+		SubAggregation("diverted_count", elastic.NewFilterAggregation().Filter(elastic.NewTermQuery("diverted", 1))).
+		SubAggregation("arrived", elastic.NewFilterAggregation().Filter(arrived).
+			SubAggregation("arr_delays", elastic.NewTermsAggregation().Field("arr_delay").Size(maxArrDelayTerms)).
+			SubAggregation("on_time", elastic.NewFilterAggregation().Filter(elastic.NewTermQuery("arr_del15", 0))).
+			SubAggregation("late_30", elastic.NewFilterAggregation().Filter(elastic.NewRangeQuery("arr_delay").Gt(30))))
+}
+
+// 由航班分组的子聚合得到准点统计
+func onTimeCountsOf(bucket *elastic.AggregationBucketCompositeItem) *onTimeCounts {
+	c := &onTimeCounts{operations: int(bucket.DocCount)}
+	if f, ok := bucket.Aggregations.Filter("cancelled_count"); ok {
+		c.cancelled = int(f.DocCount)
+	}
+	if f, ok := bucket.Aggregations.Filter("diverted_count"); ok {
+		c.diverted = int(f.DocCount)
+	}
+	arrived, ok := bucket.Aggregations.Filter("arrived")
+	if !ok || arrived.DocCount == 0 {
+		return c
+	}
+	if f, ok := arrived.Aggregations.Filter("on_time"); ok {
+		c.onTime = int(f.DocCount)
+	}
+	if f, ok := arrived.Aggregations.Filter("late_30"); ok {
+		c.late30 = int(f.DocCount)
+	}
+	if terms, ok := arrived.Aggregations.Terms("arr_delays"); ok {
+		for _, b := range terms.Buckets {
+			for i := int64(0); i < b.DocCount; i++ {
+				c.delays = append(c.delays, cast.ToFloat64(b.Key))
+			}
+		}
+	}
+	return c
+}
+
+// 由准点统计生成报表文档，文档ID与 airlines 相同
+func (c *onTimeCounts) report(al *Airline) *FlightOnTimeReport {
+	r := &FlightOnTimeReport{
+		Year: al.Year, Month: al.Month, AirCarrier: al.AirCarrier, FlightNumber: al.FlightNumber,
+		OriginAirport: al.OriginAirport, DestAirport: al.DestAirport,
+		Operations: c.operations, OnTimeArrivals: c.onTime, Late30Count: c.late30,
+		CancelledCount: c.cancelled, DivertedCount: c.diverted,
+	}
+	r.Arrivals = c.operations - c.cancelled - c.diverted
+	if len(c.delays) > 0 {
+		sum := 0.0
+		for _, d := range c.delays {
+			sum += d
+		}
+		sorted := append([]float64(nil), c.delays...)
+		sort.Float64s(sorted)
+		r.AvgArrDelay = sum / float64(len(c.delays))
+		r.P90ArrDelay = percentile(sorted, 90)
+	}
+	if c.operations > 0 {
+		r.OnTimePct = float64(c.onTime) / float64(c.operations) * 100
+		// 分母包括取消、备降的班次，分子也要包括，否则取消多的航班比例反而低
+		r.Late30Pct = float64(c.late30+c.cancelled+c.diverted) / float64(c.operations) * 100
+	}
+	r.ChronicallyDelayed = c.operations >= chronicMinOperations && r.Late30Pct > 30
+	return r
+}
+
+// 已排序数据的百分位数，在相邻两个值之间线性插值
+func percentile(sorted []float64, percent float64) float64 {
+	rank := percent / 100 * float64(len(sorted)-1)
+	i := int(rank)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (sorted[i+1]-sorted[i])*(rank-float64(i))
+}
+
+// 创建 flight_ontime_report 索引
+func initFlightOnTimeReportIndex() {
+	ctx := context.Background()
+	exists, err := esClient.IndexExists(FlightOnTimeReportIndexName).Do(ctx)
+	if err != nil {
+		fmt.Println("判断index是否存在失败:", err)
+		os.Exit(0)
+	}
+	if exists {
+		fmt.Println(FlightOnTimeReportIndexName, "索引已存在")
+		return
+	}
+	mapping := `{
+  "mappings": {
+    "properties": {
+      "year": {
+        "type": "short"
+      },
+      "month": {
+        "type": "short"
+      },
+      "air_carrier": {
+        "type": "keyword"
+      },
+      "flight_number": {
+        "type": "keyword"
+      },
+      "origin_airport": {
+        "type": "keyword"
+      },
+      "dest_airport": {
+        "type": "keyword"
+      },
+      "operations": {
+        "type": "integer"
+      },
+      "arrivals": {
+        "type": "integer"
+      },
+      "on_time_arrivals": {
+        "type": "integer"
+      },
+      "on_time_pct": {
+        "type": "float"
+      },
+      "avg_arr_delay": {
+        "type": "float"
+      },
+      "p90_arr_delay": {
+        "type": "float"
+      },
+      "late_30_count": {
+        "type": "integer"
+      },
+      "late_30_pct": {
+        "type": "float"
+      },
+      "cancelled_count": {
+        "type": "integer"
+      },
+      "diverted_count": {
+        "type": "integer"
+      },
+      "chronically_delayed": {
+        "type": "boolean"
+      }
+    }
+  }
+}`
+	index, err := esClient.CreateIndex(FlightOnTimeReportIndexName).BodyString(mapping).Do(ctx)
+	if err != nil {
+		fmt.Println("创建index失败:", err)
+		os.Exit(0)
+	}
+	if !index.Acknowledged {
+		fmt.Println("创建index.Acknowledged.no")
+		os.Exit(0)
+	}
+	fmt.Println("initFlightOnTimeReportIndex成功")
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+const RouteChangesIndexName = "route_changes"
+
+// 航线变化的类型
+const (
+	RouteLaunch            = "launch"             // 新开：本月运营，回看期内从未运营
+	RouteSuspension        = "suspension"         // 停航：上月运营，本月未运营
+	RouteResumption        = "resumption"         // 复航：本月运营，上月未运营，回看期内曾经运营
+	RouteFrequencyIncrease = "frequency_increase" // 加班：两个月都运营，班次增加超过阈值
+	RouteFrequencyDecrease = "frequency_decrease" // 减班：两个月都运营，班次减少超过阈值
+)
+
+// RouteChangesConfig 航线变化配置，config.json 中 route_changes 配置，不配置时使用默认值
+type RouteChangesConfig struct {
+	FrequencyChangePct float64 `json:"frequency_change_pct"` // 班次变化超过该比例（%）时记为加班、减班，默认 25
+	HistoryYears       int     `json:"history_years"`        // 判断复航和季节性航线时回看的年数，默认 2
+}
+
+func (c RouteChangesConfig) withDefaults() RouteChangesConfig {
+	if c.FrequencyChangePct <= 0 {
+		c.FrequencyChangePct = 25
+	}
+	if c.HistoryYears <= 0 {
+		c.HistoryYears = 2
+	}
+	return c
+}
+
+// RouteChange 航司在一条航线（出发、到达机场）上本月相对上月的变化，没有变化的航线不生成文档
+type RouteChange struct {
+	Year          int    `json:"year"`
+	Month         int    `json:"month"`
+	AirCarrier    string `json:"air_carrier"`
+	OriginAirport string `json:"origin_airport"`
+	DestAirport   string `json:"dest_airport"`
+
+	Change           string  `json:"change"`                   // launch、suspension、resumption、frequency_increase、frequency_decrease
+	Flights          int     `json:"flights"`                  // 本月计划的班次数，包括取消、备降的班次
+	PrevFlights      int     `json:"prev_flights"`             // 上月计划的班次数
+	FlightsChangePct float64 `json:"flights_change_pct"`       // 班次变化（%）= (flights - prev_flights) / prev_flights，只在加班、减班时计算，其他为 0
+	LastServed       string  `json:"last_served,omitempty"`    // 复航时，上月之前最后运营的月份，如 2019-08
+	Seasonal         bool    `json:"seasonal"`                 // 往年同月出现过同样的新开/复航或停航，为季节性航线
+	SeasonalYears    []int   `json:"seasonal_years,omitempty"` // 出现同样变化的往年，从近到远
+}
+
+// 航司的一条航线
+type routeKey struct {
+	carrier, origin, dest string
+}
+
+// 回看期内各航线每月的班次数，月份用 monthIndex 表示
+type routeHistory struct {
+	flights map[routeKey]map[int]int
+	months  map[int]bool // 有数据的月份，没有数据的月份不能判断是否运营
+}
+
+func newRouteHistory() *routeHistory {
+	return &routeHistory{flights: map[routeKey]map[int]int{}, months: map[int]bool{}}
+}
+
+func monthIndex(year, month int) int {
+	return year*12 + month - 1
+}
+
+func (h *routeHistory) add(k routeKey, year, month, flights int) {
+	m := monthIndex(year, month)
+	if h.flights[k] == nil {
+		h.flights[k] = map[int]int{}
+	}
+	h.flights[k][m] += flights
+	h.months[m] = true
+}
+
+// 本月往前回看 years 年，另加一个月，用于判断往年同月的变化
+func routeWindow(d Date, years int) (first, last Date) {
+	m := monthIndex(d.Year, d.Month) - years*12 - 1
+	return Date{Year: m / 12, Month: m%12 + 1}, d
+}
+
+// 对比本月和上月，生成有变化的航线
+func (h *routeHistory) changes(d Date, cfg RouteChangesConfig) []*RouteChange {
+	var res []*RouteChange
+	for k, flights := range h.flights {
+		if c := classifyRoute(k, d, flights, h.months, cfg); c != nil {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.OriginAirport != b.OriginAirport {
+			return a.OriginAirport < b.OriginAirport
+		}
+		if a.DestAirport != b.DestAirport {
+			return a.DestAirport < b.DestAirport
+		}
+		return a.AirCarrier < b.AirCarrier
+	})
+	return res
+}
+
+// 判断一条航线本月的变化，没有变化时返回 nil
+func classifyRoute(k routeKey, d Date, flights map[int]int, months map[int]bool, cfg RouteChangesConfig) *RouteChange {
+	cur := monthIndex(d.Year, d.Month)
+	n, prev := flights[cur], flights[cur-1]
+	c := &RouteChange{Year: d.Year, Month: d.Month, AirCarrier: k.carrier, OriginAirport: k.origin, DestAirport: k.dest,
+		Flights: n, PrevFlights: prev}
+	switch {
+	case n > 0 && prev == 0:
+		c.Change = RouteLaunch
+		for m := cur - 2; m >= cur-cfg.HistoryYears*12-1; m-- {
+			if flights[m] > 0 {
+				c.Change = RouteResumption
+				c.LastServed = fmt.Sprintf("%d-%02d", m/12, m%12+1)
+				break
+			}
+		}
+	case n == 0 && prev > 0:
+		c.Change = RouteSuspension
+	case n > 0 && prev > 0:
+		c.FlightsChangePct = float64(n-prev) / float64(prev) * 100
+		if math.Abs(c.FlightsChangePct) < cfg.FrequencyChangePct {
+			return nil
+		}
+		c.Change = RouteFrequencyIncrease
+		if n < prev {
+			c.Change = RouteFrequencyDecrease
+		}
+		return c
+	default:
+		return nil
+	}
+	// 往年同月有数据，且同样从上月的运营/未运营变为本月的运营/未运营
+	for y := 1; y <= cfg.HistoryYears; y++ {
+		m := cur - y*12
+		if !months[m] || !months[m-1] {
+			continue
+		}
+		if (flights[m] > 0) == (n > 0) && (flights[m-1] > 0) == (prev > 0) {
+			c.SeasonalYears = append(c.SeasonalYears, d.Year-y)
+		}
+	}
+	c.Seasonal = len(c.SeasonalYears) > 0
+	return c
+}
+
+// 文档ID：年_月_出发_到达_航司
+func (c *RouteChange) id() string {
+	return fmt.Sprintf("%d_%d_%s_%s_%s", c.Year, c.Month, c.OriginAirport, c.DestAirport, c.AirCarrier)
+}
+
+// 从 on_time_data 按 航司、出发、到达、年、月 聚合回看期内各月的班次数，生成本月的航线变化
+func queryRouteChanges(d Date) {
+	cfg := config.RouteChanges.withDefaults()
+	first, last := routeWindow(d, cfg.HistoryYears)
+	months := elastic.NewBoolQuery()
+	for y := first.Year; y <= last.Year; y++ {
+		lo, hi := 1, 12
+		if y == first.Year {
+			lo = first.Month
+		}
+		if y == last.Year {
+			hi = last.Month
+		}
+		months.Should(elastic.NewBoolQuery().Must(elastic.NewTermQuery("year", y), elastic.NewRangeQuery("month").Gte(lo).Lte(hi)))
+	}
+	scan := common.CompositeScan{Client: esClient, Index: OnTimeDataIndexName, Query: elastic.NewBoolQuery().Filter(months), Name: "route_months", Field: "iata_code_reporting_airline",
+		NewAgg: func() *elastic.CompositeAggregation {
+			return elastic.NewCompositeAggregation().Size(10000).Sources(
+				elastic.NewCompositeAggregationTermsValuesSource("carrier").Field("iata_code_reporting_airline"),
+				elastic.NewCompositeAggregationTermsValuesSource("origin").Field("origin"),
+				elastic.NewCompositeAggregationTermsValuesSource("dest").Field("dest"),
+				elastic.NewCompositeAggregationTermsValuesSource("year").Field("year"),
+				elastic.NewCompositeAggregationTermsValuesSource("month").Field("month"))
+		}}
+	h := newRouteHistory()
+	err := scan.Run(config.Parallel, func(bucket *elastic.AggregationBucketCompositeItem) {
+		k := routeKey{cast.ToString(bucket.Key["carrier"]), cast.ToString(bucket.Key["origin"]), cast.ToString(bucket.Key["dest"])}
+		h.add(k, cast.ToInt(bucket.Key["year"]), cast.ToInt(bucket.Key["month"]), int(bucket.DocCount))
+	})
+	if err != nil {
+		panic(err)
+	}
+	writeRouteChanges(d, h, cfg)
+}
+
+// 本地计算：从 routeMonths 取回看期内各月的班次数，缺少数据文件的月份跳过
+func localRouteChanges(d Date) {
+	cfg := config.RouteChanges.withDefaults()
+	first, last := routeWindow(d, cfg.HistoryYears)
+	h := newRouteHistory()
+	for m := monthIndex(first.Year, first.Month); m <= monthIndex(last.Year, last.Month); m++ {
+		for k, n := range routeMonths.get(m) {
+			h.add(k, m/12, m%12+1, n)
+		}
+	}
+	routeMonths.release(d)
+	writeRouteChanges(d, h, cfg)
+}
+
+// 本地计算时各月的航线班次数。相邻月份的回看期几乎完全重叠，每月的数据文件只读取一次，
+// 配置的月份中不再需要的月份随即释放，内存中最多保留并发处理的各期回看期内的月份
+var routeMonths *routeMonthCache
+
+type routeMonthCache struct {
+	mu     sync.Mutex
+	years  int
+	months map[int]*routeMonth
+	refs   map[int]int // 配置的月份中还没有处理、回看期包含该月的期数
+	reads  int         // 读取的数据文件的月数
+}
+
+type routeMonth struct {
+	once    sync.Once
+	flights map[routeKey]int // 没有数据文件时为 nil
+	err     error            // 读取失败时用到该月的期都失败
+}
+
+// 按配置的月份和回看年数统计各月被多少期用到
+func newRouteMonthCache(dates []Date, years int) *routeMonthCache {
+	c := &routeMonthCache{years: years, months: map[int]*routeMonth{}, refs: map[int]int{}}
+	for _, d := range dates {
+		c.window(d, func(m int) { c.refs[m]++ })
+	}
+	return c
+}
+
+func (c *routeMonthCache) window(d Date, fn func(m int)) {
+	first, last := routeWindow(d, c.years)
+	for m := monthIndex(first.Year, first.Month); m <= monthIndex(last.Year, last.Month); m++ {
+		fn(m)
+	}
+}
+
+// 一个月的航线班次数，第一次用到时读取数据文件，同时用到的期等待读取完成
+func (c *routeMonthCache) get(m int) map[routeKey]int {
+	c.mu.Lock()
+	rm, ok := c.months[m]
+	if !ok {
+		rm = &routeMonth{}
+		c.months[m] = rm
+	}
+	c.mu.Unlock()
+	rm.once.Do(func() {
+		year, month := m/12, m%12+1
+		names := common.OnTimeFileNames(year, month)
+		if !localFileExists(config.Local.DataDir, names) {
+			return
+		}
+		flights := map[routeKey]int{}
+		err := common.ReadLocalCsv(config.Local.DataDir, names, func(header map[string]int, record []string) error {
+			r := common.ParseOnTimeRecord(record)
+			if r.Year != year || r.Month != month {
+				return nil
+			}
+			flights[routeKey{r.IATACodeReportingAirline, r.Origin, r.Dest}]++
+			return nil
+		})
+		if err != nil {
+			rm.err = err
+			return
+		}
+		rm.flights = flights
+		c.mu.Lock()
+		c.reads++
+		c.mu.Unlock()
+	})
+	if rm.err != nil {
+		panic(rm.err)
+	}
+	return rm.flights
+}
+
+// d 处理完成，释放不再有期用到的月份。不在配置中的月份（如测试中单独调用）用到的月份也随即释放
+func (c *routeMonthCache) release(d Date) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window(d, func(m int) {
+		c.refs[m]--
+		if c.refs[m] <= 0 {
+			delete(c.refs, m)
+			delete(c.months, m)
+		}
+	})
+}
+
+func localFileExists(dir string, names []string) bool {
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func writeRouteChanges(d Date, h *routeHistory, cfg RouteChangesConfig) {
+	// 本月或上月没有数据时所有航线都会被当作新开或停航
+	if cur := monthIndex(d.Year, d.Month); !h.months[cur] || !h.months[cur-1] {
+		fmt.Println(d.Year, d.Month, "本月或上月没有数据，不生成航线变化")
+		return
+	}
+	changes := h.changes(d, cfg)
+	for _, c := range changes {
+		if err := out.Write(RouteChangesIndexName, c.id(), c); err != nil {
+			panic(err)
+		}
+	}
+	out.FlushPeriod(d.Year, d.Month)
+	fmt.Println(d.Year, d.Month, "航线变化数量", len(changes))
+}
+
+// 创建 route_changes 索引
+func initRouteChangesIndex() {
+	ctx := context.Background()
+	exists, err := esClient.IndexExists(RouteChangesIndexName).Do(ctx)
+	if err != nil {
+		fmt.Println("判断index是否存在失败:", err)
+		os.Exit(0)
+	}
+	if exists {
+		fmt.Println(RouteChangesIndexName, "索引已存在")
+		return
+	}
+	mapping := `{
+  "mappings": {
+    "properties": {
+      "year": {
+        "type": "short"
+      },
+      "month": {
+        "type": "short"
+      },
+      "air_carrier": {
+        "type": "keyword"
+      },
+      "origin_airport": {
+        "type": "keyword"
+      },
+      "dest_airport": {
+        "type": "keyword"
+      },
+      "change": {
+        "type": "keyword"
+      },
+      "flights": {
+        "type": "integer"
+      },
+      "prev_flights": {
+        "type": "integer"
+      },
+      "flights_change_pct": {
+        "type": "float"
+      },
+      "last_served": {
+        "type": "keyword"
+      },
+      "seasonal": {
+        "type": "boolean"
+      },
+      "seasonal_years": {
+        "type": "short"
+      }
+    }
+  }
+}`
+	index, err := esClient.CreateIndex(RouteChangesIndexName).BodyString(mapping).Do(ctx)
+	if err != nil {
+		fmt.Println("创建index失败:", err)
+		os.Exit(0)
+	}
+	if !index.Acknowledged {
+		fmt.Println("创建index.Acknowledged.no")
+		os.Exit(0)
+	}
+	fmt.Println("initRouteChangesIndex成功")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+// 一个航班号一个月的时刻统计，ES 聚合和本地计算的结果都先转换为这个结构，再写入 Airline
+type scheduleCounts struct {
+	dates    map[string]int // 运营日（未取消）→ 班次数
+	tails    map[string]int // 运营的机尾号 → 班次数
+	depTimes map[int]int    // 计划起飞时刻 → 班次数，包括取消的班次
+	arrTimes map[int]int    // 计划到达时刻 → 班次数
+	blocks   map[int]int    // 计划轮挡时间（分钟）→ 班次数
+}
+
+func newScheduleCounts() *scheduleCounts {
+	return &scheduleCounts{dates: map[string]int{}, tails: map[string]int{},
+		depTimes: map[int]int{}, arrTimes: map[int]int{}, blocks: map[int]int{}}
+}
+
+// 本地计算时加入一条记录
+func (s *scheduleCounts) add(r *common.OnTimeData) {
+	s.depTimes[r.CrsDepTime]++
+	s.arrTimes[r.CrsArrTime]++
+	s.blocks[r.CrsElapsedTime]++
+	if r.Cancelled != 0 {
+		return
+	}
+	s.dates[r.FlightDate]++
+	if r.TailNumber != "" {
+		s.tails[r.TailNumber]++
+	}
+}
+
+// 航班分组的子聚合：计划时刻、轮挡时间取班次最多的一个，运营日和机尾号只统计未取消的班次
+func scheduleAggregations(agg *elastic.CompositeAggregation) *elastic.CompositeAggregation {
+	return agg.
+		SubAggregation("crs_dep_time", elastic.NewTermsAggregation().Field("crs_dep_time").Size(1)).
+		SubAggregation("crs_arr_time", elastic.NewTermsAggregation().Field("crs_arr_time").Size(1)).
+		SubAggregation("crs_elapsed_time", elastic.NewTermsAggregation().Field("crs_elapsed_time").Size(1)).
+		SubAggregation("operated", elastic.NewFilterAggregation().Filter(elastic.NewTermQuery("cancelled", 0)).
+			SubAggregation("dates", elastic.NewTermsAggregation().Field("flight_date").Size(31)).
+			SubAggregation("tails", elastic.NewTermsAggregation().Field("tail_number").Size(1000)))
+}
+
+// 由航班分组的子聚合得到时刻统计
+func scheduleCountsOf(bucket *elastic.AggregationBucketCompositeItem) *scheduleCounts {
+	s := newScheduleCounts()
+	addTerms := func(aggs elastic.Aggregations, name string, fn func(key interface{}, count int)) {
+		if terms, ok := aggs.Terms(name); ok {
+			for _, b := range terms.Buckets {
+				fn(b.Key, int(b.DocCount))
+			}
+		}
+	}
+	addTerms(bucket.Aggregations, "crs_dep_time", func(k interface{}, n int) { s.depTimes[cast.ToInt(k)] += n })
+	addTerms(bucket.Aggregations, "crs_arr_time", func(k interface{}, n int) { s.arrTimes[cast.ToInt(k)] += n })
+	addTerms(bucket.Aggregations, "crs_elapsed_time", func(k interface{}, n int) { s.blocks[cast.ToInt(k)] += n })
+	if operated, ok := bucket.Aggregations.Filter("operated"); ok {
+		addTerms(operated.Aggregations, "dates", func(k interface{}, n int) { s.dates[cast.ToString(k)] += n })
+		addTerms(operated.Aggregations, "tails", func(k interface{}, n int) {
+			if tail := cast.ToString(k); tail != "" {
+				s.tails[tail] += n
+			}
+		})
+	}
+	return s
+}
+
+// 写入航班的时刻表字段
+func (s *scheduleCounts) apply(al *Airline) {
+	al.CrsDepTime = modeOf(s.depTimes)
+	al.CrsArrTime = modeOf(s.arrTimes)
+	al.CrsBlockMinutes = modeOf(s.blocks)
+
+	dates := make([]string, 0, len(s.dates))
+	weekdays := map[int]bool{}
+	al.Operations = 0
+	for date, n := range s.dates {
+		dates = append(dates, date)
+		al.Operations += n
+		if t, err := time.Parse("2006-01-02", date); err == nil {
+			weekdays[isoWeekday(t)] = true
+		}
+	}
+	sort.Strings(dates)
+	if len(dates) > 0 {
+		al.FirstDate, al.LastDate = dates[0], dates[len(dates)-1]
+	}
+	al.DaysOfWeek = []int{}
+	for d := 1; d <= 7; d++ {
+		if weekdays[d] {
+			al.DaysOfWeek = append(al.DaysOfWeek, d)
+		}
+	}
+	al.TailNumbers = make([]string, 0, len(s.tails))
+	for tail := range s.tails {
+		al.TailNumbers = append(al.TailNumbers, tail)
+	}
+	sort.Strings(al.TailNumbers)
+}
+
+// 班次最多的取值，班次相同时取较小的值，与 ES terms 聚合的排序一致
+func modeOf(counts map[int]int) int {
+	mode, best := 0, 0
+	for v, n := range counts {
+		if n > best || (n == best && v < mode) {
+			mode, best = v, n
+		}
+	}
+	return mode
+}
+
+// 星期一为 1，星期日为 7，与 on_time_data 的 dayof_week 一致
+func isoWeekday(t time.Time) int {
+	if t.Weekday() == time.Sunday {
+		return 7
+	}
+	return int(t.Weekday())
+}
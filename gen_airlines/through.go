@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+// 航段：航班号在某天用某架飞机执行的一段
+type flightLeg struct {
+	origin, dest string
+	depTime      int // 计划起飞时刻，同一天的航段按此排序
+}
+
+// 同一航班号、同一天、同一机尾号的航段属于同一次运营
+type legGroupKey struct {
+	carrier, flightNumber, date, tail string
+}
+
+// 航班文档的 key，与 airlines 的文档ID对应
+type segmentKey struct {
+	origin, dest, carrier, flightNumber string
+}
+
+// 经停航线及航段在其中的位置
+type throughRouting struct {
+	Routing string // 完整的经停航线，如 ORD-DEN-SFO
+	Seq     int    // 航段序号，从 1 开始
+	Legs    int    // 航段数
+}
+
+// 一个月的经停航班：航段 → 各经停航线运营的天数
+type throughFlights map[segmentKey]map[throughRouting]int
+
+// 收集一个月各次运营的航段，全部加入后调用 build
+type throughBuilder map[legGroupKey][]flightLeg
+
+// 取消的航班和没有机尾号的记录无法确定是否同一架飞机，不参与识别
+func (b throughBuilder) add(carrier, flightNumber, date, tail string, depTime int, origin, dest string) {
+	if tail == "" {
+		return
+	}
+	k := legGroupKey{carrier, flightNumber, date, tail}
+	b[k] = append(b[k], flightLeg{origin: origin, dest: dest, depTime: depTime})
+}
+
+// 每次运营的航段按计划起飞时刻排序，前一段的到达机场为后一段的出发机场时连成经停航线
+func (b throughBuilder) build() throughFlights {
+	res := throughFlights{}
+	for k, legs := range b {
+		sort.Slice(legs, func(i, j int) bool {
+			if legs[i].depTime != legs[j].depTime {
+				return legs[i].depTime < legs[j].depTime
+			}
+			if legs[i].origin != legs[j].origin {
+				return legs[i].origin < legs[j].origin
+			}
+			return legs[i].dest < legs[j].dest
+		})
+		start := 0
+		for i := 1; i <= len(legs); i++ {
+			if i < len(legs) && legs[i].origin == legs[i-1].dest {
+				continue
+			}
+			res.addChain(k, legs[start:i])
+			start = i
+		}
+	}
+	return res
+}
+
+func (t throughFlights) addChain(k legGroupKey, chain []flightLeg) {
+	if len(chain) < 2 {
+		return
+	}
+	airports := []string{chain[0].origin}
+	for _, leg := range chain {
+		airports = append(airports, leg.dest)
+	}
+	routing := strings.Join(airports, "-")
+	for i, leg := range chain {
+		seg := segmentKey{leg.origin, leg.dest, k.carrier, k.flightNumber}
+		if t[seg] == nil {
+			t[seg] = map[throughRouting]int{}
+		}
+		t[seg][throughRouting{Routing: routing, Seq: i + 1, Legs: len(chain)}]++
+	}
+}
+
+// 航段运营天数最多的经停航线，天数相同时取航线较小的一个；不是经停航班时返回 false
+func (t throughFlights) get(k segmentKey) (throughRouting, int, bool) {
+	var best throughRouting
+	days := 0
+	for r, n := range t[k] {
+		if n > days || (n == days && (r.Routing < best.Routing || (r.Routing == best.Routing && r.Seq < best.Seq))) {
+			best, days = r, n
+		}
+	}
+	return best, days, days > 0
+}
+
+// 写入航班的经停信息
+func (t throughFlights) apply(k segmentKey, al *Airline) {
+	if r, days, ok := t.get(k); ok {
+		al.ThroughRouting, al.LegSequence, al.LegCount, al.ThroughDays = r.Routing, r.Seq, r.Legs, days
+	}
+}
+
+// 从 on_time_data 按 航司、航班号、日期、机尾号、计划起飞时刻、出发、到达 聚合，每个分组为一个航段，
+// 在生成航班前识别该月的经停航班
+func loadThroughFlights(d Date) throughFlights {
+	query := elastic.NewBoolQuery().Must(
+		elastic.NewTermQuery("year", d.Year),
+		elastic.NewTermQuery("month", d.Month),
+		elastic.NewTermQuery("cancelled", 0))
+	scan := common.CompositeScan{Client: esClient, Index: OnTimeDataIndexName, Query: query, Name: "flight_legs", Field: "iata_code_reporting_airline",
+		NewAgg: func() *elastic.CompositeAggregation {
+			return elastic.NewCompositeAggregation().Size(10000).Sources(
+				elastic.NewCompositeAggregationTermsValuesSource("carrier").Field("iata_code_reporting_airline"),
+				elastic.NewCompositeAggregationTermsValuesSource("flight_number").Field("flight_number_reporting_airline"),
+				elastic.NewCompositeAggregationTermsValuesSource("date").Field("flight_date"),
+				elastic.NewCompositeAggregationTermsValuesSource("tail").Field("tail_number"),
+				elastic.NewCompositeAggregationTermsValuesSource("dep_time").Field("crs_dep_time"),
+				elastic.NewCompositeAggregationTermsValuesSource("origin").Field("origin"),
+				elastic.NewCompositeAggregationTermsValuesSource("dest").Field("dest"))
+		}}
+	b := throughBuilder{}
+	err := scan.Run(config.Parallel, func(bucket *elastic.AggregationBucketCompositeItem) {
+		b.add(cast.ToString(bucket.Key["carrier"]), cast.ToString(bucket.Key["flight_number"]), cast.ToString(bucket.Key["date"]),
+			cast.ToString(bucket.Key["tail"]), cast.ToInt(bucket.Key["dep_time"]), cast.ToString(bucket.Key["origin"]), cast.ToString(bucket.Key["dest"]))
+	})
+	if err != nil {
+		panic(err)
+	}
+	t := b.build()
+	fmt.Println(d.Year, d.Month, "识别经停航段完成:", len(t))
+	return t
+}
+
+// 本地计算时由每条记录加入航段
+func (b throughBuilder) addOnTime(r *common.OnTimeData) {
+	if r.Cancelled != 0 {
+		return
+	}
+	b.add(r.IATACodeReportingAirline, r.FlightNumberReportingAirline, r.FlightDate, r.TailNumber, r.CrsDepTime, r.Origin, r.Dest)
+}
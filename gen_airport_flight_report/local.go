@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+type airportReportKey struct {
+	carrier, airport string
+}
+
+// 本地计算出发、到达机场延误报表，一次读取文件同时生成两个报表
+func localAirportDelays(d Date) {
+	origins := map[airportReportKey]*OntimeAirportFlightReport{}
+	dests := map[airportReportKey]*OntimeAirportFlightReport{}
+	err := common.ReadLocalCsv(config.Local.DataDir, common.OnTimeFileNames(d.Year, d.Month), func(header map[string]int, record []string) error {
+		r := common.ParseOnTimeRecord(record)
+		if r.Year != d.Year || r.Month != d.Month {
+			return nil
+		}
+		countDelays(origins, airportReportKey{r.ReportingAirline, r.Origin}, r)
+		countDelays(dests, airportReportKey{r.ReportingAirline, r.Dest}, r)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	writeLocalReports(d, OriginAirportFlightReportIndexName, origins)
+	writeLocalReports(d, DestAirportFlightReportIndexName, dests)
+	fmt.Println("最后originDelayCount:", len(origins))
+	fmt.Println("最后DestDelayCount:", len(dests))
+}
+
+// 统计口径与聚合查询中的各个 filter 子聚合一致
+func countDelays(reports map[airportReportKey]*OntimeAirportFlightReport, k airportReportKey, d *common.OnTimeData) {
+	r, ok := reports[k]
+	if !ok {
+		r = &OntimeAirportFlightReport{Airport: k.airport, AirCarrier: k.carrier, Year: int64(d.Year), Month: int64(d.Month)}
+		reports[k] = r
+	}
+	r.FlightCount++
+	if d.Cancelled == 1 {
+		r.CancelledCount++
+	}
+	if d.Cancelled != 0 {
+		return
+	}
+	if d.DepDelay < 0 {
+		r.EarlyDepartureCount++
+	}
+	if d.DepDelay > 0 {
+		r.DelayedDepartureCount++
+	}
+	if d.DepDel15 == 1 {
+		r.Delayed15DepartureCount++
+	}
+	if d.ArrDelay < 0 {
+		r.EarlyArrivalCount++
+	}
+	if d.ArrDelay > 0 {
+		r.DelayedArrivalCount++
+	}
+	if d.ArrDel15 == 1 {
+		r.Delayed15ArrivalCount++
+	}
+}
+
+func writeLocalReports(d Date, index string, reports map[airportReportKey]*OntimeAirportFlightReport) {
+	keys := make([]airportReportKey, 0, len(reports))
+	for k := range reports {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].carrier != keys[j].carrier {
+			return keys[i].carrier < keys[j].carrier
+		}
+		return keys[i].airport < keys[j].airport
+	})
+	for _, k := range keys {
+		r := reports[k]
+		r.setLocation(index)
+		id := strings.Join([]string{cast.ToString(r.Year), cast.ToString(r.Month), r.AirCarrier, r.Airport}, "_")
+		if err := out.Write(index, id, r); err != nil {
+			panic(err)
+		}
+	}
+	out.FlushPeriod(d.Year, d.Month)
+}
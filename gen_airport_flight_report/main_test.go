@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"common"
+	"common/fakees"
+)
+
+// 用 testdata 下的 BTS 数据准备 on_time_data 索引
+func seedFakeES(t *testing.T) *fakees.ES {
+	es := fakees.New(t)
+	err := common.ReadLocalCsv("testdata", common.OnTimeFileNames(2020, 1), func(header map[string]int, record []string) error {
+		es.Seed(OnTimeDataIndexName, "", common.ParseOnTimeRecord(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+// 设置全局的 ES 客户端和输出，测试结束后还原
+func useFakeES(t *testing.T, es *fakees.ES, c Config) {
+	oldClient, oldOut, oldConfig := esClient, out, config
+	t.Cleanup(func() {
+		esClient, out, config = oldClient, oldOut, oldConfig
+	})
+	esClient = es.Client()
+	config = c
+	common.ReadAirportMaster()
+	sinks, err := common.NewSinks(nil, esClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = common.NewCountingSink(sinks)
+}
+
+// airports.csv 中的机场坐标
+var (
+	jfk = &common.GeoPoint{Lat: 40.6398, Lon: -73.7789}
+	lax = &common.GeoPoint{Lat: 33.9425, Lon: -118.4081}
+	ord = &common.GeoPoint{Lat: 41.9786, Lon: -87.9048}
+	ewr = &common.GeoPoint{Lat: 40.6925, Lon: -74.1687}
+	sju = &common.GeoPoint{Lat: 18.4394, Lon: -66.0018}
+)
+
+var wantOriginReports = map[string]interface{}{
+	"2020_1_AA_JFK": OntimeAirportFlightReport{Airport: "JFK", AirCarrier: "AA", Year: 2020, Month: 1, FlightCount: 3,
+		EarlyDepartureCount: 1, DelayedDepartureCount: 1, Delayed15DepartureCount: 1,
+		EarlyArrivalCount: 1, DelayedArrivalCount: 1, Delayed15ArrivalCount: 1, CancelledCount: 1, OriginLocation: jfk},
+	"2020_1_AA_LAX": OntimeAirportFlightReport{Airport: "LAX", AirCarrier: "AA", Year: 2020, Month: 1, FlightCount: 2,
+		DelayedDepartureCount: 1, Delayed15DepartureCount: 1,
+		DelayedArrivalCount: 2, Delayed15ArrivalCount: 1, OriginLocation: lax},
+	"2020_1_DL_JFK": OntimeAirportFlightReport{Airport: "JFK", AirCarrier: "DL", Year: 2020, Month: 1, FlightCount: 1,
+		DelayedDepartureCount: 1, OriginLocation: jfk},
+	"2020_1_DL_ORD": OntimeAirportFlightReport{Airport: "ORD", AirCarrier: "DL", Year: 2020, Month: 1, FlightCount: 3,
+		EarlyDepartureCount: 1, DelayedDepartureCount: 1, Delayed15DepartureCount: 1,
+		EarlyArrivalCount: 1, DelayedArrivalCount: 1, CancelledCount: 1, OriginLocation: ord},
+	"2020_1_UA_EWR": OntimeAirportFlightReport{Airport: "EWR", AirCarrier: "UA", Year: 2020, Month: 1, FlightCount: 2,
+		EarlyArrivalCount: 1, CancelledCount: 1, OriginLocation: ewr},
+}
+
+var wantDestReports = map[string]interface{}{
+	"2020_1_AA_LAX": OntimeAirportFlightReport{Airport: "LAX", AirCarrier: "AA", Year: 2020, Month: 1, FlightCount: 3,
+		EarlyDepartureCount: 1, DelayedDepartureCount: 1, Delayed15DepartureCount: 1,
+		EarlyArrivalCount: 1, DelayedArrivalCount: 1, Delayed15ArrivalCount: 1, CancelledCount: 1, DestLocation: lax},
+	"2020_1_AA_ORD": OntimeAirportFlightReport{Airport: "ORD", AirCarrier: "AA", Year: 2020, Month: 1, FlightCount: 2,
+		DelayedDepartureCount: 1, Delayed15DepartureCount: 1,
+		DelayedArrivalCount: 2, Delayed15ArrivalCount: 1, DestLocation: ord},
+	"2020_1_DL_JFK": OntimeAirportFlightReport{Airport: "JFK", AirCarrier: "DL", Year: 2020, Month: 1, FlightCount: 3,
+		EarlyDepartureCount: 1, DelayedDepartureCount: 1, Delayed15DepartureCount: 1,
+		EarlyArrivalCount: 1, DelayedArrivalCount: 1, CancelledCount: 1, DestLocation: jfk},
+	"2020_1_DL_SJU": OntimeAirportFlightReport{Airport: "SJU", AirCarrier: "DL", Year: 2020, Month: 1, FlightCount: 1,
+		DelayedDepartureCount: 1, DestLocation: sju},
+	"2020_1_UA_ORD": OntimeAirportFlightReport{Airport: "ORD", AirCarrier: "UA", Year: 2020, Month: 1, FlightCount: 2,
+		EarlyArrivalCount: 1, CancelledCount: 1, DestLocation: ord},
+}
+
+func TestQueryAirportDelays(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}})
+
+	initOriginReportsIndex()
+	initDestReportsIndex()
+	queryOriginDelays(Date{2020, 1})
+	queryDestDelays(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es.AssertDocs(OriginAirportFlightReportIndexName, wantOriginReports)
+	es.AssertDocs(DestAirportFlightReportIndexName, wantDestReports)
+}
+
+// 本地计算模式与ES聚合的结果一致
+func TestLocalAirportDelays(t *testing.T) {
+	es := fakees.New(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}, Local: &common.LocalConfig{DataDir: "testdata"}})
+
+	localAirportDelays(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es.AssertDocs(OriginAirportFlightReportIndexName, wantOriginReports)
+	es.AssertDocs(DestAirportFlightReportIndexName, wantDestReports)
+}
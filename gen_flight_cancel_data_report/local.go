@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+// 本地计算航班取消报表，统计口径与 queryFlightCancelDataReport 的 filter 子聚合一致
+func localFlightCancelDataReport(d Date) {
+	type cancelKey struct {
+		carrier, tailNumber string
+	}
+	reports := map[cancelKey]*FlightCancelDataReport{}
+	err := common.ReadLocalCsv(config.Local.DataDir, common.OnTimeFileNames(d.Year, d.Month), func(header map[string]int, record []string) error {
+		o := common.ParseOnTimeRecord(record)
+		if o.Year != d.Year || o.Month != d.Month {
+			return nil
+		}
+		k := cancelKey{o.ReportingAirline, o.TailNumber}
+		r, ok := reports[k]
+		if !ok {
+			r = &FlightCancelDataReport{Year: int16(o.Year), Month: int16(o.Month), AirCarrier: k.carrier, TailNumber: k.tailNumber}
+			reports[k] = r
+		}
+		r.FlightCount++
+		if o.Cancelled != 1 {
+			return nil
+		}
+		switch o.CancellationCode {
+		case "A":
+			r.CancelledCarrierCount++
+		case "B":
+			r.CancelledWeatherCount++
+		case "C":
+			r.CancelledNationalAirSystemCount++
+		case "D":
+			r.CancelledSecurityCount++
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	keys := make([]cancelKey, 0, len(reports))
+	for k := range reports {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].carrier != keys[j].carrier {
+			return keys[i].carrier < keys[j].carrier
+		}
+		return keys[i].tailNumber < keys[j].tailNumber
+	})
+	for _, k := range keys {
+		r := reports[k]
+		id := strings.Join([]string{cast.ToString(r.Year), cast.ToString(r.Month), r.AirCarrier, r.TailNumber}, "_")
+		if err = out.Write(FlightCancelDataReportIndexName, id, r); err != nil {
+			panic(err)
+		}
+	}
+	out.FlushPeriod(d.Year, d.Month)
+	fmt.Println("最后cancelDataCount:", len(reports))
+}
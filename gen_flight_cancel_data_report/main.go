@@ -6,59 +6,120 @@ import (
 	"fmt"
 	"github.com/olivere/elastic/v7"
 	"github.com/spf13/cast"
-	"log"
 	"os"
-	"runtime"
 	"strings"
 	"time"
+
+	"common"
 )
 
 const (
-	ESUrl       = "http://127.0.0.1:9200/"
-	bulkActions = 1000
-
+	ESUrl                           = "http://127.0.0.1:9200/"
 	OnTimeDataIndexName             = "on_time_data"
 	FlightCancelDataReportIndexName = "flight_cancel_data_report"
 )
 
 var (
-	dates        = []Date{}
-	actualNumCPU = runtime.GOMAXPROCS(0)
-	esClient     *elastic.Client
+	config   = Config{}
+	esClient *elastic.Client
+	out      *common.CountingSink
 )
 
+type Config struct {
+	Dates []Date              `json:"dates"`
+	Sinks []common.SinkConfig `json:"sinks"`
+	Local *common.LocalConfig `json:"local"` // 本地计算模式，不配置时从ES聚合
+
+	Concurrency common.ConcurrencyConfig `json:"concurrency"` // 同时处理多个月，不配置时逐月处理
+	Bulk        common.BulkConfig        `json:"bulk"`        // ES 批量写入的批大小和重试，不配置时使用默认值
+
+	Compare []common.CompareConfig `json:"compare"` // 需要计算环比、同比的索引，默认不计算
+}
+
+// 计算环比、同比的索引
+var compareConfigs []common.CompareConfig
+
+// 各索引默认的 key 和比较字段，config.json 的 compare 中只配置 index 时使用
+var compareDefaults = []common.CompareConfig{
+	{Index: FlightCancelDataReportIndexName, Period: "month", Keys: []string{"air_carrier", "tail_number"},
+		Fields: []string{"flight_count", "cancelled_carrier_count", "cancelled_weather_count", "cancelled_national_air_system_count", "cancelled_security_count"}},
+}
+
 func main() {
-	dates = getDateConfig()
-	if dates == nil {
+	c := getDateConfig()
+	if c == nil || len(c.Dates) == 0 {
+		os.Exit(0)
+	}
+	config = *c
+	fmt.Println("待处理数据时间为:", config.Dates)
+	var err error
+	compareConfigs, err = common.ResolveCompareConfigs(config.Compare, compareDefaults)
+	if err == nil {
+		err = common.CheckCompareSinks(compareConfigs, config.Sinks)
+	}
+	if err != nil {
+		fmt.Println("配置文件错误:", err)
 		os.Exit(0)
 	}
-	fmt.Println("待处理数据时间为:", dates)
-	connectES()
-	initFlightCancelDataReportIndex()
+	if config.Local == nil || common.HasEsSink(config.Sinks) {
+		connectES()
+	}
+	if common.HasEsSink(config.Sinks) {
+		initFlightCancelDataReportIndex()
+	}
+	common.EsWriteWorkers = config.Concurrency.EsWrite
+	common.Bulk = config.Bulk
+	sinks, err := common.NewSinks(config.Sinks, esClient)
+	if err != nil {
+		fmt.Println("创建输出失败:", err)
+		os.Exit(0)
+	}
+	out = common.NewCountingSink(sinks)
+	defer out.Close()
 
 	start := time.Now().Unix()
-	for _, d := range dates {
-		queryFlightCancelDataReport(d)
+	periods := make([]string, len(config.Dates))
+	for i, d := range config.Dates {
+		periods[i] = fmt.Sprintf("%d-%d", d.Year, d.Month)
+	}
+	network, cpu := common.NewLimiter(config.Concurrency.Network), common.NewLimiter(config.Concurrency.Cpu)
+	results := common.RunPeriods(periods, config.Concurrency.Periods, func(i int) (int64, string, error) {
+		d := config.Dates[i]
+		if config.Local != nil {
+			cpu.Do(func() { localFlightCancelDataReport(d) })
+		} else {
+			network.Do(func() { queryFlightCancelDataReport(d) })
+		}
+		return out.Count(d.Year, d.Month), "", out.Failed(d.Year, d.Month)
+	})
+	// 环比、同比要读取上一期的文档，所有月份生成完成后再按配置的顺序计算
+	for i, d := range config.Dates {
+		if results[i].Err == nil {
+			results[i].Err = common.ComparePeriod(esClient, out, compareConfigs, d.Year, d.Month)
+		}
 	}
+	common.PrintPeriodSummary(results)
 	fmt.Println("总耗时", time.Now().Unix()-start, "s")
 }
 
 // 获取下载数据配置
-func getDateConfig() []Date {
-	var config = []Date{}
-	f, err := os.Open("config.json")
+func getDateConfig() *Config {
+	var config = Config{}
+	b, err := os.ReadFile("config.json")
 	if err != nil {
 		fmt.Println("读取配置文件失败:", err)
 		return nil
 	}
-	defer f.Close()
-	encoder := json.NewDecoder(f)
-	err = encoder.Decode(&config)
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "[") {
+		err = json.Unmarshal(b, &config.Dates)
+	} else {
+		err = json.Unmarshal(b, &config)
+	}
 	if err != nil {
 		fmt.Println("解析配置文件失败:", err)
 		return nil
 	}
-	return config
+	return &config
 }
 
 // 连接es数据库
@@ -176,21 +237,6 @@ func queryFlightCancelDataReport(d Date) {
 		))
 
 	ctx := context.Background()
-	w, err := esClient.BulkProcessor().
-		BulkActions(bulkActions).
-		FlushInterval(time.Second).
-		Workers(actualNumCPU).
-		Stats(true).
-		After(GetFailed).
-		Do(ctx)
-	if err != nil {
-		// Handle error
-		panic(err)
-	}
-	defer w.Close()
-	if err = w.Start(ctx); err != nil {
-		panic(err)
-	}
 	var cancelDataCount = 0
 	// 执行查询
 	var afterKey map[string]interface{}
@@ -230,9 +276,11 @@ func queryFlightCancelDataReport(d Date) {
 			r.CancelledNationalAirSystemCount = cast.ToInt64(cancelled_national_air_system_count.DocCount)
 			r.CancelledSecurityCount = cast.ToInt64(cancelled_security_count.DocCount)
 
-			req := elastic.NewBulkIndexRequest().Index(FlightCancelDataReportIndexName).Id(strings.Join([]string{cast.ToString(r.Year), cast.ToString(r.Month), r.AirCarrier, r.TailNumber}, "_")).Doc(r)
+			id := strings.Join([]string{cast.ToString(r.Year), cast.ToString(r.Month), r.AirCarrier, r.TailNumber}, "_")
+			if err = out.Write(FlightCancelDataReportIndexName, id, r); err != nil {
+				panic(err)
+			}
 			cancelDataCount++
-			w.Add(req)
 		}
 
 		// 处理分页
@@ -241,41 +289,12 @@ func queryFlightCancelDataReport(d Date) {
 			break
 		}
 	}
-	for {
-		st1 := w.Stats() //获取数据写入情况
-
-		var finish = true
-		for _, s := range st1.Workers {
-			if s.Queued > 0 {
-				finish = false
-				break
-			}
-		}
-		if finish {
-			break
-		}
-	}
+	out.FlushPeriod(d.Year, d.Month)
 
 	fmt.Println("最后cancelDataCount:", cancelDataCount)
 
 }
 
-func GetFailed(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
-	if response == nil { //可能存在为空的情况 😳
-		//log.Println("GetNil response return")
-		return
-	}
-	fi := response.Failed()
-	if len(fi) != 0 {
-		for _, f := range fi {
-			log.Printf("DebugFailedEs: index:%s type:%s id:%s version:%d  status:%d result:%s ForceRefresh:%v errorDetail:%v getResult:%v\n", f.Index, f.Type, f.Id, f.Version, f.Status, f.Result, f.ForcedRefresh, f.Error, f.GetResult)
-			//panic(f.Error)
-			return
-		}
-	}
-
-}
-
 type Date struct {
 	Year  int
 	Month int
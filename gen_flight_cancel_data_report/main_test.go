@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"common"
+	"common/fakees"
+)
+
+// 用 testdata 下的 BTS 数据准备 on_time_data 索引
+func seedFakeES(t *testing.T) *fakees.ES {
+	es := fakees.New(t)
+	err := common.ReadLocalCsv("testdata", common.OnTimeFileNames(2020, 1), func(header map[string]int, record []string) error {
+		es.Seed(OnTimeDataIndexName, "", common.ParseOnTimeRecord(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+// 设置全局的 ES 客户端和输出，测试结束后还原
+func useFakeES(t *testing.T, es *fakees.ES, c Config) {
+	oldClient, oldOut, oldConfig := esClient, out, config
+	t.Cleanup(func() {
+		esClient, out, config = oldClient, oldOut, oldConfig
+	})
+	esClient = es.Client()
+	config = c
+	sinks, err := common.NewSinks(nil, esClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = common.NewCountingSink(sinks)
+}
+
+// 没有机尾号的航班按空字符串分组
+var wantCancelReports = map[string]interface{}{
+	"2020_1_AA_N101AA": FlightCancelDataReport{Year: 2020, Month: 1, AirCarrier: "AA", TailNumber: "N101AA", FlightCount: 3, CancelledCarrierCount: 1},
+	"2020_1_AA_N102AA": FlightCancelDataReport{Year: 2020, Month: 1, AirCarrier: "AA", TailNumber: "N102AA", FlightCount: 1},
+	"2020_1_AA_N103AA": FlightCancelDataReport{Year: 2020, Month: 1, AirCarrier: "AA", TailNumber: "N103AA", FlightCount: 1},
+	"2020_1_DL_N201DL": FlightCancelDataReport{Year: 2020, Month: 1, AirCarrier: "DL", TailNumber: "N201DL", FlightCount: 2, CancelledWeatherCount: 1},
+	"2020_1_DL_N202DL": FlightCancelDataReport{Year: 2020, Month: 1, AirCarrier: "DL", TailNumber: "N202DL", FlightCount: 2},
+	"2020_1_UA_":       FlightCancelDataReport{Year: 2020, Month: 1, AirCarrier: "UA", TailNumber: "", FlightCount: 1, CancelledNationalAirSystemCount: 1},
+	"2020_1_UA_N301UA": FlightCancelDataReport{Year: 2020, Month: 1, AirCarrier: "UA", TailNumber: "N301UA", FlightCount: 1},
+}
+
+func TestQueryFlightCancelDataReport(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}})
+
+	initFlightCancelDataReportIndex()
+	queryFlightCancelDataReport(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es.AssertDocs(FlightCancelDataReportIndexName, wantCancelReports)
+}
+
+// 本地计算模式与ES聚合的结果一致
+func TestLocalFlightCancelDataReport(t *testing.T) {
+	es := fakees.New(t)
+	useFakeES(t, es, Config{Dates: []Date{{2020, 1}}, Local: &common.LocalConfig{DataDir: "testdata"}})
+
+	localFlightCancelDataReport(Date{2020, 1})
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es.AssertDocs(FlightCancelDataReportIndexName, wantCancelReports)
+}
+
+// config.json 可以是对象，也可以是旧的日期数组
+func TestGetDateConfig(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	for _, body := range []string{`[{"year": 2020, "month": 1}]`, `{"dates": [{"year": 2020, "month": 1}]}`} {
+		if err := os.WriteFile("config.json", []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c := getDateConfig()
+		if c == nil || !reflect.DeepEqual(c.Dates, []Date{{Year: 2020, Month: 1}}) {
+			t.Errorf("%s 解析为 %+v", body, c)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+var route_carrier_share_index_name = "route_carrier_share"
+
+// RouteCarrierShare 一条航线（出发地、目的地机场）各出票航司的市场份额和集中度
+type RouteCarrierShare struct {
+	Year          int    `json:"year"`           //年
+	Quarter       int    `json:"quarter"`        //季度
+	OriginAirport string `json:"origin_airport"` //出发地机场代码
+	DestAirport   string `json:"dest_airport"`   //目的地机场代码
+
+	Passengers           int            `json:"passengers"`            // 航线乘客数（抽样）
+	CarrierCount         int            `json:"carrier_count"`         // 出票航司数
+	Hhi                  float64        `json:"hhi"`                   // 赫芬达尔指数，各航司份额（百分比）的平方和，0~10000
+	EffectiveCompetitors float64        `json:"effective_competitors"` // 有效竞争者数量 = 10000 / hhi
+	DominantCarrier      string         `json:"dominant_carrier"`      // 乘客数最多的航司
+	DominantShare        float64        `json:"dominant_share"`        // 乘客数最多的航司的份额
+	Carriers             []CarrierShare `json:"carriers"`              // 各航司的乘客数、份额和平均票价，按航司代码排序
+	Filter               MarketFilter   `json:"filter"`                // 生成该文档时生效的 markets 筛选条件
+}
+
+type CarrierShare struct {
+	Carrier    string  `json:"carrier"`    // 出票航司 tk_carrier
+	Passengers int     `json:"passengers"` // 乘客数（抽样）
+	Share      float64 `json:"share"`      // 乘客数份额 0~1
+	AvgFare    float64 `json:"avg_fare"`   // 按乘客数加权的平均票价
+}
+
+var routeCarrierShareMapping = `{
+    "mappings": {
+        "properties": {
+            "year": {
+                "type": "integer"
+            },
+            "quarter": {
+                "type": "short"
+            },
+            "origin_airport": {
+                "type": "keyword"
+            },
+            "dest_airport": {
+                "type": "keyword"
+            },
+            "passengers": {
+                "type": "integer"
+            },
+            "carrier_count": {
+                "type": "short"
+            },
+            "hhi": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "effective_competitors": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "dominant_carrier": {
+                "type": "keyword"
+            },
+            "dominant_share": {
+                "type": "float"
+            },
+            "carriers": {
+                "type": "nested",
+                "properties": {
+                    "carrier": {
+                        "type": "keyword"
+                    },
+                    "passengers": {
+                        "type": "integer"
+                    },
+                    "share": {
+                        "type": "float"
+                    },
+                    "avg_fare": {
+                        "type": "scaled_float",
+                        "scaling_factor": 100
+                    }
+                }
+            },
+            "filter": {
+                "properties": {
+                    "min_fare": {
+                        "type": "float"
+                    },
+                    "max_fare": {
+                        "type": "float"
+                    },
+                    "exclude_bulk": {
+                        "type": "boolean"
+                    },
+                    "mkt_geo_types": {
+                        "type": "short"
+                    },
+                    "itin_geo_types": {
+                        "type": "short"
+                    },
+                    "exclude_carrier_groups": {
+                        "type": "keyword"
+                    }
+                }
+            }
+        }
+    }
+}`
+
+// 按出发地、目的地、出票航司聚合 markets，同一航线的航司在复合聚合中相邻，汇总成一个文档
+func processRouteCarrierShare(year, quarter int) {
+	ctx := context.Background()
+	compositeAgg := elastic.NewCompositeAggregation().Size(10000).Sources(
+		elastic.NewCompositeAggregationTermsValuesSource("origin").Field("origin"),
+		elastic.NewCompositeAggregationTermsValuesSource("dest").Field("dest"),
+		elastic.NewCompositeAggregationTermsValuesSource("carrier").Field("tk_carrier")).
+		SubAggregation("total_passengers", elastic.NewSumAggregation().Field("passengers").Missing(0)).
+		SubAggregation("weighted_fare", newPassengerWeightedAvg("mkt_fare"))
+
+	var afterKey map[string]interface{}
+	var route *RouteCarrierShare
+	count := 0
+	for {
+		if afterKey != nil {
+			compositeAgg = compositeAgg.AggregateAfter(afterKey)
+		}
+		searchResult, err := client.Search().
+			Index(market_index_name).
+			Query(marketFilter.query(year, quarter)).
+			Size(0).
+			Aggregation("route_carriers", compositeAgg).
+			Do(ctx)
+		if err != nil {
+			panic(err)
+		}
+		agg, _ := searchResult.Aggregations.Composite("route_carriers")
+		for _, bucket := range agg.Buckets {
+			origin, dest := cast.ToString(bucket.Key["origin"]), cast.ToString(bucket.Key["dest"])
+			if route == nil || route.OriginAirport != origin || route.DestAirport != dest {
+				if route != nil {
+					writeRouteCarrierShare(route)
+					count++
+				}
+				route = &RouteCarrierShare{Year: year, Quarter: quarter, OriginAirport: origin, DestAirport: dest}
+			}
+			c := CarrierShare{Carrier: cast.ToString(bucket.Key["carrier"])}
+			if passengers, found := bucket.Aggregations.Sum("total_passengers"); found && passengers.Value != nil {
+				c.Passengers = cast.ToInt(*passengers.Value)
+			}
+			if fare, found := bucket.Aggregations.WeightedAvg("weighted_fare"); found && fare.Value != nil && c.Passengers > 0 {
+				c.AvgFare = *fare.Value
+			}
+			route.Carriers = append(route.Carriers, c)
+		}
+		afterKey = agg.AfterKey
+		if agg.AfterKey == nil {
+			break
+		}
+	}
+	if route != nil {
+		writeRouteCarrierShare(route)
+		count++
+	}
+	fmt.Println(route_carrier_share_index_name, "allcount:", count)
+	out.FlushPeriod(year, quarter)
+}
+
+// 本地计算航线各航司份额，与 processRouteCarrierShare 一致
+func localRouteCarrierShare(dataDir string, year, quarter int) {
+	type carrierKey struct {
+		origin, dest, carrier string
+	}
+	type carrierSum struct {
+		passengers int
+		revenue    float64
+	}
+	sums := map[carrierKey]*carrierSum{}
+	err := common.ReadLocalCsv(dataDir, common.MarketFileNames(year, quarter), func(header map[string]int, record []string) error {
+		m := parseMarketRecord(header, record)
+		if m.Year != year || m.Quarter != quarter || !marketFilter.match(m) {
+			return nil
+		}
+		k := carrierKey{m.Origin, m.Dest, m.TkCarrier}
+		c, ok := sums[k]
+		if !ok {
+			c = &carrierSum{}
+			sums[k] = c
+		}
+		c.passengers += m.Passengers
+		c.revenue += m.MktFare * float64(m.Passengers)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	keys := make([]carrierKey, 0, len(sums))
+	for k := range sums {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].origin != keys[j].origin {
+			return keys[i].origin < keys[j].origin
+		}
+		if keys[i].dest != keys[j].dest {
+			return keys[i].dest < keys[j].dest
+		}
+		return keys[i].carrier < keys[j].carrier
+	})
+	var route *RouteCarrierShare
+	count := 0
+	for _, k := range keys {
+		if route == nil || route.OriginAirport != k.origin || route.DestAirport != k.dest {
+			if route != nil {
+				writeRouteCarrierShare(route)
+				count++
+			}
+			route = &RouteCarrierShare{Year: year, Quarter: quarter, OriginAirport: k.origin, DestAirport: k.dest}
+		}
+		s := sums[k]
+		c := CarrierShare{Carrier: k.carrier, Passengers: s.passengers}
+		if s.passengers > 0 {
+			c.AvgFare = s.revenue / float64(s.passengers)
+		}
+		route.Carriers = append(route.Carriers, c)
+	}
+	if route != nil {
+		writeRouteCarrierShare(route)
+		count++
+	}
+	fmt.Println(route_carrier_share_index_name, "allcount:", count)
+	out.FlushPeriod(year, quarter)
+}
+
+// 计算各航司份额、HHI 和主导航司后写入
+func writeRouteCarrierShare(r *RouteCarrierShare) {
+	for _, c := range r.Carriers {
+		r.Passengers += c.Passengers
+	}
+	r.CarrierCount = len(r.Carriers)
+	hhi := 0.0
+	dominant := -1
+	for i := range r.Carriers {
+		c := &r.Carriers[i]
+		if r.Passengers > 0 {
+			c.Share = float64(c.Passengers) / float64(r.Passengers)
+		}
+		hhi += c.Share * 100 * c.Share * 100
+		if dominant < 0 || c.Passengers > r.Carriers[dominant].Passengers {
+			dominant = i
+		}
+		c.Share = math.Round(c.Share*10000) / 10000
+	}
+	r.Hhi = scaled(hhi)
+	if hhi > 0 {
+		r.EffectiveCompetitors = scaled(10000 / hhi)
+	}
+	r.DominantCarrier = r.Carriers[dominant].Carrier
+	r.DominantShare = r.Carriers[dominant].Share
+	r.Filter = marketFilter
+	id := strings.Join([]string{cast.ToString(r.Year), cast.ToString(r.Quarter), r.OriginAirport, r.DestAirport}, "_")
+	if err := out.Write(route_carrier_share_index_name, id, r); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+// DB1B Coupon 数据，每条记录为行程中的一个航段，同一市场的航段 mkt_id 相同，按 seq_num 排序
+var coupon_index_name = "coupons"
+var route_connecting_hubs_index_name = "route_connecting_hubs"
+
+// BTS DB1B Coupon 下载文件名
+const CouponNamePrefix = "Origin_and_Destination_Survey_DB1BCoupon_"
+
+// 每条航线保留的中转机场数
+var connectingHubsTop = 5
+
+// RouteConnectingHubs 一条航线（市场的出发地、目的地机场）中转乘客经过的主要机场
+type RouteConnectingHubs struct {
+	Year          int    `json:"year"`           //年
+	Quarter       int    `json:"quarter"`        //季度
+	OriginAirport string `json:"origin_airport"` //出发地机场代码
+	DestAirport   string `json:"dest_airport"`   //目的地机场代码
+
+	Passengers           int             `json:"passengers"`            // 航线乘客数（抽样），含直飞
+	ConnectingPassengers int             `json:"connecting_passengers"` // 中转乘客数
+	ConnectingShare      float64         `json:"connecting_share"`      // 中转乘客份额 0~1
+	Hubs                 []ConnectingHub `json:"hubs"`                  // 中转乘客数最多的机场，按乘客数倒序
+}
+
+type ConnectingHub struct {
+	Hub        string  `json:"hub"`        // 中转机场代码
+	Passengers int     `json:"passengers"` // 经该机场中转的乘客数
+	Share      float64 `json:"share"`      // 占中转乘客数的份额 0~1，经停两次的乘客在两个机场都计入
+}
+
+var routeConnectingHubsMapping = `{
+    "mappings": {
+        "properties": {
+            "year": {
+                "type": "integer"
+            },
+            "quarter": {
+                "type": "short"
+            },
+            "origin_airport": {
+                "type": "keyword"
+            },
+            "dest_airport": {
+                "type": "keyword"
+            },
+            "passengers": {
+                "type": "integer"
+            },
+            "connecting_passengers": {
+                "type": "integer"
+            },
+            "connecting_share": {
+                "type": "float"
+            },
+            "hubs": {
+                "type": "nested",
+                "properties": {
+                    "hub": {
+                        "type": "keyword"
+                    },
+                    "passengers": {
+                        "type": "integer"
+                    },
+                    "share": {
+                        "type": "float"
+                    }
+                }
+            }
+        }
+    }
+}`
+
+// 一个航段
+type coupon struct {
+	mktID      int64
+	origin     string
+	dest       string
+	passengers int
+}
+
+// 按市场汇总航段，市场的出发地为第一个航段的出发地，目的地为最后一个航段的目的地，中间各航段的目的地为中转机场
+type hubCounter struct {
+	market []coupon
+	routes map[[2]string]*hubRoute
+}
+
+type hubRoute struct {
+	passengers, connecting int
+	hubs                   map[string]int
+}
+
+func newHubCounter() *hubCounter {
+	return &hubCounter{routes: map[[2]string]*hubRoute{}}
+}
+
+// 依次加入航段，同一市场的航段必须相邻且按 seq_num 排序
+func (h *hubCounter) add(c coupon) {
+	if len(h.market) > 0 && h.market[0].mktID != c.mktID {
+		h.flushMarket()
+	}
+	h.market = append(h.market, c)
+}
+
+func (h *hubCounter) flushMarket() {
+	if len(h.market) == 0 {
+		return
+	}
+	first, last := h.market[0], h.market[len(h.market)-1]
+	k := [2]string{first.origin, last.dest}
+	r, ok := h.routes[k]
+	if !ok {
+		r = &hubRoute{hubs: map[string]int{}}
+		h.routes[k] = r
+	}
+	r.passengers += first.passengers
+	if len(h.market) > 1 {
+		r.connecting += first.passengers
+		for _, c := range h.market[:len(h.market)-1] {
+			r.hubs[c.dest] += first.passengers
+		}
+	}
+	h.market = h.market[:0]
+}
+
+// 写入有中转乘客的航线，返回文档数
+func (h *hubCounter) write(year, quarter int) int {
+	h.flushMarket()
+	keys := make([][2]string, 0, len(h.routes))
+	for k, r := range h.routes {
+		if r.connecting > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		r := h.routes[k]
+		doc := &RouteConnectingHubs{Year: year, Quarter: quarter, OriginAirport: k[0], DestAirport: k[1],
+			Passengers: r.passengers, ConnectingPassengers: r.connecting}
+		if r.passengers > 0 {
+			doc.ConnectingShare = round4(float64(r.connecting) / float64(r.passengers))
+		}
+		for hub, passengers := range r.hubs {
+			doc.Hubs = append(doc.Hubs, ConnectingHub{Hub: hub, Passengers: passengers, Share: round4(float64(passengers) / float64(r.connecting))})
+		}
+		// 乘客数相同时按机场代码排序
+		sort.Slice(doc.Hubs, func(i, j int) bool {
+			if doc.Hubs[i].Passengers != doc.Hubs[j].Passengers {
+				return doc.Hubs[i].Passengers > doc.Hubs[j].Passengers
+			}
+			return doc.Hubs[i].Hub < doc.Hubs[j].Hub
+		})
+		if len(doc.Hubs) > connectingHubsTop {
+			doc.Hubs = doc.Hubs[:connectingHubsTop]
+		}
+		id := strings.Join([]string{cast.ToString(year), cast.ToString(quarter), k[0], k[1]}, "_")
+		if err := out.Write(route_connecting_hubs_index_name, id, doc); err != nil {
+			panic(err)
+		}
+	}
+	return len(keys)
+}
+
+// 从 coupons 索引按 mkt_id、seq_num 顺序取航段，每个复合聚合分组为一个航段
+// coupons 中没有票价，markets 的 filter 筛选条件不生效
+func processRouteConnectingHubs(year, quarter int) {
+	ctx := context.Background()
+	exists, err := client.IndexExists(coupon_index_name).Do(ctx)
+	if err != nil {
+		panic(err)
+	}
+	if !exists {
+		fmt.Println(coupon_index_name, "索引不存在，跳过", route_connecting_hubs_index_name)
+		return
+	}
+	compositeAgg := elastic.NewCompositeAggregation().Size(10000).Sources(
+		elastic.NewCompositeAggregationTermsValuesSource("mkt_id").Field("mkt_id"),
+		elastic.NewCompositeAggregationTermsValuesSource("seq_num").Field("seq_num"),
+		elastic.NewCompositeAggregationTermsValuesSource("origin").Field("origin"),
+		elastic.NewCompositeAggregationTermsValuesSource("dest").Field("dest")).
+		SubAggregation("total_passengers", elastic.NewSumAggregation().Field("passengers").Missing(0))
+
+	h := newHubCounter()
+	var afterKey map[string]interface{}
+	for {
+		if afterKey != nil {
+			compositeAgg = compositeAgg.AggregateAfter(afterKey)
+		}
+		searchResult, err := client.Search().
+			Index(coupon_index_name).
+			Query(elastic.NewBoolQuery().Must(elastic.NewTermQuery("year", year), elastic.NewTermQuery("quarter", quarter))).
+			Size(0).
+			Aggregation("coupons", compositeAgg).
+			Do(ctx)
+		if err != nil {
+			panic(err)
+		}
+		agg, _ := searchResult.Aggregations.Composite("coupons")
+		for _, bucket := range agg.Buckets {
+			c := coupon{mktID: cast.ToInt64(bucket.Key["mkt_id"]), origin: cast.ToString(bucket.Key["origin"]), dest: cast.ToString(bucket.Key["dest"])}
+			if passengers, found := bucket.Aggregations.Sum("total_passengers"); found && passengers.Value != nil {
+				c.passengers = cast.ToInt(*passengers.Value)
+			}
+			h.add(c)
+		}
+		afterKey = agg.AfterKey
+		if agg.AfterKey == nil {
+			break
+		}
+	}
+	count := h.write(year, quarter)
+	fmt.Println(route_connecting_hubs_index_name, "allcount:", count)
+	out.FlushPeriod(year, quarter)
+}
+
+// 本地 DB1B Coupon 数据文件
+func couponFileNames(year, quarter int) []string {
+	return []string{
+		fmt.Sprintf("%s%d_%d.csv", CouponNamePrefix, year, quarter),
+		fmt.Sprintf("%s%d_%d.zip", CouponNamePrefix, year, quarter),
+	}
+}
+
+// 本地计算中转机场，BTS 的 Coupon 文件已按 ItinID、SeqNum 排序，同一市场的航段相邻
+func localRouteConnectingHubs(dataDir string, year, quarter int) {
+	found := false
+	for _, name := range couponFileNames(year, quarter) {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); err == nil {
+			found = true
+		}
+	}
+	if !found {
+		fmt.Println(dataDir, "下没有 DB1B Coupon 数据，跳过", route_connecting_hubs_index_name)
+		return
+	}
+	h := newHubCounter()
+	err := common.ReadLocalCsv(dataDir, couponFileNames(year, quarter), func(header map[string]int, record []string) error {
+		v := func(name string) string {
+			return common.CsvValue(header, record, name)
+		}
+		if cast.ToInt(v("Year")) != year || cast.ToInt(v("Quarter")) != quarter {
+			return nil
+		}
+		h.add(coupon{mktID: cast.ToInt64(v("MktID")), origin: v("Origin"), dest: v("Dest"), passengers: int(cast.ToFloat64(v("Passengers")))})
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	count := h.write(year, quarter)
+	fmt.Println(route_connecting_hubs_index_name, "allcount:", count)
+	out.FlushPeriod(year, quarter)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+// AirportDim 机场维度：机场所属的城市市场、州、国家，同一机场在所有航线中都相同
+type AirportDim struct {
+	CityMarketID int
+	State        string
+	StateName    string
+	Country      string
+}
+
+// 维度表，启动时由机场主数据生成一次，ES 和本地计算的各期共用，只读
+type dimensions struct {
+	airports    map[string]*AirportDim // key:机场代码
+	cityMarkets map[string]*AirportDim // key:城市市场ID
+}
+
+// 各期共用的维度
+var airportDims *dimensions
+
+func newDimensions() *dimensions {
+	return &dimensions{airports: map[string]*AirportDim{}, cityMarkets: map[string]*AirportDim{}}
+}
+
+func (dims *dimensions) addAirport(code string, d AirportDim) {
+	dims.airports[code] = &d
+}
+
+// 城市市场取州与城市名称中的州相同、代码最小的机场，没有相同的州时取代码最小的机场
+// 如纽约 31703 包含 EWR（NJ）和 JFK（NY），城市名称为 New York City, NY，取 JFK
+func (dims *dimensions) buildCityMarkets() {
+	dims.cityMarkets = map[string]*AirportDim{}
+	codes := make([]string, 0, len(dims.airports))
+	for code := range dims.airports {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		d := dims.airports[code]
+		id := cast.ToString(d.CityMarketID)
+		state := ""
+		if c := lookups.Cities.Get(id); c != nil {
+			state = c.State
+		}
+		if cur, ok := dims.cityMarkets[id]; !ok || (cur.State != state && d.State == state) {
+			dims.cityMarkets[id] = d
+		}
+	}
+}
+
+// 由机场主数据（common.ReadAirportMaster）中的城市市场、州、国家得到机场和城市市场维度，
+// 不再从 markets 按机场聚合，机场主数据中没有城市市场的机场在生成时记入 missing
+func loadAirportDims() *dimensions {
+	dims := newDimensions()
+	for code, a := range common.AirportInfos() {
+		dims.addAirport(code, AirportDim{CityMarketID: cast.ToInt(a.CityMarketID), State: a.State, StateName: a.StateName, Country: a.Country})
+	}
+	dims.buildCityMarkets()
+	fmt.Println("读取机场维度完成:", len(dims.airports), "城市市场:", len(dims.cityMarkets))
+	return dims
+}
+
+// 维度表中没有的机场（城市市场）及其出现的分组数，生成完成后统一输出，不中断生成
+type missingDims map[string]int
+
+func (m missingDims) add(key string) {
+	m[key]++
+}
+
+func (m missingDims) report(index string) {
+	if len(m) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = fmt.Sprintf("%s(%d)", k, m[k])
+	}
+	fmt.Println(index, "维度表中没有的机场（城市市场），文档中缺少州、国家信息:", strings.Join(keys, " "))
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+var distance_band_fares_index_name = "distance_band_fares"
+
+// DB1B 的 mkt_distance_group 每 500 英里一组
+const distanceGroupMiles = 500
+
+// DistanceBandFare 按市场距离分组汇总的票价，用于比较不同航程长度的票价水平
+type DistanceBandFare struct {
+	Year          int `json:"year"`           //年
+	Quarter       int `json:"quarter"`        //季度
+	DistanceGroup int `json:"distance_group"` //距离分组 mkt_distance_group
+	DistanceFrom  int `json:"distance_from"`  //分组距离下限（英里，包含）
+	DistanceTo    int `json:"distance_to"`    //分组距离上限（英里，不包含）
+
+	Records         int     `json:"records"`           // 记录数
+	Passengers      int     `json:"passengers"`        // 乘客数（抽样）
+	AvgFare         float64 `json:"avg_fare"`          // 平均票价
+	WeightedAvgFare float64 `json:"weighted_avg_fare"` // 按乘客数加权的平均票价
+	MedianFare      float64 `json:"median_fare"`       // 票价中位数
+	AvgDistance     float64 `json:"avg_distance"`      // 平均市场距离
+	Yield           float64 `json:"yield"`             // 收益率，每乘客英里的票价
+
+	Filter MarketFilter `json:"filter"` // 生成该文档时生效的 markets 筛选条件
+}
+
+var distanceBandFaresMapping = `{
+    "mappings": {
+        "properties": {
+            "year": {
+                "type": "integer"
+            },
+            "quarter": {
+                "type": "short"
+            },
+            "distance_group": {
+                "type": "short"
+            },
+            "distance_from": {
+                "type": "integer"
+            },
+            "distance_to": {
+                "type": "integer"
+            },
+            "records": {
+                "type": "integer"
+            },
+            "passengers": {
+                "type": "integer"
+            },
+            "avg_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "weighted_avg_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "median_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "avg_distance": {
+                "type": "float"
+            },
+            "yield": {
+                "type": "float"
+            },
+            "filter": {
+                "properties": {
+                    "min_fare": {
+                        "type": "float"
+                    },
+                    "max_fare": {
+                        "type": "float"
+                    },
+                    "exclude_bulk": {
+                        "type": "boolean"
+                    },
+                    "mkt_geo_types": {
+                        "type": "short"
+                    },
+                    "itin_geo_types": {
+                        "type": "short"
+                    },
+                    "exclude_carrier_groups": {
+                        "type": "keyword"
+                    }
+                }
+            }
+        }
+    }
+}`
+
+// 按 mkt_distance_group 聚合 markets
+func processDistanceBandFares(year, quarter int) {
+	ctx := context.Background()
+	compositeAgg := elastic.NewCompositeAggregation().Size(1000).Sources(
+		elastic.NewCompositeAggregationTermsValuesSource("group").Field("mkt_distance_group")).
+		SubAggregation("average_fare", elastic.NewAvgAggregation().Field("mkt_fare").Missing(0)).
+		SubAggregation("total_passengers", elastic.NewSumAggregation().Field("passengers").Missing(0)).
+		SubAggregation("weighted_fare", newPassengerWeightedAvg("mkt_fare")).
+		SubAggregation("fare_percentiles", elastic.NewPercentilesAggregation().Field("mkt_fare").Missing(0).Percentiles(50)).
+		SubAggregation("avg_distance", elastic.NewAvgAggregation().Field("mkt_distance").Missing(0)).
+		SubAggregation("weighted_distance", newPassengerWeightedAvg("mkt_distance"))
+
+	var afterKey map[string]interface{}
+	count := 0
+	for {
+		if afterKey != nil {
+			compositeAgg = compositeAgg.AggregateAfter(afterKey)
+		}
+		searchResult, err := client.Search().
+			Index(market_index_name).
+			Query(marketFilter.query(year, quarter)).
+			Size(0).
+			Aggregation("distance_groups", compositeAgg).
+			Do(ctx)
+		if err != nil {
+			panic(err)
+		}
+		agg, _ := searchResult.Aggregations.Composite("distance_groups")
+		for _, bucket := range agg.Buckets {
+			value := func(agg *elastic.AggregationValueMetric, found bool) float64 {
+				if !found || agg.Value == nil {
+					return 0
+				}
+				return *agg.Value
+			}
+			d := newDistanceBandFare(year, quarter, cast.ToInt(bucket.Key["group"]))
+			d.Records = int(bucket.DocCount)
+			d.Passengers = int(value(bucket.Aggregations.Sum("total_passengers")))
+			d.AvgFare = value(bucket.Aggregations.Avg("average_fare"))
+			d.AvgDistance = value(bucket.Aggregations.Avg("avg_distance"))
+			if d.Passengers > 0 {
+				d.WeightedAvgFare = value(bucket.Aggregations.WeightedAvg("weighted_fare"))
+				if weightedDistance := value(bucket.Aggregations.WeightedAvg("weighted_distance")); weightedDistance > 0 {
+					d.Yield = round4(d.WeightedAvgFare / weightedDistance)
+				}
+			}
+			if percentiles, found := bucket.Aggregations.Percentiles("fare_percentiles"); found {
+				d.MedianFare = scaled(percentiles.Values["50.0"])
+			}
+			writeDistanceBandFare(d)
+			count++
+		}
+		afterKey = agg.AfterKey
+		if agg.AfterKey == nil {
+			break
+		}
+	}
+	fmt.Println(distance_band_fares_index_name, "allcount:", count)
+	out.FlushPeriod(year, quarter)
+}
+
+// 本地计算距离分组的票价，与 processDistanceBandFares 一致
+func localDistanceBandFares(dataDir string, year, quarter int) {
+	type groupSum struct {
+		fareSum, revenue, distance, paxMiles float64
+		passengers                           int
+		fares                                []float64
+	}
+	groups := map[int]*groupSum{}
+	err := common.ReadLocalCsv(dataDir, common.MarketFileNames(year, quarter), func(header map[string]int, record []string) error {
+		m := parseMarketRecord(header, record)
+		if m.Year != year || m.Quarter != quarter || !marketFilter.match(m) {
+			return nil
+		}
+		g, ok := groups[m.MktDistanceGroup]
+		if !ok {
+			g = &groupSum{}
+			groups[m.MktDistanceGroup] = g
+		}
+		g.fareSum += m.MktFare
+		g.revenue += m.MktFare * float64(m.Passengers)
+		g.distance += m.MktDistance
+		g.paxMiles += m.MktDistance * float64(m.Passengers)
+		g.passengers += m.Passengers
+		g.fares = append(g.fares, m.MktFare)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	keys := make([]int, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		g := groups[k]
+		n := float64(len(g.fares))
+		d := newDistanceBandFare(year, quarter, k)
+		d.Records = len(g.fares)
+		d.Passengers = g.passengers
+		d.AvgFare = g.fareSum / n
+		d.AvgDistance = g.distance / n
+		if g.passengers > 0 {
+			d.WeightedAvgFare = g.revenue / float64(g.passengers)
+			if weightedDistance := g.paxMiles / float64(g.passengers); weightedDistance > 0 {
+				d.Yield = round4(d.WeightedAvgFare / weightedDistance)
+			}
+		}
+		sort.Float64s(g.fares)
+		d.MedianFare = scaled(percentile(g.fares, 50))
+		writeDistanceBandFare(d)
+	}
+	fmt.Println(distance_band_fares_index_name, "allcount:", len(keys))
+	out.FlushPeriod(year, quarter)
+}
+
+func newDistanceBandFare(year, quarter, group int) *DistanceBandFare {
+	return &DistanceBandFare{Year: year, Quarter: quarter, DistanceGroup: group,
+		DistanceFrom: (group - 1) * distanceGroupMiles, DistanceTo: group * distanceGroupMiles, Filter: marketFilter}
+}
+
+func writeDistanceBandFare(d *DistanceBandFare) {
+	id := strings.Join([]string{cast.ToString(d.Year), cast.ToString(d.Quarter), cast.ToString(d.DistanceGroup)}, "_")
+	if err := out.Write(distance_band_fares_index_name, id, d); err != nil {
+		panic(err)
+	}
+}
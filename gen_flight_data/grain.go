@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+)
+
+// 聚合粒度，每个粒度写入单独的索引，文档结构都是 AirportFlight
+type grain struct {
+	name       string // 文档中的 grain 字段，也是 config.json 中 grains 的取值
+	index      string
+	cityMarket bool // 按城市市场 origin_city_market_id/dest_city_market_id 分组，否则按机场 origin/dest
+	pair       bool // 无方向，A→B 与 B→A 合并，origin 为较小的一方
+}
+
+var (
+	airportGrain        = &grain{name: "airport", index: airport_flights_index_name}
+	cityMarketGrain     = &grain{name: "city_market", index: "city_market_flights", cityMarket: true}
+	airportPairGrain    = &grain{name: "airport_pair", index: "airport_pair_flights", pair: true}
+	cityMarketPairGrain = &grain{name: "city_market_pair", index: "city_market_pair_flights", cityMarket: true, pair: true}
+)
+
+var allGrains = []*grain{airportGrain, cityMarketGrain, airportPairGrain, cityMarketPairGrain}
+
+// 生成的聚合粒度，默认只生成机场粒度的 airport_flights
+var flightGrains = []*grain{airportGrain}
+
+// 按配置的名称选择聚合粒度
+func selectGrains(names []string) ([]*grain, error) {
+	if len(names) == 0 {
+		return []*grain{airportGrain}, nil
+	}
+	var res []*grain
+	for _, name := range names {
+		var g *grain
+		for _, x := range allGrains {
+			if x.name == name {
+				g = x
+			}
+		}
+		if g == nil {
+			return nil, fmt.Errorf("不支持的聚合粒度: %s", name)
+		}
+		res = append(res, g)
+	}
+	return res, nil
+}
+
+// 无方向分组的 key，lower 为 true 时取两个字段中较小的值，否则取较大的值
+const pairKeyScript = "def a = doc[params.a].value; def b = doc[params.b].value; return (a.compareTo(b) <= 0) == params.lower ? a : b;"
+
+func (g *grain) fields() (origin, dest string) {
+	if g.cityMarket {
+		return "origin_city_market_id", "dest_city_market_id"
+	}
+	return "origin", "dest"
+}
+
+// 复合聚合的 origin、dest 两个分组
+func (g *grain) sources() []elastic.CompositeAggregationValuesSource {
+	origin, dest := g.fields()
+	if !g.pair {
+		return []elastic.CompositeAggregationValuesSource{
+			elastic.NewCompositeAggregationTermsValuesSource("origin").Field(origin),
+			elastic.NewCompositeAggregationTermsValuesSource("dest").Field(dest),
+		}
+	}
+	key := func(lower bool) *elastic.Script {
+		return elastic.NewScript(pairKeyScript).Params(map[string]interface{}{"a": origin, "b": dest, "lower": lower})
+	}
+	return []elastic.CompositeAggregationValuesSource{
+		elastic.NewCompositeAggregationTermsValuesSource("origin").Script(key(true)),
+		elastic.NewCompositeAggregationTermsValuesSource("dest").Script(key(false)),
+	}
+}
+
+// 并行翻页的分区字段，无方向分组的 key 由脚本计算，不能按字段分区
+func (g *grain) partitionField() string {
+	if g.pair {
+		return ""
+	}
+	origin, _ := g.fields()
+	return origin
+}
+
+// 本地计算时一条记录的分组 key，与 sources 一致：机场代码按字符串比较，城市市场ID按数值比较
+func (g *grain) localKey(m *Market) (origin, dest string) {
+	if !g.cityMarket {
+		if g.pair && m.Dest < m.Origin {
+			return m.Dest, m.Origin
+		}
+		return m.Origin, m.Dest
+	}
+	o, d := m.OriginCityMarketID, m.DestCityMarketID
+	if g.pair && d < o {
+		o, d = d, o
+	}
+	return cast.ToString(o), cast.ToString(d)
+}
+
+// 填充分组 key，并从维度表补充机场、城市、州、国家信息，维度表中没有的 key 记入 missing
+func (g *grain) fillInfo(af *AirportFlight, dims *dimensions, origin, dest string, missing missingDims) {
+	af.Grain = g.name
+	table := dims.airports
+	if g.cityMarket {
+		table = dims.cityMarkets
+	} else {
+		af.OriginAirport = origin
+		af.DestAirport = dest
+	}
+	dim := func(key string) *AirportDim {
+		if d, ok := table[key]; ok {
+			return d
+		}
+		missing.add(key)
+		if g.cityMarket {
+			return &AirportDim{CityMarketID: cast.ToInt(key)}
+		}
+		return &AirportDim{}
+	}
+	fillAirportFlightInfo(af, dim(origin), dim(dest))
+}
+
+func (g *grain) id(af *AirportFlight) string {
+	if !g.cityMarket {
+		return airportFlightId(af)
+	}
+	return strings.Join([]string{cast.ToString(af.Year), cast.ToString(af.Quarter), cast.ToString(af.OriginCityMarketID), cast.ToString(af.DestCityMarketID)}, "_")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+// Market DB1B Market 的一行，字段与 markets 索引一致
+type Market struct {
+	ItinID             int64   `json:"itin_id"`
+	MktID              int64   `json:"mkt_id"`
+	MktCoupons         int     `json:"mkt_coupons"`
+	Year               int     `json:"year"`
+	Quarter            int     `json:"quarter"`
+	OriginAirportID    int     `json:"origin_airport_id"`
+	OriginCityMarketID int     `json:"origin_city_market_id"`
+	Origin             string  `json:"origin"`
+	OriginCountry      string  `json:"origin_country"`
+	OriginState        string  `json:"origin_state"`
+	OriginStateName    string  `json:"origin_state_name"`
+	OriginWac          int     `json:"origin_wac"`
+	DestAirportID      int     `json:"dest_airport_id"`
+	DestCityMarketID   int     `json:"dest_city_market_id"`
+	Dest               string  `json:"dest"`
+	DestCountry        string  `json:"dest_country"`
+	DestState          string  `json:"dest_state"`
+	DestStateName      string  `json:"dest_state_name"`
+	DestWac            int     `json:"dest_wac"`
+	TkCarrierGroup     string  `json:"tk_carrier_group"`
+	OpCarrierGroup     string  `json:"op_carrier_group"`
+	RpCarrier          string  `json:"rp_carrier"`
+	TkCarrier          string  `json:"tk_carrier"`
+	OpCarrier          string  `json:"op_carrier"`
+	BulkFare           int     `json:"bulk_fare"`
+	Passengers         int     `json:"passengers"`
+	MktFare            float64 `json:"mkt_fare"`
+	MktDistance        float64 `json:"mkt_distance"`
+	MktDistanceGroup   int     `json:"mkt_distance_group"`
+	MktMilesFlown      float64 `json:"mkt_miles_flown"`
+	NonStopMiles       float64 `json:"non_stop_miles"`
+	ItinGeoType        int     `json:"itin_geo_type"`
+	MktGeoType         int     `json:"mkt_geo_type"`
+
+	FareMissing bool `json:"-"` // csv 中 MktFare 为空，与 ES 中没有 mkt_fare 字段一样不参与票价分布的计算
+}
+
+// 按 BTS DB1B Market 的列名解析一行 csv，scaled_float 字段与写入ES后一样保留两位小数
+func parseMarketRecord(header map[string]int, record []string) *Market {
+	v := func(name string) string {
+		return common.CsvValue(header, record, name)
+	}
+	return &Market{
+		ItinID:             cast.ToInt64(v("ItinID")),
+		MktID:              cast.ToInt64(v("MktID")),
+		MktCoupons:         int(cast.ToFloat64(v("MktCoupons"))),
+		Year:               cast.ToInt(v("Year")),
+		Quarter:            cast.ToInt(v("Quarter")),
+		OriginAirportID:    cast.ToInt(v("OriginAirportID")),
+		OriginCityMarketID: cast.ToInt(v("OriginCityMarketID")),
+		Origin:             v("Origin"),
+		OriginCountry:      v("OriginCountry"),
+		OriginState:        v("OriginState"),
+		OriginStateName:    v("OriginStateName"),
+		OriginWac:          cast.ToInt(v("OriginWac")),
+		DestAirportID:      cast.ToInt(v("DestAirportID")),
+		DestCityMarketID:   cast.ToInt(v("DestCityMarketID")),
+		Dest:               v("Dest"),
+		DestCountry:        v("DestCountry"),
+		DestState:          v("DestState"),
+		DestStateName:      v("DestStateName"),
+		DestWac:            cast.ToInt(v("DestWac")),
+		TkCarrierGroup:     v("TkCarrierGroup"),
+		OpCarrierGroup:     v("OpCarrierGroup"),
+		RpCarrier:          v("RPCarrier"),
+		TkCarrier:          v("TkCarrier"),
+		OpCarrier:          v("OpCarrier"),
+		BulkFare:           int(cast.ToFloat64(v("BulkFare"))),
+		Passengers:         int(cast.ToFloat64(v("Passengers"))),
+		MktFare:            scaled(cast.ToFloat64(v("MktFare"))),
+		MktDistance:        scaled(cast.ToFloat64(v("MktDistance"))),
+		MktDistanceGroup:   int(cast.ToFloat64(v("MktDistanceGroup"))),
+		MktMilesFlown:      cast.ToFloat64(v("MktMilesFlown")),
+		NonStopMiles:       scaled(cast.ToFloat64(v("NonStopMiles"))),
+		ItinGeoType:        int(cast.ToFloat64(v("ItinGeoType"))),
+		MktGeoType:         int(cast.ToFloat64(v("MktGeoType"))),
+		FareMissing:        v("MktFare") == "",
+	}
+}
+
+// scaled_float(scaling_factor=100) 的存储精度
+func scaled(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// 本地计算航线票价和乘客数，各粒度的分组方式与 processGrainFlightsData 的复合聚合一致
+func localFlightsData(dataDir string, year, quarter int) {
+	type routeSum struct {
+		fareSum    float64
+		count      int
+		passengers int
+		revenue    float64
+		fareDist   *fareDistribution
+		distance   float64 // 市场距离之和
+		nonStop    float64
+		milesFlown float64
+		paxMiles   float64 // 乘客英里数
+		stops      []StopsShare
+		stopsFare  []float64 // 各分类的票价收入
+	}
+	dims := airportDims
+	routes := make([]map[routeKey]*routeSum, len(flightGrains))
+	for i := range routes {
+		routes[i] = map[routeKey]*routeSum{}
+	}
+	err := common.ReadLocalCsv(dataDir, common.MarketFileNames(year, quarter), func(header map[string]int, record []string) error {
+		m := parseMarketRecord(header, record)
+		if m.Year != year || m.Quarter != quarter {
+			return nil
+		}
+		if !marketFilter.match(m) {
+			return nil
+		}
+		for i, g := range flightGrains {
+			var k routeKey
+			k.origin, k.dest = g.localKey(m)
+			r, ok := routes[i][k]
+			if !ok {
+				r = &routeSum{fareDist: newFareDistribution(), stops: make([]StopsShare, len(stopsCategories)), stopsFare: make([]float64, len(stopsCategories))}
+				routes[i][k] = r
+			}
+			r.fareSum += m.MktFare
+			r.count++
+			r.passengers += m.Passengers
+			r.revenue += m.MktFare * float64(m.Passengers)
+			if !m.FareMissing {
+				r.fareDist.add(m.MktFare, m.Passengers)
+			}
+			r.distance += m.MktDistance
+			r.nonStop += m.NonStopMiles
+			r.milesFlown += m.MktMilesFlown
+			r.paxMiles += m.MktDistance * float64(m.Passengers)
+			s := stopsIndex(m.MktCoupons)
+			r.stops[s].Records++
+			r.stops[s].Passengers += m.Passengers
+			r.stopsFare[s] += m.MktFare * float64(m.Passengers)
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	for i, g := range flightGrains {
+		missing := missingDims{}
+		var summary *marketSummary
+		if g == airportGrain {
+			summary = newMarketSummary()
+		}
+		keys := make([]routeKey, 0, len(routes[i]))
+		for k := range routes[i] {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(x, y int) bool {
+			if keys[x].origin != keys[y].origin {
+				return keys[x].origin < keys[y].origin
+			}
+			return keys[x].dest < keys[y].dest
+		})
+		for _, k := range keys {
+			r := routes[i][k]
+			af := &AirportFlight{}
+			af.Year = year
+			af.Quarter = quarter
+			af.AvgFare = r.fareSum / float64(r.count)
+			af.Passengers = r.passengers
+			if r.passengers > 0 {
+				af.WeightedAvgFare = r.revenue / float64(r.passengers)
+				af.Revenue = scaled(r.revenue)
+			}
+			fillEstimatedPassengers(af)
+			af.Filter = marketFilter
+			fillFareStats(af, r.fareDist.stats())
+			n := float64(r.count)
+			weightedDistance := 0.0
+			if r.passengers > 0 {
+				weightedDistance = r.paxMiles / float64(r.passengers)
+			}
+			fillDistanceStats(af, r.distance/n, r.nonStop/n, r.milesFlown/n, weightedDistance)
+			for s := range r.stops {
+				if r.stops[s].Passengers > 0 {
+					r.stops[s].AvgFare = r.stopsFare[s] / float64(r.stops[s].Passengers)
+				}
+			}
+			fillStops(af, r.stops)
+			g.fillInfo(af, dims, k.origin, k.dest, missing)
+			if err = out.Write(g.index, g.id(af), af); err != nil {
+				panic(err)
+			}
+			if summary != nil {
+				summary.add(af)
+			}
+		}
+		fmt.Println(g.index, "allcount:", len(keys))
+		missing.report(g.index)
+		if summary != nil {
+			summary.write(year, quarter)
+		}
+	}
+	out.FlushPeriod(year, quarter)
+}
+
+// 已排序数据的百分位数，在相邻两个值之间线性插值
+func percentile(sorted []float64, percent float64) float64 {
+	rank := percent / 100 * float64(len(sorted)-1)
+	i := int(rank)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (sorted[i+1]-sorted[i])*(rank-float64(i))
+}
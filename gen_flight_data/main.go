@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"github.com/olivere/elastic/v7"
@@ -10,198 +9,599 @@ import (
 
 	"io"
 	"log"
+	"math"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
+
+	"common"
 )
 
 var (
 	client *elastic.Client
+	out    *common.CountingSink
 )
 
-// key:城市id value:城市名称
-var cityMap = map[string]string{}
-
-// key:机场代码 value:机场名称
-var airportMap = map[string]string{}
+// 城市维度、机场名称及其解析质量报告
+var lookups = common.NewLookups()
 
 var market_index_name = "markets"
 var airport_flights_index_name = "airport_flights"
 
 var actualNumCPU = runtime.GOMAXPROCS(0)
-var bulkActions = 1000
+
+// DB1B 为 10% 抽样，估算乘客数 = 抽样乘客数 × passengerScale
+var passengerScale = 10.0
+
+// 参与聚合的 markets 记录筛选条件
+var marketFilter MarketFilter
+
+// 并行翻页配置，config.json 中 parallel 配置
+var parallel common.ParallelConfig
 
 type DateArg struct {
 	Year    int
 	Quarter int
 }
 
+type Config struct {
+	Dates []DateArg           `json:"dates"`
+	Sinks []common.SinkConfig `json:"sinks"`
+	Local *common.LocalConfig `json:"local"` // 本地计算模式，不配置时从ES聚合
+
+	PassengerScale float64      `json:"passenger_scale"` // 抽样乘客数的放大倍数，默认 10
+	Filter         MarketFilter `json:"filter"`          // markets 记录筛选条件，不配置时聚合全部记录
+	Grains         []string     `json:"grains"`          // 聚合粒度 airport、city_market、airport_pair、city_market_pair，默认只生成 airport
+	Reports        []string     `json:"reports"`         // 附加报表，如 route_carrier_share，默认不生成
+
+	StateFlowsMatrixDir string `json:"state_flows_matrix_dir"` // state_flows 报表的乘客数矩阵 CSV 输出目录，不配置时不导出
+
+	Parallel    common.ParallelConfig    `json:"parallel"`    // 并行翻页复合聚合，不配置时顺序翻页
+	Concurrency common.ConcurrencyConfig `json:"concurrency"` // 同时处理多个季度，不配置时逐季度处理
+	Bulk        common.BulkConfig        `json:"bulk"`        // ES 批量写入的批大小和重试，不配置时使用默认值
+
+	Compare []common.CompareConfig `json:"compare"` // 需要计算环比、同比的索引，默认不计算
+}
+
+// 计算环比、同比的索引
+var compareConfigs []common.CompareConfig
+
+// 各索引默认的 key 和比较字段，config.json 的 compare 中只配置 index 时使用
+var compareDefaults = []common.CompareConfig{
+	{Index: airport_flights_index_name, Period: "quarter", Keys: []string{"origin_airport", "dest_airport"}, Fields: []string{"passengers", "avg_fare", "weighted_avg_fare"}},
+	{Index: cityMarketGrain.index, Period: "quarter", Keys: []string{"origin_city_market_id", "dest_city_market_id"}, Fields: []string{"passengers", "avg_fare", "weighted_avg_fare"}},
+	{Index: airportPairGrain.index, Period: "quarter", Keys: []string{"origin_airport", "dest_airport"}, Fields: []string{"passengers", "avg_fare", "weighted_avg_fare"}},
+	{Index: cityMarketPairGrain.index, Period: "quarter", Keys: []string{"origin_city_market_id", "dest_city_market_id"}, Fields: []string{"passengers", "avg_fare", "weighted_avg_fare"}},
+	{Index: route_carrier_share_index_name, Period: "quarter", Keys: []string{"origin_airport", "dest_airport"}, Fields: []string{"passengers", "hhi"}},
+	{Index: distance_band_fares_index_name, Period: "quarter", Keys: []string{"distance_group"}, Fields: []string{"passengers", "avg_fare", "yield"}},
+	{Index: airport_market_summary_index_name, Period: "quarter", Keys: []string{"airport"}, Fields: []string{"origin_passengers", "dest_passengers", "markets", "avg_fare"}},
+	{Index: route_connecting_hubs_index_name, Period: "quarter", Keys: []string{"origin_airport", "dest_airport"}, Fields: []string{"passengers", "connecting_passengers"}},
+	{Index: state_flows_index_name, Period: "quarter", Keys: []string{"level", "origin", "dest"}, Fields: []string{"passengers", "weighted_avg_fare", "routes"}},
+}
+
+// MarketFilter 按分析 DB1B 时常用的清洗规则筛选 markets 记录，未配置的条件不生效
+type MarketFilter struct {
+	MinFare              *float64 `json:"min_fare,omitempty"`               // 最低票价（包含），用于排除 0 票价和接近 0 的里程兑换票
+	MaxFare              *float64 `json:"max_fare,omitempty"`               // 最高票价（包含），用于排除不合理的高票价
+	ExcludeBulk          bool     `json:"exclude_bulk,omitempty"`           // 排除团体票 bulk_fare=1
+	MktGeoTypes          []int    `json:"mkt_geo_types,omitempty"`          // 只保留这些 mkt_geo_type，如 [2] 为只保留本土航线
+	ItinGeoTypes         []int    `json:"itin_geo_types,omitempty"`         // 只保留这些 itin_geo_type
+	ExcludeCarrierGroups []string `json:"exclude_carrier_groups,omitempty"` // 排除出票或实际承运航司属于这些分组的记录
+}
+
 func main() {
+	config := getDataConfig()
+	if config == nil || len(config.Dates) == 0 {
+		fmt.Println("配置文件解析失败")
+		os.Exit(0)
+	}
+	if config.PassengerScale > 0 {
+		passengerScale = config.PassengerScale
+	}
+	marketFilter = config.Filter
+	stateFlowsMatrixDir = config.StateFlowsMatrixDir
+	parallel = config.Parallel
+	var err error
+	flightGrains, err = selectGrains(config.Grains)
+	if err != nil {
+		fmt.Println("配置文件错误:", err)
+		os.Exit(0)
+	}
+	flightReports, err = selectReports(config.Reports)
+	if err != nil {
+		fmt.Println("配置文件错误:", err)
+		os.Exit(0)
+	}
+	compareConfigs, err = common.ResolveCompareConfigs(config.Compare, compareDefaults)
+	if err == nil {
+		err = common.CheckCompareSinks(compareConfigs, config.Sinks)
+	}
+	if err != nil {
+		fmt.Println("配置文件错误:", err)
+		os.Exit(0)
+	}
 	//连接数据库
-	connectEs()
-	initFlightsIndex()
+	if config.Local == nil || common.HasEsSink(config.Sinks) {
+		connectEs()
+	}
+	if common.HasEsSink(config.Sinks) {
+		initFlightsIndex()
+		initReportIndices()
+	}
+	common.EsWriteWorkers = config.Concurrency.EsWrite
+	common.Bulk = config.Bulk
+	sinks, err := common.NewSinks(config.Sinks, client)
+	if err != nil {
+		fmt.Println("创建输出失败:", err)
+		os.Exit(0)
+	}
+	out = common.NewCountingSink(sinks)
+	defer out.Close()
 	//// 设置要使用的最大CPU核心数
 	runtime.GOMAXPROCS(actualNumCPU)
 	fmt.Println("CPU核心数:", actualNumCPU)
 	//读取机场和地区信息
-	readCityMarketID()
-	readAirportCode()
+	readLookups()
+	lookups.Cities.Quality.Report("城市、机场表")
+	common.ReadAirportMaster()
+	airportDims = loadAirportDims()
 
-	arr := getDataConfig()
-	if arr == nil || len(arr) == 0 {
-		fmt.Println("配置文件解析失败")
-		os.Exit(0)
-	}
 	start := time.Now().Unix()
-	for _, tt := range arr {
-		processFlightsData(tt.Year, tt.Quarter)
+	periods := make([]string, len(config.Dates))
+	for i, tt := range config.Dates {
+		periods[i] = fmt.Sprintf("%d-Q%d", tt.Year, tt.Quarter)
+	}
+	network, cpu := common.NewLimiter(config.Concurrency.Network), common.NewLimiter(config.Concurrency.Cpu)
+	results := common.RunPeriods(periods, config.Concurrency.Periods, func(i int) (int64, string, error) {
+		tt := config.Dates[i]
+		if config.Local != nil {
+			cpu.Do(func() {
+				localFlightsData(config.Local.DataDir, tt.Year, tt.Quarter)
+				for _, r := range flightReports {
+					r.local(config.Local.DataDir, tt.Year, tt.Quarter)
+				}
+			})
+		} else {
+			network.Do(func() {
+				processFlightsData(tt.Year, tt.Quarter)
+				for _, r := range flightReports {
+					r.es(tt.Year, tt.Quarter)
+				}
+			})
+		}
+		return out.Count(tt.Year, tt.Quarter), "", out.Failed(tt.Year, tt.Quarter)
+	})
+	// 环比、同比要读取上一期的文档，所有季度生成完成后再按配置的顺序计算
+	for i, tt := range config.Dates {
+		if results[i].Err == nil {
+			results[i].Err = common.ComparePeriod(client, out, compareConfigs, tt.Year, tt.Quarter)
+		}
 	}
+	common.PrintPeriodSummary(results)
+	common.ReportMissingLocations()
 	fmt.Println("总耗时", time.Now().Unix()-start, "s")
 }
 func processFlightsData(year, quarter int) {
-	ctx := context.Background()
-	boolQuery := elastic.NewBoolQuery().
-		Must(
-			elastic.NewTermQuery("year", year),
-			elastic.NewTermQuery("quarter", quarter),
-		)
+	for _, g := range flightGrains {
+		processGrainFlightsData(g, airportDims, year, quarter)
+	}
+}
+
+// 按一种粒度聚合 markets 写入该粒度的索引
+func processGrainFlightsData(g *grain, dims *dimensions, year, quarter int) {
+	scan := common.CompositeScan{Client: client, Index: market_index_name, Query: marketFilter.query(year, quarter),
+		Name: "unique_routes", NewAgg: func() *elastic.CompositeAggregation { return newGrainAggregation(g) }, Field: g.partitionField()}
+
+	// 机场粒度同时累加各机场的 O&D 乘客汇总
+	var summary *marketSummary
+	if g == airportGrain {
+		summary = newMarketSummary()
+	}
+
+	// 票价分布先单独聚合，再按 origin、dest 与航线合并
+	fares, err := loadFareStats(g, year, quarter)
+	if err != nil {
+		panic(err)
+	}
+
+	// 机场、城市信息在启动时由 loadAirportDims 从机场主数据读取，不在每个分组中取
+	missing := missingDims{}
+	var count = 0
+	err = scan.Run(parallel, func(bucket *elastic.AggregationBucketCompositeItem) {
+		count++
+		af := &AirportFlight{}
+		af.Year = year
+		af.Quarter = quarter
+		origin, dest := cast.ToString(bucket.Key["origin"]), cast.ToString(bucket.Key["dest"])
+		//af.FlightNum = cast.ToInt(bucket.DocCount)
+
+		avgFare, _ := bucket.Aggregations.Avg("average_fare")
+		totalPassengers, _ := bucket.Aggregations.Sum("total_passengers")
+		if avgFare.Value != nil {
+			af.AvgFare = cast.ToFloat64(*avgFare.Value)
+		} else {
+			af.AvgFare = 0 // 设置默认值为 0
+		}
+		if totalPassengers.Value != nil {
+			af.Passengers = cast.ToInt(*totalPassengers.Value)
+		} else {
+			af.Passengers = 0 // 设置默认值为 0
+		}
+		weightedFare, _ := bucket.Aggregations.WeightedAvg("weighted_fare")
+		if weightedFare != nil && weightedFare.Value != nil && af.Passengers > 0 {
+			af.WeightedAvgFare = *weightedFare.Value
+			af.Revenue = scaled(*weightedFare.Value * float64(af.Passengers))
+		}
+		fillEstimatedPassengers(af)
+		af.Filter = marketFilter
+		fillFareStats(af, fares[routeKey{origin, dest}])
+		fillDistanceStatsFromAggs(af, bucket.Aggregations)
+		fillStopsFromAggs(af, bucket.Aggregations)
+		g.fillInfo(af, dims, origin, dest, missing)
+
+		if err := out.Write(g.index, g.id(af), af); err != nil {
+			panic(err)
+		}
+		if summary != nil {
+			summary.add(af)
+		}
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(g.index, "allcount:", count)
+	missing.report(g.index)
+	if summary != nil {
+		summary.write(year, quarter)
+	}
+	out.FlushPeriod(year, quarter)
+
+}
+
+// 一条航线的分组 key，与复合聚合的 origin、dest 分组一致
+type routeKey struct {
+	origin, dest string
+}
+
+// 粒度的复合聚合，分组为 origin、dest，子聚合计算平均票价、乘客数、距离和经停
+func newGrainAggregation(g *grain) *elastic.CompositeAggregation {
 	// 定义复合聚合查询
-	compositeAgg := elastic.NewCompositeAggregation().Size(10000).Sources(
-		elastic.NewCompositeAggregationTermsValuesSource("origin").Field("origin"),
-		elastic.NewCompositeAggregationTermsValuesSource("dest").Field("dest"))
+	// 每个分组连同 stops 的 3 个子桶共 4 个桶，每页 500 个分组共 2000 个桶，不会超过 ES 的 search.max_buckets。
+	// 票价分布每条航线的桶数不固定，不在这里作为子聚合，由 newFareDistributionAggregation 单独聚合
+	compositeAgg := elastic.NewCompositeAggregation().Size(500).Sources(g.sources()...)
 	// 子聚合，用于计算平均票价和乘客总数
 	avgFareAgg := elastic.NewAvgAggregation().Field("mkt_fare").Missing(0)      // 当 mkt_fare 缺失时，使用 0 计算平均值
 	passengersAgg := elastic.NewSumAggregation().Field("passengers").Missing(0) // 当 passengers 缺失时，使用 0 计算总和
 	compositeAgg = compositeAgg.
 		SubAggregation("average_fare", avgFareAgg).
-		SubAggregation("total_passengers", passengersAgg)
-	// 定义子聚合（top_hits用于获取origin_country和origin_state）
-	topHitsAgg := elastic.NewTopHitsAggregation().
-		Size(1). // 只需要返回1条记录
-		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("origin_city_market_id", "origin_state", "origin_state_name", "origin_country", "dest_city_market_id", "dest_state", "dest_state_name", "dest_country"))
-
-	w, err := client.BulkProcessor().
-		BulkActions(bulkActions).
-		FlushInterval(time.Second).
-		Workers(actualNumCPU).
-		Stats(true).
-		After(GetFailed).
-		Do(ctx)
-	if err != nil {
-		// Handle error
-		panic(err)
+		SubAggregation("total_passengers", passengersAgg).
+		SubAggregation("weighted_fare", newPassengerWeightedAvg("mkt_fare"))
+	// 距离：平均市场距离、直飞距离、实际飞行距离，按乘客数加权的市场距离用于计算收益率
+	compositeAgg = compositeAgg.
+		SubAggregation("avg_distance", elastic.NewAvgAggregation().Field("mkt_distance").Missing(0)).
+		SubAggregation("avg_non_stop_miles", elastic.NewAvgAggregation().Field("non_stop_miles").Missing(0)).
+		SubAggregation("avg_miles_flown", elastic.NewAvgAggregation().Field("mkt_miles_flown").Missing(0)).
+		SubAggregation("weighted_distance", newPassengerWeightedAvg("mkt_distance"))
+	// 按 mkt_coupons 区分直飞、经停一次、经停两次及以上
+	compositeAgg = compositeAgg.SubAggregation("stops", newStopsAggregation())
+	return compositeAgg
+}
+
+// 补充机场、城市、州、国家信息，origin、dest 为出发地、目的地的维度
+func fillAirportFlightInfo(af *AirportFlight, origin, dest *AirportDim) {
+	af.OriginAirportName = lookups.AirportName(af.OriginAirport)
+	af.OriginCityMarketID = origin.CityMarketID
+	af.OriginCityName = lookups.Cities.Name(cast.ToString(origin.CityMarketID))
+	af.OriginState = origin.State
+	af.OriginStateName = origin.StateName
+	af.OriginCountry = origin.Country
+
+	af.DestAirportName = lookups.AirportName(af.DestAirport)
+	af.DestCityMarketID = dest.CityMarketID
+	af.DestCityName = lookups.Cities.Name(cast.ToString(dest.CityMarketID))
+	af.DestState = dest.State
+	af.DestStateName = dest.StateName
+	af.DestCountry = dest.Country
+
+	af.OriginLocation = common.AirportLocation(af.OriginAirport)
+	af.DestLocation = common.AirportLocation(af.DestAirport)
+	af.GreatCircleMiles = common.GreatCircleMiles(af.OriginLocation, af.DestLocation)
+}
+
+// 指定季度且满足筛选条件的 markets 记录
+func (f MarketFilter) query(year, quarter int) *elastic.BoolQuery {
+	q := elastic.NewBoolQuery().
+		Must(
+			elastic.NewTermQuery("year", year),
+			elastic.NewTermQuery("quarter", quarter),
+		)
+	if f.MinFare != nil {
+		q = q.Filter(elastic.NewRangeQuery("mkt_fare").Gte(*f.MinFare))
 	}
-	w.Start(ctx)
-	defer w.Close()
+	if f.MaxFare != nil {
+		q = q.Filter(elastic.NewRangeQuery("mkt_fare").Lte(*f.MaxFare))
+	}
+	if f.ExcludeBulk {
+		q = q.MustNot(elastic.NewTermQuery("bulk_fare", 1))
+	}
+	if len(f.MktGeoTypes) > 0 {
+		q = q.Filter(elastic.NewTermsQuery("mkt_geo_type", intValues(f.MktGeoTypes)...))
+	}
+	if len(f.ItinGeoTypes) > 0 {
+		q = q.Filter(elastic.NewTermsQuery("itin_geo_type", intValues(f.ItinGeoTypes)...))
+	}
+	if len(f.ExcludeCarrierGroups) > 0 {
+		groups := make([]interface{}, len(f.ExcludeCarrierGroups))
+		for i, g := range f.ExcludeCarrierGroups {
+			groups[i] = g
+		}
+		q = q.MustNot(
+			elastic.NewTermsQuery("tk_carrier_group", groups...),
+			elastic.NewTermsQuery("op_carrier_group", groups...),
+		)
+	}
+	return q
+}
 
-	var afterKey map[string]interface{}
-	var count = 0
-	for {
-		// 每次查询时将 afterKey 传递给聚合
-		if afterKey != nil {
-			compositeAgg = compositeAgg.AggregateAfter(afterKey)
+// 本地计算模式下判断一条记录是否满足筛选条件，与 query 一致
+func (f MarketFilter) match(m *Market) bool {
+	if f.MinFare != nil && m.MktFare < *f.MinFare {
+		return false
+	}
+	if f.MaxFare != nil && m.MktFare > *f.MaxFare {
+		return false
+	}
+	if f.ExcludeBulk && m.BulkFare == 1 {
+		return false
+	}
+	if len(f.MktGeoTypes) > 0 && !containsInt(f.MktGeoTypes, m.MktGeoType) {
+		return false
+	}
+	if len(f.ItinGeoTypes) > 0 && !containsInt(f.ItinGeoTypes, m.ItinGeoType) {
+		return false
+	}
+	for _, g := range f.ExcludeCarrierGroups {
+		if m.TkCarrierGroup == g || m.OpCarrierGroup == g {
+			return false
 		}
-		// 组合查询
-		searchResult, err := client.Search().
-			Index(market_index_name). // 索引名称
-			Query(boolQuery).         // 添加查询条件
-			Size(0).                  // 我们不需要返回文档，设置为0
-			Aggregation("unique_routes", compositeAgg.SubAggregation("route_info", topHitsAgg)).
-			Do(ctx)
-		if err != nil {
-			panic(err)
+	}
+	return true
+}
+
+func intValues(values []int) []interface{} {
+	res := make([]interface{}, len(values))
+	for i, v := range values {
+		res[i] = v
+	}
+	return res
+}
+
+func containsInt(values []int, v int) bool {
+	for _, x := range values {
+		if x == v {
+			return true
 		}
+	}
+	return false
+}
 
-		// 处理结果
-		agg, _ := searchResult.Aggregations.Composite("unique_routes")
-		for _, bucket := range agg.Buckets {
-			count++
-			af := &AirportFlight{}
-			af.Year = year
-			af.Quarter = quarter
-			af.OriginAirport = cast.ToString(bucket.Key["origin"])
-			af.DestAirport = cast.ToString(bucket.Key["dest"])
-			//af.FlightNum = cast.ToInt(bucket.DocCount)
+// 按乘客数加权的平均值，一条记录代表 passengers 个乘客
+func newPassengerWeightedAvg(field string) *elastic.WeightedAvgAggregation {
+	return elastic.NewWeightedAvgAggregation().
+		Value(&elastic.MultiValuesSourceFieldConfig{FieldName: field, Missing: 0}).
+		Weight(&elastic.MultiValuesSourceFieldConfig{FieldName: "passengers", Missing: 0})
+}
 
-			avgFare, _ := bucket.Aggregations.Avg("average_fare")
-			totalPassengers, _ := bucket.Aggregations.Sum("total_passengers")
-			if avgFare.Value != nil {
-				af.AvgFare = cast.ToFloat64(*avgFare.Value)
-			} else {
-				af.AvgFare = 0 // 设置默认值为 0
-			}
-			if totalPassengers.Value != nil {
-				af.Passengers = cast.ToInt(*totalPassengers.Value)
-			} else {
-				af.Passengers = 0 // 设置默认值为 0
-			}
+// 从距离子聚合取平均距离，计算绕航系数和收益率
+func fillDistanceStatsFromAggs(af *AirportFlight, aggs elastic.Aggregations) {
+	value := func(agg *elastic.AggregationValueMetric, found bool) float64 {
+		if !found || agg.Value == nil {
+			return 0
+		}
+		return *agg.Value
+	}
+	avgDistance := value(aggs.Avg("avg_distance"))
+	nonStopMiles := value(aggs.Avg("avg_non_stop_miles"))
+	milesFlown := value(aggs.Avg("avg_miles_flown"))
+	weightedDistance := value(aggs.WeightedAvg("weighted_distance"))
+	fillDistanceStats(af, avgDistance, nonStopMiles, milesFlown, weightedDistance)
+}
+
+// 绕航系数 = 实际飞行距离 / 直飞距离，收益率 = 票价收入 / 乘客英里数，即加权平均票价 / 加权平均距离
+func fillDistanceStats(af *AirportFlight, avgDistance, nonStopMiles, milesFlown, weightedDistance float64) {
+	af.AvgDistance = avgDistance
+	af.NonStopMiles = nonStopMiles
+	af.AvgMilesFlown = milesFlown
+	if nonStopMiles > 0 {
+		af.Circuity = round4(milesFlown / nonStopMiles)
+	}
+	if weightedDistance > 0 && af.Passengers > 0 {
+		af.Yield = round4(af.WeightedAvgFare / weightedDistance)
+	}
+}
 
-			topHits, _ := bucket.Aggregations.TopHits("route_info")
+func round4(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
 
-			if topHits == nil || topHits.Hits.TotalHits.Value <= 0 || len(topHits.Hits.Hits) <= 0 {
-				fmt.Println("No hits found for this bucket.origin:", af.OriginAirport, "dest:", af.DestAirport)
-				continue
-			}
-			hit := topHits.Hits.Hits[0]
-
-			var source map[string]interface{}
-			_ = json.Unmarshal(hit.Source, &source)
-			af.OriginAirportName = airportMap[af.OriginAirport]
-			af.OriginCityName = cityMap[cast.ToString(source["origin_city_market_id"])]
-			af.OriginState = cast.ToString(source["origin_state"])
-			af.OriginStateName = cast.ToString(source["origin_state_name"])
-			af.OriginCountry = cast.ToString(source["origin_country"])
-
-			af.DestAirportName = airportMap[af.DestAirport]
-			af.DestCityName = cityMap[cast.ToString(source["dest_city_market_id"])]
-			af.DestState = cast.ToString(source["dest_state"])
-			af.DestStateName = cast.ToString(source["dest_state_name"])
-			af.DestCountry = cast.ToString(source["dest_country"])
+// 按抽样比例估算实际乘客数
+func fillEstimatedPassengers(af *AirportFlight) {
+	af.PassengerScale = passengerScale
+	af.EstimatedPassengers = int(math.Round(float64(af.Passengers) * passengerScale))
+	af.IsEstimate = true
+}
 
-			req := elastic.NewBulkIndexRequest().Index(airport_flights_index_name).Id(strings.Join([]string{cast.ToString(af.Year), cast.ToString(af.Quarter), af.OriginAirport, af.DestAirport}, "_")).Doc(af)
+// 票价段，包含 from 不包含 to，0 票价（里程兑换等）单独一段
+type fareBand struct {
+	key      string
+	from, to float64 // from 为 0 时不限下限，to 为 0 时不限上限
+}
 
-			w.Add(req)
+var fareBands = []fareBand{
+	{key: "0", to: 0.01},
+	{key: "0-100", from: 0.01, to: 100},
+	{key: "100-200", from: 100, to: 200},
+	{key: "200-300", from: 200, to: 300},
+	{key: "300-500", from: 300, to: 500},
+	{key: "500-1000", from: 500, to: 1000},
+	{key: "1000+", from: 1000},
+}
+
+func (b fareBand) contains(fare float64) bool {
+	return (b.from == 0 || fare >= b.from) && (b.to == 0 || fare < b.to)
+}
+
+// 票价分布复合聚合每页的分组数。每个分组只有一个 sum 子聚合，不产生子桶，每页的桶数即分组数，远小于 ES 的 search.max_buckets
+const fareDistributionPageSize = 10000
+
+// 票价分布的复合聚合：在粒度的 origin、dest 分组之后再按 mkt_fare 的取值分组，每个分组为一条航线上一种票价的乘客数。
+// ES 的 percentiles 不能按乘客数加权，按票价取值累计乘客数后计算的百分位数是精确值。
+// 缺少 mkt_fare 的记录不参与分组，与本地计算时跳过 MktFare 为空的记录一致
+func newFareDistributionAggregation(g *grain) *elastic.CompositeAggregation {
+	sources := append(g.sources(), elastic.NewCompositeAggregationTermsValuesSource("fare").Field("mkt_fare"))
+	return elastic.NewCompositeAggregation().Size(fareDistributionPageSize).Sources(sources...).
+		SubAggregation("passengers", elastic.NewSumAggregation().Field("passengers").Missing(0))
+}
+
+// 读取粒度内各航线的票价分布。分组按 origin、dest、票价排序，一条航线的分组是连续的，
+// 读完一条航线就算出结果，只保存每条航线的 fareStats，不保存所有票价
+func loadFareStats(g *grain, year, quarter int) (map[routeKey]*fareStats, error) {
+	scan := common.CompositeScan{Client: client, Index: market_index_name, Query: marketFilter.query(year, quarter),
+		Name: "fare_distribution", NewAgg: func() *elastic.CompositeAggregation { return newFareDistributionAggregation(g) }, Field: g.partitionField()}
+	res := map[routeKey]*fareStats{}
+	var k routeKey
+	var d *fareDistribution
+	err := scan.Run(parallel, func(bucket *elastic.AggregationBucketCompositeItem) {
+		key := routeKey{cast.ToString(bucket.Key["origin"]), cast.ToString(bucket.Key["dest"])}
+		if d == nil || key != k {
+			if d != nil {
+				res[k] = d.stats()
+			}
+			k, d = key, newFareDistribution()
 		}
-		afterKey = agg.AfterKey
-		if agg.AfterKey == nil {
-			break
+		passengers := 0
+		if sum, found := bucket.Aggregations.Sum("passengers"); found && sum.Value != nil {
+			passengers = cast.ToInt(*sum.Value)
 		}
+		d.add(cast.ToFloat64(bucket.Key["fare"]), passengers)
+	})
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("allcount:", count)
-	for {
-		st1 := w.Stats() //获取数据写入情况
-		var finish = true
-		for _, s := range st1.Workers {
-			if s.Queued > 0 {
-				finish = false
-				break
+	if d != nil {
+		res[k] = d.stats()
+	}
+	return res, nil
+}
+
+// fareDistribution 一条航线按票价取值累计的乘客数，ES 由 fare_distribution 复合聚合得到，本地计算时逐条记录累加
+type fareDistribution struct {
+	fares map[float64]int // key:票价，value:乘客数。有记录的票价都在其中，乘客数可以为 0
+}
+
+func newFareDistribution() *fareDistribution {
+	return &fareDistribution{fares: map[float64]int{}}
+}
+
+func (d *fareDistribution) add(fare float64, passengers int) {
+	d.fares[fare] += passengers
+}
+
+// fareStats 一条航线的票价分布，除最低、最高票价外都按乘客数加权
+type fareStats struct {
+	min, max, stdDev        float64
+	p10, p25, p50, p75, p90 float64
+	bands                   []int // 与 fareBands 对应的乘客数
+}
+
+// 计算票价分布：百分位数取累计乘客数达到该比例的最低票价，标准差为按乘客数加权的总体标准差，
+// 最低、最高票价为有记录的票价（不论乘客数）。没有乘客时百分位数和标准差为 0
+func (d *fareDistribution) stats() *fareStats {
+	s := &fareStats{bands: make([]int, len(fareBands))}
+	if len(d.fares) == 0 {
+		return s
+	}
+	fares := make([]float64, 0, len(d.fares))
+	passengers, revenue := 0, 0.0
+	for fare, n := range d.fares {
+		fares = append(fares, fare)
+		passengers += n
+		revenue += fare * float64(n)
+		for i, b := range fareBands {
+			if b.contains(fare) {
+				s.bands[i] += n
 			}
 		}
-		if finish {
-			break
+	}
+	sort.Float64s(fares)
+	s.min, s.max = fares[0], fares[len(fares)-1]
+	if passengers == 0 {
+		return s
+	}
+	mean := revenue / float64(passengers)
+	variance := 0.0
+	for fare, n := range d.fares {
+		variance += float64(n) * (fare - mean) * (fare - mean)
+	}
+	s.stdDev = math.Sqrt(variance / float64(passengers))
+	percentile := func(percent float64) float64 {
+		target := percent / 100 * float64(passengers)
+		cum := 0
+		for _, fare := range fares {
+			cum += d.fares[fare]
+			if float64(cum) >= target {
+				return fare
+			}
 		}
+		return s.max
+	}
+	s.p10, s.p25, s.p50, s.p75, s.p90 = percentile(10), percentile(25), percentile(50), percentile(75), percentile(90)
+	return s
+}
 
+// 写入票价分布，s 为 nil（航线的记录都缺少票价）时各票价段的乘客数为 0，其余字段为 0
+func fillFareStats(af *AirportFlight, s *fareStats) {
+	if s == nil {
+		s = newFareDistribution().stats()
+	}
+	af.MinFare = scaled(s.min)
+	af.MaxFare = scaled(s.max)
+	af.FareStdDev = scaled(s.stdDev)
+	af.FareP10 = scaled(s.p10)
+	af.FareP25 = scaled(s.p25)
+	af.MedianFare = scaled(s.p50)
+	af.FareP75 = scaled(s.p75)
+	af.FareP90 = scaled(s.p90)
+	af.FareBands = make([]FareBandCount, len(fareBands))
+	for i, b := range fareBands {
+		af.FareBands[i] = FareBandCount{Band: b.key, Passengers: s.bands[i]}
 	}
+}
 
+func airportFlightId(af *AirportFlight) string {
+	return strings.Join([]string{cast.ToString(af.Year), cast.ToString(af.Quarter), af.OriginAirport, af.DestAirport}, "_")
 }
 
 // 获取下载数据配置
-func getDataConfig() []DateArg {
-	var config = []DateArg{}
-	f, err := os.Open("config.json")
+func getDataConfig() *Config {
+	var config = Config{}
+	b, err := os.ReadFile("config.json")
 	if err != nil {
 		fmt.Println("读取配置文件失败:", err)
 		return nil
 	}
-	defer f.Close()
-	encoder := json.NewDecoder(f)
-	err = encoder.Decode(&config)
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "[") {
+		err = json.Unmarshal(b, &config.Dates)
+	} else {
+		err = json.Unmarshal(b, &config)
+	}
 	if err != nil {
 		fmt.Println("解析配置文件失败:", err)
 		return nil
 	}
-	return config
+	return &config
 }
 
 /*
@@ -220,26 +620,13 @@ func queryAirportFlightByYearQuarter(year, quarter int) {
 	compositeAgg := elastic.NewCompositeAggregation().Size(10000).Sources(
 		elastic.NewCompositeAggregationTermsValuesSource("origin").Field("origin"),
 		elastic.NewCompositeAggregationTermsValuesSource("dest").Field("dest"))
-	// 定义子聚合（top_hits用于获取origin_country和origin_state）
-	topHitsAgg := elastic.NewTopHitsAggregation().
-		Size(1). // 只需要返回1条记录
-		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("origin_city_market_id", "origin_state", "origin_state_name", "origin_country", "dest_city_market_id", "dest_state", "dest_state_name", "dest_country"))
+	dims := airportDims
+	missing := missingDims{}
 
 	var afterKey map[string]interface{}
 	//var count = 0
 	ctx := context.Background()
-	w, err := client.BulkProcessor().
-		BulkActions(bulkActions).
-		FlushInterval(time.Second).
-		Workers(actualNumCPU).
-		Stats(true).
-		After(GetFailed).
-		Do(ctx)
-	if err != nil {
-		// Handle error
-		panic(err)
-	}
-	w.Start(ctx)
+	w := common.NewBulkWriter(client, actualNumCPU)
 	defer w.Close()
 
 	for {
@@ -252,7 +639,7 @@ func queryAirportFlightByYearQuarter(year, quarter int) {
 			Index(market_index_name). // 索引名称
 			Query(boolQuery).         // 添加查询条件
 			Size(0).                  // 我们不需要返回文档，设置为0
-			Aggregation("unique_routes", compositeAgg.SubAggregation("route_info", topHitsAgg)).
+			Aggregation("unique_routes", compositeAgg).
 			Do(ctx)
 		if err != nil {
 			panic(err)
@@ -269,22 +656,7 @@ func queryAirportFlightByYearQuarter(year, quarter int) {
 			af.DestAirport = cast.ToString(bucket.Key["dest"])
 			//af.FlightNum = cast.ToInt(bucket.DocCount)
 
-			topHits, _ := bucket.Aggregations.TopHits("route_info")
-			hit := topHits.Hits.Hits[0]
-
-			var source map[string]interface{}
-			_ = json.Unmarshal(hit.Source, &source)
-			af.OriginAirportName = airportMap[af.OriginAirport]
-			af.OriginCityName = cityMap[cast.ToString(source["origin_city_market_id"])]
-			af.OriginState = cast.ToString(source["origin_state"])
-			af.OriginStateName = cast.ToString(source["origin_state_name"])
-			af.OriginCountry = cast.ToString(source["origin_country"])
-
-			af.DestAirportName = airportMap[af.DestAirport]
-			af.DestCityName = cityMap[cast.ToString(source["dest_city_market_id"])]
-			af.DestState = cast.ToString(source["dest_state"])
-			af.DestStateName = cast.ToString(source["dest_state_name"])
-			af.DestCountry = cast.ToString(source["dest_country"])
+			airportGrain.fillInfo(af, dims, af.OriginAirport, af.DestAirport, missing)
 
 			req := elastic.NewBulkIndexRequest().Index(airport_flights_index_name).Id(strings.Join([]string{cast.ToString(af.Year), cast.ToString(af.Quarter), af.OriginAirport, af.DestAirport}, "_")).Doc(af)
 
@@ -295,21 +667,8 @@ func queryAirportFlightByYearQuarter(year, quarter int) {
 			break
 		}
 	}
-	for {
-		st1 := w.Stats() //获取数据写入情况
-
-		var finish = true
-		for _, s := range st1.Workers {
-			if s.Queued > 0 {
-				finish = false
-				break
-			}
-		}
-		if finish {
-			break
-		}
-
-	}
+	w.Flush()
+	missing.report(airport_flights_index_name)
 	//fmt.Println("最后数量", count)
 }
 
@@ -318,18 +677,8 @@ func updateAirportFlightAvgFareAndSumPassengers(year, quarter int) {
 
 	ctx := context.Background()
 
-	// 初始化 BulkProcessor
-	bulkProcessor, err := client.BulkProcessor().
-		BulkActions(bulkActions).
-		FlushInterval(time.Second).
-		Workers(actualNumCPU).
-		Stats(true).
-		After(GetFailed).
-		Do(ctx)
-	if err != nil {
-		panic(err)
-	}
-	bulkProcessor.Start(ctx)
+	// 初始化批量写入
+	bulkProcessor := common.NewBulkWriter(client, actualNumCPU)
 	defer bulkProcessor.Close()
 
 	boolQuery := elastic.NewBoolQuery().
@@ -451,86 +800,21 @@ func updateAirportFlightAvgFareAndSumPassengers(year, quarter int) {
 
 	//}
 
-	for {
-		st1 := bulkProcessor.Stats() //获取数据写入情况
-		var finish = true
-		for _, s := range st1.Workers {
-			if s.Queued > 0 {
-				finish = false
-				break
-			}
-		}
-		if finish {
-			break
-		}
-
-	}
-	st := bulkProcessor.Stats() //获取数据写入情况
-	log.Printf("bulkProcessor state Succeeded:%d Failed:%d Created:%d Updated:%d Deleted:%d Flushed:%d Committed:%d Indexed:%d\n", st.Succeeded, st.Failed, st.Created, st.Updated, st.Deleted, st.Flushed, st.Committed, st.Indexed)
+	bulkProcessor.Flush()
+	log.Println(year, quarter, "bulkProcessor", bulkProcessor.Stats())
 
 	//fmt.Println("最后航班数量", count)
 }
 
-// 读取机场到内存
-func readAirportCode() {
-	f, e := os.Open("L_AIRPORT.csv")
-	if e != nil {
-		panic(e)
-	}
-	defer f.Close()
-	reader := csv.NewReader(f)
-	var n = 0
-	var all = 0
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		all++
-		if err != nil {
-			panic(err)
-		}
-		if record[0] != "Code" {
-			n++
-			arr := strings.Split(record[1], ": ")
-			if len(arr) < 2 {
-				airportMap[record[0]] = record[1]
-			} else {
-				airportMap[record[0]] = arr[1]
-			}
-
-		}
-	}
-	fmt.Println("读取机场完成:", n)
-}
-
-// 读取城市表到内存
-func readCityMarketID() {
-
-	f, e := os.Open("L_CITY_MARKET_ID.csv")
-	if e != nil {
-		panic(e)
+// 读取城市表和机场表，描述中不能正常解析的城市记入城市维度的质量报告
+func readLookups() {
+	lookups = common.NewLookups()
+	if err := lookups.Cities.ReadCityMarkets(common.CityMarketFile); err != nil {
+		panic(err)
 	}
-	defer f.Close()
-	reader := csv.NewReader(f)
-	var n = 0
-	var all = 0
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		all++
-		if err != nil {
-			panic(err)
-		}
-		if record[0] != "Code" {
-			n++
-			arr := strings.Split(record[1], ":")
-			cityMap[record[0]] = arr[0]
-		}
+	if err := lookups.ReadAirports(common.AirportFile); err != nil {
+		panic(err)
 	}
-	fmt.Println("读取城市完成:", n)
 }
 
 func connectEs() {
@@ -548,18 +832,8 @@ func connectEs() {
 	}
 
 }
-func initFlightsIndex() {
-	ctx := context.Background()
-	exists, err := client.IndexExists(airport_flights_index_name).Do(ctx)
-	if err != nil {
-		fmt.Println("判断airport_flights_index_name是否存在失败:", err)
-		os.Exit(0)
-	}
-	if exists {
-		fmt.Println(airport_flights_index_name, "索引已存在")
-		return
-	}
-	mapping := `{
+
+var airportFlightsMapping = `{
     "mappings": {
         "properties": {
             "year": {
@@ -568,6 +842,15 @@ func initFlightsIndex() {
             "quarter": {
                 "type": "short"
             },
+            "grain": {
+                "type": "keyword"
+            },
+            "origin_city_market_id": {
+                "type": "integer"
+            },
+            "dest_city_market_id": {
+                "type": "integer"
+            },
             "origin_airport": {
                 "type": "keyword"
             },
@@ -605,6 +888,15 @@ func initFlightsIndex() {
             "dest_country": {
                 "type": "keyword"
             },
+            "origin_location": {
+                "type": "geo_point"
+            },
+            "dest_location": {
+                "type": "geo_point"
+            },
+            "great_circle_miles": {
+                "type": "float"
+            },
             "passengers": {
                 "type": "integer"
             },
@@ -612,43 +904,171 @@ func initFlightsIndex() {
                 "type": "scaled_float",
                 "scaling_factor": 100
             },
+            "weighted_avg_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "revenue": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "estimated_passengers": {
+                "type": "integer"
+            },
+            "passenger_scale": {
+                "type": "float"
+            },
+            "is_estimate": {
+                "type": "boolean"
+            },
+            "avg_distance": {
+                "type": "float"
+            },
+            "non_stop_miles": {
+                "type": "float"
+            },
+            "avg_miles_flown": {
+                "type": "float"
+            },
+            "circuity": {
+                "type": "float"
+            },
+            "yield": {
+                "type": "float"
+            },
+            "filter": {
+                "properties": {
+                    "min_fare": {
+                        "type": "float"
+                    },
+                    "max_fare": {
+                        "type": "float"
+                    },
+                    "exclude_bulk": {
+                        "type": "boolean"
+                    },
+                    "mkt_geo_types": {
+                        "type": "short"
+                    },
+                    "itin_geo_types": {
+                        "type": "short"
+                    },
+                    "exclude_carrier_groups": {
+                        "type": "keyword"
+                    }
+                }
+            },
+            "median_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "fare_p10": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "fare_p25": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "fare_p75": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "fare_p90": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "min_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "max_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "fare_std_dev": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "fare_bands": {
+                "properties": {
+                    "band": {
+                        "type": "keyword"
+                    },
+                    "passengers": {
+                        "type": "integer"
+                    }
+                }
+            },
+            "stops": {
+                "properties": {
+                    "stops": {
+                        "type": "keyword"
+                    },
+                    "records": {
+                        "type": "integer"
+                    },
+                    "passengers": {
+                        "type": "integer"
+                    },
+                    "share": {
+                        "type": "float"
+                    },
+                    "avg_fare": {
+                        "type": "scaled_float",
+                        "scaling_factor": 100
+                    }
+                }
+            },
             "flight_num": {
                 "type": "integer"
             }
         }
     }
 }`
-	index, err := client.CreateIndex(airport_flights_index_name).BodyString(mapping).Do(ctx)
+
+// 创建各聚合粒度的索引，所有粒度使用相同的 mapping，机场粒度同时生成 airport_market_summary
+func initFlightsIndex() {
+	for _, g := range flightGrains {
+		initIndex(g.index, airportFlightsMapping)
+		if g == airportGrain {
+			initIndex(airport_market_summary_index_name, airportMarketSummaryMapping)
+		}
+	}
+}
+
+// 索引不存在时按 mapping 创建
+func initIndex(indexName, mapping string) {
+	ctx := context.Background()
+	exists, err := client.IndexExists(indexName).Do(ctx)
+	if err != nil {
+		fmt.Println("判断", indexName, "是否存在失败:", err)
+		os.Exit(0)
+	}
+	if exists {
+		fmt.Println(indexName, "索引已存在")
+		return
+	}
+	index, err := client.CreateIndex(indexName).BodyString(mapping).Do(ctx)
 	if err != nil {
-		fmt.Println("创建airport_flights_index_name失败:", err)
+		fmt.Println("创建", indexName, "失败:", err)
 		os.Exit(0)
 	}
 	if !index.Acknowledged {
 		// Not acknowledged
-		fmt.Println("创建airport_flights_index_name.Acknowledged.no")
+		fmt.Println("创建", indexName, "Acknowledged.no")
 		os.Exit(0)
 	}
-	fmt.Println("initairport_flights_index_name成功")
-}
-func GetFailed(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
-	if response == nil { //可能存在为空的情况 😳
-		//log.Println("GetNil response return")
-		return
-	}
-	fi := response.Failed()
-	if len(fi) != 0 {
-		for _, f := range fi {
-			log.Printf("DebugFailedEs: index:%s type:%s id:%s version:%d  status:%d result:%s ForceRefresh:%v errorDetail:%v getResult:%v\n", f.Index, f.Type, f.Id, f.Version, f.Status, f.Result, f.ForcedRefresh, f.Error, f.GetResult)
-			//panic(f.Error)
-			return
-		}
-	}
-
+	fmt.Println("init", indexName, "成功")
 }
 
 type AirportFlight struct {
-	Year    int `json:"year"`    //年
-	Quarter int `json:"quarter"` //季度
+	Year    int    `json:"year"`    //年
+	Quarter int    `json:"quarter"` //季度
+	Grain   string `json:"grain"`   //聚合粒度 airport、city_market、airport_pair、city_market_pair
+
+	OriginCityMarketID int `json:"origin_city_market_id"` //出发地城市市场ID
+	DestCityMarketID   int `json:"dest_city_market_id"`   //目的地城市市场ID
 
 	OriginAirport     string `json:"origin_airport"`      //出发地机场代码
 	OriginAirportName string `json:"origin_airport_name"` //出发地机场名称
@@ -664,6 +1084,42 @@ type AirportFlight struct {
 	DestStateName   string `json:"dest_state_name"`   //目的地州名称
 	DestCountry     string `json:"dest_country"`      //目的地国家代码
 
+	OriginLocation   *common.GeoPoint `json:"origin_location,omitempty"`    // 出发地机场坐标，城市市场粒度和机场主数据中没有的机场不写
+	DestLocation     *common.GeoPoint `json:"dest_location,omitempty"`      // 目的地机场坐标
+	GreatCircleMiles *float64         `json:"great_circle_miles,omitempty"` // 两个机场间的大圆距离（英里），任一机场没有坐标时不写
+
 	Passengers int     `json:"passengers"` // 乘客数量
 	AvgFare    float64 `json:"avg_fare"`   // 平均市场票价
+
+	WeightedAvgFare     float64 `json:"weighted_avg_fare"`    // 按乘客数加权的平均票价
+	Revenue             float64 `json:"revenue"`              // 票价收入合计（票价×乘客数），与 passengers 一样为抽样数据
+	EstimatedPassengers int     `json:"estimated_passengers"` // 估算乘客数 = passengers × passenger_scale
+	PassengerScale      float64 `json:"passenger_scale"`      // 抽样乘客数的放大倍数
+	IsEstimate          bool    `json:"is_estimate"`          // estimated_passengers 为按抽样比例估算的值，不是实际统计
+
+	AvgDistance   float64 `json:"avg_distance"`    // 平均市场距离 mkt_distance
+	NonStopMiles  float64 `json:"non_stop_miles"`  // 平均直飞距离
+	AvgMilesFlown float64 `json:"avg_miles_flown"` // 平均实际飞行距离，含中转绕行
+	Circuity      float64 `json:"circuity"`        // 绕航系数 = avg_miles_flown / non_stop_miles
+	Yield         float64 `json:"yield"`           // 收益率，每乘客英里的票价
+
+	Filter MarketFilter `json:"filter"` // 生成该文档时生效的 markets 筛选条件
+
+	// 票价分布，百分位数按乘客数加权，为累计乘客数达到该比例的票价
+	MedianFare float64         `json:"median_fare"`  // 票价中位数
+	FareP10    float64         `json:"fare_p10"`     // 票价 10 分位数
+	FareP25    float64         `json:"fare_p25"`     // 票价 25 分位数
+	FareP75    float64         `json:"fare_p75"`     // 票价 75 分位数
+	FareP90    float64         `json:"fare_p90"`     // 票价 90 分位数
+	MinFare    float64         `json:"min_fare"`     // 最低票价
+	MaxFare    float64         `json:"max_fare"`     // 最高票价
+	FareStdDev float64         `json:"fare_std_dev"` // 票价标准差，按乘客数加权
+	FareBands  []FareBandCount `json:"fare_bands"`   // 各票价段的乘客数
+
+	Stops []StopsShare `json:"stops"` // 按直飞、经停一次、经停两次及以上分别统计的乘客数、份额和平均票价
+}
+
+type FareBandCount struct {
+	Band       string `json:"band"`       // 票价段，如 100-200
+	Passengers int    `json:"passengers"` // 乘客数
 }
@@ -0,0 +1,830 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cast"
+
+	"common"
+	"common/fakees"
+)
+
+func init() {
+	fakees.Scripts[pairKeyScript] = func(params, doc map[string]interface{}) interface{} {
+		a, b := doc[cast.ToString(params["a"])], doc[cast.ToString(params["b"])]
+		if a == nil || b == nil {
+			return nil
+		}
+		if (fakees.CompareValues(a, b) <= 0) == cast.ToBool(params["lower"]) {
+			return a
+		}
+		return b
+	}
+}
+
+// 用 testdata 下的 DB1B Market 数据准备 markets 索引
+func seedFakeES(t *testing.T) *fakees.ES {
+	es := fakees.New(t)
+	seedMarkets(t, es, "testdata")
+	return es
+}
+
+// 把 dir 下的 DB1B Market 数据写入 markets 索引，MktFare 为空的记录不写 mkt_fare 字段
+func seedMarkets(t *testing.T, es *fakees.ES, dir string) {
+	err := common.ReadLocalCsv(dir, common.MarketFileNames(2020, 1), func(header map[string]int, record []string) error {
+		m := parseMarketRecord(header, record)
+		doc := fakees.DocMap(t, m)
+		if m.FareMissing {
+			delete(doc, "mkt_fare")
+		}
+		es.Seed(market_index_name, "", doc)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 设置全局的 ES 客户端和输出并读取机场、城市表，测试结束后还原
+func useFakeES(t *testing.T, es *fakees.ES) {
+	oldClient, oldOut, oldDims, oldLookups := client, out, airportDims, lookups
+	t.Cleanup(func() {
+		client, out, airportDims, lookups = oldClient, oldOut, oldDims, oldLookups
+	})
+	client = es.Client()
+	sinks, err := common.NewSinks(nil, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = common.NewCountingSink(sinks)
+	readLookups()
+	common.ReadAirportMaster()
+	airportDims = loadAirportDims()
+}
+
+// 按顺序累加求平均，与ES和本地计算的浮点误差一致
+func avg(values ...float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// 按顺序累加求乘客加权平均，values 为 票价,乘客数 交替
+func weightedAvg(values ...float64) float64 {
+	sum, weights := 0.0, 0.0
+	for i := 0; i < len(values); i += 2 {
+		sum += values[i] * values[i+1]
+		weights += values[i+1]
+	}
+	return sum / weights
+}
+
+func wantAirportFlights() map[string]interface{} {
+	jfk := AirportFlight{OriginCityMarketID: 31703, OriginAirport: "JFK", OriginAirportName: "John F. Kennedy International", OriginCityName: "New York City, NY (Metropolitan Area)",
+		OriginState: "NY", OriginStateName: "New York", OriginCountry: "US",
+		OriginLocation: &common.GeoPoint{Lat: 40.6398, Lon: -73.7789}}
+	lax := AirportFlight{OriginCityMarketID: 32575, OriginAirport: "LAX", OriginAirportName: "Los Angeles International", OriginCityName: "Los Angeles, CA (Metropolitan Area)",
+		OriginState: "CA", OriginStateName: "California", OriginCountry: "US",
+		OriginLocation: &common.GeoPoint{Lat: 33.9425, Lon: -118.4081}}
+	ord := AirportFlight{OriginCityMarketID: 30977, OriginAirport: "ORD", OriginAirportName: "Chicago O'Hare International", OriginCityName: "Chicago, IL",
+		OriginState: "IL", OriginStateName: "Illinois", OriginCountry: "US",
+		OriginLocation: &common.GeoPoint{Lat: 41.9786, Lon: -87.9048}}
+	ewr := AirportFlight{OriginCityMarketID: 31703, OriginAirport: "EWR", OriginAirportName: "Newark Liberty International", OriginCityName: "New York City, NY (Metropolitan Area)",
+		OriginState: "NJ", OriginStateName: "New Jersey", OriginCountry: "US",
+		OriginLocation: &common.GeoPoint{Lat: 40.6925, Lon: -74.1687}}
+	sju := AirportFlight{OriginCityMarketID: 34819, OriginAirport: "SJU", OriginAirportName: "Luis Munoz Marin International", OriginCityName: "San Juan, PR",
+		OriginState: "PR", OriginStateName: "Puerto Rico", OriginCountry: "PR",
+		OriginLocation: &common.GeoPoint{Lat: 18.4394, Lon: -66.0018}}
+	// 按 airports.csv 的坐标计算的大圆距离
+	greatCircle := map[string]float64{"JFKLAX": 2469.5, "EWRORD": 717.4, "JFKSJU": 1601.9, "LAXORD": 1741.2, "EWRLAX": 2448.9}
+	// 测试数据中同一航线各记录的市场距离和直飞距离相同，未给出实际飞行距离时也与之相同
+	route := func(origin, dest AirportFlight, passengers int, avgFare, miles float64) AirportFlight {
+		af := origin
+		af.Year = 2020
+		af.Quarter = 1
+		af.Grain = "airport"
+		af.DestCityMarketID = dest.OriginCityMarketID
+		af.DestAirport = dest.OriginAirport
+		af.DestAirportName = dest.OriginAirportName
+		af.DestCityName = dest.OriginCityName
+		af.DestState = dest.OriginState
+		af.DestStateName = dest.OriginStateName
+		af.DestCountry = dest.OriginCountry
+		af.DestLocation = dest.OriginLocation
+		gcm := greatCircle[origin.OriginAirport+dest.OriginAirport] + greatCircle[dest.OriginAirport+origin.OriginAirport]
+		af.GreatCircleMiles = &gcm
+		af.Passengers = passengers
+		af.AvgFare = avgFare
+		af.WeightedAvgFare = avgFare
+		af.Revenue = avgFare * float64(passengers)
+		af.EstimatedPassengers = passengers * 10
+		af.PassengerScale = 10
+		af.IsEstimate = true
+		af.AvgDistance, af.NonStopMiles, af.AvgMilesFlown, af.Circuity = miles, miles, miles, 1
+		af.Stops = stopsShares(map[string]StopsShare{"nonstop": {Records: 1, Passengers: passengers, Share: 1, AvgFare: avgFare}})
+		return af
+	}
+	// 只有一条记录的航线，各项票价统计都等于该票价
+	single := func(origin, dest AirportFlight, passengers int, fare, miles float64, band string) AirportFlight {
+		af := route(origin, dest, passengers, fare, miles)
+		af.MinFare, af.MaxFare = fare, fare
+		af.FareP10, af.FareP25, af.MedianFare, af.FareP75, af.FareP90 = fare, fare, fare, fare, fare
+		af.FareBands = fareBandCounts(map[string]int{band: passengers})
+		return af
+	}
+	// 票价 0、199.99、250（2 人）、350、410.5，百分位数为累计乘客数达到该比例的票价，标准差按乘客数加权
+	jfkLax := route(jfk, lax, 6, avg(350, 250, 410.5, 0, 199.99), 2475)
+	jfkLax.WeightedAvgFare = weightedAvg(350, 1, 250, 2, 410.5, 1, 0, 1, 199.99, 1)
+	jfkLax.Revenue = 1460.49
+	jfkLax.MinFare, jfkLax.MaxFare, jfkLax.FareStdDev = 0, 410.5, 129.42
+	jfkLax.FareP10, jfkLax.FareP25, jfkLax.MedianFare, jfkLax.FareP75, jfkLax.FareP90 = 0, 199.99, 250, 350, 410.5
+	jfkLax.FareBands = fareBandCounts(map[string]int{"0": 1, "100-200": 1, "200-300": 2, "300-500": 2})
+	// 410.5 的记录实际飞行 2484 英里
+	jfkLax.AvgMilesFlown = avg(2475, 2475, 2484, 2475, 2475)
+	jfkLax.Circuity = round4(jfkLax.AvgMilesFlown / 2475)
+	// 410.5 的记录经 ORD 中转
+	jfkLax.Stops = stopsShares(map[string]StopsShare{
+		"nonstop": {Records: 4, Passengers: 5, Share: 0.8333, AvgFare: weightedAvg(350, 1, 250, 2, 0, 1, 199.99, 1)},
+		"1-stop":  {Records: 1, Passengers: 1, Share: 0.1667, AvgFare: 410.5},
+	})
+	// 经 DTW、CLE 两次中转
+	ordEwr := single(ord, ewr, 1, 220, 719, "200-300")
+	ordEwr.AvgMilesFlown, ordEwr.Circuity = 836, round4(836.0/719)
+	ordEwr.Stops = stopsShares(map[string]StopsShare{"2+": {Records: 1, Passengers: 1, Share: 1, AvgFare: 220}})
+	want := map[string]interface{}{
+		"2020_1_JFK_LAX": jfkLax,
+		"2020_1_LAX_JFK": single(lax, jfk, 3, 330, 2475, "300-500"),
+		"2020_1_EWR_ORD": single(ewr, ord, 2, 180.25, 719, "100-200"),
+		"2020_1_ORD_EWR": ordEwr,
+		"2020_1_JFK_SJU": single(jfk, sju, 2, 275.4, 1598, "200-300"),
+		"2020_1_LAX_ORD": single(lax, ord, 1, 260, 1744, "200-300"),
+		"2020_1_EWR_LAX": single(ewr, lax, 1, 300, 2454, "300-500"),
+	}
+	for id, af := range want {
+		want[id] = withYield(af.(AirportFlight))
+	}
+	return want
+}
+
+// 同一航线的市场距离相同，加权平均距离即平均距离
+func withYield(af AirportFlight) AirportFlight {
+	af.Yield = round4(af.WeightedAvgFare / af.AvgDistance)
+	return af
+}
+
+// 按 stopsCategories 的顺序列出直飞、经停一次、经停两次及以上，未给出的分类各项为 0
+func stopsShares(shares map[string]StopsShare) []StopsShare {
+	var res []StopsShare
+	for _, k := range []string{"nonstop", "1-stop", "2+"} {
+		share := shares[k]
+		share.Stops = k
+		res = append(res, share)
+	}
+	return res
+}
+
+// 按 fareBands 的顺序列出所有票价段，未给出的票价段乘客数为 0
+func fareBandCounts(passengers map[string]int) []FareBandCount {
+	var res []FareBandCount
+	for _, b := range []string{"0", "0-100", "100-200", "200-300", "300-500", "500-1000", "1000+"} {
+		res = append(res, FareBandCount{Band: b, Passengers: passengers[b]})
+	}
+	return res
+}
+
+// 由 wantAirportFlights 的航线汇总各机场，SJU 只有到达的乘客
+func wantAirportMarketSummary() map[string]interface{} {
+	flights := wantAirportFlights()
+	summary := func(code string, originPassengers, destPassengers, domestic int, avgFare float64, dests ...SummaryDestination) AirportMarketSummary {
+		s := AirportMarketSummary{Year: 2020, Quarter: 1, Airport: code, OriginPassengers: originPassengers, DestPassengers: destPassengers,
+			Markets: len(dests), DomesticPassengers: domestic, InternationalPassengers: originPassengers - domestic, AvgFare: avgFare, TopDestinations: dests}
+		if originPassengers > 0 {
+			s.DomesticShare = round4(float64(domestic) / float64(originPassengers))
+		}
+		for _, f := range flights {
+			af := f.(AirportFlight)
+			if af.OriginAirport == code {
+				s.AirportName, s.CityMarketID, s.CityName, s.Location = af.OriginAirportName, af.OriginCityMarketID, af.OriginCityName, af.OriginLocation
+				s.State, s.StateName, s.Country = af.OriginState, af.OriginStateName, af.OriginCountry
+			}
+			if af.DestAirport == code && s.Location == nil {
+				s.AirportName, s.CityMarketID, s.CityName, s.Location = af.DestAirportName, af.DestCityMarketID, af.DestCityName, af.DestLocation
+				s.State, s.StateName, s.Country = af.DestState, af.DestStateName, af.DestCountry
+			}
+		}
+		return s
+	}
+	dest := func(id string, share float64) SummaryDestination {
+		af := flights[id].(AirportFlight)
+		return SummaryDestination{Airport: af.DestAirport, CityName: af.DestCityName, Passengers: af.Passengers, Share: share,
+			AvgFare: af.WeightedAvgFare, MedianFare: af.MedianFare}
+	}
+	return map[string]interface{}{
+		// JFK-SJU 的目的地国家为 PR，计入国际乘客
+		"2020_1_JFK": summary("JFK", 8, 3, 6, scaled((1460.49+275.4*2)/8),
+			dest("2020_1_JFK_LAX", 0.75), dest("2020_1_JFK_SJU", 0.25)),
+		"2020_1_LAX": summary("LAX", 4, 7, 4, 312.5,
+			dest("2020_1_LAX_JFK", 0.75), dest("2020_1_LAX_ORD", 0.25)),
+		"2020_1_EWR": summary("EWR", 3, 1, 3, scaled((180.25*2+300)/3),
+			dest("2020_1_EWR_ORD", 0.6667), dest("2020_1_EWR_LAX", 0.3333)),
+		"2020_1_ORD": summary("ORD", 1, 3, 1, 220,
+			dest("2020_1_ORD_EWR", 1)),
+		"2020_1_SJU": summary("SJU", 0, 2, 0, 0),
+	}
+}
+
+func TestProcessFlightsData(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es)
+
+	initFlightsIndex()
+	processFlightsData(2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es.AssertDocs(airport_flights_index_name, wantAirportFlights())
+	es.AssertDocs(airport_market_summary_index_name, wantAirportMarketSummary())
+}
+
+// 本地计算模式与ES聚合的结果一致
+func TestLocalFlightsData(t *testing.T) {
+	es := fakees.New(t)
+	useFakeES(t, es)
+
+	localFlightsData("testdata", 2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es.AssertDocs(airport_flights_index_name, wantAirportFlights())
+	es.AssertDocs(airport_market_summary_index_name, wantAirportMarketSummary())
+}
+
+// 票价分布按乘客数计算，缺少票价的记录（5 人）不按 0 票价计算，ES 与本地计算的结果相同
+func TestMissingFares(t *testing.T) {
+	dir := t.TempDir()
+	data := "Year,Quarter,Origin,Dest,OriginCityMarketID,DestCityMarketID,MktCoupons,Passengers,MktFare\n" +
+		"2020,1,JFK,LAX,31703,32575,1,1,300.00\n" +
+		"2020,1,JFK,LAX,31703,32575,1,3,320.00\n" +
+		"2020,1,JFK,LAX,31703,32575,1,5,\n"
+	if err := os.WriteFile(filepath.Join(dir, common.MarketFileNames(2020, 1)[0]), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check := func(es *fakees.ES) {
+		t.Helper()
+		d := es.Docs(airport_flights_index_name)["2020_1_JFK_LAX"]
+		got := []float64{cast.ToFloat64(d["min_fare"]), cast.ToFloat64(d["fare_p10"]), cast.ToFloat64(d["median_fare"]), cast.ToFloat64(d["fare_p90"])}
+		if want := []float64{300, 300, 320, 320}; !reflect.DeepEqual(got, want) {
+			t.Errorf("最低票价、10 分位数、中位数、90 分位数 %v，期望 %v", got, want)
+		}
+		bands := map[string]int{}
+		for _, b := range d["fare_bands"].([]interface{}) {
+			bands[cast.ToString(b.(map[string]interface{})["band"])] = cast.ToInt(b.(map[string]interface{})["passengers"])
+		}
+		if bands["0"] != 0 || bands["300-500"] != 4 {
+			t.Errorf("票价段乘客数 %v，期望 0 票价 0 人、300-500 4 人", bands)
+		}
+	}
+
+	es := fakees.New(t)
+	seedMarkets(t, es, dir)
+	useFakeES(t, es)
+	processFlightsData(2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(es)
+
+	local := fakees.New(t)
+	useFakeES(t, local)
+	localFlightsData(dir, 2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(local)
+}
+
+// 排除 0 票价、超过 400 的票价、团体票、非本土航线和支线航司承运的记录
+func wantFilteredAirportFlights(f MarketFilter) map[string]interface{} {
+	all := wantAirportFlights()
+	want := map[string]interface{}{}
+	for _, id := range []string{"2020_1_LAX_JFK", "2020_1_ORD_EWR", "2020_1_LAX_ORD", "2020_1_EWR_LAX"} {
+		af := all[id].(AirportFlight)
+		af.Filter = f
+		want[id] = af
+	}
+	// 只剩票价 350（1 人）和 250（2 人）两条
+	af := all["2020_1_JFK_LAX"].(AirportFlight)
+	af.Filter = f
+	af.Passengers, af.EstimatedPassengers = 3, 30
+	af.AvgFare = avg(350, 250)
+	af.WeightedAvgFare = weightedAvg(350, 1, 250, 2)
+	af.Revenue = 850
+	af.MinFare, af.MaxFare, af.FareStdDev = 250, 350, 47.14
+	af.FareP10, af.FareP25, af.MedianFare, af.FareP75, af.FareP90 = 250, 250, 250, 350, 350
+	af.FareBands = fareBandCounts(map[string]int{"200-300": 2, "300-500": 1})
+	af.AvgMilesFlown, af.Circuity = 2475, 1
+	af.Stops = stopsShares(map[string]StopsShare{"nonstop": {Records: 2, Passengers: 3, Share: 1, AvgFare: af.WeightedAvgFare}})
+	want["2020_1_JFK_LAX"] = withYield(af)
+	return want
+}
+
+func testMarketFilter() MarketFilter {
+	minFare, maxFare := 10.0, 400.0
+	return MarketFilter{MinFare: &minFare, MaxFare: &maxFare, ExcludeBulk: true, MktGeoTypes: []int{2}, ExcludeCarrierGroups: []string{"2"}}
+}
+
+func TestMarketFilter(t *testing.T) {
+	f := testMarketFilter()
+	old := marketFilter
+	marketFilter = f
+	t.Cleanup(func() { marketFilter = old })
+
+	es := seedFakeES(t)
+	useFakeES(t, es)
+	processFlightsData(2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(airport_flights_index_name, wantFilteredAirportFlights(f))
+
+	local := fakees.New(t)
+	useFakeES(t, local)
+	localFlightsData("testdata", 2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	local.AssertDocs(airport_flights_index_name, wantFilteredAirportFlights(f))
+}
+
+// 各粒度的文档，只核对分组 key、城市和州信息及票价、乘客数，完整字段由 ES 与本地计算的结果互相核对
+type grainWant struct {
+	origin, dest           string // 机场粒度为机场代码，城市市场粒度为城市市场ID
+	originCity, destCity   string
+	originState, destState string
+	passengers             int
+	avgFare, medianFare    float64
+}
+
+func wantGrainFlights() map[string]map[string]grainWant {
+	nyc, la, chi, sj := "New York City, NY (Metropolitan Area)", "Los Angeles, CA (Metropolitan Area)", "Chicago, IL", "San Juan, PR"
+	return map[string]map[string]grainWant{
+		// JFK、EWR 合并为纽约，城市市场的州与城市名称一致取 JFK 的 NY
+		"city_market_flights": {
+			"2020_1_31703_32575": {"31703", "32575", nyc, la, "NY", "CA", 7, avg(350, 250, 410.5, 0, 199.99, 300), 250},
+			"2020_1_32575_31703": {"32575", "31703", la, nyc, "CA", "NY", 3, 330, 330},
+			"2020_1_31703_30977": {"31703", "30977", nyc, chi, "NY", "IL", 2, 180.25, 180.25},
+			"2020_1_30977_31703": {"30977", "31703", chi, nyc, "IL", "NY", 1, 220, 220},
+			"2020_1_31703_34819": {"31703", "34819", nyc, sj, "NY", "PR", 2, 275.4, 275.4},
+			"2020_1_32575_30977": {"32575", "30977", la, chi, "CA", "IL", 1, 260, 260},
+		},
+		// A→B 与 B→A 合并，origin 为机场代码较小的一方
+		"airport_pair_flights": {
+			"2020_1_JFK_LAX": {"JFK", "LAX", nyc, la, "NY", "CA", 9, avg(350, 250, 410.5, 0, 199.99, 330), 330},
+			"2020_1_EWR_ORD": {"EWR", "ORD", nyc, chi, "NJ", "IL", 3, avg(180.25, 220), 180.25},
+			"2020_1_JFK_SJU": {"JFK", "SJU", nyc, sj, "NY", "PR", 2, 275.4, 275.4},
+			"2020_1_LAX_ORD": {"LAX", "ORD", la, chi, "CA", "IL", 1, 260, 260},
+			"2020_1_EWR_LAX": {"EWR", "LAX", nyc, la, "NJ", "CA", 1, 300, 300},
+		},
+		// origin 为城市市场ID较小的一方
+		"city_market_pair_flights": {
+			"2020_1_31703_32575": {"31703", "32575", nyc, la, "NY", "CA", 10, avg(350, 250, 410.5, 0, 199.99, 330, 300), 300},
+			"2020_1_30977_31703": {"30977", "31703", chi, nyc, "IL", "NY", 3, avg(180.25, 220), 180.25},
+			"2020_1_31703_34819": {"31703", "34819", nyc, sj, "NY", "PR", 2, 275.4, 275.4},
+			"2020_1_30977_32575": {"30977", "32575", chi, la, "IL", "CA", 1, 260, 260},
+		},
+	}
+}
+
+func assertGrainDocs(t *testing.T, es *fakees.ES) {
+	t.Helper()
+	for index, want := range wantGrainFlights() {
+		docs := es.Docs(index)
+		if len(docs) != len(want) {
+			t.Errorf("%s 文档数 %d，期望 %d", index, len(docs), len(want))
+		}
+		for id, w := range want {
+			d, ok := docs[id]
+			if !ok {
+				t.Errorf("%s 缺少文档 %s", index, id)
+				continue
+			}
+			origin, dest := d["origin_airport"], d["dest_airport"]
+			if index == "city_market_flights" || index == "city_market_pair_flights" {
+				origin, dest = cast.ToString(d["origin_city_market_id"]), cast.ToString(d["dest_city_market_id"])
+			}
+			got := grainWant{cast.ToString(origin), cast.ToString(dest), cast.ToString(d["origin_city_name"]), cast.ToString(d["dest_city_name"]),
+				cast.ToString(d["origin_state"]), cast.ToString(d["dest_state"]), cast.ToInt(d["passengers"]), cast.ToFloat64(d["avg_fare"]), cast.ToFloat64(d["median_fare"])}
+			if got != w {
+				t.Errorf("%s 文档 %s 不一致\n got: %+v\nwant: %+v", index, id, got, w)
+			}
+		}
+	}
+}
+
+func TestFlightGrains(t *testing.T) {
+	old := flightGrains
+	flightGrains = allGrains
+	t.Cleanup(func() { flightGrains = old })
+
+	es := seedFakeES(t)
+	useFakeES(t, es)
+	initFlightsIndex()
+	processFlightsData(2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(airport_flights_index_name, wantAirportFlights())
+	assertGrainDocs(t, es)
+
+	local := fakees.New(t)
+	useFakeES(t, local)
+	localFlightsData("testdata", 2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range allGrains {
+		if !reflect.DeepEqual(local.Docs(g.index), es.Docs(g.index)) {
+			t.Errorf("%s 本地计算的结果与ES聚合不一致", g.index)
+		}
+	}
+}
+
+// 并行翻页的文档及写入顺序与顺序翻页相同，与协程数、分区数无关
+func TestParallelFlightGrains(t *testing.T) {
+	oldGrains, oldParallel := flightGrains, parallel
+	flightGrains = allGrains
+	t.Cleanup(func() { flightGrains, parallel = oldGrains, oldParallel })
+
+	run := func(p common.ParallelConfig) *fakees.ES {
+		parallel = p
+		es := seedFakeES(t)
+		useFakeES(t, es)
+		processFlightsData(2020, 1)
+		if err := out.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return es
+	}
+	ids := func(es *fakees.ES) []string {
+		var res []string
+		for _, w := range es.Writes {
+			res = append(res, w.Index+"/"+w.Id)
+		}
+		return res
+	}
+	want := run(common.ParallelConfig{})
+	for _, p := range []common.ParallelConfig{{Workers: 3}, {Workers: 2, Partitions: 2}, {Workers: 4, Partitions: 100}} {
+		es := run(p)
+		for _, g := range allGrains {
+			if !reflect.DeepEqual(es.Docs(g.index), want.Docs(g.index)) {
+				t.Errorf("%+v %s 并行翻页的结果与顺序翻页不一致", p, g.index)
+			}
+		}
+		if !reflect.DeepEqual(ids(es), ids(want)) {
+			t.Errorf("%+v 并行翻页的写入顺序与顺序翻页不一致:\n%v\n%v", p, ids(es), ids(want))
+		}
+	}
+}
+
+// 机场维度取自机场主数据，不读取 markets；纽约 31703 的州取城市名称中的 NY（JFK），不取 EWR 的 NJ
+func TestLoadAirportDims(t *testing.T) {
+	useFakeES(t, fakees.New(t))
+	if d := airportDims.airports["EWR"]; d == nil || *d != (AirportDim{CityMarketID: 31703, State: "NJ", StateName: "New Jersey", Country: "US"}) {
+		t.Errorf("EWR 的维度: %+v", d)
+	}
+	if d := airportDims.airports["SJU"]; d == nil || d.Country != "PR" {
+		t.Errorf("SJU 的维度: %+v", d)
+	}
+	if d := airportDims.cityMarkets["31703"]; d == nil || d.State != "NY" {
+		t.Errorf("城市市场 31703 的维度: %+v", d)
+	}
+}
+
+// 维度表中没有的机场记入 missing，文档中只缺少州、国家信息
+func TestMissingAirportDims(t *testing.T) {
+	dims := newDimensions()
+	dims.addAirport("JFK", AirportDim{CityMarketID: 31703, State: "NY", StateName: "New York", Country: "US"})
+	dims.buildCityMarkets()
+
+	missing := missingDims{}
+	af := &AirportFlight{}
+	airportGrain.fillInfo(af, dims, "JFK", "XXX", missing)
+	if af.OriginState != "NY" || af.DestAirport != "XXX" || af.DestState != "" {
+		t.Errorf("机场信息错误: %+v", af)
+	}
+	af = &AirportFlight{}
+	cityMarketGrain.fillInfo(af, dims, "31703", "99999", missing)
+	if af.OriginState != "NY" || af.DestCityMarketID != 99999 || af.DestState != "" {
+		t.Errorf("城市市场信息错误: %+v", af)
+	}
+	if !reflect.DeepEqual(missing, missingDims{"XXX": 1, "99999": 1}) {
+		t.Errorf("缺少的维度: %v", missing)
+	}
+}
+
+func wantRouteCarrierShares() map[string]interface{} {
+	route := func(origin, dest string, passengers int, carriers ...CarrierShare) RouteCarrierShare {
+		r := RouteCarrierShare{Year: 2020, Quarter: 1, OriginAirport: origin, DestAirport: dest, Passengers: passengers,
+			CarrierCount: len(carriers), Hhi: 10000, EffectiveCompetitors: 1, DominantCarrier: carriers[0].Carrier, DominantShare: 1, Carriers: carriers}
+		return r
+	}
+	// AA 4 人、DL 1 人、UA 1 人
+	jfkLax := route("JFK", "LAX", 6,
+		CarrierShare{Carrier: "AA", Passengers: 4, Share: 0.6667, AvgFare: weightedAvg(350, 1, 250, 2, 199.99, 1)},
+		CarrierShare{Carrier: "DL", Passengers: 1, Share: 0.1667, AvgFare: 410.5},
+		CarrierShare{Carrier: "UA", Passengers: 1, Share: 0.1667, AvgFare: 0},
+	)
+	jfkLax.Hhi, jfkLax.EffectiveCompetitors, jfkLax.DominantShare = 5000, 2, 0.6667
+	return map[string]interface{}{
+		"2020_1_JFK_LAX": jfkLax,
+		"2020_1_LAX_JFK": route("LAX", "JFK", 3, CarrierShare{Carrier: "AA", Passengers: 3, Share: 1, AvgFare: 330}),
+		"2020_1_EWR_ORD": route("EWR", "ORD", 2, CarrierShare{Carrier: "UA", Passengers: 2, Share: 1, AvgFare: 180.25}),
+		"2020_1_ORD_EWR": route("ORD", "EWR", 1, CarrierShare{Carrier: "DL", Passengers: 1, Share: 1, AvgFare: 220}),
+		"2020_1_JFK_SJU": route("JFK", "SJU", 2, CarrierShare{Carrier: "DL", Passengers: 2, Share: 1, AvgFare: 275.4}),
+		"2020_1_LAX_ORD": route("LAX", "ORD", 1, CarrierShare{Carrier: "AA", Passengers: 1, Share: 1, AvgFare: 260}),
+		"2020_1_EWR_LAX": route("EWR", "LAX", 1, CarrierShare{Carrier: "UA", Passengers: 1, Share: 1, AvgFare: 300}),
+	}
+}
+
+func TestRouteCarrierShare(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es)
+	initIndex(route_carrier_share_index_name, routeCarrierShareMapping)
+	processRouteCarrierShare(2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(route_carrier_share_index_name, wantRouteCarrierShares())
+
+	local := fakees.New(t)
+	useFakeES(t, local)
+	localRouteCarrierShare("testdata", 2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	local.AssertDocs(route_carrier_share_index_name, wantRouteCarrierShares())
+}
+
+func wantDistanceBandFares() map[string]interface{} {
+	band := func(group, records, passengers int) DistanceBandFare {
+		return DistanceBandFare{Year: 2020, Quarter: 1, DistanceGroup: group, DistanceFrom: (group - 1) * 500, DistanceTo: group * 500,
+			Records: records, Passengers: passengers}
+	}
+	// JFK→LAX 5 条、LAX→JFK、EWR→LAX
+	g5 := band(5, 7, 10)
+	g5.AvgFare = avg(350, 250, 410.5, 0, 199.99, 330, 300)
+	g5.WeightedAvgFare = weightedAvg(350, 1, 250, 2, 410.5, 1, 0, 1, 199.99, 1, 330, 3, 300, 1)
+	g5.MedianFare = 300
+	g5.AvgDistance = avg(2475, 2475, 2475, 2475, 2475, 2475, 2454)
+	g5.Yield = round4(g5.WeightedAvgFare / weightedAvg(2475, 1, 2475, 2, 2475, 1, 2475, 1, 2475, 1, 2475, 3, 2454, 1))
+	// EWR→ORD、ORD→EWR
+	g2 := band(2, 2, 3)
+	g2.AvgFare = avg(180.25, 220)
+	g2.WeightedAvgFare = weightedAvg(180.25, 2, 220, 1)
+	g2.MedianFare = 200.13
+	g2.AvgDistance = 719
+	g2.Yield = round4(g2.WeightedAvgFare / 719)
+	// JFK→SJU、LAX→ORD
+	g4 := band(4, 2, 3)
+	g4.AvgFare = avg(275.4, 260)
+	g4.WeightedAvgFare = weightedAvg(275.4, 2, 260, 1)
+	g4.MedianFare = 267.7
+	g4.AvgDistance = avg(1598, 1744)
+	g4.Yield = round4(g4.WeightedAvgFare / weightedAvg(1598, 2, 1744, 1))
+	return map[string]interface{}{
+		"2020_1_2": g2,
+		"2020_1_4": g4,
+		"2020_1_5": g5,
+	}
+}
+
+func TestDistanceBandFares(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es)
+	initIndex(distance_band_fares_index_name, distanceBandFaresMapping)
+	processDistanceBandFares(2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(distance_band_fares_index_name, wantDistanceBandFares())
+
+	local := fakees.New(t)
+	useFakeES(t, local)
+	localDistanceBandFares("testdata", 2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	local.AssertDocs(distance_band_fares_index_name, wantDistanceBandFares())
+}
+
+func wantRouteConnectingHubs() map[string]interface{} {
+	return map[string]interface{}{
+		// 6 名乘客中 1 名经 ORD 中转
+		"2020_1_JFK_LAX": RouteConnectingHubs{Year: 2020, Quarter: 1, OriginAirport: "JFK", DestAirport: "LAX", Passengers: 6, ConnectingPassengers: 1, ConnectingShare: 0.1667,
+			Hubs: []ConnectingHub{{Hub: "ORD", Passengers: 1, Share: 1}}},
+		// 经 DTW、CLE 两次中转，两个机场都计入，乘客数相同时按机场代码排序
+		"2020_1_ORD_EWR": RouteConnectingHubs{Year: 2020, Quarter: 1, OriginAirport: "ORD", DestAirport: "EWR", Passengers: 1, ConnectingPassengers: 1, ConnectingShare: 1,
+			Hubs: []ConnectingHub{{Hub: "CLE", Passengers: 1, Share: 1}, {Hub: "DTW", Passengers: 1, Share: 1}}},
+	}
+}
+
+func TestRouteConnectingHubs(t *testing.T) {
+	// 没有 coupons 索引时跳过
+	es := seedFakeES(t)
+	useFakeES(t, es)
+	processRouteConnectingHubs(2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(route_connecting_hubs_index_name, map[string]interface{}{})
+
+	err := common.ReadLocalCsv("testdata", couponFileNames(2020, 1), func(header map[string]int, record []string) error {
+		v := func(name string) string {
+			return common.CsvValue(header, record, name)
+		}
+		es.Seed(coupon_index_name, "", map[string]interface{}{
+			"year": cast.ToInt(v("Year")), "quarter": cast.ToInt(v("Quarter")), "mkt_id": cast.ToInt64(v("MktID")), "seq_num": cast.ToFloat64(v("SeqNum")),
+			"origin": v("Origin"), "dest": v("Dest"), "passengers": cast.ToFloat64(v("Passengers")),
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFakeES(t, es)
+	initIndex(route_connecting_hubs_index_name, routeConnectingHubsMapping)
+	processRouteConnectingHubs(2020, 1)
+	if err = out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(route_connecting_hubs_index_name, wantRouteConnectingHubs())
+
+	local := fakees.New(t)
+	useFakeES(t, local)
+	localRouteConnectingHubs("testdata", 2020, 1)
+	if err = out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	local.AssertDocs(route_connecting_hubs_index_name, wantRouteConnectingHubs())
+
+	// 没有 Coupon 文件时跳过
+	empty := fakees.New(t)
+	useFakeES(t, empty)
+	localRouteConnectingHubs(t.TempDir(), 2020, 1)
+	if err = out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	empty.AssertDocs(route_connecting_hubs_index_name, map[string]interface{}{})
+}
+
+func wantStateFlows() map[string]interface{} {
+	flow := func(level, origin, dest, originRegion, destRegion string, records, passengers, routes int, fareSum, revenue float64) StateFlow {
+		return StateFlow{Year: 2020, Quarter: 1, Level: level, Origin: origin, Dest: dest, OriginRegion: originRegion, DestRegion: destRegion,
+			Records: records, Passengers: passengers, Routes: routes,
+			AvgFare: scaled(fareSum / float64(records)), WeightedAvgFare: scaled(revenue / float64(passengers))}
+	}
+	// JFK、EWR 属于 Northeast，LAX 属于 West，ORD 属于 Midwest，SJU（PR）归入 Other
+	return map[string]interface{}{
+		"2020_1_state_NY_CA":              flow("state", "NY", "CA", "Northeast", "West", 5, 6, 1, 1210.49, 1460.49),
+		"2020_1_state_CA_NY":              flow("state", "CA", "NY", "West", "Northeast", 1, 3, 1, 330, 990),
+		"2020_1_state_NJ_IL":              flow("state", "NJ", "IL", "Northeast", "Midwest", 1, 2, 1, 180.25, 360.5),
+		"2020_1_state_IL_NJ":              flow("state", "IL", "NJ", "Midwest", "Northeast", 1, 1, 1, 220, 220),
+		"2020_1_state_NY_PR":              flow("state", "NY", "PR", "Northeast", "Other", 1, 2, 1, 275.4, 550.8),
+		"2020_1_state_CA_IL":              flow("state", "CA", "IL", "West", "Midwest", 1, 1, 1, 260, 260),
+		"2020_1_state_NJ_CA":              flow("state", "NJ", "CA", "Northeast", "West", 1, 1, 1, 300, 300),
+		"2020_1_region_Northeast_West":    flow("region", "Northeast", "West", "Northeast", "West", 6, 7, 2, 1510.49, 1760.49),
+		"2020_1_region_West_Northeast":    flow("region", "West", "Northeast", "West", "Northeast", 1, 3, 1, 330, 990),
+		"2020_1_region_Northeast_Midwest": flow("region", "Northeast", "Midwest", "Northeast", "Midwest", 1, 2, 1, 180.25, 360.5),
+		"2020_1_region_Midwest_Northeast": flow("region", "Midwest", "Northeast", "Midwest", "Northeast", 1, 1, 1, 220, 220),
+		"2020_1_region_Northeast_Other":   flow("region", "Northeast", "Other", "Northeast", "Other", 1, 2, 1, 275.4, 550.8),
+		"2020_1_region_West_Midwest":      flow("region", "West", "Midwest", "West", "Midwest", 1, 1, 1, 260, 260),
+	}
+}
+
+func TestStateFlows(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es)
+	initIndex(state_flows_index_name, stateFlowsMapping)
+	processStateFlows(2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es.AssertDocs(state_flows_index_name, wantStateFlows())
+
+	old := stateFlowsMatrixDir
+	stateFlowsMatrixDir = t.TempDir()
+	t.Cleanup(func() { stateFlowsMatrixDir = old })
+	local := fakees.New(t)
+	useFakeES(t, local)
+	localStateFlows("testdata", 2020, 1)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	local.AssertDocs(state_flows_index_name, wantStateFlows())
+
+	// 行、列顺序相同的乘客数方阵
+	b, err := os.ReadFile(filepath.Join(stateFlowsMatrixDir, "state_flows_region_2020_1.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "origin,Midwest,Northeast,Other,West\n" +
+		"Midwest,0,1,0,0\n" +
+		"Northeast,2,0,2,7\n" +
+		"Other,0,0,0,0\n" +
+		"West,1,3,0,0\n"
+	if string(b) != want {
+		t.Errorf("区域矩阵错误:\n%s", b)
+	}
+	if _, err = os.Stat(filepath.Join(stateFlowsMatrixDir, "state_flows_state_2020_1.csv")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestComparePeriod(t *testing.T) {
+	es := seedFakeES(t)
+	useFakeES(t, es)
+	// 上一期 2019 年 4 季度、去年同期 2019 年 1 季度
+	es.Seed(airport_flights_index_name, "2019_4_JFK_LAX", map[string]interface{}{"year": 2019, "quarter": 4, "origin_airport": "JFK", "dest_airport": "LAX", "passengers": 4})
+	es.Seed(airport_flights_index_name, "2019_4_ORD_SJU", map[string]interface{}{"year": 2019, "quarter": 4, "origin_airport": "ORD", "dest_airport": "SJU", "passengers": 2})
+	es.Seed(airport_flights_index_name, "2019_1_JFK_LAX", map[string]interface{}{"year": 2019, "quarter": 1, "origin_airport": "JFK", "dest_airport": "LAX", "passengers": 3})
+	cfgs, err := common.ResolveCompareConfigs([]common.CompareConfig{{Index: airport_flights_index_name, Fields: []string{"passengers"}}}, compareDefaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processFlightsData(2020, 1)
+	if err := common.ComparePeriod(client, out, cfgs, 2020, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	f := func(v float64) *float64 { return &v }
+	want := map[string]common.PeriodChanges{
+		"2020_1_JFK_LAX": {PrevYear: 2019, PrevPeriod: 4, Fields: map[string]common.FieldChange{
+			"passengers": {Prev: f(4), Delta: f(2), Pct: f(0.5), YoyPrev: f(3), YoyDelta: f(3), YoyPct: f(1)}}},
+		"2020_1_LAX_JFK": {PrevYear: 2019, PrevPeriod: 4, IsNew: true, IsNewYoy: true, Fields: map[string]common.FieldChange{"passengers": {}}},
+		"2020_1_ORD_SJU": {PrevYear: 2019, PrevPeriod: 4, IsNewYoy: true, Discontinued: true, Fields: map[string]common.FieldChange{
+			"passengers": {Prev: f(2), Delta: f(-2), Pct: f(-1)}}},
+	}
+	// 重复计算时之前写入的 discontinued 文档不算本期的对象
+	for i := 0; i < 2; i++ {
+		docs := es.Docs(airport_flights_index_name)
+		for id, w := range want {
+			if got := docs[id]["changes"]; !reflect.DeepEqual(got, fakees.DocMap(t, w)) {
+				t.Errorf("%s changes = %v, want %v", id, got, fakees.DocMap(t, w))
+			}
+		}
+		if ord := docs["2020_1_ORD_SJU"]; ord["passengers"] != 0.0 || ord["quarter"] != 1.0 || ord["origin_airport"] != "ORD" {
+			t.Errorf("discontinued 文档 = %v", ord)
+		}
+		if len(docs) != 3+len(wantAirportFlights())+1 {
+			t.Errorf("文档数 = %d", len(docs))
+		}
+		if err := common.ComparePeriod(client, out, cfgs, 2020, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// L_CITY_MARKET_ID、L_AIRPORT 中不能正常解析的描述记入质量报告，city_market_id 对应的城市与表中一致
+func TestCityDimension(t *testing.T) {
+	es := fakees.New(t)
+	useFakeES(t, es)
+	if c := lookups.Cities.Get("31703"); c == nil || c.City != "New York City" || c.State != "NY" || c.Source != "L_CITY_MARKET_ID" {
+		t.Errorf("31703 = %+v", c)
+	}
+	if got := lookups.AirportName("JFK"); got != "John F. Kennedy International" {
+		t.Errorf("JFK = %q", got)
+	}
+	if n := lookups.Cities.Quality.Count(common.CityNoSeparator, "L_CITY_MARKET_ID", "Unknown Point in Alaska"); n == 0 {
+		t.Error("质量报告中缺少 Unknown Point in Alaska")
+	}
+	if n := lookups.Cities.Quality.Count(common.AirportNoSeparator, "L_AIRPORT", "Unknown Point in Alaska"); n == 0 {
+		t.Error("质量报告中缺少 L_AIRPORT 的 Unknown Point in Alaska")
+	}
+	lookups.Cities.Quality.Report("测试")
+}
+
+// config.json 可以是对象，也可以是旧的日期数组
+func TestGetDataConfig(t *testing.T) {
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	for _, body := range []string{`[{"year": 1993, "quarter": 1}]`, `{"dates": [{"year": 1993, "quarter": 1}]}`} {
+		if err := os.WriteFile("config.json", []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c := getDataConfig()
+		if c == nil || !reflect.DeepEqual(c.Dates, []DateArg{{Year: 1993, Quarter: 1}}) {
+			t.Errorf("%s 解析为 %+v", body, c)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+var airport_market_summary_index_name = "airport_market_summary"
+
+// 每个机场保留的乘客数最多的目的地数
+var marketSummaryTop = 10
+
+// AirportMarketSummary 一个机场一个季度的 O&D 乘客汇总，由机场粒度的航线在同一次聚合中累加得到
+type AirportMarketSummary struct {
+	Year         int              `json:"year"`               //年
+	Quarter      int              `json:"quarter"`            //季度
+	Airport      string           `json:"airport"`            //机场代码
+	AirportName  string           `json:"airport_name"`       //机场名称
+	CityMarketID int              `json:"city_market_id"`     //城市市场ID
+	CityName     string           `json:"city_name"`          //城市名称
+	State        string           `json:"state"`              //州代码
+	StateName    string           `json:"state_name"`         //州名称
+	Country      string           `json:"country"`            //国家代码
+	Location     *common.GeoPoint `json:"location,omitempty"` //机场坐标
+
+	OriginPassengers        int     `json:"origin_passengers"`        // 从该机场出发的乘客数（抽样）
+	DestPassengers          int     `json:"dest_passengers"`          // 到达该机场的乘客数（抽样）
+	Markets                 int     `json:"markets"`                  // 从该机场出发的航线（目的地机场）数
+	DomesticPassengers      int     `json:"domestic_passengers"`      // 出发乘客中目的地与该机场国家相同的乘客数
+	InternationalPassengers int     `json:"international_passengers"` // 出发乘客中目的地为其他国家（地区）的乘客数
+	DomesticShare           float64 `json:"domestic_share"`           // 国内乘客占出发乘客的份额 0~1
+	AvgFare                 float64 `json:"avg_fare"`                 // 出发航线按乘客数加权的平均票价
+
+	TopDestinations []SummaryDestination `json:"top_destinations"` // 出发乘客数最多的目的地，按乘客数倒序
+
+	Filter MarketFilter `json:"filter"` // 生成该文档时生效的 markets 筛选条件
+}
+
+type SummaryDestination struct {
+	Airport    string  `json:"airport"`     // 目的地机场代码
+	CityName   string  `json:"city_name"`   // 目的地城市名称
+	Passengers int     `json:"passengers"`  // 乘客数
+	Share      float64 `json:"share"`       // 占出发乘客数的份额 0~1
+	AvgFare    float64 `json:"avg_fare"`    // 按乘客数加权的平均票价，与 airport_flights 的 weighted_avg_fare 相同
+	MedianFare float64 `json:"median_fare"` // 票价中位数
+}
+
+var airportMarketSummaryMapping = `{
+    "mappings": {
+        "properties": {
+            "year": {
+                "type": "integer"
+            },
+            "quarter": {
+                "type": "short"
+            },
+            "airport": {
+                "type": "keyword"
+            },
+            "airport_name": {
+                "type": "keyword"
+            },
+            "city_market_id": {
+                "type": "integer"
+            },
+            "city_name": {
+                "type": "keyword"
+            },
+            "state": {
+                "type": "keyword"
+            },
+            "state_name": {
+                "type": "keyword"
+            },
+            "country": {
+                "type": "keyword"
+            },
+            "location": {
+                "type": "geo_point"
+            },
+            "origin_passengers": {
+                "type": "integer"
+            },
+            "dest_passengers": {
+                "type": "integer"
+            },
+            "markets": {
+                "type": "integer"
+            },
+            "domestic_passengers": {
+                "type": "integer"
+            },
+            "international_passengers": {
+                "type": "integer"
+            },
+            "domestic_share": {
+                "type": "float"
+            },
+            "avg_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "top_destinations": {
+                "type": "nested",
+                "properties": {
+                    "airport": {
+                        "type": "keyword"
+                    },
+                    "city_name": {
+                        "type": "keyword"
+                    },
+                    "passengers": {
+                        "type": "integer"
+                    },
+                    "share": {
+                        "type": "float"
+                    },
+                    "avg_fare": {
+                        "type": "scaled_float",
+                        "scaling_factor": 100
+                    },
+                    "median_fare": {
+                        "type": "scaled_float",
+                        "scaling_factor": 100
+                    }
+                }
+            },
+            "filter": {
+                "properties": {
+                    "min_fare": {
+                        "type": "float"
+                    },
+                    "max_fare": {
+                        "type": "float"
+                    },
+                    "exclude_bulk": {
+                        "type": "boolean"
+                    },
+                    "mkt_geo_types": {
+                        "type": "short"
+                    },
+                    "itin_geo_types": {
+                        "type": "short"
+                    },
+                    "exclude_carrier_groups": {
+                        "type": "keyword"
+                    }
+                }
+            }
+        }
+    }
+}`
+
+// 累加机场粒度的航线，出发机场计入出发乘客和目的地，目的机场计入到达乘客
+type marketSummary struct {
+	airports map[string]*airportSummary
+}
+
+type airportSummary struct {
+	doc     AirportMarketSummary
+	revenue float64
+}
+
+func newMarketSummary() *marketSummary {
+	return &marketSummary{airports: map[string]*airportSummary{}}
+}
+
+// 机场信息取自该机场第一次出现的航线
+func (s *marketSummary) airport(code string, cityMarketID int, cityName, state, stateName, country string, location *common.GeoPoint) *airportSummary {
+	a, ok := s.airports[code]
+	if !ok {
+		a = &airportSummary{doc: AirportMarketSummary{Airport: code, AirportName: lookups.AirportName(code), CityMarketID: cityMarketID,
+			CityName: cityName, State: state, StateName: stateName, Country: country, Location: location}}
+		s.airports[code] = a
+	}
+	return a
+}
+
+func (s *marketSummary) add(af *AirportFlight) {
+	o := s.airport(af.OriginAirport, af.OriginCityMarketID, af.OriginCityName, af.OriginState, af.OriginStateName, af.OriginCountry, af.OriginLocation)
+	o.doc.OriginPassengers += af.Passengers
+	o.doc.Markets++
+	if af.OriginCountry == af.DestCountry {
+		o.doc.DomesticPassengers += af.Passengers
+	} else {
+		o.doc.InternationalPassengers += af.Passengers
+	}
+	o.revenue += af.WeightedAvgFare * float64(af.Passengers)
+	o.doc.TopDestinations = append(o.doc.TopDestinations, SummaryDestination{Airport: af.DestAirport, CityName: af.DestCityName,
+		Passengers: af.Passengers, AvgFare: af.WeightedAvgFare, MedianFare: af.MedianFare})
+
+	d := s.airport(af.DestAirport, af.DestCityMarketID, af.DestCityName, af.DestState, af.DestStateName, af.DestCountry, af.DestLocation)
+	d.doc.DestPassengers += af.Passengers
+}
+
+// 写入各机场的汇总
+func (s *marketSummary) write(year, quarter int) {
+	codes := make([]string, 0, len(s.airports))
+	for code := range s.airports {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		a := s.airports[code]
+		doc := &a.doc
+		doc.Year = year
+		doc.Quarter = quarter
+		doc.Filter = marketFilter
+		if doc.OriginPassengers > 0 {
+			doc.DomesticShare = round4(float64(doc.DomesticPassengers) / float64(doc.OriginPassengers))
+			doc.AvgFare = scaled(a.revenue / float64(doc.OriginPassengers))
+		}
+		for i := range doc.TopDestinations {
+			if doc.OriginPassengers > 0 {
+				doc.TopDestinations[i].Share = round4(float64(doc.TopDestinations[i].Passengers) / float64(doc.OriginPassengers))
+			}
+		}
+		// 乘客数相同时按机场代码排序
+		sort.Slice(doc.TopDestinations, func(i, j int) bool {
+			x, y := doc.TopDestinations[i], doc.TopDestinations[j]
+			if x.Passengers != y.Passengers {
+				return x.Passengers > y.Passengers
+			}
+			return x.Airport < y.Airport
+		})
+		if len(doc.TopDestinations) > marketSummaryTop {
+			doc.TopDestinations = doc.TopDestinations[:marketSummaryTop]
+		}
+		id := strings.Join([]string{cast.ToString(year), cast.ToString(quarter), code}, "_")
+		if err := out.Write(airport_market_summary_index_name, id, doc); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(airport_market_summary_index_name, "allcount:", len(codes))
+}
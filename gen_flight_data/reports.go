@@ -0,0 +1,46 @@
+package main
+
+import "fmt"
+
+// 基于 markets 的附加报表，config.json 中 reports 配置需要生成的报表，每个报表写入单独的索引
+type report struct {
+	name    string
+	index   string
+	mapping string
+	es      func(year, quarter int)                 // 从ES聚合
+	local   func(dataDir string, year, quarter int) // 本地计算模式
+}
+
+var allReports = []*report{
+	{name: "route_carrier_share", index: route_carrier_share_index_name, mapping: routeCarrierShareMapping, es: processRouteCarrierShare, local: localRouteCarrierShare},
+	{name: "distance_band_fares", index: distance_band_fares_index_name, mapping: distanceBandFaresMapping, es: processDistanceBandFares, local: localDistanceBandFares},
+	{name: "route_connecting_hubs", index: route_connecting_hubs_index_name, mapping: routeConnectingHubsMapping, es: processRouteConnectingHubs, local: localRouteConnectingHubs},
+	{name: "state_flows", index: state_flows_index_name, mapping: stateFlowsMapping, es: processStateFlows, local: localStateFlows},
+}
+
+// 生成的附加报表，默认不生成
+var flightReports []*report
+
+// 按配置的名称选择附加报表
+func selectReports(names []string) ([]*report, error) {
+	var res []*report
+	for _, name := range names {
+		var r *report
+		for _, x := range allReports {
+			if x.name == name {
+				r = x
+			}
+		}
+		if r == nil {
+			return nil, fmt.Errorf("不支持的报表: %s", name)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func initReportIndices() {
+	for _, r := range flightReports {
+		initIndex(r.index, r.mapping)
+	}
+}
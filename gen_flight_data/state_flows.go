@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/spf13/cast"
+
+	"common"
+)
+
+var state_flows_index_name = "state_flows"
+
+// state_flows 矩阵 CSV 的输出目录，config.json 中 state_flows_matrix_dir 配置，为空时不导出
+var stateFlowsMatrixDir string
+
+// 美国人口普查局的四大区域，其他州代码（PR、VI 等海外领地和外国）归入 Other
+var censusRegions = map[string][]string{
+	"Northeast": {"CT", "ME", "MA", "NH", "RI", "VT", "NJ", "NY", "PA"},
+	"Midwest":   {"IL", "IN", "MI", "OH", "WI", "IA", "KS", "MN", "MO", "NE", "ND", "SD"},
+	"South":     {"DE", "DC", "FL", "GA", "MD", "NC", "SC", "VA", "WV", "AL", "KY", "MS", "TN", "AR", "LA", "OK", "TX"},
+	"West":      {"AZ", "CO", "ID", "MT", "NV", "NM", "UT", "WY", "AK", "CA", "HI", "OR", "WA"},
+}
+
+const otherRegion = "Other"
+
+// key:州代码 value:区域
+var stateRegion = map[string]string{}
+
+func init() {
+	for region, states := range censusRegions {
+		for _, s := range states {
+			stateRegion[s] = region
+		}
+	}
+}
+
+func regionOf(state string) string {
+	if r, ok := stateRegion[state]; ok {
+		return r
+	}
+	return otherRegion
+}
+
+// StateFlow 出发州到目的州（或区域到区域）的乘客流量
+type StateFlow struct {
+	Year         int    `json:"year"`          //年
+	Quarter      int    `json:"quarter"`       //季度
+	Level        string `json:"level"`         //state 州，region 人口普查区域
+	Origin       string `json:"origin"`        //出发州代码或区域
+	Dest         string `json:"dest"`          //目的州代码或区域
+	OriginRegion string `json:"origin_region"` //出发地所属区域
+	DestRegion   string `json:"dest_region"`   //目的地所属区域
+
+	Records         int     `json:"records"`           // 记录数
+	Passengers      int     `json:"passengers"`        // 乘客数（抽样）
+	Routes          int     `json:"routes"`            // 机场航线数
+	AvgFare         float64 `json:"avg_fare"`          // 平均票价
+	WeightedAvgFare float64 `json:"weighted_avg_fare"` // 按乘客数加权的平均票价
+
+	Filter MarketFilter `json:"filter"` // 生成该文档时生效的 markets 筛选条件
+}
+
+var stateFlowsMapping = `{
+    "mappings": {
+        "properties": {
+            "year": {
+                "type": "integer"
+            },
+            "quarter": {
+                "type": "short"
+            },
+            "level": {
+                "type": "keyword"
+            },
+            "origin": {
+                "type": "keyword"
+            },
+            "dest": {
+                "type": "keyword"
+            },
+            "origin_region": {
+                "type": "keyword"
+            },
+            "dest_region": {
+                "type": "keyword"
+            },
+            "records": {
+                "type": "integer"
+            },
+            "passengers": {
+                "type": "integer"
+            },
+            "routes": {
+                "type": "integer"
+            },
+            "avg_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "weighted_avg_fare": {
+                "type": "scaled_float",
+                "scaling_factor": 100
+            },
+            "filter": {
+                "properties": {
+                    "min_fare": {
+                        "type": "float"
+                    },
+                    "max_fare": {
+                        "type": "float"
+                    },
+                    "exclude_bulk": {
+                        "type": "boolean"
+                    },
+                    "mkt_geo_types": {
+                        "type": "short"
+                    },
+                    "itin_geo_types": {
+                        "type": "short"
+                    },
+                    "exclude_carrier_groups": {
+                        "type": "keyword"
+                    }
+                }
+            }
+        }
+    }
+}`
+
+// 按机场航线累加到州、区域
+type flowCounter struct {
+	states  map[[2]string]*flowSum
+	regions map[[2]string]*flowSum
+}
+
+type flowSum struct {
+	records, passengers, routes int
+	fareSum, revenue            float64
+}
+
+func newFlowCounter() *flowCounter {
+	return &flowCounter{states: map[[2]string]*flowSum{}, regions: map[[2]string]*flowSum{}}
+}
+
+// 加入一条机场航线，fareSum 为各记录票价之和，revenue 为票价×乘客数之和
+func (f *flowCounter) add(originState, destState string, records, passengers int, fareSum, revenue float64) {
+	for _, x := range []struct {
+		sums map[[2]string]*flowSum
+		k    [2]string
+	}{
+		{f.states, [2]string{originState, destState}},
+		{f.regions, [2]string{regionOf(originState), regionOf(destState)}},
+	} {
+		s, ok := x.sums[x.k]
+		if !ok {
+			s = &flowSum{}
+			x.sums[x.k] = s
+		}
+		s.records += records
+		s.passengers += passengers
+		s.routes++
+		s.fareSum += fareSum
+		s.revenue += revenue
+	}
+}
+
+// 写入州、区域两级的文档，配置了 state_flows_matrix_dir 时导出矩阵
+func (f *flowCounter) write(year, quarter int) {
+	count := 0
+	for _, level := range []struct {
+		name string
+		sums map[[2]string]*flowSum
+	}{{"state", f.states}, {"region", f.regions}} {
+		for _, k := range sortedFlowKeys(level.sums) {
+			s := level.sums[k]
+			doc := &StateFlow{Year: year, Quarter: quarter, Level: level.name, Origin: k[0], Dest: k[1],
+				Records: s.records, Passengers: s.passengers, Routes: s.routes, Filter: marketFilter}
+			doc.OriginRegion, doc.DestRegion = k[0], k[1]
+			if level.name == "state" {
+				doc.OriginRegion, doc.DestRegion = regionOf(k[0]), regionOf(k[1])
+			}
+			if s.records > 0 {
+				doc.AvgFare = scaled(s.fareSum / float64(s.records))
+			}
+			if s.passengers > 0 {
+				doc.WeightedAvgFare = scaled(s.revenue / float64(s.passengers))
+			}
+			id := strings.Join([]string{cast.ToString(year), cast.ToString(quarter), level.name, k[0], k[1]}, "_")
+			if err := out.Write(state_flows_index_name, id, doc); err != nil {
+				panic(err)
+			}
+			count++
+		}
+		if stateFlowsMatrixDir != "" {
+			path := filepath.Join(stateFlowsMatrixDir, fmt.Sprintf("%s_%s_%d_%d.csv", state_flows_index_name, level.name, year, quarter))
+			if err := writeFlowMatrix(path, level.sums); err != nil {
+				panic(err)
+			}
+			fmt.Println("导出矩阵:", path)
+		}
+	}
+	fmt.Println(state_flows_index_name, "allcount:", count)
+}
+
+func sortedFlowKeys(sums map[[2]string]*flowSum) [][2]string {
+	keys := make([][2]string, 0, len(sums))
+	for k := range sums {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// 导出乘客数方阵：第一行为表头，之后每行第一列为出发地，其余列为到各目的地的乘客数，行列顺序相同
+func writeFlowMatrix(path string, sums map[[2]string]*flowSum) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	var names []string
+	for k := range sums {
+		for _, name := range k {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if err = w.Write(append([]string{"origin"}, names...)); err != nil {
+		return err
+	}
+	for _, origin := range names {
+		row := []string{origin}
+		for _, dest := range names {
+			passengers := 0
+			if s, ok := sums[[2]string{origin, dest}]; ok {
+				passengers = s.passengers
+			}
+			row = append(row, cast.ToString(passengers))
+		}
+		if err = w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// 按出发州、目的州、出发机场、目的机场聚合 markets，每个分组为一条机场航线
+func processStateFlows(year, quarter int) {
+	ctx := context.Background()
+	compositeAgg := elastic.NewCompositeAggregation().Size(10000).Sources(
+		elastic.NewCompositeAggregationTermsValuesSource("origin_state").Field("origin_state"),
+		elastic.NewCompositeAggregationTermsValuesSource("dest_state").Field("dest_state"),
+		elastic.NewCompositeAggregationTermsValuesSource("origin").Field("origin"),
+		elastic.NewCompositeAggregationTermsValuesSource("dest").Field("dest")).
+		SubAggregation("fare_sum", elastic.NewSumAggregation().Field("mkt_fare").Missing(0)).
+		SubAggregation("total_passengers", elastic.NewSumAggregation().Field("passengers").Missing(0)).
+		SubAggregation("weighted_fare", newPassengerWeightedAvg("mkt_fare"))
+
+	f := newFlowCounter()
+	var afterKey map[string]interface{}
+	for {
+		if afterKey != nil {
+			compositeAgg = compositeAgg.AggregateAfter(afterKey)
+		}
+		searchResult, err := client.Search().
+			Index(market_index_name).
+			Query(marketFilter.query(year, quarter)).
+			Size(0).
+			Aggregation("state_routes", compositeAgg).
+			Do(ctx)
+		if err != nil {
+			panic(err)
+		}
+		agg, _ := searchResult.Aggregations.Composite("state_routes")
+		for _, bucket := range agg.Buckets {
+			var passengers int
+			var fareSum, revenue float64
+			if sum, found := bucket.Aggregations.Sum("total_passengers"); found && sum.Value != nil {
+				passengers = cast.ToInt(*sum.Value)
+			}
+			if sum, found := bucket.Aggregations.Sum("fare_sum"); found && sum.Value != nil {
+				fareSum = *sum.Value
+			}
+			if fare, found := bucket.Aggregations.WeightedAvg("weighted_fare"); found && fare.Value != nil && passengers > 0 {
+				revenue = *fare.Value * float64(passengers)
+			}
+			f.add(cast.ToString(bucket.Key["origin_state"]), cast.ToString(bucket.Key["dest_state"]), int(bucket.DocCount), passengers, fareSum, revenue)
+		}
+		afterKey = agg.AfterKey
+		if agg.AfterKey == nil {
+			break
+		}
+	}
+	f.write(year, quarter)
+	out.FlushPeriod(year, quarter)
+}
+
+// 本地计算州、区域流量，与 processStateFlows 一致
+func localStateFlows(dataDir string, year, quarter int) {
+	type routeKey struct {
+		originState, destState, origin, dest string
+	}
+	type routeSum struct {
+		records, passengers int
+		fareSum, revenue    float64
+	}
+	routes := map[routeKey]*routeSum{}
+	err := common.ReadLocalCsv(dataDir, common.MarketFileNames(year, quarter), func(header map[string]int, record []string) error {
+		m := parseMarketRecord(header, record)
+		if m.Year != year || m.Quarter != quarter || !marketFilter.match(m) {
+			return nil
+		}
+		k := routeKey{m.OriginState, m.DestState, m.Origin, m.Dest}
+		r, ok := routes[k]
+		if !ok {
+			r = &routeSum{}
+			routes[k] = r
+		}
+		r.records++
+		r.passengers += m.Passengers
+		r.fareSum += m.MktFare
+		r.revenue += m.MktFare * float64(m.Passengers)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	f := newFlowCounter()
+	for k, r := range routes {
+		f.add(k.originState, k.destState, r.records, r.passengers, r.fareSum, r.revenue)
+	}
+	f.write(year, quarter)
+	out.FlushPeriod(year, quarter)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/olivere/elastic/v7"
+)
+
+// 按 mkt_coupons 区分直飞和中转，mkt_coupons 为该市场的航段数，1 为直飞，2 为经停一次
+type stopsCategory struct {
+	key      string
+	from, to int // 包含 from 不包含 to，from 为 0 时不限下限，to 为 0 时不限上限
+}
+
+var stopsCategories = []stopsCategory{
+	{key: "nonstop", to: 2},
+	{key: "1-stop", from: 2, to: 3},
+	{key: "2+", from: 3},
+}
+
+type StopsShare struct {
+	Stops      string  `json:"stops"`      // nonstop 直飞、1-stop 经停一次、2+ 经停两次及以上
+	Records    int     `json:"records"`    // 记录数
+	Passengers int     `json:"passengers"` // 乘客数（抽样）
+	Share      float64 `json:"share"`      // 乘客数占航线乘客数的份额 0~1
+	AvgFare    float64 `json:"avg_fare"`   // 按乘客数加权的平均票价
+}
+
+// 一条记录所属的分类下标
+func stopsIndex(coupons int) int {
+	for i, c := range stopsCategories {
+		if (c.from == 0 || coupons >= c.from) && (c.to == 0 || coupons < c.to) {
+			return i
+		}
+	}
+	return len(stopsCategories) - 1
+}
+
+func newStopsAggregation() *elastic.RangeAggregation {
+	agg := elastic.NewRangeAggregation().Field("mkt_coupons").Missing(1)
+	for _, c := range stopsCategories {
+		switch {
+		case c.from == 0:
+			agg = agg.AddUnboundedFromWithKey(c.key, float64(c.to))
+		case c.to == 0:
+			agg = agg.AddUnboundedToWithKey(c.key, float64(c.from))
+		default:
+			agg = agg.AddRangeWithKey(c.key, float64(c.from), float64(c.to))
+		}
+	}
+	return agg.
+		SubAggregation("total_passengers", elastic.NewSumAggregation().Field("passengers").Missing(0)).
+		SubAggregation("weighted_fare", newPassengerWeightedAvg("mkt_fare"))
+}
+
+// 从 stops 子聚合取直飞、中转的乘客数和票价
+func fillStopsFromAggs(af *AirportFlight, aggs elastic.Aggregations) {
+	stops := make([]StopsShare, len(stopsCategories))
+	if ranges, found := aggs.Range("stops"); found {
+		for _, b := range ranges.Buckets {
+			for i, c := range stopsCategories {
+				if b.Key != c.key {
+					continue
+				}
+				stops[i].Records = int(b.DocCount)
+				if passengers, found := b.Aggregations.Sum("total_passengers"); found && passengers.Value != nil {
+					stops[i].Passengers = int(*passengers.Value)
+				}
+				if fare, found := b.Aggregations.WeightedAvg("weighted_fare"); found && fare.Value != nil && stops[i].Passengers > 0 {
+					stops[i].AvgFare = *fare.Value
+				}
+			}
+		}
+	}
+	fillStops(af, stops)
+}
+
+// 补充分类名称和乘客数份额
+func fillStops(af *AirportFlight, stops []StopsShare) {
+	for i := range stops {
+		stops[i].Stops = stopsCategories[i].key
+		if af.Passengers > 0 {
+			stops[i].Share = round4(float64(stops[i].Passengers) / float64(af.Passengers))
+		}
+	}
+	af.Stops = stops
+}
@@ -9,18 +9,16 @@ import (
 	"github.com/olivere/elastic/v7"
 	"github.com/spf13/cast"
 	"io"
-	"log"
 	"net/http"
 	"os"
-	"runtime"
 	"strings"
-	"sync"
 	"time"
+
+	"common"
 )
 
 const (
 	ESUrl               = "http://127.0.0.1:9200/"
-	bulkActions         = 1000
 	DownloadUrl         = "https://transtats.bts.gov/PREZIP/"
 	NamePrefix          = "On_Time_Reporting_Carrier_On_Time_Performance_1987_present_"
 	CVSNamePrefix       = "On_Time_Reporting_Carrier_On_Time_Performance_(1987_present)_"
@@ -33,15 +31,18 @@ const (
 type Date struct {
 	Year  int
 	Month int
-	Down  int
-	Unzip int
+}
+
+// Config 配置文件，兼容只有日期数组的旧格式
+type Config struct {
+	Dates       []Date                   `json:"dates"`
+	Concurrency common.ConcurrencyConfig `json:"concurrency"`
+	Bulk        common.BulkConfig        `json:"bulk"`
 }
 
 var (
-	actualNumCPU = runtime.GOMAXPROCS(0)
-	esClient     *elastic.Client
-	dates        = []Date{}
-	nowErr       = false
+	esClient  *elastic.Client
+	countWait = 20 * time.Second // 导入完成后等待ES刷新再核对条数
 )
 
 func main() {
@@ -52,61 +53,75 @@ func main() {
 	if err != nil {
 		os.Exit(0)
 	}
-	dates = getDateConfig()
-	if dates == nil {
+	config := getDateConfig()
+	if config == nil || len(config.Dates) == 0 {
 		os.Exit(0)
 	}
+	dates := config.Dates
 	fmt.Println("待下载数据时间为:", dates)
 
-	goroutineNum := initGoroutineNum()
-	if goroutineNum > len(dates) {
-		goroutineNum = len(dates)
+	// 下载数：concurrency.network，其次为命令行参数；解压导入数默认为 1，与原来逐月导入一致
+	c := config.Concurrency
+	if c.Network <= 0 {
+		c.Network = initGoroutineNum()
+	}
+	if c.Cpu <= 0 {
+		c.Cpu = 1
 	}
-	fmt.Println("下载线程数为：", goroutineNum)
-	fmt.Println("导入线程数为：", actualNumCPU)
+	if c.Periods <= 0 {
+		c.Periods = c.Network + c.Cpu
+	}
+	common.EsWriteWorkers = c.EsWrite
+	common.Bulk = config.Bulk
+	fmt.Println("同时处理月数：", c.Periods, "下载线程数：", c.Network, "导入线程数：", c.Cpu, "写入ES并发数：", common.EsWorkers())
 
 	fmt.Println("--------start")
 	start := time.Now().Unix()
-	semaphore := make(chan struct{}, goroutineNum)
-	var wg sync.WaitGroup
-	for i := range dates {
-		wg.Add(1)
-		go func(i int) {
-			d := dates[i]
-			defer wg.Done()
-			semaphore <- struct{}{}
-			err := downloadFile(d.Year, d.Month)
-			if err != nil {
-				fmt.Println("【下载】", d.Year, "年", d.Month, "月文件失败")
-			} else {
-				dates[i].Down = 1
-			}
-			<-semaphore
-		}(i)
-	}
-	wg.Wait()
-	fmt.Println("下载结束，耗时", time.Now().Unix()-start, "s")
-
-	fmt.Println("开始解压")
-	start = time.Now().Unix()
-	//读取临时目录下所有文件进行解压
-	unzipAllFiles()
-	fmt.Println("解压文件完成，耗时", time.Now().Unix()-start, "s")
-
-	//开始导入到ES
-	for i := range dates {
-		d := dates[i]
-		if d.Unzip != 1 {
-			continue
+	periods := make([]string, len(dates))
+	for i, d := range dates {
+		periods[i] = fmt.Sprintf("%d-%d", d.Year, d.Month)
+	}
+	network, cpu := common.NewLimiter(c.Network), common.NewLimiter(c.Cpu)
+	results := common.RunPeriods(periods, c.Periods, func(i int) (int64, string, error) {
+		return processMonth(dates[i], network, cpu)
+	})
+	common.PrintPeriodSummary(results)
+	fmt.Println("总耗时", time.Now().Unix()-start, "s")
+	fmt.Println("--------over")
+
+}
+
+// 一个月的下载 → 解压 → 导入，下载受 network 限制，解压和导入受 cpu 限制，
+// 各月份独立推进，前面的月份导入时后面的月份可以同时下载
+func processMonth(d Date, network, cpu common.Limiter) (int64, string, error) {
+	var err error
+	network.Do(func() { err = downloadFile(d.Year, d.Month) })
+	if err != nil {
+		fmt.Println("【下载】", d.Year, "年", d.Month, "月文件失败")
+		return 0, "", fmt.Errorf("下载失败: %v", err)
+	}
+	var rows int
+	var indexed int64
+	cpu.Do(func() {
+		if err = unzipFile(d.Year, d.Month); err != nil {
+			fmt.Println("【解压】", d.Year, "年", d.Month, "月文件失败")
+			err = fmt.Errorf("解压失败: %v", err)
+			return
 		}
-		suc := importData(d.Year, d.Month)
-		if !suc {
+		rows, indexed, err = importData(d.Year, d.Month)
+		if err != nil {
 			fmt.Println("【导入】", d.Year, "年", d.Month, "月文件失败")
+			err = fmt.Errorf("导入失败: %v", err)
 		}
+	})
+	if err != nil {
+		return int64(rows), "", err
 	}
-	fmt.Println("总耗时", time.Now().Unix()-start, "s")
-	fmt.Println("--------over")
-
+	note := fmt.Sprintf("ES条数 %d", indexed)
+	if indexed != int64(rows) {
+		note += "，与导入条数不一致"
+	}
+	return int64(rows), note, nil
 }
 
 // 从参数读取线程数
@@ -127,22 +142,24 @@ func initGoroutineNum() int {
 	}
 }
 
-// 获取下载数据配置
-func getDateConfig() []Date {
-	var config = []Date{}
-	f, err := os.Open("config.json")
+// 获取下载数据配置，config.json 为日期数组时只配置了日期
+func getDateConfig() *Config {
+	var config = Config{}
+	b, err := os.ReadFile("config.json")
 	if err != nil {
 		fmt.Println("读取配置文件失败:", err)
 		return nil
 	}
-	defer f.Close()
-	encoder := json.NewDecoder(f)
-	err = encoder.Decode(&config)
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "[") {
+		err = json.Unmarshal(b, &config.Dates)
+	} else {
+		err = json.Unmarshal(b, &config)
+	}
 	if err != nil {
 		fmt.Println("解析配置文件失败:", err)
 		return nil
 	}
-	return config
+	return &config
 }
 
 // 创建临时文件夹
@@ -202,20 +219,6 @@ func downloadFile(year, month int) error {
 }
 
 // 解压文件
-func unzipAllFiles() {
-	for i := range dates {
-		d := dates[i]
-		if d.Down != 1 {
-			continue
-		}
-		err := unzipFile(d.Year, d.Month)
-		if err != nil {
-			fmt.Println("【解压】", d.Year, "年", d.Month, "月文件失败")
-		} else {
-			dates[i].Unzip = 1
-		}
-	}
-}
 func unzipFile(year, month int) error {
 	csvFileName := fmt.Sprintf("%s%d_%d.csv", CVSNamePrefix, year, month)
 	_, err := os.Stat(TempCsvFolderPath + csvFileName)
@@ -256,17 +259,14 @@ func unzipFile(year, month int) error {
 	return nil
 }
 
-func importData(year, month int) bool {
+// 导入一个月的数据，返回文件中的记录数和导入后ES中的条数
+func importData(year, month int) (int, int64, error) {
 	//清空已有数据防止重复
 	clearSuc := clearData(year, month)
 	if !clearSuc {
-		return false
-	}
-	suc := readCsv(year, month)
-	if !suc {
-		return false
+		return 0, 0, fmt.Errorf("清空旧数据失败")
 	}
-	return true
+	return readCsv(year, month)
 }
 
 // 连接es数据库
@@ -503,35 +503,23 @@ func clearData(year, month int) bool {
 	return true
 }
 
-// 读取csv文件
-func readCsv(year, month int) bool {
+// 读取csv文件，每个月单独一个 BulkWriter，被ES拒绝的文档退避重试，重试后仍失败只影响该月
+func readCsv(year, month int) (int, int64, error) {
 	fileName := fmt.Sprintf("%s%d_%d.csv", CVSNamePrefix, year, month)
 	f, e := os.Open(TempCsvFolderPath + fileName)
 	if e != nil {
 		fmt.Println("读取", fileName, "失败:", e)
-		return false
+		return 0, 0, e
 	}
 	defer f.Close()
 	reader := csv.NewReader(f)
-	nowErr = false
-	ctx := context.Background()
-	w, err := esClient.BulkProcessor().
-		BulkActions(bulkActions).
-		FlushInterval(time.Second).
-		Workers(actualNumCPU).
-		Stats(true).
-		After(GetFailed).
-		Do(ctx)
-	if err != nil {
-		fmt.Println("esClient.BulkProcessor", fileName, "失败:", err)
-		return false
-	}
-	w.Start(ctx)
+	w := common.NewBulkWriter(esClient, common.EsWorkers())
 	defer w.Close()
 	//var i = 0
 	var n = 0
 	for {
-		if nowErr {
+		// 已有文档最终写入失败时该月会被清空，不必继续读取
+		if w.Stats().Failed > 0 {
 			break
 		}
 		record, err := reader.Read()
@@ -539,95 +527,32 @@ func readCsv(year, month int) bool {
 			break
 		}
 		if err != nil {
+			// 已提交的部分与写入失败时一样清空，不留下不完整的月份
 			fmt.Println("逐行读取", fileName, "失败:", err)
+			w.Flush()
+			clearData(year, month)
+			return n, 0, fmt.Errorf("读取 %s 失败: %v，已清空该月数据", fileName, err)
 		}
 		if record[0] != "Year" {
-			d := &OnTimeData{
-				Year:                         cast.ToInt(record[0]),
-				Quarter:                      cast.ToInt(record[1]),
-				Month:                        cast.ToInt(record[2]),
-				DayofMonth:                   cast.ToInt(record[3]),
-				DayofWeek:                    cast.ToInt(record[4]),
-				FlightDate:                   record[5],
-				ReportingAirline:             record[6],
-				DotIDReportingAirline:        record[7],
-				IATACodeReportingAirline:     record[8],
-				TailNumber:                   record[9],
-				FlightNumberReportingAirline: record[10],
-				OriginAirportID:              record[11],
-				OriginAirportSeqID:           record[12],
-				OriginCityMarketID:           record[13],
-				Origin:                       record[14],
-				OriginCityName:               record[15],
-				OriginState:                  record[16],
-				OriginStateFips:              cast.ToInt(record[17]),
-				OriginStateName:              record[18],
-				OriginWac:                    record[19],
-				DestAirportID:                record[20],
-				DestAirportSeqID:             cast.ToInt(record[21]),
-				DestCityMarketID:             record[22],
-				Dest:                         record[23],
-				DestCityName:                 record[24],
-				DestState:                    record[25],
-				DestStateFips:                cast.ToInt(record[26]),
-				DestStateName:                record[27],
-				DestWac:                      cast.ToInt(record[28]),
-				CrsDepTime:                   cast.ToInt(record[29]),
-				DepTime:                      cast.ToInt(record[30]),
-				DepDelay:                     cast.ToInt(record[31]),
-				DepDelayMinutes:              cast.ToInt(record[32]),
-				DepDel15:                     cast.ToInt(record[33]),
-				DepartureDelayGroups:         cast.ToInt(record[34]),
-				DepTimeBlk:                   record[25],
-				TaxiOut:                      cast.ToInt(record[36]),
-				WheelsOff:                    cast.ToInt(record[37]),
-				WheelsOn:                     cast.ToInt(record[38]),
-				TaxiIn:                       cast.ToInt(record[39]),
-				CrsArrTime:                   cast.ToInt(record[40]),
-				ArrTime:                      cast.ToInt(record[41]),
-				ArrDelay:                     cast.ToInt(record[42]),
-				ArrDelayMinutes:              cast.ToInt(record[43]),
-				ArrDel15:                     cast.ToInt(record[44]),
-				ArrivalDelayGroups:           cast.ToInt(record[45]),
-				ArrTimeBlk:                   record[46],
-				Cancelled:                    cast.ToInt(record[47]),
-				CancellationCode:             record[48],
-				Diverted:                     cast.ToInt(record[49]),
-				CrsElapsedTime:               cast.ToInt(record[50]),
-				ActualElapsedTime:            cast.ToInt(record[51]),
-				AirTime:                      cast.ToInt(record[52]),
-				Flights:                      cast.ToInt(record[53]),
-				Distance:                     cast.ToFloat64(record[54]),
-				DistanceGroup:                cast.ToInt(record[55]),
-			}
-			req := elastic.NewBulkIndexRequest().Index(OnTimeDataIndexName).Doc(d)
+			d := common.ParseOnTimeRecord(record)
 			n++
+			req := elastic.NewBulkIndexRequest().Index(OnTimeDataIndexName).Id(onTimeDataId(year, month, n)).Doc(d)
 			w.Add(req)
 		}
 	}
 
-	for {
-		st1 := w.Stats() //获取数据写入情况
-		var finish = true
-		for _, s := range st1.Workers {
-			if s.Queued > 0 {
-				finish = false
-				break
-			}
-		}
-		if finish {
-			break
-		}
+	// 等待该月的数据全部提交
+	w.Flush()
+	st := w.Stats()
+	fmt.Println(year, "年", month, "月ES写入统计:", st)
 
-	}
-
-	if nowErr {
+	if st.Failed > 0 {
 		//为保证数据完整性，发现存在错误则清空该季度数据
 		fmt.Println(year, "年", month, "月存在导入错误")
 		clearData(year, month)
-		return false
+		return n, 0, fmt.Errorf("写入ES失败 %d 条，已清空该月数据", st.Failed)
 	}
-	time.Sleep(20 * time.Second)
+	time.Sleep(countWait)
 	fmt.Println(year, "年", month, "月总条数:", n)
 	queryNum := queryDataNum(year, month)
 	fmt.Println("查询数据库条数为:", queryNum)
@@ -636,8 +561,14 @@ func readCsv(year, month int) bool {
 	} else {
 		fmt.Println("【异常】", year, "年", month, "月导入数据不一致")
 	}
-	return true
+	return n, queryNum, nil
 }
+
+// 文档ID：年_月_记录在文件中的序号。同一文件的序号不变，请求超时后重试或重新导入时按ID覆盖，不会写入重复的文档
+func onTimeDataId(year, month, n int) string {
+	return fmt.Sprintf("%d_%d_%d", year, month, n)
+}
+
 func queryDataNum(year, month int) int64 {
 	ctx := context.Background()
 	count, err := esClient.Count(OnTimeDataIndexName).Query(elastic.NewBoolQuery().Must(elastic.NewTermsQuery("year", year), elastic.NewTermsQuery("month", month))).Do(ctx)
@@ -647,77 +578,3 @@ func queryDataNum(year, month int) int64 {
 	}
 	return count
 }
-func GetFailed(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
-	if response == nil { //可能存在为空的情况 😳
-		//log.Println("GetNil response return")
-		return
-	}
-	fi := response.Failed()
-	if len(fi) != 0 {
-		for _, f := range fi {
-			nowErr = true
-			log.Printf("DebugFailedEs: index:%s type:%s id:%s version:%d  status:%d result:%s ForceRefresh:%v errorDetail:%v getResult:%v\n", f.Index, f.Type, f.Id, f.Version, f.Status, f.Result, f.ForcedRefresh, f.Error, f.GetResult)
-			//panic(f.Error)
-		}
-	}
-
-}
-
-type OnTimeData struct {
-	Year                         int     `json:"year"`
-	Quarter                      int     `json:"quarter"`
-	Month                        int     `json:"month"`
-	DayofMonth                   int     `json:"dayof_month"`
-	DayofWeek                    int     `json:"dayof_week"`
-	FlightDate                   string  `json:"flight_date"`
-	ReportingAirline             string  `json:"reporting_airline"`
-	DotIDReportingAirline        string  `json:"dot_id_reporting_airline"`
-	IATACodeReportingAirline     string  `json:"iata_code_reporting_airline"`
-	TailNumber                   string  `json:"tail_number"`
-	FlightNumberReportingAirline string  `json:"flight_number_reporting_airline"`
-	OriginAirportID              string  `json:"origin_airport_id"`
-	OriginAirportSeqID           string  `json:"origin_airport_seq_id"`
-	OriginCityMarketID           string  `json:"origin_city_market_id"`
-	Origin                       string  `json:"origin"`
-	OriginCityName               string  `json:"origin_city_name"`
-	OriginState                  string  `json:"origin_state"`
-	OriginStateFips              int     `json:"origin_state_fips"`
-	OriginStateName              string  `json:"origin_state_name"`
-	OriginWac                    string  `json:"origin_wac"`
-	DestAirportID                string  `json:"dest_airport_id"`
-	DestAirportSeqID             int     `json:"dest_airport_seq_id"`
-	DestCityMarketID             string  `json:"dest_city_market_id"`
-	Dest                         string  `json:"dest"`
-	DestCityName                 string  `json:"dest_city_name"`
-	DestState                    string  `json:"dest_state"`
-	DestStateFips                int     `json:"dest_state_fips"`
-	DestStateName                string  `json:"dest_state_name"`
-	DestWac                      int     `json:"dest_wac"`
-	CrsDepTime                   int     `json:"crs_dep_time"`
-	DepTime                      int     `json:"dep_time"`
-	DepDelay                     int     `json:"dep_delay"`
-	DepDelayMinutes              int     `json:"dep_delay_minutes"`
-	DepDel15                     int     `json:"dep_del15"`
-	DepartureDelayGroups         int     `json:"departure_delay_groups"`
-	DepTimeBlk                   string  `json:"dep_time_blk"`
-	TaxiOut                      int     `json:"taxi_out"`
-	WheelsOff                    int     `json:"wheels_off"`
-	WheelsOn                     int     `json:"wheels_on"`
-	TaxiIn                       int     `json:"taxi_in"`
-	CrsArrTime                   int     `json:"crs_arr_time"`
-	ArrTime                      int     `json:"arr_time"`
-	ArrDelay                     int     `json:"arr_delay"`
-	ArrDelayMinutes              int     `json:"arr_delay_minutes"`
-	ArrDel15                     int     `json:"arr_del15"`
-	ArrivalDelayGroups           int     `json:"arrival_delay_groups"`
-	ArrTimeBlk                   string  `json:"arr_time_blk"`
-	Cancelled                    int     `json:"cancelled"`
-	CancellationCode             string  `json:"cancellation_code"`
-	Diverted                     int     `json:"diverted"`
-	CrsElapsedTime               int     `json:"crs_elapsed_time"`
-	ActualElapsedTime            int     `json:"actual_elapsed_time"`
-	AirTime                      int     `json:"air_time"`
-	Flights                      int     `json:"flights"`
-	Distance                     float64 `json:"distance"`
-	DistanceGroup                int     `json:"distance_group"`
-}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"common"
+	"common/fakees"
+)
+
+// 在临时目录中准备 temp_csvs 下的 BTS 数据，返回数据文件中的全部记录
+func prepareCsv(t *testing.T) [][]string {
+	name := CVSNamePrefix + "2020_1.csv"
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, _ := os.Getwd()
+	dir := t.TempDir()
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+	if err = createTempFolder(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(TempCsvFolderPath+name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return records[1:]
+}
+
+func TestImportData(t *testing.T) {
+	es := fakees.New(t)
+	records := prepareCsv(t)
+	oldClient, oldWait := esClient, countWait
+	t.Cleanup(func() { esClient, countWait = oldClient, oldWait })
+	esClient = es.Client()
+	countWait = 0
+
+	createIndex()
+	// 同月份的旧数据应被清除，其他月份保留
+	es.Seed(OnTimeDataIndexName, "stale", common.OnTimeData{Year: 2020, Month: 1, FlightDate: "2020-01-31"})
+	es.Seed(OnTimeDataIndexName, "feb", common.OnTimeData{Year: 2020, Month: 2, FlightDate: "2020-02-01"})
+
+	rows, indexed, err := importData(2020, 1)
+	if err != nil {
+		t.Fatal("importData 返回失败:", err)
+	}
+	if rows != len(records) || indexed != int64(len(records)) {
+		t.Errorf("导入 %d 条，ES中 %d 条，期望 %d 条", rows, indexed, len(records))
+	}
+
+	ops := map[string]int{}
+	for _, w := range es.Writes {
+		ops[w.Op]++
+	}
+	if es.Writes[0].Op != "create_index" || es.Writes[1].Op != "delete_by_query" {
+		t.Errorf("应先创建索引再清空旧数据: %+v %+v", es.Writes[0], es.Writes[1])
+	}
+	if ops["index"] != len(records) {
+		t.Errorf("写入 %d 条，期望 %d 条", ops["index"], len(records))
+	}
+
+	docs := es.Docs(OnTimeDataIndexName)
+	if _, ok := docs["stale"]; ok {
+		t.Error("旧数据未清除")
+	}
+	if _, ok := docs["feb"]; !ok {
+		t.Error("其他月份的数据被误删")
+	}
+	delete(docs, "feb")
+	var got, want []string
+	for _, doc := range docs {
+		b, _ := json.Marshal(doc)
+		got = append(got, string(b))
+	}
+	for _, r := range records {
+		b, _ := json.Marshal(fakees.DocMap(t, common.ParseOnTimeRecord(r)))
+		want = append(want, string(b))
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("on_time_data 文档不一致\n got: %v\nwant: %v", got, want)
+	}
+}
+
+// 下载 → 解压 → 导入的流水线：已下载的压缩包不再下载，解压后导入，结果中记录导入条数和ES条数
+func TestProcessMonth(t *testing.T) {
+	es := fakees.New(t)
+	records := prepareCsv(t)
+	oldClient, oldWait := esClient, countWait
+	t.Cleanup(func() { esClient, countWait = oldClient, oldWait })
+	esClient = es.Client()
+	countWait = 0
+	createIndex()
+
+	// 把 csv 打包为下载的压缩包，删除解压后的文件
+	name := CVSNamePrefix + "2020_1.csv"
+	b, err := os.ReadFile(TempCsvFolderPath + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(TempZipFolderPath+NamePrefix+"2020_1.zip", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(TempCsvFolderPath + name); err != nil {
+		t.Fatal(err)
+	}
+
+	network, cpu := common.NewLimiter(2), common.NewLimiter(1)
+	results := common.RunPeriods([]string{"2020-1"}, 2, func(i int) (int64, string, error) {
+		return processMonth(Date{2020, 1}, network, cpu)
+	})
+	common.PrintPeriodSummary(results)
+	r := results[0]
+	if r.Err != nil || r.Docs != int64(len(records)) || r.Note != fmt.Sprintf("ES条数 %d", len(records)) {
+		t.Errorf("2020-1 的结果错误: %+v", r)
+	}
+	if _, err = os.Stat(TempCsvFolderPath + name); err != nil {
+		t.Error("压缩包未解压:", err)
+	}
+}
+
+// ES 拒绝的文档退避重试后该月仍导入成功，重试后仍被拒绝或请求超时时该月失败并清空
+func TestImportDataRejected(t *testing.T) {
+	es := fakees.New(t)
+	records := prepareCsv(t)
+	oldClient, oldWait, oldBulk := esClient, countWait, common.Bulk
+	t.Cleanup(func() { esClient, countWait, common.Bulk = oldClient, oldWait, oldBulk })
+	esClient = es.Client()
+	countWait = 0
+	common.Bulk = common.BulkConfig{MaxRetries: 2, InitialBackoff: 1, MaxBackoff: 5}
+	createIndex()
+
+	es.Rejects = 3
+	rows, indexed, err := importData(2020, 1)
+	if err != nil || rows != len(records) || indexed != int64(len(records)) {
+		t.Errorf("重试后导入 %d 条，ES中 %d 条，err %v，期望 %d 条", rows, indexed, err, len(records))
+	}
+
+	es.Mu.Lock()
+	es.Rejects = len(records) * 3
+	es.Mu.Unlock()
+	if _, _, err = importData(2020, 1); err == nil {
+		t.Error("重试后仍被拒绝时应返回失败")
+	}
+	if n := len(es.Docs(OnTimeDataIndexName)); n != 0 {
+		t.Errorf("失败的月份应清空，剩余 %d 条", n)
+	}
+
+	// 请求超时时ES已写入，文档ID按记录的序号生成，重试时按ID覆盖，不会重复，该月导入成功
+	es.Mu.Lock()
+	es.Timeouts = 1
+	writes := len(es.Writes)
+	es.Mu.Unlock()
+	rows, indexed, err = importData(2020, 1)
+	if err != nil || rows != len(records) || indexed != int64(len(records)) {
+		t.Errorf("超时重试后导入 %d 条，ES中 %d 条，err %v，期望 %d 条", rows, indexed, err, len(records))
+	}
+	es.Mu.Lock()
+	retried := 0
+	for _, w := range es.Writes[writes:] {
+		if w.Op == "index" {
+			retried++
+		}
+	}
+	es.Mu.Unlock()
+	if retried <= len(records) {
+		t.Errorf("超时的请求应重试，写入 %d 次，共 %d 条", retried, len(records))
+	}
+	if _, ok := es.Docs(OnTimeDataIndexName)[onTimeDataId(2020, 1, len(records))]; !ok {
+		t.Error("文档ID应为 年_月_序号")
+	}
+}
+
+// csv 格式错误时返回错误，不因空记录 panic，已写入的部分清空
+func TestImportDataBadCsv(t *testing.T) {
+	es := fakees.New(t)
+	prepareCsv(t)
+	oldClient, oldWait := esClient, countWait
+	t.Cleanup(func() { esClient, countWait = oldClient, oldWait })
+	esClient = es.Client()
+	countWait = 0
+	createIndex()
+
+	path := TempCsvFolderPath + CVSNamePrefix + "2020_1.csv"
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 最后加一行有裸引号的记录，读取时返回错误和空记录
+	if err = os.WriteFile(path, append(b, "2020,1\"x\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = importData(2020, 1); err == nil {
+		t.Error("csv 格式错误时应返回失败")
+	}
+	if n := len(es.Docs(OnTimeDataIndexName)); n != 0 {
+		t.Errorf("失败的月份应清空，剩余 %d 条", n)
+	}
+}
@@ -0,0 +1,3 @@
+module synth
+
+go 1.21.5
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// Config 合成数据配置，数值参数不配置时使用 applyDefaults 中的默认值
+type Config struct {
+	Seed         int64         `json:"seed"`        // 随机种子，相同的种子和配置生成完全相同的文件
+	OutputDir    string        `json:"output_dir"`  // 输出目录，默认 output
+	Formats      []string      `json:"formats"`     // csv、zip，默认只输出 csv
+	Scale        float64       `json:"scale"`       // 航班频次和行程数的倍数，用于压测，默认 1
+	OnTime       []MonthDate   `json:"on_time"`     // 生成 on-time 数据的年月
+	Markets      []QuarterDate `json:"markets"`     // 生成 DB1B Market 数据的年季度
+	Itineraries  int           `json:"itineraries"` // 每季度 DB1B 行程数
+	Airports     []Airport     `json:"airports"`
+	Carriers     []Carrier     `json:"carriers"`
+	Routes       []Route       `json:"routes"` // 不配置时按各航司的枢纽生成航线网络
+	Delay        DelayConfig   `json:"delay"`
+	Cancellation CancelConfig  `json:"cancellation"`
+	Fare         FareConfig    `json:"fare"`
+}
+
+type MonthDate struct {
+	Year  int
+	Month int
+}
+
+type QuarterDate struct {
+	Year    int
+	Quarter int
+}
+
+type Airport struct {
+	Code         string  `json:"code"`
+	AirportID    int     `json:"airport_id"`
+	CityMarketID int     `json:"city_market_id"`
+	CityName     string  `json:"city_name"` // BTS 格式，如 New York, NY
+	State        string  `json:"state"`
+	StateFips    string  `json:"state_fips"`
+	StateName    string  `json:"state_name"`
+	Wac          int     `json:"wac"`
+	Country      string  `json:"country"`
+	Lat          float64 `json:"lat"`
+	Lon          float64 `json:"lon"`
+	UtcOffset    int     `json:"utc_offset"` // 当地时间与UTC相差的小时数，计划到达时间按当地时间计算
+	Weight       float64 `json:"weight"`     // 客流权重，默认 1
+}
+
+type Carrier struct {
+	Code              string       `json:"code"`
+	DotID             int          `json:"dot_id"`
+	Group             string       `json:"group"`               // 航司分组，默认 3
+	Hubs              []string     `json:"hubs"`                // 枢纽机场
+	Airports          []string     `json:"airports"`            // 通航机场，不配置时为全部机场
+	Weight            float64      `json:"weight"`              // DB1B 中的市场份额权重，默认 1
+	DailyFlights      []int        `json:"daily_flights"`       // 每条航线每日航班数范围 [min,max]，默认 [1,3]
+	Fleet             int          `json:"fleet"`               // 机尾号数量，默认 20
+	FlightNumberStart int          `json:"flight_number_start"` // 起始航班号，默认 100
+	Regionals         []string     `json:"regionals"`           // 支线承运航司，DB1B 中作为实际承运人
+	RegionalRate      float64      `json:"regional_rate"`       // 由支线航司承运的比例
+	CancelRate        *float64     `json:"cancel_rate"`         // 覆盖全局取消率
+	Delay             *DelayConfig `json:"delay"`               // 覆盖全局延误分布
+}
+
+// Route 显式配置的航线，会生成两个方向的航班
+type Route struct {
+	Origin       string   `json:"origin"`
+	Dest         string   `json:"dest"`
+	Carriers     []string `json:"carriers"`
+	DailyFlights int      `json:"daily_flights"`
+}
+
+type DelayConfig struct {
+	EarlyRate  float64 `json:"early_rate"`   // 提前起飞的比例
+	OnTimeRate float64 `json:"on_time_rate"` // 准点起飞的比例，其余为延误
+	MeanDelay  float64 `json:"mean_delay"`   // 延误航班的平均延误分钟数，按指数分布
+	MaxDelay   int     `json:"max_delay"`    // 最大延误分钟数
+	ArrSigma   float64 `json:"arr_sigma"`    // 到达延误相对起飞延误的标准差
+	DivertRate float64 `json:"divert_rate"`  // 备降比例
+}
+
+type CancelConfig struct {
+	Rate  float64            `json:"rate"`  // 取消率
+	Codes map[string]float64 `json:"codes"` // 取消原因 A/B/C/D 的权重
+}
+
+type FareConfig struct {
+	Base          float64 `json:"base"`           // 基础票价
+	PerMile       float64 `json:"per_mile"`       // 每英里票价
+	Sigma         float64 `json:"sigma"`          // 票价对数正态分布的标准差
+	ZeroRate      float64 `json:"zero_rate"`      // 0 票价（里程兑换）的比例
+	PremiumRate   float64 `json:"premium_rate"`   // 高舱位比例
+	PremiumFactor float64 `json:"premium_factor"` // 高舱位票价倍数
+	BulkRate      float64 `json:"bulk_rate"`      // 团体票比例
+	ConnectRate   float64 `json:"connect_rate"`   // 有直飞航线时仍选择中转的比例
+	RoundTripRate float64 `json:"round_trip_rate"`
+}
+
+func main() {
+	config := getConfig()
+	if config == nil {
+		os.Exit(0)
+	}
+	applyDefaults(config)
+	if err := checkConfig(config); err != nil {
+		fmt.Println("配置文件错误:", err)
+		os.Exit(0)
+	}
+	if err := os.MkdirAll(config.OutputDir, os.ModePerm); err != nil {
+		fmt.Println("创建输出目录失败:", err)
+		os.Exit(0)
+	}
+	network := buildNetwork(config)
+	fmt.Println("航线数:", len(network.routes))
+
+	start := time.Now().Unix()
+	for _, d := range config.OnTime {
+		n, err := writeOnTime(config, network, d.Year, d.Month)
+		if err != nil {
+			fmt.Println("生成", d.Year, "年", d.Month, "月 on-time 数据失败:", err)
+			os.Exit(0)
+		}
+		fmt.Println(d.Year, "年", d.Month, "月 on-time 航班数:", n)
+	}
+	for _, d := range config.Markets {
+		n, err := writeMarkets(config, network, d.Year, d.Quarter)
+		if err != nil {
+			fmt.Println("生成", d.Year, "年", d.Quarter, "季度 DB1B Market 数据失败:", err)
+			os.Exit(0)
+		}
+		fmt.Println(d.Year, "年", d.Quarter, "季度 DB1B Market 行数:", n)
+	}
+	fmt.Println("总耗时", time.Now().Unix()-start, "s")
+}
+
+// 读取配置
+func getConfig() *Config {
+	var config = Config{}
+	f, err := os.Open("config.json")
+	if err != nil {
+		fmt.Println("读取配置文件失败:", err)
+		return nil
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&config)
+	if err != nil {
+		fmt.Println("解析配置文件失败:", err)
+		return nil
+	}
+	return &config
+}
+
+func applyDefaults(c *Config) {
+	if c.OutputDir == "" {
+		c.OutputDir = "output"
+	}
+	if len(c.Formats) == 0 {
+		c.Formats = []string{"csv"}
+	}
+	if c.Scale <= 0 {
+		c.Scale = 1
+	}
+	if c.Itineraries <= 0 {
+		c.Itineraries = 10000
+	}
+	for i := range c.Airports {
+		if c.Airports[i].Weight <= 0 {
+			c.Airports[i].Weight = 1
+		}
+		if c.Airports[i].Country == "" {
+			c.Airports[i].Country = "US"
+		}
+	}
+	for i := range c.Carriers {
+		cr := &c.Carriers[i]
+		if cr.Group == "" {
+			cr.Group = "3"
+		}
+		if cr.Weight <= 0 {
+			cr.Weight = 1
+		}
+		if len(cr.DailyFlights) != 2 {
+			cr.DailyFlights = []int{1, 3}
+		}
+		if cr.Fleet <= 0 {
+			cr.Fleet = 20
+		}
+		if cr.FlightNumberStart <= 0 {
+			cr.FlightNumberStart = 100
+		}
+		if cr.Delay != nil {
+			delayDefaults(cr.Delay)
+		}
+	}
+	delayDefaults(&c.Delay)
+	if c.Cancellation.Rate == 0 {
+		c.Cancellation.Rate = 0.015
+	}
+	if len(c.Cancellation.Codes) == 0 {
+		c.Cancellation.Codes = map[string]float64{"A": 0.35, "B": 0.4, "C": 0.24, "D": 0.01}
+	}
+	f := &c.Fare
+	if f.Base == 0 {
+		f.Base = 60
+	}
+	if f.PerMile == 0 {
+		f.PerMile = 0.11
+	}
+	if f.Sigma == 0 {
+		f.Sigma = 0.45
+	}
+	if f.ZeroRate == 0 {
+		f.ZeroRate = 0.03
+	}
+	if f.PremiumRate == 0 {
+		f.PremiumRate = 0.05
+	}
+	if f.PremiumFactor == 0 {
+		f.PremiumFactor = 3
+	}
+	if f.BulkRate == 0 {
+		f.BulkRate = 0.01
+	}
+	if f.ConnectRate == 0 {
+		f.ConnectRate = 0.15
+	}
+	if f.RoundTripRate == 0 {
+		f.RoundTripRate = 0.5
+	}
+}
+
+func delayDefaults(d *DelayConfig) {
+	if d.EarlyRate == 0 {
+		d.EarlyRate = 0.55
+	}
+	if d.OnTimeRate == 0 {
+		d.OnTimeRate = 0.1
+	}
+	if d.MeanDelay == 0 {
+		d.MeanDelay = 30
+	}
+	if d.MaxDelay == 0 {
+		d.MaxDelay = 600
+	}
+	if d.ArrSigma == 0 {
+		d.ArrSigma = 8
+	}
+	if d.DivertRate == 0 {
+		d.DivertRate = 0.002
+	}
+}
+
+func checkConfig(c *Config) error {
+	if len(c.OnTime) == 0 && len(c.Markets) == 0 {
+		return fmt.Errorf("on_time 和 markets 都未配置")
+	}
+	for _, format := range c.Formats {
+		if format != "csv" && format != "zip" {
+			return fmt.Errorf("不支持的输出格式 %s", format)
+		}
+	}
+	airports := map[string]bool{}
+	for _, a := range c.Airports {
+		airports[a.Code] = true
+	}
+	if len(airports) < 2 {
+		return fmt.Errorf("至少需要配置两个机场")
+	}
+	carriers := map[string]bool{}
+	for _, cr := range c.Carriers {
+		carriers[cr.Code] = true
+		for _, code := range append(append([]string{}, cr.Hubs...), cr.Airports...) {
+			if !airports[code] {
+				return fmt.Errorf("航司 %s 的机场 %s 未配置", cr.Code, code)
+			}
+		}
+		if len(c.Routes) == 0 && len(cr.Hubs) == 0 {
+			return fmt.Errorf("航司 %s 未配置枢纽", cr.Code)
+		}
+	}
+	if len(carriers) == 0 {
+		return fmt.Errorf("至少需要配置一个航司")
+	}
+	for _, r := range c.Routes {
+		if !airports[r.Origin] || !airports[r.Dest] {
+			return fmt.Errorf("航线 %s-%s 的机场未配置", r.Origin, r.Dest)
+		}
+		for _, code := range r.Carriers {
+			if !carriers[code] {
+				return fmt.Errorf("航线 %s-%s 的航司 %s 未配置", r.Origin, r.Dest, code)
+			}
+		}
+	}
+	return nil
+}
+
+// 一个航司在一个方向上的航线及其固定的航班计划
+type route struct {
+	carrier *Carrier
+	origin  *Airport
+	dest    *Airport
+	miles   int
+	flights []scheduledFlight
+}
+
+type scheduledFlight struct {
+	number int
+	crsDep int // 当地时间，距当天0点的分钟数
+	crsArr int
+}
+
+type network struct {
+	airports map[string]*Airport
+	carriers map[string]*Carrier
+	routes   []*route
+	// key: 航司+出发地+目的地，用于 DB1B 判断是否有直飞
+	direct map[string]*route
+}
+
+// 生成航线网络和航班计划，只由 seed 和配置决定，各月份使用同一套航班计划
+func buildNetwork(c *Config) *network {
+	r := rand.New(rand.NewSource(c.Seed))
+	n := &network{airports: map[string]*Airport{}, carriers: map[string]*Carrier{}, direct: map[string]*route{}}
+	for i := range c.Airports {
+		n.airports[c.Airports[i].Code] = &c.Airports[i]
+	}
+	for i := range c.Carriers {
+		n.carriers[c.Carriers[i].Code] = &c.Carriers[i]
+	}
+
+	type leg struct {
+		carrier, origin, dest string
+		daily                 int
+	}
+	var legs []leg
+	seen := map[string]bool{}
+	add := func(carrier, origin, dest string, daily int) {
+		k := carrier + origin + dest
+		if origin == dest || seen[k] {
+			return
+		}
+		seen[k] = true
+		legs = append(legs, leg{carrier, origin, dest, daily})
+	}
+	if len(c.Routes) > 0 {
+		for _, rt := range c.Routes {
+			for _, code := range rt.Carriers {
+				add(code, rt.Origin, rt.Dest, rt.DailyFlights)
+				add(code, rt.Dest, rt.Origin, rt.DailyFlights)
+			}
+		}
+	} else {
+		// 枢纽辐射网络：每个枢纽连接航司的全部通航机场
+		for _, cr := range c.Carriers {
+			airports := cr.Airports
+			if len(airports) == 0 {
+				for _, a := range c.Airports {
+					airports = append(airports, a.Code)
+				}
+			}
+			for _, hub := range cr.Hubs {
+				for _, code := range airports {
+					add(cr.Code, hub, code, 0)
+					add(cr.Code, code, hub, 0)
+				}
+			}
+		}
+	}
+
+	nextNumber := map[string]int{}
+	for _, l := range legs {
+		cr := n.carriers[l.carrier]
+		rt := &route{carrier: cr, origin: n.airports[l.origin], dest: n.airports[l.dest]}
+		rt.miles = greatCircleMiles(rt.origin, rt.dest)
+		daily := l.daily
+		if daily <= 0 {
+			daily = cr.DailyFlights[0] + r.Intn(cr.DailyFlights[1]-cr.DailyFlights[0]+1)
+		}
+		daily = int(math.Round(float64(daily) * c.Scale))
+		if daily < 1 {
+			daily = 1
+		}
+		block := blockMinutes(rt.miles)
+		for i := 0; i < daily; i++ {
+			if _, ok := nextNumber[cr.Code]; !ok {
+				nextNumber[cr.Code] = cr.FlightNumberStart
+			}
+			number := nextNumber[cr.Code]
+			nextNumber[cr.Code]++
+			// 计划起飞时间在 06:00 到 22:00 之间，按 5 分钟取整
+			dep := 360 + r.Intn(193)*5
+			arr := dep + block + (rt.dest.UtcOffset-rt.origin.UtcOffset)*60
+			rt.flights = append(rt.flights, scheduledFlight{number: number, crsDep: dep, crsArr: arr})
+		}
+		sort.Slice(rt.flights, func(i, j int) bool { return rt.flights[i].crsDep < rt.flights[j].crsDep })
+		n.routes = append(n.routes, rt)
+		n.direct[cr.Code+rt.origin.Code+rt.dest.Code] = rt
+	}
+	return n
+}
+
+// 两个机场的大圆距离（英里）
+func greatCircleMiles(a, b *Airport) int {
+	const earthRadiusMiles = 3958.8
+	rad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat := rad(b.Lat - a.Lat)
+	dLon := rad(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return int(math.Round(2 * earthRadiusMiles * math.Asin(math.Sqrt(h))))
+}
+
+// 计划飞行时间：巡航约 480 英里/小时，加上滑行和起降 30 分钟，按 5 分钟取整
+func blockMinutes(miles int) int {
+	m := float64(miles)/8 + 30
+	return int(math.Round(m/5) * 5)
+}
+
+// 按权重随机选择一个下标
+func weightedIndex(r *rand.Rand, weights []float64) int {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	x := r.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return i
+		}
+		x -= w
+	}
+	return len(weights) - 1
+}
+
+// 每个文件使用独立的随机数，单独生成某个月份时结果不变
+func periodRand(seed int64, kind, year, period int) *rand.Rand {
+	return rand.New(rand.NewSource(seed*1000003 + int64(kind*100000+year*100+period)))
+}
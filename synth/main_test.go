@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testConfig(t *testing.T) *Config {
+	c := &Config{
+		Seed:        42,
+		OutputDir:   t.TempDir(),
+		Formats:     []string{"csv", "zip"},
+		OnTime:      []MonthDate{{2020, 2}},
+		Markets:     []QuarterDate{{2020, 1}},
+		Itineraries: 500,
+		Airports: []Airport{
+			{Code: "JFK", AirportID: 12478, CityMarketID: 31703, CityName: "New York, NY", State: "NY", StateFips: "36", StateName: "New York", Wac: 22, Lat: 40.6398, Lon: -73.7789, UtcOffset: -5},
+			{Code: "ORD", AirportID: 13930, CityMarketID: 30977, CityName: "Chicago, IL", State: "IL", StateFips: "17", StateName: "Illinois", Wac: 41, Lat: 41.9786, Lon: -87.9048, UtcOffset: -6},
+			{Code: "LAX", AirportID: 12892, CityMarketID: 32575, CityName: "Los Angeles, CA", State: "CA", StateFips: "06", StateName: "California", Wac: 91, Lat: 33.9425, Lon: -118.4081, UtcOffset: -8},
+			{Code: "HNL", AirportID: 12173, CityMarketID: 32134, CityName: "Honolulu, HI", State: "HI", StateFips: "15", StateName: "Hawaii", Wac: 2, Lat: 21.3187, Lon: -157.9225, UtcOffset: -10},
+		},
+		Carriers: []Carrier{
+			{Code: "AA", DotID: 19805, Hubs: []string{"ORD"}},
+			{Code: "DL", DotID: 19790, Hubs: []string{"JFK", "LAX"}, Regionals: []string{"OO"}, RegionalRate: 0.5},
+		},
+	}
+	c.Cancellation.Rate = 0.05
+	applyDefaults(c)
+	if err := checkConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func generate(t *testing.T, c *Config) {
+	n := buildNetwork(c)
+	for _, d := range c.OnTime {
+		if _, err := writeOnTime(c, n, d.Year, d.Month); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range c.Markets {
+		if _, err := writeMarkets(c, n, d.Year, d.Quarter); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 读取 csv，校验每行列数与表头一致（末尾多一个空列）
+func readRecords(t *testing.T, b []byte, columns []btsColumn) []map[string]string {
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []map[string]string
+	for i, record := range records {
+		if len(record) != len(columns)+1 || record[len(columns)] != "" {
+			t.Fatalf("第 %d 行列数为 %d，期望 %d 列加末尾逗号", i, len(record), len(columns))
+		}
+		if i == 0 {
+			for j, col := range columns {
+				if record[j] != col.name {
+					t.Fatalf("第 %d 列表头为 %s，期望 %s", j, record[j], col.name)
+				}
+			}
+			continue
+		}
+		row := map[string]string{}
+		for j, col := range columns {
+			row[col.name] = record[j]
+		}
+		res = append(res, row)
+	}
+	return res
+}
+
+func TestOnTimeLayout(t *testing.T) {
+	if len(onTimeColumns) != 109 {
+		t.Fatalf("on-time 列数为 %d，期望 109", len(onTimeColumns))
+	}
+	c := testConfig(t)
+	generate(t, c)
+	name := OnTimeCsvNamePrefix + "2020_2.csv"
+	b := readFile(t, filepath.Join(c.OutputDir, name))
+	rows := readRecords(t, b, onTimeColumns)
+	if len(rows) == 0 {
+		t.Fatal("没有生成航班")
+	}
+	cancelled := 0
+	for _, r := range rows {
+		if r["Year"] != "2020" || r["Month"] != "2" || r["Quarter"] != "1" {
+			t.Fatalf("年月错误: %v", r)
+		}
+		if r["Origin"] == r["Dest"] {
+			t.Fatalf("出发地与目的地相同: %v", r)
+		}
+		switch r["Cancelled"] {
+		case "1.00":
+			cancelled++
+			if r["CancellationCode"] == "" || r["DepTime"] != "" || r["ArrDelay"] != "" {
+				t.Fatalf("取消航班数据错误: %v", r)
+			}
+		case "0.00":
+			if r["CancellationCode"] != "" || r["DepDelay"] == "" {
+				t.Fatalf("未取消航班数据错误: %v", r)
+			}
+		default:
+			t.Fatalf("Cancelled 取值错误: %v", r["Cancelled"])
+		}
+	}
+	if cancelled == 0 {
+		t.Error("没有生成取消航班")
+	}
+
+	// zip 中的 csv 与单独输出的 csv 完全一致，文件名与 BTS 下载一致
+	archive, err := zip.OpenReader(filepath.Join(c.OutputDir, OnTimeZipNamePrefix+"2020_2.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if len(archive.File) != 1 || archive.File[0].Name != name {
+		t.Fatalf("zip 内容错误: %v", archive.File)
+	}
+	src, err := archive.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	zb, _ := io.ReadAll(src)
+	if !bytes.Equal(zb, b) {
+		t.Error("zip 中的 csv 与 csv 文件不一致")
+	}
+}
+
+func TestMarketLayout(t *testing.T) {
+	if len(marketColumns) != 41 {
+		t.Fatalf("DB1B Market 列数为 %d，期望 41", len(marketColumns))
+	}
+	c := testConfig(t)
+	generate(t, c)
+	rows := readRecords(t, readFile(t, filepath.Join(c.OutputDir, MarketNamePrefix+"2020_1.csv")), marketColumns)
+	if len(rows) < c.Itineraries {
+		t.Fatalf("行数 %d 少于行程数 %d", len(rows), c.Itineraries)
+	}
+	regional := 0
+	for _, r := range rows {
+		if r["Year"] != "2020" || r["Quarter"] != "1" || r["Origin"] == r["Dest"] {
+			t.Fatalf("数据错误: %v", r)
+		}
+		if r["OpCarrier"] == "OO" {
+			regional++
+			if r["TkCarrier"] != "DL" || r["OpCarrierChange"] != "1.00" {
+				t.Fatalf("支线承运数据错误: %v", r)
+			}
+		}
+		if (r["Origin"] == "HNL" || r["Dest"] == "HNL") && r["MktGeoType"] != "1.00" {
+			t.Fatalf("非本土航线 geo type 错误: %v", r)
+		}
+	}
+	if regional == 0 {
+		t.Error("没有生成支线承运的行程")
+	}
+}
+
+// 相同的种子和配置生成完全相同的文件，不同的种子结果不同
+func TestReproducible(t *testing.T) {
+	a, b := testConfig(t), testConfig(t)
+	generate(t, a)
+	generate(t, b)
+	for _, name := range []string{OnTimeCsvNamePrefix + "2020_2.csv", MarketNamePrefix + "2020_1.csv"} {
+		if !bytes.Equal(readFile(t, filepath.Join(a.OutputDir, name)), readFile(t, filepath.Join(b.OutputDir, name))) {
+			t.Errorf("%s 两次生成的结果不一致", name)
+		}
+	}
+	d := testConfig(t)
+	d.Seed = 43
+	generate(t, d)
+	name := OnTimeCsvNamePrefix + "2020_2.csv"
+	if bytes.Equal(readFile(t, filepath.Join(a.OutputDir, name)), readFile(t, filepath.Join(d.OutputDir, name))) {
+		t.Error("不同的种子生成了相同的结果")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BTS DB1B Market 下载文件名
+const MarketNamePrefix = "Origin_and_Destination_Survey_DB1BMarket_"
+
+// BTS DB1B Market 的 41 列
+var marketColumns = []btsColumn{
+	{"ItinID", false}, {"MktID", false}, {"MktCoupons", false}, {"Year", false}, {"Quarter", false},
+	{"OriginAirportID", false}, {"OriginAirportSeqID", false}, {"OriginCityMarketID", false}, {"Origin", true}, {"OriginCountry", true},
+	{"OriginStateFips", true}, {"OriginState", true}, {"OriginStateName", true}, {"OriginWac", false},
+	{"DestAirportID", false}, {"DestAirportSeqID", false}, {"DestCityMarketID", false}, {"Dest", true}, {"DestCountry", true},
+	{"DestStateFips", true}, {"DestState", true}, {"DestStateName", true}, {"DestWac", false},
+	{"AirportGroup", true}, {"WacGroup", true}, {"TkCarrierChange", false}, {"TkCarrierGroup", true}, {"OpCarrierChange", false}, {"OpCarrierGroup", true},
+	{"RPCarrier", true}, {"TkCarrier", true}, {"OpCarrier", true}, {"BulkFare", false}, {"Passengers", false}, {"MktFare", false},
+	{"MktDistance", false}, {"MktDistanceGroup", false}, {"MktMilesFlown", false}, {"NonStopMiles", false}, {"ItinGeoType", false}, {"MktGeoType", false},
+}
+
+// 非本土（阿拉斯加、夏威夷及海外属地）的州代码，用于 geo type
+var nonContiguousStates = map[string]bool{"AK": true, "HI": true, "PR": true, "VI": true, "GU": true, "AS": true, "MP": true, "TT": true}
+
+// 生成一个季度的 DB1B Market 数据，返回行数
+func writeMarkets(c *Config, n *network, year, quarter int) (int, error) {
+	csvName := fmt.Sprintf("%s%d_%d.csv", MarketNamePrefix, year, quarter)
+	w, err := newBtsWriter(c, csvName, strings.TrimSuffix(csvName, ".csv")+".zip", marketColumns)
+	if err != nil {
+		return 0, err
+	}
+	r := periodRand(c.Seed, 2, year, quarter)
+
+	carriers := make([]*Carrier, 0, len(n.carriers))
+	for _, cr := range n.carriers {
+		carriers = append(carriers, cr)
+	}
+	sort.Slice(carriers, func(i, j int) bool { return carriers[i].Code < carriers[j].Code })
+	carrierWeights := make([]float64, len(carriers))
+	// 各航司的通航机场及其客流权重
+	served := make([][]*Airport, len(carriers))
+	servedWeights := make([][]float64, len(carriers))
+	for i, cr := range carriers {
+		carrierWeights[i] = cr.Weight
+		seen := map[string]bool{}
+		for _, rt := range n.routes {
+			if rt.carrier != cr {
+				continue
+			}
+			for _, a := range []*Airport{rt.origin, rt.dest} {
+				if !seen[a.Code] {
+					seen[a.Code] = true
+					served[i] = append(served[i], a)
+				}
+			}
+		}
+		sort.Slice(served[i], func(x, y int) bool { return served[i][x].Code < served[i][y].Code })
+		for _, a := range served[i] {
+			servedWeights[i] = append(servedWeights[i], a.Weight)
+		}
+	}
+
+	count := 0
+	itineraries := int(math.Round(float64(c.Itineraries) * c.Scale))
+	for i := 0; i < itineraries; i++ {
+		ci := weightedIndex(r, carrierWeights)
+		if len(served[ci]) < 2 {
+			continue
+		}
+		cr := carriers[ci]
+		o := served[ci][weightedIndex(r, servedWeights[ci])]
+		d := o
+		for d == o {
+			d = served[ci][weightedIndex(r, servedWeights[ci])]
+		}
+		itinID := int64(year*10+quarter)*100000000 + int64(i+1)
+		m := &market{carrier: cr, op: cr, passengers: 1}
+		if len(cr.Regionals) > 0 && r.Float64() < cr.RegionalRate {
+			code := cr.Regionals[r.Intn(len(cr.Regionals))]
+			if m.op = n.carriers[code]; m.op == nil {
+				m.op = &Carrier{Code: code, Group: "2"}
+			}
+		}
+		if r.Float64() > 0.6 {
+			m.passengers = 2 + r.Intn(3)
+		}
+		m.bulk = r.Float64() < c.Fare.BulkRate
+		m.path = marketPath(r, c, n, cr, o, d)
+		m.fare = sampleFare(r, c.Fare, pathMiles(m.path))
+		legs := 1
+		if r.Float64() < c.Fare.RoundTripRate {
+			legs = 2
+		}
+		for leg := 0; leg < legs; leg++ {
+			if leg == 1 {
+				m.path = reversePath(m.path)
+			}
+			fillMarket(w, year, quarter, itinID, itinID*100+int64(leg+1), m)
+			if err = w.writeRow(); err != nil {
+				w.close()
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, w.close()
+}
+
+type market struct {
+	carrier    *Carrier
+	op         *Carrier
+	path       []*Airport
+	passengers int
+	fare       float64
+	bulk       bool
+}
+
+// 有直飞时大多直飞，否则经航司枢纽中转一次，少量经两个枢纽中转
+func marketPath(r *rand.Rand, c *Config, n *network, cr *Carrier, o, d *Airport) []*Airport {
+	_, direct := n.direct[cr.Code+o.Code+d.Code]
+	if direct && r.Float64() >= c.Fare.ConnectRate {
+		return []*Airport{o, d}
+	}
+	var hubs []*Airport
+	for _, code := range cr.Hubs {
+		h := n.airports[code]
+		if h != o && h != d && n.direct[cr.Code+o.Code+h.Code] != nil && n.direct[cr.Code+h.Code+d.Code] != nil {
+			hubs = append(hubs, h)
+		}
+	}
+	if len(hubs) == 0 {
+		return []*Airport{o, d}
+	}
+	h := hubs[r.Intn(len(hubs))]
+	if len(hubs) > 1 && r.Float64() < 0.05 {
+		h2 := hubs[r.Intn(len(hubs))]
+		if h2 != h && n.direct[cr.Code+h.Code+h2.Code] != nil {
+			return []*Airport{o, h, h2, d}
+		}
+	}
+	return []*Airport{o, h, d}
+}
+
+func reversePath(path []*Airport) []*Airport {
+	res := make([]*Airport, len(path))
+	for i, a := range path {
+		res[len(path)-1-i] = a
+	}
+	return res
+}
+
+func pathMiles(path []*Airport) int {
+	miles := 0
+	for i := 1; i < len(path); i++ {
+		miles += greatCircleMiles(path[i-1], path[i])
+	}
+	return miles
+}
+
+// 对数正态分布的票价，少量 0 票价和高舱位票价
+func sampleFare(r *rand.Rand, f FareConfig, miles int) float64 {
+	x := r.Float64()
+	if x < f.ZeroRate {
+		return 0
+	}
+	fare := (f.Base + f.PerMile*float64(miles)) * math.Exp(r.NormFloat64()*f.Sigma-f.Sigma*f.Sigma/2)
+	if x < f.ZeroRate+f.PremiumRate {
+		fare *= f.PremiumFactor
+	}
+	return math.Round(fare*100) / 100
+}
+
+func fillMarket(w *btsWriter, year, quarter int, itinID, mktID int64, m *market) {
+	o, d := m.path[0], m.path[len(m.path)-1]
+	w.set("ItinID", strconv.FormatInt(itinID, 10))
+	w.set("MktID", strconv.FormatInt(mktID, 10))
+	w.setFloat("MktCoupons", float64(len(m.path)-1))
+	w.setInt("Year", year)
+	w.setInt("Quarter", quarter)
+	fillMarketAirport(w, "Origin", o)
+	fillMarketAirport(w, "Dest", d)
+
+	codes := make([]string, len(m.path))
+	wacs := make([]string, len(m.path))
+	for i, a := range m.path {
+		codes[i] = a.Code
+		wacs[i] = strconv.Itoa(a.Wac)
+	}
+	w.set("AirportGroup", strings.Join(codes, ":"))
+	w.set("WacGroup", strings.Join(wacs, ":"))
+	w.setFloat("TkCarrierChange", 0)
+	w.set("TkCarrierGroup", m.carrier.Group)
+	opChange := 0.0
+	if m.op != m.carrier {
+		opChange = 1
+	}
+	w.setFloat("OpCarrierChange", opChange)
+	w.set("OpCarrierGroup", m.op.Group)
+	w.set("RPCarrier", m.carrier.Code)
+	w.set("TkCarrier", m.carrier.Code)
+	w.set("OpCarrier", m.op.Code)
+	bulk := 0.0
+	if m.bulk {
+		bulk = 1
+	}
+	w.setFloat("BulkFare", bulk)
+	w.setFloat("Passengers", float64(m.passengers))
+	w.setFloat("MktFare", m.fare)
+	miles := pathMiles(m.path)
+	w.setFloat("MktDistance", float64(miles))
+	w.setFloat("MktDistanceGroup", float64(miles/500+1))
+	w.setFloat("MktMilesFlown", float64(miles))
+	w.setFloat("NonStopMiles", float64(greatCircleMiles(o, d)))
+	geo := 2.0
+	for _, a := range m.path {
+		if nonContiguousStates[a.State] {
+			geo = 1
+		}
+	}
+	w.setFloat("ItinGeoType", geo)
+	w.setFloat("MktGeoType", geo)
+}
+
+func fillMarketAirport(w *btsWriter, prefix string, a *Airport) {
+	w.setInt(prefix+"AirportID", a.AirportID)
+	w.setInt(prefix+"AirportSeqID", a.AirportID*100+1)
+	w.setInt(prefix+"CityMarketID", a.CityMarketID)
+	w.set(prefix, a.Code)
+	w.set(prefix+"Country", a.Country)
+	w.set(prefix+"StateFips", a.StateFips)
+	w.set(prefix+"State", a.State)
+	w.set(prefix+"StateName", a.StateName)
+	w.setInt(prefix+"Wac", a.Wac)
+}
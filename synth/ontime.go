@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// 与 BTS 下载的文件名一致，import_ontime 可以直接使用
+	OnTimeZipNamePrefix = "On_Time_Reporting_Carrier_On_Time_Performance_1987_present_"
+	OnTimeCsvNamePrefix = "On_Time_Reporting_Carrier_On_Time_Performance_(1987_present)_"
+)
+
+// BTS on-time 报表的 109 列
+var onTimeColumns = func() []btsColumn {
+	cols := []btsColumn{
+		{"Year", false}, {"Quarter", false}, {"Month", false}, {"DayofMonth", false}, {"DayOfWeek", false}, {"FlightDate", false},
+		{"Reporting_Airline", true}, {"DOT_ID_Reporting_Airline", false}, {"IATA_CODE_Reporting_Airline", true}, {"Tail_Number", true}, {"Flight_Number_Reporting_Airline", false},
+		{"OriginAirportID", false}, {"OriginAirportSeqID", false}, {"OriginCityMarketID", false}, {"Origin", true}, {"OriginCityName", true},
+		{"OriginState", true}, {"OriginStateFips", true}, {"OriginStateName", true}, {"OriginWac", false},
+		{"DestAirportID", false}, {"DestAirportSeqID", false}, {"DestCityMarketID", false}, {"Dest", true}, {"DestCityName", true},
+		{"DestState", true}, {"DestStateFips", true}, {"DestStateName", true}, {"DestWac", false},
+		{"CRSDepTime", true}, {"DepTime", true}, {"DepDelay", false}, {"DepDelayMinutes", false}, {"DepDel15", false}, {"DepartureDelayGroups", false}, {"DepTimeBlk", true},
+		{"TaxiOut", false}, {"WheelsOff", true}, {"WheelsOn", true}, {"TaxiIn", false},
+		{"CRSArrTime", true}, {"ArrTime", true}, {"ArrDelay", false}, {"ArrDelayMinutes", false}, {"ArrDel15", false}, {"ArrivalDelayGroups", false}, {"ArrTimeBlk", true},
+		{"Cancelled", false}, {"CancellationCode", true}, {"Diverted", false},
+		{"CRSElapsedTime", false}, {"ActualElapsedTime", false}, {"AirTime", false}, {"Flights", false}, {"Distance", false}, {"DistanceGroup", false},
+		{"CarrierDelay", false}, {"WeatherDelay", false}, {"NASDelay", false}, {"SecurityDelay", false}, {"LateAircraftDelay", false},
+		{"FirstDepTime", true}, {"TotalAddGTime", false}, {"LongestAddGTime", false},
+		{"DivAirportLandings", false}, {"DivReachedDest", false}, {"DivActualElapsedTime", false}, {"DivArrDelay", false}, {"DivDistance", false},
+	}
+	for i := 1; i <= 5; i++ {
+		p := "Div" + strconv.Itoa(i)
+		cols = append(cols,
+			btsColumn{p + "Airport", true}, btsColumn{p + "AirportID", false}, btsColumn{p + "AirportSeqID", false}, btsColumn{p + "WheelsOn", true},
+			btsColumn{p + "TotalGTime", false}, btsColumn{p + "LongestGTime", false}, btsColumn{p + "WheelsOff", true}, btsColumn{p + "TailNum", true})
+	}
+	return cols
+}()
+
+// 延误原因，到达延误 15 分钟以上时按权重分摊
+var delayCauses = []string{"CarrierDelay", "WeatherDelay", "NASDelay", "SecurityDelay", "LateAircraftDelay"}
+var delayCauseWeights = []float64{0.33, 0.06, 0.24, 0.01, 0.36}
+
+// 生成一个月的 on-time 数据，返回航班数
+func writeOnTime(c *Config, n *network, year, month int) (int, error) {
+	csvName := fmt.Sprintf("%s%d_%d.csv", OnTimeCsvNamePrefix, year, month)
+	zipName := fmt.Sprintf("%s%d_%d.zip", OnTimeZipNamePrefix, year, month)
+	w, err := newBtsWriter(c, csvName, zipName, onTimeColumns)
+	if err != nil {
+		return 0, err
+	}
+	r := periodRand(c.Seed, 1, year, month)
+	codes := make([]string, 0, len(c.Cancellation.Codes))
+	for code := range c.Cancellation.Codes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	codeWeights := make([]float64, len(codes))
+	for i, code := range codes {
+		codeWeights[i] = c.Cancellation.Codes[code]
+	}
+	airports := make([]*Airport, 0, len(n.airports))
+	for _, a := range n.airports {
+		airports = append(airports, a)
+	}
+	sort.Slice(airports, func(i, j int) bool { return airports[i].Code < airports[j].Code })
+
+	count := 0
+	days := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for day := 1; day <= days; day++ {
+		date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+		for _, rt := range n.routes {
+			for _, f := range rt.flights {
+				fillOnTimeFlight(w, r, c, rt, f, date, codes, codeWeights, airports)
+				if err = w.writeRow(); err != nil {
+					w.close()
+					return count, err
+				}
+				count++
+			}
+		}
+	}
+	return count, w.close()
+}
+
+func fillOnTimeFlight(w *btsWriter, r *rand.Rand, c *Config, rt *route, f scheduledFlight, date time.Time, codes []string, codeWeights []float64, airports []*Airport) {
+	cr, o, d := rt.carrier, rt.origin, rt.dest
+	dow := int(date.Weekday())
+	if dow == 0 {
+		dow = 7
+	}
+	w.setInt("Year", date.Year())
+	w.setInt("Quarter", (int(date.Month())-1)/3+1)
+	w.setInt("Month", int(date.Month()))
+	w.setInt("DayofMonth", date.Day())
+	w.setInt("DayOfWeek", dow)
+	w.set("FlightDate", date.Format("2006-01-02"))
+	w.set("Reporting_Airline", cr.Code)
+	w.setInt("DOT_ID_Reporting_Airline", cr.DotID)
+	w.set("IATA_CODE_Reporting_Airline", cr.Code)
+	w.set("Tail_Number", fmt.Sprintf("N%d%s", 100+r.Intn(cr.Fleet), cr.Code))
+	w.setInt("Flight_Number_Reporting_Airline", f.number)
+	fillOnTimeAirport(w, "Origin", o)
+	fillOnTimeAirport(w, "Dest", d)
+
+	crsElapsed := f.crsArr - f.crsDep - (d.UtcOffset-o.UtcOffset)*60
+	w.set("CRSDepTime", hhmm(f.crsDep))
+	w.set("DepTimeBlk", timeBlock(f.crsDep))
+	w.set("CRSArrTime", hhmm(f.crsArr))
+	w.set("ArrTimeBlk", timeBlock(f.crsArr))
+	w.setFloat("CRSElapsedTime", float64(crsElapsed))
+	w.setFloat("Flights", 1)
+	w.setFloat("Distance", float64(rt.miles))
+	w.setInt("DistanceGroup", distanceGroup(rt.miles))
+	w.set("CancellationCode", "")
+	w.set("FirstDepTime", "")
+	w.setInt("DivAirportLandings", 0)
+	for i := 1; i <= 5; i++ {
+		p := "Div" + strconv.Itoa(i)
+		w.set(p+"Airport", "")
+		w.set(p+"WheelsOn", "")
+		w.set(p+"WheelsOff", "")
+		w.set(p+"TailNum", "")
+	}
+
+	delay := c.Delay
+	if cr.Delay != nil {
+		delay = *cr.Delay
+	}
+	cancelRate := c.Cancellation.Rate
+	if cr.CancelRate != nil {
+		cancelRate = *cr.CancelRate
+	}
+	if r.Float64() < cancelRate {
+		w.setFloat("Cancelled", 1)
+		w.set("CancellationCode", codes[weightedIndex(r, codeWeights)])
+		w.setFloat("Diverted", 0)
+		return
+	}
+	w.setFloat("Cancelled", 0)
+
+	depDelay := sampleDelay(r, delay)
+	taxiOut := 10 + r.Intn(16)
+	taxiIn := 4 + r.Intn(10)
+	dep := f.crsDep + depDelay
+	w.set("DepTime", hhmm(dep))
+	fillDelay(w, "Dep", depDelay)
+	w.setFloat("TaxiOut", float64(taxiOut))
+	w.set("WheelsOff", hhmm(dep+taxiOut))
+
+	if r.Float64() < delay.DivertRate {
+		// 备降：没有到达数据，记录一个备降机场
+		div := airports[r.Intn(len(airports))]
+		for div == o || (div == d && len(airports) > 2) {
+			div = airports[r.Intn(len(airports))]
+		}
+		w.setFloat("Diverted", 1)
+		w.setInt("DivAirportLandings", 1)
+		w.setFloat("DivReachedDest", 0)
+		w.set("Div1Airport", div.Code)
+		w.setInt("Div1AirportID", div.AirportID)
+		w.setInt("Div1AirportSeqID", div.AirportID*100+1)
+		return
+	}
+	w.setFloat("Diverted", 0)
+
+	arrDelay := depDelay + int(math.Round(r.NormFloat64()*delay.ArrSigma))
+	if floor := -crsElapsed / 4; arrDelay < floor {
+		arrDelay = floor
+	}
+	actualElapsed := crsElapsed + arrDelay - depDelay
+	arr := f.crsArr + arrDelay
+	w.set("ArrTime", hhmm(arr))
+	fillDelay(w, "Arr", arrDelay)
+	w.setFloat("TaxiIn", float64(taxiIn))
+	w.set("WheelsOn", hhmm(arr-taxiIn))
+	w.setFloat("ActualElapsedTime", float64(actualElapsed))
+	w.setFloat("AirTime", float64(actualElapsed-taxiOut-taxiIn))
+	if arrDelay >= 15 {
+		minutes := make([]int, len(delayCauses))
+		primary := weightedIndex(r, delayCauseWeights)
+		minutes[primary] = int(float64(arrDelay) * (0.6 + 0.4*r.Float64()))
+		rest := 4 // 其余计入 LateAircraftDelay，主因为 LateAircraftDelay 时计入 NASDelay
+		if primary == rest {
+			rest = 2
+		}
+		minutes[rest] += arrDelay - minutes[primary]
+		for i, name := range delayCauses {
+			w.setFloat(name, float64(minutes[i]))
+		}
+	}
+}
+
+func fillOnTimeAirport(w *btsWriter, prefix string, a *Airport) {
+	w.setInt(prefix+"AirportID", a.AirportID)
+	w.setInt(prefix+"AirportSeqID", a.AirportID*100+1)
+	w.setInt(prefix+"CityMarketID", a.CityMarketID)
+	w.set(prefix, a.Code)
+	w.set(prefix+"CityName", a.CityName)
+	w.set(prefix+"State", a.State)
+	w.set(prefix+"StateFips", a.StateFips)
+	w.set(prefix+"StateName", a.StateName)
+	w.setInt(prefix+"Wac", a.Wac)
+}
+
+// 起飞或到达的延误相关列
+func fillDelay(w *btsWriter, prefix string, delay int) {
+	w.setFloat(prefix+"Delay", float64(delay))
+	w.setFloat(prefix+"DelayMinutes", math.Max(float64(delay), 0))
+	del15 := 0.0
+	if delay >= 15 {
+		del15 = 1
+	}
+	w.setFloat(prefix+"Del15", del15)
+	group := "DepartureDelayGroups"
+	if prefix == "Arr" {
+		group = "ArrivalDelayGroups"
+	}
+	w.setInt(group, delayGroup(delay))
+}
+
+// 提前、准点、延误三段分布，延误分钟数为指数分布
+func sampleDelay(r *rand.Rand, d DelayConfig) int {
+	x := r.Float64()
+	switch {
+	case x < d.EarlyRate:
+		return -(1 + r.Intn(12))
+	case x < d.EarlyRate+d.OnTimeRate:
+		return 0
+	}
+	delay := 1 + int(r.ExpFloat64()*d.MeanDelay)
+	if delay > d.MaxDelay {
+		delay = d.MaxDelay
+	}
+	return delay
+}
+
+// BTS 的延误分组：每 15 分钟一组，提前 15 分钟以上为 -2，最大为 12
+func delayGroup(delay int) int {
+	switch {
+	case delay < -15:
+		return -2
+	case delay < 0:
+		return -1
+	case delay >= 180:
+		return 12
+	}
+	return delay / 15
+}
+
+// BTS 的时间段，06:00 之前合并为 0001-0559
+func timeBlock(minutes int) string {
+	h := ((minutes % 1440) + 1440) % 1440 / 60
+	if h < 6 {
+		return "0001-0559"
+	}
+	s := strconv.Itoa(h + 100)[1:]
+	return s + "00-" + s + "59"
+}
+
+// 每 250 英里一组，最大为 11
+func distanceGroup(miles int) int {
+	g := miles/250 + 1
+	if g > 11 {
+		g = 11
+	}
+	return g
+}
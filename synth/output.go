@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BTS 下载文件的一列，quoted 为 BTS 文件中带引号输出的文本列
+type btsColumn struct {
+	name   string
+	quoted bool
+}
+
+// 按 BTS 下载文件的格式逐行写出：文本列带引号，每行末尾多一个逗号
+type btsWriter struct {
+	columns []btsColumn
+	index   map[string]int
+	row     []string
+	w       *bufio.Writer
+	zip     *zip.Writer
+	files   []*os.File
+}
+
+// 按配置的格式输出 csv 文件和（或）包含该 csv 的 zip 文件
+func newBtsWriter(c *Config, csvName, zipName string, columns []btsColumn) (*btsWriter, error) {
+	bw := &btsWriter{columns: columns, index: map[string]int{}, row: make([]string, len(columns))}
+	for i, col := range columns {
+		bw.index[col.name] = i
+	}
+	var writers []io.Writer
+	for _, format := range c.Formats {
+		switch format {
+		case "csv":
+			f, err := os.Create(filepath.Join(c.OutputDir, csvName))
+			if err != nil {
+				bw.close()
+				return nil, err
+			}
+			bw.files = append(bw.files, f)
+			writers = append(writers, f)
+		case "zip":
+			f, err := os.Create(filepath.Join(c.OutputDir, zipName))
+			if err != nil {
+				bw.close()
+				return nil, err
+			}
+			bw.files = append(bw.files, f)
+			bw.zip = zip.NewWriter(f)
+			entry, err := bw.zip.Create(csvName)
+			if err != nil {
+				bw.close()
+				return nil, err
+			}
+			writers = append(writers, entry)
+		}
+	}
+	bw.w = bufio.NewWriterSize(io.MultiWriter(writers...), 1024*1024)
+	for i, col := range columns {
+		bw.row[i] = col.name
+	}
+	// 表头所有列都带引号
+	if err := bw.write(true); err != nil {
+		bw.close()
+		return nil, err
+	}
+	for i := range bw.row {
+		bw.row[i] = ""
+	}
+	return bw, nil
+}
+
+func (bw *btsWriter) set(name, value string) {
+	i, ok := bw.index[name]
+	if !ok {
+		panic("未定义的列: " + name)
+	}
+	bw.row[i] = value
+}
+
+func (bw *btsWriter) setInt(name string, v int) {
+	bw.set(name, strconv.Itoa(v))
+}
+
+// BTS 中的数值列大多保留两位小数
+func (bw *btsWriter) setFloat(name string, v float64) {
+	bw.set(name, strconv.FormatFloat(v, 'f', 2, 64))
+}
+
+// 写出当前行并清空
+func (bw *btsWriter) writeRow() error {
+	err := bw.write(false)
+	for i := range bw.row {
+		bw.row[i] = ""
+	}
+	return err
+}
+
+func (bw *btsWriter) write(header bool) error {
+	for i, col := range bw.columns {
+		v := bw.row[i]
+		if header || col.quoted {
+			v = `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+		}
+		if _, err := bw.w.WriteString(v); err != nil {
+			return err
+		}
+		if err := bw.w.WriteByte(','); err != nil {
+			return err
+		}
+	}
+	return bw.w.WriteByte('\n')
+}
+
+func (bw *btsWriter) close() error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if bw.w != nil {
+		keep(bw.w.Flush())
+	}
+	if bw.zip != nil {
+		keep(bw.zip.Close())
+	}
+	for _, f := range bw.files {
+		keep(f.Close())
+	}
+	return firstErr
+}
+
+// hhmm 格式的当地时间
+func hhmm(minutes int) string {
+	minutes = ((minutes % 1440) + 1440) % 1440
+	return strconv.Itoa(minutes/60 + 100)[1:] + strconv.Itoa(minutes%60 + 100)[1:]
+}